@@ -0,0 +1,337 @@
+// Package cache maintains an in-memory list of the members of a Serf
+// cluster for client applications. The list is loaded from an agent and
+// is kept current with the event stream of the agent, so applications
+// don't have to poll for the members.
+package cache
+
+import (
+	"fmt"
+	"github.com/hashicorp/serf/command/agent"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// memberEvents is the filter of the events that the cache streams
+const memberEvents = "member-join,member-leave,member-failed,member-update"
+
+// ChangeFunc is called for each member event, after the cache has been
+// updated. The members are those of the event, in their new state.
+type ChangeFunc func(event string, members []agent.Member)
+
+// Cache is a list of the members of a cluster, kept current by the event
+// stream of an agent. Members that leave the cluster are removed, while
+// failed members are kept with the "failed" status since they may still
+// come back. It is safe to use from many goroutines.
+//
+// The members of streamed events only have their name, address, port,
+// role, tags and status, so the other fields of agent.Member are only
+// set for members that haven't changed since the cache was created.
+type Cache struct {
+	client *agent.RPCClient
+	handle agent.StreamHandle
+	doneCh chan struct{}
+
+	lock    sync.RWMutex
+	members map[string]agent.Member
+
+	// index maps tag names, then tag values, to the names of the members
+	// with the tag. The role is indexed as the "role" tag.
+	index map[string]map[string]map[string]struct{}
+
+	callbackLock sync.Mutex
+	callbacks    []ChangeFunc
+
+	// waiters are notified after every member event, see WaitFor
+	waiters map[chan struct{}]struct{}
+}
+
+// New creates a cache of the members known to the agent of the client.
+// The cache starts an event stream on the client, which is stopped by
+// Close. The client must not be closed before the cache.
+func New(client *agent.RPCClient) (*Cache, error) {
+	c := &Cache{
+		client:  client,
+		doneCh:  make(chan struct{}),
+		members: make(map[string]agent.Member),
+		index:   make(map[string]map[string]map[string]struct{}),
+		waiters: make(map[chan struct{}]struct{}),
+	}
+
+	// Start the stream before loading the members, so no change is
+	// missed in between. Events for changes that are already loaded
+	// only set the same state again.
+	eventCh := make(chan map[string]interface{}, 512)
+	handle, err := client.Stream(memberEvents, eventCh)
+	if err != nil {
+		return nil, err
+	}
+	c.handle = handle
+
+	members, err := client.Members()
+	if err != nil {
+		client.Stop(handle)
+		return nil, err
+	}
+
+	c.lock.Lock()
+	for _, m := range members {
+		c.update(m)
+	}
+	c.lock.Unlock()
+
+	go c.stream(eventCh)
+	return c, nil
+}
+
+// Close stops updating the cache. The members can still be read.
+func (c *Cache) Close() error {
+	return c.client.Stop(c.handle)
+}
+
+// Done returns a channel that is closed once the cache stops being
+// updated, either because it was closed or because the stream ended,
+// such as when the agent shut down.
+func (c *Cache) Done() <-chan struct{} {
+	return c.doneCh
+}
+
+// OnChange registers a function that is called for each member event.
+// The functions are called in order from a single goroutine, so they
+// should return quickly.
+func (c *Cache) OnChange(f ChangeFunc) {
+	c.callbackLock.Lock()
+	defer c.callbackLock.Unlock()
+	c.callbacks = append(c.callbacks, f)
+}
+
+// Members returns all the members in the cache.
+func (c *Cache) Members() []agent.Member {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	result := make([]agent.Member, 0, len(c.members))
+	for _, m := range c.members {
+		result = append(result, m)
+	}
+	return result
+}
+
+// Member returns the named member, if it is in the cache.
+func (c *Cache) Member(name string) (agent.Member, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	m, ok := c.members[name]
+	return m, ok
+}
+
+// WithTag returns the members whose tag has the given value. The role
+// is available as the "role" tag.
+func (c *Cache) WithTag(name, value string) []agent.Member {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	names := c.index[name][value]
+	result := make([]agent.Member, 0, len(names))
+	for n := range names {
+		result = append(result, c.members[n])
+	}
+	return result
+}
+
+// Filter selects members, such as for WaitFor.
+type Filter func(m agent.Member) bool
+
+// TagFilter returns a Filter that matches the members that have all the
+// given tags. The role can be matched as the "role" tag.
+func TagFilter(tags map[string]string) Filter {
+	return func(m agent.Member) bool {
+		have := memberTags(m)
+		for name, value := range tags {
+			if have[name] != value {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// WaitFor blocks until at least n alive members match the filter, and
+// returns them. A nil filter matches every member. It returns an error
+// if the timeout passes first, or if the cache stops being updated. A
+// timeout of zero waits forever.
+func (c *Cache) WaitFor(filter Filter, n int, timeout time.Duration) ([]agent.Member, error) {
+	ch := make(chan struct{}, 1)
+	c.callbackLock.Lock()
+	c.waiters[ch] = struct{}{}
+	c.callbackLock.Unlock()
+	defer func() {
+		c.callbackLock.Lock()
+		delete(c.waiters, ch)
+		c.callbackLock.Unlock()
+	}()
+
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timeoutCh = time.After(timeout)
+	}
+
+	for {
+		var matched []agent.Member
+		for _, m := range c.Members() {
+			if m.Status == "alive" && (filter == nil || filter(m)) {
+				matched = append(matched, m)
+			}
+		}
+		if len(matched) >= n {
+			return matched, nil
+		}
+
+		select {
+		case <-ch:
+		case <-c.doneCh:
+			return nil, fmt.Errorf("Stream closed")
+		case <-timeoutCh:
+			return nil, fmt.Errorf("Timed out with %d of %d members", len(matched), n)
+		}
+	}
+}
+
+// WaitForMembers is a helper that creates a cache for the client, waits
+// on it with WaitFor and closes it again.
+func WaitForMembers(client *agent.RPCClient, filter Filter, n int,
+	timeout time.Duration) ([]agent.Member, error) {
+	c, err := New(client)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.WaitFor(filter, n, timeout)
+}
+
+// stream applies the streamed events until the stream is closed
+func (c *Cache) stream(eventCh <-chan map[string]interface{}) {
+	defer close(c.doneCh)
+	for rec := range eventCh {
+		event, _ := rec["Event"].(string)
+		raw, _ := rec["Members"].([]interface{})
+
+		members := make([]agent.Member, 0, len(raw))
+		for _, r := range raw {
+			m, ok := decodeMember(r)
+			if !ok {
+				log.Printf("[ERR] cache: Invalid member in event: %#v", r)
+				continue
+			}
+			members = append(members, m)
+		}
+
+		c.lock.Lock()
+		for _, m := range members {
+			if event == "member-leave" {
+				m.Status = "left"
+			}
+			c.update(m)
+		}
+		c.lock.Unlock()
+
+		c.callbackLock.Lock()
+		callbacks := c.callbacks
+		for ch := range c.waiters {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+		c.callbackLock.Unlock()
+		for _, f := range callbacks {
+			f(event, members)
+		}
+	}
+}
+
+// update stores the state of a member, removing it if it left. The lock
+// must be held.
+func (c *Cache) update(m agent.Member) {
+	if old, ok := c.members[m.Name]; ok {
+		c.unindex(old)
+		delete(c.members, m.Name)
+	}
+	if m.Status == "left" {
+		return
+	}
+
+	c.members[m.Name] = m
+	for name, value := range memberTags(m) {
+		values, ok := c.index[name]
+		if !ok {
+			values = make(map[string]map[string]struct{})
+			c.index[name] = values
+		}
+		names, ok := values[value]
+		if !ok {
+			names = make(map[string]struct{})
+			values[value] = names
+		}
+		names[m.Name] = struct{}{}
+	}
+}
+
+// unindex removes a member from the tag index. The lock must be held.
+func (c *Cache) unindex(m agent.Member) {
+	for name, value := range memberTags(m) {
+		names := c.index[name][value]
+		delete(names, m.Name)
+		if len(names) == 0 {
+			delete(c.index[name], value)
+		}
+		if len(c.index[name]) == 0 {
+			delete(c.index, name)
+		}
+	}
+}
+
+// memberTags returns the tags of a member, with the role as the "role"
+// tag unless the member has such a tag.
+func memberTags(m agent.Member) map[string]string {
+	tags := make(map[string]string, len(m.Tags)+1)
+	if m.Role != "" {
+		tags["role"] = m.Role
+	}
+	for name, value := range m.Tags {
+		tags[name] = value
+	}
+	return tags
+}
+
+// decodeMember converts a member of a streamed event, as decoded by the
+// RPC client, into a Member.
+func decodeMember(raw interface{}) (agent.Member, bool) {
+	var m agent.Member
+	fields, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		return m, false
+	}
+
+	if m.Name, ok = fields["Name"].(string); !ok {
+		return m, false
+	}
+	if addr, ok := fields["Addr"].([]byte); ok {
+		m.Addr = net.IP(addr)
+	}
+	if port, ok := fields["Port"].(uint64); ok {
+		m.Port = uint16(port)
+	}
+	m.Role, _ = fields["Role"].(string)
+	m.Status, _ = fields["Status"].(string)
+	if tags, ok := fields["Tags"].(map[interface{}]interface{}); ok {
+		m.Tags = make(map[string]string, len(tags))
+		for k, v := range tags {
+			name, _ := k.(string)
+			value, _ := v.(string)
+			m.Tags[name] = value
+		}
+	}
+	return m, true
+}
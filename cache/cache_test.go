@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/hashicorp/serf/command/agent"
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	// Seed the random number generator
+	rand.Seed(time.Now().UnixNano())
+}
+
+func testAgent(t *testing.T, role string) *agent.Agent {
+	config := serf.DefaultConfig()
+	config.MemberlistConfig.BindAddr = testutil.GetBindAddr().String()
+	config.MemberlistConfig.ProbeInterval = 50 * time.Millisecond
+	config.MemberlistConfig.ProbeTimeout = 25 * time.Millisecond
+	config.MemberlistConfig.SuspicionMult = 1
+	config.NodeName = config.MemberlistConfig.BindAddr
+	config.Role = role
+
+	a, err := agent.Create(config, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := a.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return a
+}
+
+func testClient(t *testing.T, a *agent.Agent) (*agent.RPCClient, *agent.AgentIPC) {
+	var l net.Listener
+	var err error
+	for i := 0; i < 500; i++ {
+		addr := fmt.Sprintf("127.0.0.1:%d", rand.Int31n(25000)+1024)
+		if l, err = net.Listen("tcp", addr); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	lw := agent.NewLogWriter(512)
+	mult := io.MultiWriter(os.Stderr, lw)
+	ipc := agent.NewAgentIPC(a, l, mult, lw)
+
+	client, err := agent.NewRPCClient(l.Addr().String())
+	if err != nil {
+		ipc.Shutdown()
+		t.Fatalf("err: %s", err)
+	}
+	return client, ipc
+}
+
+func TestCache(t *testing.T) {
+	a1 := testAgent(t, "web")
+	defer a1.Shutdown()
+	a2 := testAgent(t, "db")
+	defer a2.Shutdown()
+
+	client, ipc := testClient(t, a1)
+	defer ipc.Shutdown()
+	defer client.Close()
+
+	c, err := New(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	var lock sync.Mutex
+	var events []string
+	c.OnChange(func(event string, members []agent.Member) {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, m := range members {
+			events = append(events, event+" "+m.Name)
+		}
+	})
+
+	name1 := a1.SerfConfig().NodeName
+	name2 := a2.SerfConfig().NodeName
+	if members := c.Members(); len(members) != 1 || members[0].Name != name1 {
+		t.Fatalf("bad: %#v", members)
+	}
+
+	if _, err := a1.Join([]string{a2.SerfConfig().MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	m, ok := c.Member(name2)
+	if !ok || m.Role != "db" || m.Status != "alive" {
+		t.Fatalf("bad: %#v", m)
+	}
+	if members := c.WithTag("role", "db"); len(members) != 1 || members[0].Name != name2 {
+		t.Fatalf("bad: %#v", members)
+	}
+	if members := c.WithTag("role", "web"); len(members) != 1 || members[0].Name != name1 {
+		t.Fatalf("bad: %#v", members)
+	}
+
+	if err := a2.Leave(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if _, ok := c.Member(name2); ok {
+		t.Fatalf("should be removed")
+	}
+	if members := c.WithTag("role", "db"); len(members) != 0 {
+		t.Fatalf("bad: %#v", members)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	expected := []string{"member-join " + name2, "member-leave " + name2}
+	if fmt.Sprintf("%v", events) != fmt.Sprintf("%v", expected) {
+		t.Fatalf("bad: %#v", events)
+	}
+}
+
+func TestCache_update(t *testing.T) {
+	c := &Cache{
+		members: make(map[string]agent.Member),
+		index:   make(map[string]map[string]map[string]struct{}),
+	}
+
+	c.update(agent.Member{Name: "foo", Role: "web", Tags: map[string]string{"dc": "east"}, Status: "alive"})
+	c.update(agent.Member{Name: "bar", Tags: map[string]string{"dc": "east"}, Status: "alive"})
+	if members := c.WithTag("dc", "east"); len(members) != 2 {
+		t.Fatalf("bad: %#v", members)
+	}
+
+	// Changed tags are reindexed
+	c.update(agent.Member{Name: "foo", Role: "web", Tags: map[string]string{"dc": "west"}, Status: "failed"})
+	if members := c.WithTag("dc", "east"); len(members) != 1 || members[0].Name != "bar" {
+		t.Fatalf("bad: %#v", members)
+	}
+	if m, _ := c.Member("foo"); m.Status != "failed" {
+		t.Fatalf("bad: %#v", m)
+	}
+
+	// Members that left are removed along with their index entries
+	c.update(agent.Member{Name: "foo", Status: "left"})
+	if _, ok := c.Member("foo"); ok {
+		t.Fatalf("should be removed")
+	}
+	if _, ok := c.index["role"]; ok {
+		t.Fatalf("bad: %#v", c.index)
+	}
+}
+
+func TestWaitForMembers(t *testing.T) {
+	a1 := testAgent(t, "web")
+	defer a1.Shutdown()
+	a2 := testAgent(t, "web")
+	defer a2.Shutdown()
+
+	client, ipc := testClient(t, a1)
+	defer ipc.Shutdown()
+	defer client.Close()
+
+	filter := TagFilter(map[string]string{"role": "web"})
+	if _, err := WaitForMembers(client, filter, 2, 50*time.Millisecond); err == nil {
+		t.Fatalf("should time out")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		a1.Join([]string{a2.SerfConfig().MemberlistConfig.BindAddr}, false)
+	}()
+
+	members, err := WaitForMembers(client, filter, 2, time.Second)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(members) != 2 {
+		t.Fatalf("bad: %#v", members)
+	}
+}
+
+func TestTagFilter(t *testing.T) {
+	m := agent.Member{Name: "foo", Role: "web", Tags: map[string]string{"dc": "east"}}
+	if !TagFilter(map[string]string{"role": "web", "dc": "east"})(m) {
+		t.Fatalf("should match")
+	}
+	if TagFilter(map[string]string{"dc": "west"})(m) {
+		t.Fatalf("should not match")
+	}
+}
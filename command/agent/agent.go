@@ -5,8 +5,14 @@ import (
 	"github.com/hashicorp/serf/serf"
 	"io"
 	"log"
+	"net"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Agent starts and manages a Serf instance, adding some niceties
@@ -23,6 +29,45 @@ type Agent struct {
 	eventHandlers     map[EventHandler]struct{}
 	eventHandlersLock sync.Mutex
 
+	// annotations are the unexpired member annotations, keyed by node
+	annotations    map[string]Annotation
+	annotationLock sync.Mutex
+
+	// tags are the configured tags of the local node, which it advertises
+	// along with the maintenance tag, see advertisedTags. The tagLock
+	// serializes the changes to the advertised tags.
+	tags    map[string]string
+	tagLock sync.Mutex
+
+	// maintenance is the maintenance mode of the local node, persisted at
+	// the maintenancePath, if set
+	maintenance     maintenanceState
+	maintenanceLock sync.Mutex
+	maintenancePath string
+
+	// health are the members whose health check fails, keyed by node
+	health     map[string]healthState
+	healthLock sync.Mutex
+
+	// rtt are the last round trip times to the reference nodes, see
+	// StartRTT
+	rtt     map[string]time.Duration
+	rttLock sync.Mutex
+
+	// userEvents are the most recent user events, see RecentUserEvents
+	userEvents     []serf.UserEvent
+	userEventsLock sync.Mutex
+
+	// views are the named member filters, see View
+	views    map[string]View
+	viewLock sync.Mutex
+
+	// disabledEvents are dropped instead of delivered to the handlers,
+	// as are user events from origins that eventOrigins doesn't allow
+	disabledEvents []EventFilter
+	eventOrigins   EventOrigins
+	disabledLock   sync.Mutex
+
 	// logger instance wraps the logOutput
 	logger *log.Logger
 
@@ -55,6 +100,10 @@ func Create(conf *serf.Config, logOutput io.Writer) (*Agent, error) {
 		conf:          conf,
 		eventCh:       eventCh,
 		eventHandlers: make(map[EventHandler]struct{}),
+		annotations:   make(map[string]Annotation),
+		tags:          conf.Tags,
+		health:        make(map[string]healthState),
+		rtt:           make(map[string]time.Duration),
 		logger:        log.New(logOutput, "", log.LstdFlags),
 		shutdownCh:    make(chan struct{}),
 	}
@@ -65,18 +114,31 @@ func Create(conf *serf.Config, logOutput io.Writer) (*Agent, error) {
 // create so that there isn't a race condition between creating the
 // agent and registering handlers
 func (a *Agent) Start() error {
+	if err := a.startSerf(); err != nil {
+		return err
+	}
+
+	// Start event loop
+	a.startEventLoop()
+	return nil
+}
+
+// startSerf creates the underlying Serf, which binds the listeners.
+// Events are not delivered to handlers until startEventLoop is called.
+func (a *Agent) startSerf() error {
 	a.logger.Printf("[INFO] Serf agent starting")
 
-	// Create serf first
 	serf, err := serf.Create(a.conf)
 	if err != nil {
 		return fmt.Errorf("Error creating Serf: %s", err)
 	}
 	a.serf = serf
+	return nil
+}
 
-	// Start event loop
+// startEventLoop starts delivering events to the event handlers
+func (a *Agent) startEventLoop() {
 	go a.eventLoop()
-	return nil
 }
 
 // Leave prepares for a graceful shutdown of the agent and its processes
@@ -109,6 +171,16 @@ func (a *Agent) Shutdown() error {
 	}
 
 EXIT:
+	// Let the handlers finish what they deferred, such as the batches of
+	// the event scripts, before the shutdown is complete
+	a.eventHandlersLock.Lock()
+	for eh := range a.eventHandlers {
+		if s, ok := eh.(eventHandlerStopper); ok {
+			s.Stop()
+		}
+	}
+	a.eventHandlersLock.Unlock()
+
 	a.logger.Println("[INFO] agent: shutdown complete")
 	a.shutdown = true
 	close(a.shutdownCh)
@@ -131,6 +203,15 @@ func (a *Agent) SerfConfig() *serf.Config {
 	return a.conf
 }
 
+// metrics returns the sink of the metrics of the agent, which is the one
+// of Serf
+func (a *Agent) metrics() serf.MetricsSink {
+	if a.conf.Metrics == nil {
+		return serf.BlackholeSink{}
+	}
+	return a.conf.Metrics
+}
+
 // Join asks the Serf instance to join. See the Serf.Join function.
 func (a *Agent) Join(addrs []string, replay bool) (n int, err error) {
 	a.logger.Printf("[INFO] agent: joining: %v replay: %v", addrs, replay)
@@ -150,11 +231,137 @@ func (a *Agent) ForceLeave(node string) error {
 	return err
 }
 
+// ForceLeaveAddr force leaves the members that advertise the given
+// address, either an IP or an IP and port, for when the name of a member
+// is ambiguous or unknown. If several members match, they are only
+// removed if all is true. It returns the names of the removed members.
+func (a *Agent) ForceLeaveAddr(addr string, all bool) ([]string, error) {
+	host, port := addr, ""
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		host, port = h, p
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid address: %s", addr)
+	}
+
+	var names []string
+	for _, m := range a.serf.Members() {
+		if m.Status == serf.StatusLeft || !m.Addr.Equal(ip) {
+			continue
+		}
+		if port != "" && port != strconv.Itoa(int(m.Port)) {
+			continue
+		}
+		names = append(names, m.Name)
+	}
+
+	switch {
+	case len(names) == 0:
+		return nil, fmt.Errorf("No member has the address %s", addr)
+	case len(names) > 1 && !all:
+		sort.Strings(names)
+		return nil, fmt.Errorf("Several members have the address %s: %s",
+			addr, strings.Join(names, ", "))
+	}
+
+	for _, name := range names {
+		if err := a.ForceLeave(name); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// ForceLeaveMatching force leaves the members whose status matches the
+// regular expression, and that have had it for longer than olderThan if
+// it is positive, such as the members that failed hours ago after a
+// decommission. Only members that failed or are leaving are matched,
+// never alive members, members that left or the local node, even if the
+// status is empty. With dryRun, the members are only selected. It returns
+// the names of the selected members, sorted.
+func (a *Agent) ForceLeaveMatching(status string, olderThan time.Duration, dryRun bool) ([]string, error) {
+	members, err := filterMembers(a.serf.Members(), "", status)
+	if err != nil {
+		return nil, err
+	}
+
+	times := a.serf.MemberTimes()
+	now := time.Now()
+	var names []string
+	for _, m := range members {
+		if m.Status == serf.StatusAlive || m.Status == serf.StatusLeft || m.Name == a.conf.NodeName {
+			continue
+		}
+		if olderThan > 0 && now.Sub(times[m.Name].Status) < olderThan {
+			continue
+		}
+		names = append(names, m.Name)
+	}
+	sort.Strings(names)
+
+	if dryRun || len(names) == 0 {
+		return names, nil
+	}
+
+	// Broadcast the removals at once, waiting for each in turn could take
+	// longer than the RPC timeout of the client
+	a.logger.Printf("[INFO] Force leaving nodes: %v", names)
+	if err := a.serf.RemoveFailedNodes(names); err != nil {
+		a.logger.Printf("[WARN] agent: failed to remove nodes: %v", err)
+		return nil, err
+	}
+	return names, nil
+}
+
+// CheckQuorum verifies, using the local view of membership, that at least
+// n alive members have all of the given tags. This is used to refuse user
+// events when a required part of the cluster is unavailable.
+func (a *Agent) CheckQuorum(tags map[string]string, n int) error {
+	count := 0
+	for _, m := range a.serf.Members() {
+		if m.Status == serf.StatusAlive && matchTags(m.Tags, tags) {
+			count++
+		}
+	}
+	if count < n {
+		return fmt.Errorf("Quorum not met: %d of %d required members alive", count, n)
+	}
+	return nil
+}
+
 // UserEvent sends a UserEvent on Serf, see Serf.UserEvent.
 func (a *Agent) UserEvent(name string, payload []byte, coalesce bool) error {
-	a.logger.Printf("[DEBUG] agent: Requesting user event send: %s. Coalesced: %#v. Payload: %#v",
-		name, coalesce, string(payload))
-	return a.serf.UserEvent(name, payload, coalesce)
+	return a.UserEventVersion(name, payload, 0, coalesce)
+}
+
+// UserEventVersion sends a UserEvent with the schema version of its
+// payload on Serf, see Serf.UserEventVersion.
+func (a *Agent) UserEventVersion(name string, payload []byte, version uint8, coalesce bool) error {
+	a.logger.Printf("[DEBUG] agent: Requesting user event send: %s. Coalesced: %#v. Version: %d. Payload: %#v",
+		name, coalesce, version, string(payload))
+	return a.serf.UserEventVersion(name, payload, version, coalesce)
+}
+
+// UserEventNode sends a UserEvent that only invokes the event handlers
+// of the named member, see Serf.UserEventNode. It refuses to send the
+// event unless the member is alive, so that a mistyped name doesn't
+// silently send an event that nobody acts on.
+func (a *Agent) UserEventNode(name string, payload []byte, version uint8, node string, coalesce bool) error {
+	alive := false
+	for _, m := range a.serf.Members() {
+		if m.Name == node && m.Status == serf.StatusAlive {
+			alive = true
+			break
+		}
+	}
+	if !alive {
+		return fmt.Errorf("No alive member named '%s'", node)
+	}
+
+	a.logger.Printf("[DEBUG] agent: Requesting user event send: %s. Node: %s. Coalesced: %#v. Version: %d. Payload: %#v",
+		name, node, coalesce, version, string(payload))
+	return a.serf.UserEventNode(name, payload, version, node, coalesce)
 }
 
 // RegisterEventHandler adds an event handler to recieve event notifications
@@ -171,12 +378,128 @@ func (a *Agent) DeregisterEventHandler(eh EventHandler) {
 	delete(a.eventHandlers, eh)
 }
 
+// matchTags checks if the given member tags contain all of the
+// expected key/value pairs.
+func matchTags(tags, expected map[string]string) bool {
+	for k, v := range expected {
+		if tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// StartReconcile periodically delivers a member-reconcile event with the
+// full member list to the event handlers, even if nothing has changed.
+// This lets handlers that generate configuration from the member list
+// recover from manual edits or missed events. It must be called after
+// Start.
+func (a *Agent) StartReconcile(interval time.Duration) {
+	go a.reconcileLoop(interval)
+}
+
+// reconcileLoop sends the reconcile events until shutdown
+func (a *Agent) reconcileLoop(interval time.Duration) {
+	for {
+		select {
+		case <-time.After(interval):
+			e := ReconcileEvent{Members: a.serf.Members()}
+			select {
+			case a.eventCh <- e:
+			case <-a.shutdownCh:
+				return
+			}
+
+		case <-a.shutdownCh:
+			return
+		}
+	}
+}
+
+// SetTags changes the configured tags of the local node, which it
+// advertises along with the maintenance tag. The members of the cluster,
+// including this one, deliver a member-update event with the previous
+// and the new tags.
+func (a *Agent) SetTags(tags map[string]string) error {
+	a.tagLock.Lock()
+	defer a.tagLock.Unlock()
+
+	if reflect.DeepEqual(tags, a.tags) {
+		return nil
+	}
+
+	old := a.tags
+	a.tags = tags
+	if err := a.serf.SetTags(a.advertisedTags()); err != nil {
+		a.tags = old
+		return err
+	}
+	return nil
+}
+
+// advertisedTags returns the configured tags along with the maintenance
+// tag, if the local node is in maintenance mode. The tagLock must be
+// held.
+func (a *Agent) advertisedTags() map[string]string {
+	tags := make(map[string]string, len(a.tags)+1)
+	for k, v := range a.tags {
+		tags[k] = v
+	}
+
+	a.maintenanceLock.Lock()
+	defer a.maintenanceLock.Unlock()
+	if a.maintenance.Enabled {
+		tags[maintenanceTag] = a.maintenance.Reason
+	}
+	return tags
+}
+
+// applyConfig applies the settings of the configuration that can be
+// changed while the agent is running.
+func (a *Agent) applyConfig(config *Config) {
+	// Validated already by Validate
+	views, _ := config.ParsedViews()
+	a.SetViews(views)
+
+	// Validated already by Validate
+	disabled, _ := config.DisabledEvents()
+	a.SetDisabledEvents(disabled)
+
+	// Validated already by Validate
+	origins, _ := ParseEventOrigins(config.UserEventOrigins)
+	a.SetEventOrigins(origins)
+}
+
 // eventLoop listens to events from Serf and fans out to event handlers
 func (a *Agent) eventLoop() {
 	for {
 		select {
 		case e := <-a.eventCh:
-			a.logger.Printf("[INFO] agent: Received event: %s", e.String())
+			if ue, ok := e.(serf.UserEvent); ok {
+				switch ue.Name {
+				case annotationEvent:
+					a.handleAnnotation(ue)
+					continue
+				case healthEvent:
+					a.handleHealth(ue)
+					continue
+				}
+				a.recordUserEvent(ue)
+			}
+
+			if a.eventDisabled(e) {
+				a.logger.Printf("[INFO] agent: Dropped disabled event: %s", e.String())
+				continue
+			}
+
+			if ue, ok := e.(serf.UserEvent); ok && !a.originAllowed(ue) {
+				a.metrics().IncrCounter([]string{"agent", "event", "unauthorized"}, 1)
+				a.logger.Printf("[WARN] agent: Dropped user event %s from unauthorized origin %#v",
+					ue.Name, ue.Origin)
+				continue
+			}
+
+			a.logger.Printf("[INFO] agent: Received event: %s (id %s)", e.String(), EventID(e))
 			a.eventHandlersLock.Lock()
 			for eh, _ := range a.eventHandlers {
 				eh.HandleEvent(e)
@@ -188,3 +511,57 @@ func (a *Agent) eventLoop() {
 		}
 	}
 }
+
+// SetDisabledEvents replaces the event types that the agent drops instead
+// of delivering them to the event handlers. This can be changed while the
+// agent is running, such as on a reload.
+func (a *Agent) SetDisabledEvents(filters []EventFilter) {
+	a.disabledLock.Lock()
+	defer a.disabledLock.Unlock()
+	a.disabledEvents = filters
+
+	if len(filters) > 0 {
+		names := make([]string, 0, len(filters))
+		for _, f := range filters {
+			name := f.Event
+			if f.UserEvent != "" {
+				name = "user:" + f.UserEvent
+			}
+			names = append(names, name)
+		}
+		a.logger.Printf("[WARN] agent: Events are disabled: %s", strings.Join(names, ", "))
+	}
+}
+
+// SetEventOrigins replaces the origins that user events are allowed
+// from, see EventOrigins. This can be changed while the agent is running,
+// such as on a reload.
+func (a *Agent) SetEventOrigins(origins EventOrigins) {
+	a.disabledLock.Lock()
+	defer a.disabledLock.Unlock()
+	a.eventOrigins = origins
+}
+
+// originAllowed tests whether the origin of a user event is allowed
+func (a *Agent) originAllowed(e serf.UserEvent) bool {
+	a.disabledLock.Lock()
+	origins := a.eventOrigins
+	a.disabledLock.Unlock()
+
+	if len(origins) == 0 {
+		return true
+	}
+	return origins.Allow(e, a.serf.Members())
+}
+
+// eventDisabled tests whether an event matches any of the disabled events.
+func (a *Agent) eventDisabled(e serf.Event) bool {
+	a.disabledLock.Lock()
+	defer a.disabledLock.Unlock()
+	for _, f := range a.disabledEvents {
+		if f.Invoke(e) {
+			return true
+		}
+	}
+	return false
+}
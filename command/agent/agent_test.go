@@ -1,9 +1,17 @@
 package agent
 
 import (
+	"encoding/json"
 	"github.com/hashicorp/serf/serf"
 	"github.com/hashicorp/serf/testutil"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 func TestAgent_eventHandler(t *testing.T) {
@@ -82,3 +90,686 @@ func TestAgentUserEvent(t *testing.T) {
 		t.Fatalf("bad: %#v", e)
 	}
 }
+
+func TestAgentSetDisabledEvents(t *testing.T) {
+	a1 := testAgent(nil)
+	defer a1.Shutdown()
+	defer a1.Leave()
+
+	handler := new(MockEventHandler)
+	a1.RegisterEventHandler(handler)
+	a1.SetDisabledEvents(ParseEventFilter("user:deploy"))
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if err := a1.UserEvent("deploy", []byte("foo"), false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := a1.UserEvent("restart", []byte("bar"), false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	handler.Lock()
+	defer handler.Unlock()
+
+	if len(handler.Events) == 0 {
+		t.Fatal("no events")
+	}
+
+	for _, e := range handler.Events {
+		if ue, ok := e.(serf.UserEvent); ok && ue.Name == "deploy" {
+			t.Fatalf("bad: %#v", e)
+		}
+	}
+
+	e, ok := handler.Events[len(handler.Events)-1].(serf.UserEvent)
+	if !ok || e.Name != "restart" {
+		t.Fatalf("bad: %#v", handler.Events)
+	}
+}
+
+func TestAgentSetEventOrigins(t *testing.T) {
+	a1 := testAgent(nil)
+	defer a1.Shutdown()
+	defer a1.Leave()
+
+	handler := new(MockEventHandler)
+	a1.RegisterEventHandler(handler)
+	a1.SetEventOrigins(EventOrigins{
+		"deploy":  []string{"ci"},
+		"restart": []string{a1.conf.NodeName},
+	})
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if err := a1.UserEvent("deploy", []byte("foo"), false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := a1.UserEvent("restart", []byte("bar"), false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	handler.Lock()
+	defer handler.Unlock()
+
+	if len(handler.Events) == 0 {
+		t.Fatal("no events")
+	}
+
+	for _, e := range handler.Events {
+		if ue, ok := e.(serf.UserEvent); ok && ue.Name == "deploy" {
+			t.Fatalf("bad: %#v", e)
+		}
+	}
+
+	e, ok := handler.Events[len(handler.Events)-1].(serf.UserEvent)
+	if !ok || e.Name != "restart" {
+		t.Fatalf("bad: %#v", handler.Events)
+	}
+}
+
+func TestAgentCheckQuorum(t *testing.T) {
+	a1 := testAgent(nil)
+	a1.conf.Tags = map[string]string{"role": "db"}
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if err := a1.CheckQuorum(map[string]string{"role": "db"}, 1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := a1.CheckQuorum(map[string]string{"role": "db"}, 2); err == nil {
+		t.Fatalf("should not meet quorum")
+	}
+
+	if err := a1.CheckQuorum(map[string]string{"role": "web"}, 1); err == nil {
+		t.Fatalf("should not meet quorum")
+	}
+}
+
+func TestAgentStartReconcile(t *testing.T) {
+	a1 := testAgent(nil)
+	defer a1.Shutdown()
+
+	handler := new(MockEventHandler)
+	a1.RegisterEventHandler(handler)
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	a1.StartReconcile(10 * time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+
+	handler.Lock()
+	defer handler.Unlock()
+
+	found := 0
+	for _, raw := range handler.Events {
+		e, ok := raw.(ReconcileEvent)
+		if !ok {
+			continue
+		}
+		found++
+
+		if len(e.Members) != 1 {
+			t.Fatalf("bad: %#v", e)
+		}
+	}
+
+	if found < 2 {
+		t.Fatalf("bad: %#v", handler.Events)
+	}
+}
+
+func TestAgentAnnotate(t *testing.T) {
+	a1 := testAgent(nil)
+	defer a1.Shutdown()
+	defer a1.Leave()
+
+	handler := new(MockEventHandler)
+	a1.RegisterEventHandler(handler)
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if err := a1.Annotate("draining", time.Hour); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	anns := a1.Annotations()
+	if anns[a1.conf.NodeName].Text != "draining" {
+		t.Fatalf("bad: %#v", anns)
+	}
+
+	// The annotation events must not reach the handlers
+	handler.Lock()
+	for _, e := range handler.Events {
+		if _, ok := e.(serf.UserEvent); ok {
+			t.Fatalf("bad: %#v", e)
+		}
+	}
+	handler.Unlock()
+
+	// Clear it
+	if err := a1.Annotate("", 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if anns := a1.Annotations(); len(anns) != 0 {
+		t.Fatalf("bad: %#v", anns)
+	}
+}
+
+func TestAgentAnnotate_badTTL(t *testing.T) {
+	a1 := testAgent(nil)
+	defer a1.Shutdown()
+
+	if err := a1.Annotate("draining", 0); err == nil {
+		t.Fatalf("should err")
+	}
+}
+
+func TestAgent_handleAnnotation(t *testing.T) {
+	a1 := testAgent(nil)
+	defer a1.Shutdown()
+
+	event := func(ltime serf.LamportTime, text string, expires time.Time) serf.UserEvent {
+		return serf.UserEvent{
+			LTime:   ltime,
+			Name:    annotationEvent,
+			Payload: []byte(`{"Node":"foo","Text":"` + text + `","Expires":` + strconv.FormatInt(expires.Unix(), 10) + `}`),
+		}
+	}
+
+	later := time.Now().Add(time.Hour)
+	a1.handleAnnotation(event(2, "new", later))
+
+	// An older event is ignored
+	a1.handleAnnotation(event(1, "old", later))
+	if anns := a1.Annotations(); anns["foo"].Text != "new" {
+		t.Fatalf("bad: %#v", anns)
+	}
+
+	// Expired annotations are dropped
+	a1.handleAnnotation(event(3, "expired", time.Now().Add(-time.Minute)))
+	if anns := a1.Annotations(); len(anns) != 0 {
+		t.Fatalf("bad: %#v", anns)
+	}
+
+	// And an older event delivered late doesn't bring one back
+	a1.handleAnnotation(event(2, "new", later))
+	if anns := a1.Annotations(); len(anns) != 0 {
+		t.Fatalf("bad: %#v", anns)
+	}
+
+	// Neither after clearing
+	a1.handleAnnotation(event(5, "", later))
+	a1.handleAnnotation(event(4, "old", later))
+	if anns := a1.Annotations(); len(anns) != 0 {
+		t.Fatalf("bad: %#v", anns)
+	}
+
+	// A member may not annotate another one
+	e := event(6, "own", later)
+	e.Origin = "bar"
+	a1.handleAnnotation(e)
+	if anns := a1.Annotations(); len(anns) != 0 {
+		t.Fatalf("bad: %#v", anns)
+	}
+
+	e.Origin = "foo"
+	a1.handleAnnotation(e)
+	if anns := a1.Annotations(); anns["foo"].Text != "own" {
+		t.Fatalf("bad: %#v", anns)
+	}
+}
+
+func TestAgentMaintenance(t *testing.T) {
+	a1 := testAgent(nil)
+	defer a1.Shutdown()
+	defer a1.Leave()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if err := a1.SetMaintenance(true, "kernel patch"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if !a1.InMaintenance() {
+		t.Fatalf("should be in maintenance")
+	}
+	if m := a1.Maintenance(); m[a1.conf.NodeName] != "kernel patch" {
+		t.Fatalf("bad: %#v", m)
+	}
+
+	// The maintenance mode is a tag, so members that join later see it
+	a2 := testAgent(nil)
+	defer a2.Shutdown()
+	defer a2.Leave()
+
+	if err := a2.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := a2.Join([]string{a1.conf.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if m := a2.Maintenance(); m[a1.conf.NodeName] != "kernel patch" {
+		t.Fatalf("bad: %#v", m)
+	}
+
+	// Changing the other tags keeps the maintenance mode
+	if err := a1.SetTags(map[string]string{"dc": "east"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if m := a2.Maintenance(); m[a1.conf.NodeName] != "kernel patch" {
+		t.Fatalf("bad: %#v", m)
+	}
+
+	if err := a1.SetMaintenance(false, ""); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if a1.InMaintenance() {
+		t.Fatalf("should not be in maintenance")
+	}
+	if m := a2.Maintenance(); len(m) != 0 {
+		t.Fatalf("bad: %#v", m)
+	}
+	for _, m := range a2.Serf().Members() {
+		if m.Name == a1.conf.NodeName && m.Tags["dc"] != "east" {
+			t.Fatalf("bad: %#v", m)
+		}
+	}
+}
+
+func TestAgentMaintenance_restart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "maintenance")
+
+	a1 := testAgent(nil)
+	if err := a1.LoadMaintenance(path); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := a1.SetMaintenance(true, ""); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	a1.Shutdown()
+
+	// The maintenance mode is restored and advertised from the start
+	a2 := testAgent(nil)
+	defer a2.Shutdown()
+	if err := a2.LoadMaintenance(path); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := a2.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !a2.InMaintenance() {
+		t.Fatalf("should be in maintenance")
+	}
+	if m := a2.Maintenance(); m[a2.conf.NodeName] != "maintenance" {
+		t.Fatalf("bad: %#v", m)
+	}
+
+	if err := a2.SetMaintenance(false, ""); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("should be removed: %v", err)
+	}
+}
+
+func TestAgentStartHealthCheck(t *testing.T) {
+	healthy, err := ioutil.TempFile("", "serf")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	healthy.Close()
+	defer os.Remove(healthy.Name())
+
+	a1 := testAgent(nil)
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	a1.SetViews(map[string]View{
+		"alive":    View{"status": "alive"},
+		"critical": View{"health": "critical"},
+	})
+	a1.StartHealthCheck("test -f "+healthy.Name(), "", 10*time.Millisecond, time.Second)
+
+	time.Sleep(50 * time.Millisecond)
+	if m := a1.CriticalMembers(); len(m) != 0 {
+		t.Fatalf("bad: %#v", m)
+	}
+
+	os.Remove(healthy.Name())
+	time.Sleep(50 * time.Millisecond)
+
+	if _, ok := a1.CriticalMembers()[a1.conf.NodeName]; !ok {
+		t.Fatalf("should be critical: %#v", a1.CriticalMembers())
+	}
+
+	// Critical members are only in the views that select them
+	if mem, err := a1.ViewMembers("alive"); err != nil || len(mem) != 0 {
+		t.Fatalf("bad: %#v %v", mem, err)
+	}
+	mem, err := a1.ViewMembers("critical")
+	if err != nil || len(mem) != 1 || mem[0].Tags["health"] != "critical" {
+		t.Fatalf("bad: %#v %v", mem, err)
+	}
+
+	if err := ioutil.WriteFile(healthy.Name(), nil, 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if m := a1.CriticalMembers(); len(m) != 0 {
+		t.Fatalf("bad: %#v", m)
+	}
+	if mem, err := a1.ViewMembers("alive"); err != nil || len(mem) != 1 {
+		t.Fatalf("bad: %#v %v", mem, err)
+	}
+}
+
+func TestAgentStartHealthCheck_rebroadcast(t *testing.T) {
+	old := healthRebroadcastInterval
+	healthRebroadcastInterval = 10 * time.Millisecond
+	defer func() { healthRebroadcastInterval = old }()
+
+	a1 := testAgent(nil)
+	a2 := testAgent(nil)
+	defer a1.Shutdown()
+	defer a2.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := a2.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	a1.StartHealthCheck("exit 1", "", 10*time.Millisecond, time.Second)
+
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := a1.CriticalMembers()[a1.conf.NodeName]; !ok {
+		t.Fatalf("should be critical: %#v", a1.CriticalMembers())
+	}
+
+	// A member that joins later learns that the node is critical
+	if _, err := a2.Join([]string{a1.conf.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testutil.Yield()
+	time.Sleep(50 * time.Millisecond)
+
+	if _, ok := a2.CriticalMembers()[a1.conf.NodeName]; !ok {
+		t.Fatalf("should be critical: %#v", a2.CriticalMembers())
+	}
+}
+
+func TestAgentStartHealthCheck_longOutput(t *testing.T) {
+	a1 := testAgent(nil)
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	a1.StartHealthCheck("printf '%0500d' 0; exit 1", "", 10*time.Millisecond, time.Second)
+
+	time.Sleep(50 * time.Millisecond)
+	output, ok := a1.CriticalMembers()[a1.conf.NodeName]
+	if !ok {
+		t.Fatalf("should be critical: %#v", a1.CriticalMembers())
+	}
+	if !strings.HasPrefix(output, "000") || !strings.HasSuffix(output, "...") {
+		t.Fatalf("bad: %#v", output)
+	}
+}
+
+func TestAgentStartHealthCheck_restart(t *testing.T) {
+	a1 := testAgent(nil)
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The members still know the node as critical from before a restart
+	a1.handleHealth(serf.UserEvent{
+		LTime:   0,
+		Name:    healthEvent,
+		Payload: []byte(`{"Node":"` + a1.conf.NodeName + `","Critical":true}`),
+	})
+	if _, ok := a1.CriticalMembers()[a1.conf.NodeName]; !ok {
+		t.Fatalf("should be critical: %#v", a1.CriticalMembers())
+	}
+
+	// The first result is broadcast even if it passes
+	a1.StartHealthCheck("true", "", 10*time.Millisecond, time.Second)
+	time.Sleep(50 * time.Millisecond)
+	if m := a1.CriticalMembers(); len(m) != 0 {
+		t.Fatalf("bad: %#v", m)
+	}
+}
+
+func TestHealthEventPayload(t *testing.T) {
+	output := strings.Repeat("\u00e9\"", 200)
+	payload, err := healthEventPayload("foo", true, output)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(healthEvent)+len(payload) > serf.UserEventSizeLimit {
+		t.Fatalf("too long: %d", len(payload))
+	}
+
+	var p healthPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.Node != "foo" || !p.Critical || !strings.HasSuffix(p.Output, "...") {
+		t.Fatalf("bad: %#v", p)
+	}
+	if !utf8.ValidString(p.Output) {
+		t.Fatalf("bad: %#v", p.Output)
+	}
+
+	// Short output is kept as it is
+	payload, err = healthEventPayload("foo", true, "disk full")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := json.Unmarshal(payload, &p); err != nil || p.Output != "disk full" {
+		t.Fatalf("bad: %#v %v", p, err)
+	}
+}
+
+func TestAgent_handleHealth(t *testing.T) {
+	a1 := testAgent(nil)
+	defer a1.Shutdown()
+
+	event := func(ltime serf.LamportTime, critical bool) serf.UserEvent {
+		return serf.UserEvent{
+			LTime:   ltime,
+			Name:    healthEvent,
+			Payload: []byte(`{"Node":"foo","Critical":` + strconv.FormatBool(critical) + `}`),
+			Origin:  "foo",
+		}
+	}
+
+	a1.handleHealth(event(2, true))
+	if _, ok := a1.CriticalMembers()["foo"]; !ok {
+		t.Fatalf("bad: %#v", a1.CriticalMembers())
+	}
+
+	a1.handleHealth(event(3, false))
+	if m := a1.CriticalMembers(); len(m) != 0 {
+		t.Fatalf("bad: %#v", m)
+	}
+
+	// An older event is ignored after the check passes again
+	a1.handleHealth(event(2, true))
+	if m := a1.CriticalMembers(); len(m) != 0 {
+		t.Fatalf("bad: %#v", m)
+	}
+
+	// Members can't set the health of others
+	spoofed := event(4, true)
+	spoofed.Origin = "bar"
+	a1.handleHealth(spoofed)
+	if m := a1.CriticalMembers(); len(m) != 0 {
+		t.Fatalf("bad: %#v", m)
+	}
+}
+
+func TestAgentStartRTT(t *testing.T) {
+	a1 := testAgent(nil)
+	a2 := testAgent(nil)
+	defer a1.Shutdown()
+	defer a2.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := a2.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := a1.Join([]string{a2.conf.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	// Unknown nodes are left out
+	a1.StartRTT([]string{a2.conf.NodeName, "unknown"}, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	rtt := a1.RTT()
+	if len(rtt) != 1 || rtt[a2.conf.NodeName] == "" {
+		t.Fatalf("bad: %#v", rtt)
+	}
+}
+
+func TestAgentForceLeaveAddr(t *testing.T) {
+	a1 := testAgent(nil)
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := a1.ForceLeaveAddr("foo", false); err == nil {
+		t.Fatalf("should err")
+	}
+
+	if _, err := a1.ForceLeaveAddr("10.255.255.1:7946", false); err == nil {
+		t.Fatalf("should err")
+	}
+
+	// A port that doesn't match
+	bind := a1.conf.MemberlistConfig.BindAddr
+	if _, err := a1.ForceLeaveAddr(bind+":1", false); err == nil {
+		t.Fatalf("should err")
+	}
+
+	names, err := a1.ForceLeaveAddr(bind, false)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(names) != 1 || names[0] != a1.conf.NodeName {
+		t.Fatalf("bad: %#v", names)
+	}
+}
+
+func TestAgentForceLeaveMatching(t *testing.T) {
+	a1 := testAgent(nil)
+	a2 := testAgent(nil)
+	defer a1.Shutdown()
+	defer a2.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := a2.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := a1.Join([]string{a2.conf.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	// Alive members, including the local node, are never selected
+	names, err := a1.ForceLeaveMatching("", 0, false)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(names) != 0 {
+		t.Fatalf("bad: %#v", names)
+	}
+	for _, m := range a1.Serf().Members() {
+		if m.Status != serf.StatusAlive {
+			t.Fatalf("should be alive: %#v", m)
+		}
+	}
+
+	if err := a2.Serf().Shutdown(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	time.Sleep(a2.conf.MemberlistConfig.ProbeInterval * 5)
+
+	names, err = a1.ForceLeaveMatching("", 0, false)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(names) != 1 || names[0] != a2.conf.NodeName {
+		t.Fatalf("bad: %#v", names)
+	}
+}
@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/serf/serf"
+	"time"
+)
+
+// internalEventPrefix is the prefix of the names of the user events
+// that are used by the agent itself
+const internalEventPrefix = "_serf_"
+
+// annotationEvent is the name of the user event used to gossip member
+// annotations. These events are consumed by the agent and are never
+// delivered to event handlers.
+const annotationEvent = internalEventPrefix + "annotate"
+
+// Annotation is a short, operator provided note attached to a member,
+// such as "draining for maintenance". It is gossiped with a user event
+// and is no longer shown once it expires. An annotation that expired or
+// was cleared is kept, so that older events delivered late don't set it
+// again.
+type Annotation struct {
+	Text    string
+	Expires time.Time
+
+	// ltime is the Lamport time of the user event that set the
+	// annotation, used to ignore events delivered out of order
+	ltime serf.LamportTime
+}
+
+// annotationPayload is the payload of an annotation user event
+type annotationPayload struct {
+	Node    string
+	Text    string
+	Expires int64
+}
+
+// Annotate attaches an annotation to the local node that expires after
+// the given ttl. An empty text clears the annotation. Since the
+// annotation is sent as a user event, it is subject to the size limit
+// of user events.
+func (a *Agent) Annotate(text string, ttl time.Duration) error {
+	if text != "" && ttl <= 0 {
+		return fmt.Errorf("Annotation TTL must be positive")
+	}
+
+	payload, err := json.Marshal(&annotationPayload{
+		Node:    a.conf.NodeName,
+		Text:    text,
+		Expires: time.Now().Add(ttl).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Annotations from different nodes share the event name, so they
+	// must not be coalesced
+	a.logger.Printf("[DEBUG] agent: Requesting annotation: %#v", text)
+	return a.serf.UserEvent(annotationEvent, payload, false)
+}
+
+// Annotations returns the unexpired annotations known to this agent,
+// keyed by node name.
+func (a *Agent) Annotations() map[string]Annotation {
+	a.annotationLock.Lock()
+	defer a.annotationLock.Unlock()
+
+	now := time.Now()
+	result := make(map[string]Annotation, len(a.annotations))
+	for node, ann := range a.annotations {
+		if ann.Text != "" && !now.After(ann.Expires) {
+			result[node] = ann
+		}
+	}
+	return result
+}
+
+// handleAnnotation stores the annotation from an annotation user event.
+// A member may only annotate itself, so events whose node isn't the
+// member that sent them are ignored. Events of older members don't carry
+// the sender and are trusted.
+func (a *Agent) handleAnnotation(e serf.UserEvent) {
+	var p annotationPayload
+	if err := json.Unmarshal(e.Payload, &p); err != nil {
+		a.logger.Printf("[WARN] agent: Invalid annotation: %s", err)
+		return
+	}
+	if e.Origin != "" && e.Origin != p.Node {
+		a.logger.Printf("[WARN] agent: Ignoring annotation of %s sent by %s", p.Node, e.Origin)
+		return
+	}
+
+	a.annotationLock.Lock()
+	defer a.annotationLock.Unlock()
+
+	if old, ok := a.annotations[p.Node]; ok && old.ltime > e.LTime {
+		return
+	}
+
+	a.annotations[p.Node] = Annotation{
+		Text:    p.Text,
+		Expires: time.Unix(p.Expires, 0),
+		ltime:   e.LTime,
+	}
+}
@@ -8,10 +8,12 @@ import (
 	"github.com/hashicorp/serf/serf"
 	"github.com/mitchellh/cli"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
@@ -28,8 +30,18 @@ type Command struct {
 	Ui            cli.Ui
 	ShutdownCh    <-chan struct{}
 	args          []string
+	checkConfig   bool
+	force         bool
+	strictConfig  bool
 	scriptHandler *ScriptEventHandler
 	logFilter     *logutils.LevelFilter
+	logWriter     *logWriter
+	logOutput     io.Writer
+	rpcListener   net.Listener
+
+	// handoffReady is the pipe to report on once the agent is running,
+	// if it was started by a handoff
+	handoffReady *os.File
 }
 
 // readConfig is responsible for setup of our configuration using
@@ -37,14 +49,24 @@ type Command struct {
 func (c *Command) readConfig() *Config {
 	var cmdConfig Config
 	var configFiles []string
+	var tags []string
 	cmdFlags := flag.NewFlagSet("agent", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
 	cmdFlags.StringVar(&cmdConfig.BindAddr, "bind", "", "address to bind listeners to")
+	cmdFlags.Var((*AppendSliceValue)(&cmdConfig.ExtraBindAddrs), "extra-bind",
+		"additional IP address to bind listeners to")
 	cmdFlags.StringVar(&cmdConfig.AdvertiseAddr, "advertise", "", "address to advertise to cluster")
+	cmdFlags.BoolVar(&c.checkConfig, "check-config", false,
+		"verify the agent can start, then exit")
+	cmdFlags.BoolVar(&c.strictConfig, "strict-config", false,
+		"refuse configuration files with unknown keys")
+	cmdFlags.BoolVar(&c.force, "force", false,
+		"start with a snapshot of another node name or IP address")
 	cmdFlags.Var((*AppendSliceValue)(&configFiles), "config-file",
 		"json file to read config from")
 	cmdFlags.Var((*AppendSliceValue)(&configFiles), "config-dir",
 		"directory of json files to read")
+	cmdFlags.StringVar(&cmdConfig.Datacenter, "dc", "", "datacenter of this node")
 	cmdFlags.StringVar(&cmdConfig.EncryptKey, "encrypt", "", "encryption key")
 	cmdFlags.Var((*AppendSliceValue)(&cmdConfig.EventHandlers), "event-handler",
 		"command to execute when events occur")
@@ -54,19 +76,39 @@ func (c *Command) readConfig() *Config {
 		"replay events for startup join")
 	cmdFlags.StringVar(&cmdConfig.LogLevel, "log-level", "", "log level")
 	cmdFlags.StringVar(&cmdConfig.NodeName, "node", "", "node name")
+	cmdFlags.BoolVar(&cmdConfig.Observer, "observer", false,
+		"mark this node as an observer")
 	cmdFlags.IntVar(&cmdConfig.Protocol, "protocol", -1, "protocol version")
 	cmdFlags.StringVar(&cmdConfig.Role, "role", "", "role name")
+	cmdFlags.Var((*AppendSliceValue)(&tags), "tag",
+		"tag in the form of key=value")
+	cmdFlags.Var((*AppendSliceValue)(&cmdConfig.TagMetadata), "tag-metadata",
+		"metadata service to populate tags from")
 	cmdFlags.StringVar(&cmdConfig.RPCAddr, "rpc-addr", "",
 		"address to bind RPC listener to")
 	cmdFlags.StringVar(&cmdConfig.Profile, "profile", "", "timing profile to use (lan, wan, local)")
 	cmdFlags.StringVar(&cmdConfig.SnapshotPath, "snapshot", "", "path to the snapshot file")
+	cmdFlags.StringVar(&cmdConfig.DataDir, "data-dir", "", "directory of the agent state")
+	cmdFlags.StringVar(&cmdConfig.User, "user", "", "user to run as after binding")
+	cmdFlags.StringVar(&cmdConfig.Group, "group", "", "group to run as after binding")
 	if err := cmdFlags.Parse(c.args); err != nil {
 		return nil
 	}
 
+	var err error
+	cmdConfig.Tags, err = UnmarshalTags(tags)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return nil
+	}
+
 	config := DefaultConfig
 	if len(configFiles) > 0 {
-		fileConfig, err := ReadConfigPaths(configFiles)
+		read := ReadConfigPaths
+		if c.strictConfig || c.checkConfig {
+			read = ReadConfigPathsStrict
+		}
+		fileConfig, err := read(configFiles)
 		if err != nil {
 			c.Ui.Error(err.Error())
 			return nil
@@ -77,21 +119,14 @@ func (c *Command) readConfig() *Config {
 
 	config = MergeConfig(config, &cmdConfig)
 
-	if config.NodeName == "" {
-		hostname, err := os.Hostname()
-		if err != nil {
-			c.Ui.Error(fmt.Sprintf("Error determining hostname: %s", err))
-			return nil
-		}
-		config.NodeName = hostname
+	if err := config.setDefaults(); err != nil {
+		c.Ui.Error(err.Error())
+		return nil
 	}
 
-	eventScripts := config.EventScripts()
-	for _, script := range eventScripts {
-		if !script.Valid() {
-			c.Ui.Error(fmt.Sprintf("Invalid event script: %s", script.String()))
-			return nil
-		}
+	if err := config.Validate(); err != nil {
+		c.Ui.Error(err.Error())
+		return nil
 	}
 
 	return config
@@ -99,55 +134,18 @@ func (c *Command) readConfig() *Config {
 
 // setupAgent is used to create the agent we use
 func (c *Command) setupAgent(config *Config, logOutput io.Writer) *Agent {
-	bindIP, bindPort, err := config.AddrParts(config.BindAddr)
+	serfConfig, err := config.SerfConfig(log.New(logOutput, "", log.LstdFlags))
 	if err != nil {
-		c.Ui.Error(fmt.Sprintf("Invalid bind address: %s", err))
-		return nil
-	}
-
-	var advertiseIP string
-	var advertisePort int
-	if config.AdvertiseAddr != "" {
-		advertiseIP, advertisePort, err = config.AddrParts(config.AdvertiseAddr)
-		if err != nil {
-			c.Ui.Error(fmt.Sprintf("Invalid advertise address: %s", err))
-			return nil
-		}
-	}
-
-	encryptKey, err := config.EncryptBytes()
-	if err != nil {
-		c.Ui.Error(fmt.Sprintf("Invalid encryption key: %s", err))
+		c.Ui.Error(err.Error())
 		return nil
 	}
+	serfConfig.ForceSnapshotIdentity = c.force
 
-	serfConfig := serf.DefaultConfig()
-	switch config.Profile {
-	case "lan":
-		serfConfig.MemberlistConfig = memberlist.DefaultLANConfig()
-	case "wan":
-		serfConfig.MemberlistConfig = memberlist.DefaultWANConfig()
-	case "local":
-		serfConfig.MemberlistConfig = memberlist.DefaultLocalConfig()
-	default:
-		c.Ui.Error(fmt.Sprintf("Unknown profile: %s", config.Profile))
+	if err := config.createDataDir(); err != nil {
+		c.Ui.Error(err.Error())
 		return nil
 	}
 
-	serfConfig.MemberlistConfig.BindAddr = bindIP
-	serfConfig.MemberlistConfig.BindPort = bindPort
-	serfConfig.MemberlistConfig.AdvertiseAddr = advertiseIP
-	serfConfig.MemberlistConfig.AdvertisePort = advertisePort
-	serfConfig.MemberlistConfig.SecretKey = encryptKey
-	serfConfig.NodeName = config.NodeName
-	serfConfig.Role = config.Role
-	serfConfig.SnapshotPath = config.SnapshotPath
-	serfConfig.ProtocolVersion = uint8(config.Protocol)
-	serfConfig.CoalescePeriod = 3 * time.Second
-	serfConfig.QuiescentPeriod = time.Second
-	serfConfig.UserCoalescePeriod = 3 * time.Second
-	serfConfig.UserQuiescentPeriod = time.Second
-
 	// Start Serf
 	c.Ui.Output("Starting Serf agent...")
 	agent, err := Create(serfConfig, logOutput)
@@ -155,6 +153,13 @@ func (c *Command) setupAgent(config *Config, logOutput io.Writer) *Agent {
 		c.Ui.Error(fmt.Sprintf("Failed to start the Serf agent: %v", err))
 		return nil
 	}
+
+	if path := config.MaintenanceFile(); path != "" {
+		if err := agent.LoadMaintenance(path); err != nil {
+			c.Ui.Error(err.Error())
+			return nil
+		}
+	}
 	return agent
 }
 
@@ -187,29 +192,74 @@ func (c *Command) setupLoggers(config *Config) (*GatedWriter, *logWriter, io.Wri
 func (c *Command) startAgent(config *Config, agent *Agent,
 	logWriter *logWriter, logOutput io.Writer) *AgentIPC {
 	// Add the script event handlers
-	c.scriptHandler = &ScriptEventHandler{
-		Self: serf.Member{
-			Name: config.NodeName,
-			Role: config.Role,
-		},
-		Scripts: config.EventScripts(),
-		Logger:  log.New(logOutput, "", log.LstdFlags),
-	}
+	c.scriptHandler = newScriptEventHandler(config, agent, logOutput)
 	agent.RegisterEventHandler(c.scriptHandler)
 
-	// Start the agent after the handler is registered
-	if err := agent.Start(); err != nil {
+	// Bind all the listeners before dropping privileges
+	if err := agent.startSerf(); err != nil {
 		c.Ui.Error(fmt.Sprintf("Failed to start the Serf agent: %v", err))
 		return nil
 	}
 
-	// Setup the RPC listener
-	rpcListener, err := net.Listen("tcp", config.RPCAddr)
-	if err != nil {
-		c.Ui.Error(fmt.Sprintf("Error starting RPC listener: %s", err))
-		return nil
+	// Setup the RPC listener, unless systemd or the agent that handed
+	// off to this process already passed one, or the agent takes over
+	// again after a failed handoff
+	var err error
+	rpcListener := c.rpcListener
+	activated := false
+	handedOff := false
+	if rpcListener == nil {
+		rpcListener, err = activatedListener()
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error using the socket from systemd: %s", err))
+			return nil
+		}
+		activated = rpcListener != nil
+	}
+	if rpcListener == nil {
+		rpcListener, c.handoffReady, err = handedOffListener()
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error using the socket from the handoff: %s", err))
+			return nil
+		}
+		handedOff = rpcListener != nil
+	}
+	if rpcListener == nil {
+		rpcListener, err = net.Listen("tcp", config.RPCAddr)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error starting RPC listener: %s", err))
+			return nil
+		}
+	}
+
+	if config.User != "" || config.Group != "" {
+		if err := dropPrivileges(config.User, config.Group); err != nil {
+			rpcListener.Close()
+			c.Ui.Error(fmt.Sprintf("Error dropping privileges: %s", err))
+			return nil
+		}
 	}
 
+	// Start delivering events after the handler is registered, and
+	// after privileges are dropped so handlers never run privileged
+	agent.startEventLoop()
+
+	// Validated already by readConfig
+	if interval, _ := config.ReconcileDuration(); interval > 0 {
+		agent.StartReconcile(interval)
+	}
+	if config.HealthCheck != "" {
+		interval, timeout, _ := config.HealthCheckDurations()
+		agent.StartHealthCheck(config.HealthCheck, config.EventHandlerShell, interval, timeout)
+	}
+	if len(config.RTTNodes) > 0 {
+		interval, _ := config.RTTDuration()
+		agent.StartRTT(config.RTTNodes, interval)
+	}
+
+	agent.applyConfig(config)
+	c.rpcListener = rpcListener
+
 	// Start the IPC layer
 	c.Ui.Output("Starting Serf agent RPC...")
 	ipc := NewAgentIPC(agent, rpcListener, logOutput, logWriter)
@@ -219,6 +269,10 @@ func (c *Command) startAgent(config *Config, agent *Agent,
 	c.Ui.Output("Serf agent running!")
 	c.Ui.Info(fmt.Sprintf("     Node name: '%s'", config.NodeName))
 	c.Ui.Info(fmt.Sprintf("     Bind addr: '%s'", bindAddr))
+	for _, ip := range config.ExtraBindAddrs {
+		extraAddr := (&net.TCPAddr{IP: net.ParseIP(ip), Port: bindPort}).String()
+		c.Ui.Info(fmt.Sprintf("    Extra bind: '%s'", extraAddr))
+	}
 
 	if config.AdvertiseAddr != "" {
 		advertiseIP, advertisePort, _ := config.AddrParts(config.AdvertiseAddr)
@@ -226,13 +280,142 @@ func (c *Command) startAgent(config *Config, agent *Agent,
 		c.Ui.Info(fmt.Sprintf("Advertise addr: '%s'", advertiseAddr))
 	}
 
-	c.Ui.Info(fmt.Sprintf("      RPC addr: '%s'", config.RPCAddr))
+	if activated {
+		c.Ui.Info(fmt.Sprintf("      RPC addr: '%s' (from systemd)", rpcListener.Addr()))
+	} else if handedOff {
+		c.Ui.Info(fmt.Sprintf("      RPC addr: '%s' (from handoff)", rpcListener.Addr()))
+	} else {
+		c.Ui.Info(fmt.Sprintf("      RPC addr: '%s'", config.RPCAddr))
+	}
 	c.Ui.Info(fmt.Sprintf("     Encrypted: %#v", config.EncryptKey != ""))
-	c.Ui.Info(fmt.Sprintf("      Snapshot: %v", config.SnapshotPath != ""))
+	c.Ui.Info(fmt.Sprintf("      Snapshot: %v", config.SnapshotFile() != ""))
 	c.Ui.Info(fmt.Sprintf("       Profile: %s", config.Profile))
 	return ipc
 }
 
+// checkBind verifies that all the listeners of the agent can be bound,
+// releasing them immediately. It is used by -check-config, so that the
+// agent never joins the cluster or invokes event handlers.
+func (c *Command) checkBind(config *Config, agent *Agent) int {
+	serfConfig := agent.SerfConfig()
+	mlConfig := serfConfig.MemberlistConfig
+	bindIPs := append([]string{mlConfig.BindAddr}, serfConfig.ExtraBindAddrs...)
+	for _, ip := range bindIPs {
+		bindAddr := (&net.TCPAddr{IP: net.ParseIP(ip), Port: mlConfig.BindPort}).String()
+
+		tcpLn, err := net.Listen("tcp", bindAddr)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error binding TCP listener: %s", err))
+			return 1
+		}
+		defer tcpLn.Close()
+
+		udpLn, err := net.ListenPacket("udp", bindAddr)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error binding UDP listener: %s", err))
+			return 1
+		}
+		defer udpLn.Close()
+	}
+
+	rpcLn, err := net.Listen("tcp", config.RPCAddr)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error binding RPC listener: %s", err))
+		return 1
+	}
+	defer rpcLn.Close()
+
+	if err := c.checkSerf(agent); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	c.Ui.Output("Configuration is valid and all listeners can be bound")
+	return 0
+}
+
+// checkSerf creates and shuts down a Serf with the configuration of the
+// agent, which validates the encryption key and the snapshot, including
+// that it belongs to this node. It is used by -check-config, so the
+// Serf works on a copy of the snapshot and never contacts the cluster.
+func (c *Command) checkSerf(agent *Agent) error {
+	conf := *agent.SerfConfig()
+	mlConf := *conf.MemberlistConfig
+	conf.MemberlistConfig = &mlConf
+	conf.EventCh = nil
+	conf.Metrics = nil
+
+	if conf.SnapshotPath != "" {
+		dir, err := ioutil.TempDir("", "serf-check")
+		if err != nil {
+			return fmt.Errorf("Error copying snapshot: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "snapshot")
+		if err := copySnapshot(conf.SnapshotPath, path); err != nil {
+			return fmt.Errorf("Error copying snapshot: %s", err)
+		}
+		conf.SnapshotPath = path
+	}
+
+	// Bind a random port on the same address, so that the advertised
+	// address is the one of the agent
+	nt, err := memberlist.NewNetTransport(&memberlist.NetTransportConfig{
+		BindAddrs: []string{mlConf.BindAddr},
+		BindPort:  0,
+		Logger:    log.New(c.logOutput, "", log.LstdFlags),
+	})
+	if err != nil {
+		return fmt.Errorf("Error binding check listener: %s", err)
+	}
+	mlConf.BindPort = nt.GetAutoBindPort()
+	mlConf.Transport = &checkTransport{nt}
+
+	s, err := serf.Create(&conf)
+	if err != nil {
+		nt.Shutdown()
+		return fmt.Errorf("Error creating Serf: %s", err)
+	}
+	return s.Shutdown()
+}
+
+// copySnapshot copies the snapshot at src to dst, if there is one.
+func copySnapshot(src, dst string) error {
+	in, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// checkTransport is the memberlist transport of the Serf created by
+// checkSerf. It drops every packet and refuses every connection, so
+// that rejoining the members in the snapshot doesn't reach them.
+type checkTransport struct {
+	memberlist.Transport
+}
+
+func (t *checkTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	return time.Now(), nil
+}
+
+func (t *checkTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	return nil, fmt.Errorf("not connecting to %s while checking the configuration", addr)
+}
+
 // startupJoin is invoked to handle any joins specified to take place at start time
 func (c *Command) startupJoin(config *Config, agent *Agent) error {
 	if len(config.StartJoin) == 0 {
@@ -269,6 +452,7 @@ func (c *Command) Run(args []string) int {
 	if logWriter == nil {
 		return 1
 	}
+	c.logWriter, c.logOutput = logWriter, logOutput
 
 	// Setup serf
 	agent := c.setupAgent(config, logOutput)
@@ -277,6 +461,11 @@ func (c *Command) Run(args []string) int {
 	}
 	defer agent.Shutdown()
 
+	// Only verify that we can start if requested
+	if c.checkConfig {
+		return c.checkBind(config, agent)
+	}
+
 	// Start the agent
 	ipc := c.startAgent(config, agent, logWriter, logOutput)
 	if ipc == nil {
@@ -290,19 +479,33 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
+	// Let the agent that handed off to this process exit
+	if c.handoffReady != nil {
+		if err := signalHandoffReady(c.handoffReady); err != nil {
+			c.Ui.Error(fmt.Sprintf("Error reporting the handoff: %s", err))
+			return 1
+		}
+		c.handoffReady = nil
+	}
+
+	// Warn about OS limits that are too low for the cluster
+	agent.LogTuningHints()
+
 	// Enable log streaming
 	c.Ui.Info("")
 	c.Ui.Output("Log data will now stream in as it occurs:\n")
 	logGate.Flush()
 
 	// Wait for exit
-	return c.handleSignals(config, agent)
+	return c.handleSignals(config, agent, ipc)
 }
 
 // handleSignals blocks until we get an exit-causing signal
-func (c *Command) handleSignals(config *Config, agent *Agent) int {
+func (c *Command) handleSignals(config *Config, agent *Agent, ipc *AgentIPC) int {
 	signalCh := make(chan os.Signal, 4)
 	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	signal.Notify(signalCh, dumpSignals...)
+	signal.Notify(signalCh, handoffSignals...)
 
 	// Wait for a signal
 WAIT:
@@ -318,12 +521,37 @@ WAIT:
 	}
 	c.Ui.Output(fmt.Sprintf("Caught signal: %v", sig))
 
+	// Dump the runtime state without stopping
+	for _, s := range dumpSignals {
+		if sig == s {
+			agent.LogRuntimeDump()
+			goto WAIT
+		}
+	}
+
 	// Check if this is a SIGHUP
 	if sig == syscall.SIGHUP {
 		config = c.handleReload(config, agent)
 		goto WAIT
 	}
 
+	// Hand off to a new agent process, without leaving
+	for _, s := range handoffSignals {
+		if sig == s {
+			newAgent, newIPC, code, done := c.handoff(config, agent, ipc)
+			if done {
+				return code
+			}
+			if newAgent != agent {
+				// The agent took over again after a failed handoff
+				defer newAgent.Shutdown()
+				defer newIPC.Shutdown()
+				agent, ipc = newAgent, newIPC
+			}
+			goto WAIT
+		}
+	}
+
 	// Check if we should do a graceful leave
 	graceful := false
 	if sig == os.Interrupt && !config.SkipLeaveOnInt {
@@ -359,6 +587,62 @@ WAIT:
 	}
 }
 
+// handoff shuts down the agent without leaving and starts a new agent
+// process that takes over, see startHandoff. Once the new process reports
+// that it is running, this process exits with the returned code. If it
+// doesn't, it is killed and a new agent is started in this process with
+// the same RPC listener, which is returned to keep running with. The
+// agent keeps running as well if the RPC listener can't be handed off.
+func (c *Command) handoff(config *Config, agent *Agent, ipc *AgentIPC) (*Agent, *AgentIPC, int, bool) {
+	f, err := listenerFile(c.rpcListener)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error handing off: %s", err))
+		return agent, ipc, 0, false
+	}
+	defer f.Close()
+
+	c.Ui.Output("Handing off to a new agent process...")
+	ipc.Shutdown()
+	agent.Shutdown()
+
+	cmd, ready, err := startHandoff(f, os.Args[1:])
+	if err == nil {
+		err = waitHandoffReady(ready, handoffTimeout)
+		ready.Close()
+		if err == nil {
+			c.Ui.Output(fmt.Sprintf("Handed off to process %d", cmd.Process.Pid))
+			if err := notifyMainPID(cmd.Process.Pid); err != nil {
+				c.Ui.Error(fmt.Sprintf("Error notifying systemd of process %d: %s", cmd.Process.Pid, err))
+			}
+			return nil, nil, 0, true
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	c.Ui.Error(fmt.Sprintf("Error handing off: %s. Taking over again", err))
+
+	// Start again with the listener of the handoff, the current one is
+	// closed by the shutdown of the IPC
+	c.rpcListener, err = net.FileListener(f)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error taking over the RPC listener: %s", err))
+		return nil, nil, 1, true
+	}
+	newAgent := c.setupAgent(config, c.logOutput)
+	if newAgent == nil {
+		return nil, nil, 1, true
+	}
+	newIPC := c.startAgent(config, newAgent, c.logWriter, c.logOutput)
+	if newIPC == nil {
+		newAgent.Shutdown()
+		return nil, nil, 1, true
+	}
+	if err := c.startupJoin(config, newAgent); err != nil {
+		c.Ui.Error(err.Error())
+	}
+	return newAgent, newIPC, 0, false
+}
+
 // handleReload is invoked when we should reload our configs, e.g. SIGHUP
 func (c *Command) handleReload(config *Config, agent *Agent) *Config {
 	c.Ui.Output("Reloading configuration...")
@@ -383,6 +667,21 @@ func (c *Command) handleReload(config *Config, agent *Agent) *Config {
 
 	// Change the event handlers
 	c.scriptHandler.UpdateScripts(config.EventScripts())
+	cooldown, _ := newConf.HandlerCooldownDuration()
+	c.scriptHandler.SetFailureLimit(newConf.HandlerFailureLimit, cooldown)
+
+	// Change the views, the disabled events and the user event origins
+	agent.applyConfig(newConf)
+
+	// Change the tags, which are advertised to the cluster right away
+	tags, err := newConf.AdvertisedTags(agent.logger)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Failed to reload tags: %s", err))
+		newConf.Tags = config.Tags
+	} else if err := agent.SetTags(tags); err != nil {
+		c.Ui.Error(fmt.Sprintf("Failed to change tags: %s", err))
+		newConf.Tags = config.Tags
+	}
 	return newConf
 }
 
@@ -401,21 +700,41 @@ Options:
 
   -bind=0.0.0.0            Address to bind network listeners to
   -advertise=0.0.0.0       Address to advertise to the other cluster members
+  -check-config            Parse the configuration and verify all the
+                           listeners can be bound, and the encryption key
+                           and snapshot can be used, then exit without
+                           starting the agent. Implies -strict-config.
   -config-file=foo         Path to a JSON file to read configuration from.
                            This can be specified multiple times.
   -config-dir=foo          Path to a directory to read configuration files
                            from. This will read every file ending in ".json"
                            as configuration in this directory in alphabetical
                            order.
+  -dc=east                 Datacenter of this node, advertised as the "dc"
+                           tag. Failed members in other datacenters are
+                           given longer to reconnect. Requires protocol
+                           version 3.
   -encrypt=foo             Key for encrypting network traffic within Serf.
                            Must be a base64-encoded 16-byte key.
   -event-handler=foo       Script to execute when events occur. This can
                            be specified multiple times. See the event scripts
                            section below for more info.
+  -extra-bind=10.1.0.5     Additional IP address to bind network listeners
+                           to, on the port of -bind, which must then be a
+                           specific address. Only -bind or -advertise is
+                           advertised. This can be specified multiple times.
+  -force                   Start with a snapshot that was written by another
+                           node name or advertised IP address, such as after
+                           renaming this node.
+  -group=serf              Group to switch to after binding the listeners.
+                           Defaults to the primary group of -user.
   -join=addr               An initial agent to join with. This flag can be
                            specified multiple times.
   -log-level=info          Log level of the agent.
   -node=hostname           Name of this node. Must be unique in the cluster
+  -observer                Mark this node as an observer that sees the cluster
+                           but isn't part of the serving fleet, advertised as
+                           the "observer" tag. Requires protocol version 3.
   -profile=[lan|wan|local] Profile is used to control the timing profiles used in Serf.
 						   The default if not provided is lan.
   -protocol=n              Serf protocol version to use. This defaults to
@@ -424,9 +743,24 @@ Options:
                            by event scripts to differentiate different types
                            of nodes that may be part of the same cluster.
   -rpc-addr=127.0.0.1:7373 Address to bind the RPC listener.
+  -strict-config           Refuse configuration files with unknown keys,
+                           instead of ignoring them.
+  -tag key=value           Tag to advertise along with this node. This can be
+                           specified multiple times. Tags other than the role
+                           require protocol version 3.
+  -tag-metadata=ec2        Populate the "az", "instance_type" and
+                           "instance_id" tags from the instance metadata
+                           service at startup. Either "ec2" or "gce". Tags
+                           given with -tag take precedence.
+  -user=serf               User to switch to after binding the listeners, so
+                           the agent can bind privileged ports as root but
+                           run event handlers and serve RPC unprivileged.
   -snapshot=path/to/file   The snapshot file is used to store alive nodes and
                            event information so that Serf can rejoin a cluster
 						   and avoid event replay on restart.
+  -data-dir=path/to/dir    Directory in which the agent keeps its state,
+                           created if it doesn't exist. The snapshot is kept
+                           in it unless -snapshot is given.
 
 Event handlers:
 
@@ -4,7 +4,12 @@ import (
 	"bytes"
 	"github.com/hashicorp/serf/testutil"
 	"github.com/mitchellh/cli"
+	"io/ioutil"
 	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -217,3 +222,189 @@ func TestCommandRun_advertiseAddr(t *testing.T) {
 		t.Fatalf("bad: %#v", m)
 	}
 }
+
+func TestCommandRun_checkConfig(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &Command{
+		ShutdownCh: make(chan struct{}),
+		Ui:         ui,
+	}
+
+	args := []string{
+		"-check-config",
+		"-bind", testutil.GetBindAddr().String(),
+		"-rpc-addr", getRPCAddr(),
+	}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	if !strings.Contains(ui.OutputWriter.String(), "Configuration is valid") {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+}
+
+func TestCommandRun_dataDir(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	ui := new(cli.MockUi)
+	c := &Command{
+		ShutdownCh: make(chan struct{}),
+		Ui:         ui,
+	}
+
+	dataDir := td + "/data"
+	args := []string{
+		"-check-config",
+		"-bind", testutil.GetBindAddr().String(),
+		"-rpc-addr", getRPCAddr(),
+		"-data-dir", dataDir,
+	}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	info, err := os.Stat(dataDir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !info.IsDir() || info.Mode().Perm()&0077 != 0 {
+		t.Fatalf("bad: %s", info.Mode())
+	}
+}
+
+func TestCommandRun_checkConfigBindFail(t *testing.T) {
+	rpcAddr := getRPCAddr()
+	l, err := net.Listen("tcp", rpcAddr)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer l.Close()
+
+	ui := new(cli.MockUi)
+	c := &Command{
+		ShutdownCh: make(chan struct{}),
+		Ui:         ui,
+	}
+
+	args := []string{
+		"-check-config",
+		"-bind", testutil.GetBindAddr().String(),
+		"-rpc-addr", rpcAddr,
+	}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "RPC listener") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
+func TestCommandRun_checkConfigSnapshot(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	// A snapshot written by another node
+	snapshot := []byte("identity: other 10.1.2.3:7946\n")
+	path := filepath.Join(td, "snapshot")
+	if err := ioutil.WriteFile(path, snapshot, 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ui := new(cli.MockUi)
+	c := &Command{
+		ShutdownCh: make(chan struct{}),
+		Ui:         ui,
+	}
+
+	args := []string{
+		"-check-config",
+		"-node", "foo",
+		"-bind", testutil.GetBindAddr().String(),
+		"-rpc-addr", getRPCAddr(),
+		"-snapshot", path,
+	}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "was written by node other") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+
+	// The check must not touch the snapshot
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(raw, snapshot) {
+		t.Fatalf("bad: %q", raw)
+	}
+}
+
+func TestCommandRun_checkConfigUnknownKey(t *testing.T) {
+	tf, err := ioutil.TempFile("", "serf")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(tf.Name())
+	tf.Write([]byte(`{"event_handers": ["foo.sh"]}`))
+	tf.Close()
+
+	ui := new(cli.MockUi)
+	c := &Command{
+		ShutdownCh: make(chan struct{}),
+		Ui:         ui,
+	}
+
+	args := []string{
+		"-check-config",
+		"-config-file", tf.Name(),
+		"-bind", testutil.GetBindAddr().String(),
+		"-rpc-addr", getRPCAddr(),
+	}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), `did you mean "event_handlers"`) {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
+func TestCommand_readConfig_observer(t *testing.T) {
+	c := &Command{
+		Ui:   new(cli.MockUi),
+		args: []string{"-observer", "-tag", "role=monitor"},
+	}
+
+	config := c.readConfig()
+	if config == nil {
+		t.Fatalf("should read config")
+	}
+
+	if !config.Observer || config.Tags["observer"] != "true" {
+		t.Fatalf("bad: %#v", config)
+	}
+	if config.Tags["role"] != "monitor" {
+		t.Fatalf("bad: %#v", config.Tags)
+	}
+}
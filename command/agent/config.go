@@ -4,14 +4,21 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/metrics"
 	"github.com/hashicorp/serf/serf"
 	"github.com/mitchellh/mapstructure"
 	"io"
+	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
 	"sort"
 	"strings"
+	"time"
 )
 
 // This is the default port that we use for Serf communication
@@ -26,6 +33,32 @@ var DefaultConfig = &Config{
 	Protocol:      serf.ProtocolVersionMax,
 	ReplayOnJoin:  false,
 	Profile:       "lan",
+
+	CoalescePeriod:  "3s",
+	QuiescentPeriod: "1s",
+	HandlerCooldown: "1m",
+}
+
+// DefaultEventHandlerEnv is the list of environment variables of the
+// agent that are passed through to event handlers if EventHandlerEnv
+// is not set.
+var DefaultEventHandlerEnv = defaultEventHandlerEnv(runtime.GOOS)
+
+// defaultEventHandlerEnv returns the DefaultEventHandlerEnv for the given
+// OS. Windows programs, including cmd and PowerShell themselves, fail in
+// odd ways without the variables that locate the system directories.
+func defaultEventHandlerEnv(goos string) []string {
+	switch goos {
+	case windows:
+		return []string{
+			"PATH", "PATHEXT", "SystemRoot", "COMSPEC", "TEMP", "TMP",
+			"USERPROFILE", "SERF_*",
+		}
+	default:
+		return []string{
+			"PATH", "HOME", "USER", "LANG", "TMPDIR", "TZ", "SERF_*",
+		}
+	}
 }
 
 type dirEnts []os.FileInfo
@@ -41,12 +74,53 @@ type Config struct {
 	NodeName string `mapstructure:"node_name"`
 	Role     string `mapstructure:"role"`
 
+	// Tags are a set of key/value pairs that are advertised along with
+	// this node's membership. Tags other than "role" require protocol
+	// version 3.
+	Tags map[string]string `mapstructure:"tags"`
+
+	// RoleTag is the name of the tag that event handlers are given as the
+	// role of members, for clusters that identify services with a tag
+	// other than the role. By default the role itself is given.
+	RoleTag string `mapstructure:"role_tag"`
+
+	// TagMetadata is a list of names of MetadataFetchers that are used
+	// to populate tags when the agent starts, such as "ec2". Tags that
+	// are set explicitly take precedence over the fetched ones. A fetcher
+	// that fails is only logged as a warning, unless TagMetadataRequired
+	// is set, in which case the agent doesn't start.
+	TagMetadata         []string `mapstructure:"tag_metadata"`
+	TagMetadataRequired bool     `mapstructure:"tag_metadata_required"`
+
+	// TagsFrom maps tag names to the sources of their values, which are
+	// read once when the agent starts: "file:<path>" for the contents of
+	// a file, or "cmd:<command>" for the output of a command run with the
+	// EventHandlerShell. Tags that are set explicitly take precedence.
+	TagsFrom map[string]string `mapstructure:"tags_from"`
+
+	// Datacenter is the datacenter this node is in. It is advertised as
+	// the "dc" tag, and failed members in other datacenters are given
+	// longer to reconnect before they are reaped. Failure detection
+	// itself is the same for all members.
+	Datacenter string `mapstructure:"datacenter"`
+
+	// Observer marks this node as an observer, such as a monitoring host,
+	// that sees the membership and events of the cluster but isn't part
+	// of the serving fleet. It is advertised as the "observer" tag.
+	Observer bool `mapstructure:"observer"`
+
 	// BindAddr is the address that the Serf agent's communication ports
 	// will bind to. Serf will use this address to bind to for both TCP
 	// and UDP connections. If no port is present in the address, the default
 	// port will be used.
 	BindAddr string `mapstructure:"bind"`
 
+	// ExtraBindAddrs are IP addresses that the communication ports are
+	// also bound to, on the port of the BindAddr, for hosts that reach
+	// members on several networks. Only the BindAddr, or AdvertiseAddr,
+	// is advertised.
+	ExtraBindAddrs []string `mapstructure:"extra_bind"`
+
 	// AdvertiseAddr is the address that the Serf agent will advertise to
 	// other members of the cluster. Can be used for basic NAT traversal
 	// where both the internal ip:port and external ip:port are known.
@@ -70,6 +144,11 @@ type Config struct {
 	// Protocol is the Serf protocol version to use.
 	Protocol int `mapstructure:"protocol"`
 
+	// ProtocolUpgradeCheck, if greater than Protocol, is the protocol
+	// version the cluster is about to be upgraded to. Members that don't
+	// support it are logged and counted, see serf.Config.UpgradeCheckVersion.
+	ProtocolUpgradeCheck int `mapstructure:"protocol_upgrade_check"`
+
 	// ReplayOnJoin tells Serf to replay past user events
 	// when joining based on a `StartJoin`.
 	ReplayOnJoin bool `mapstructure:"replay_on_join"`
@@ -83,6 +162,115 @@ type Config struct {
 	// These can be updated during a reload.
 	EventHandlers []string `mapstructure:"event_handlers"`
 
+	// EventHandlerEnv is the list of environment variables of the agent
+	// that are passed through to event handlers. A trailing "*" matches
+	// every variable with the given prefix. If this is not set, then
+	// DefaultEventHandlerEnv is used.
+	EventHandlerEnv []string `mapstructure:"event_handler_env"`
+
+	// EventHandlerFormat is the format of the event data that is given to
+	// event handlers on stdin. It is "text" for the line based format, or
+	// "json" for a single JSON document describing the whole event.
+	// Defaults to "text".
+	EventHandlerFormat string `mapstructure:"event_handler_format"`
+
+	// EventHandlerShell is the shell that runs event handlers: "sh",
+	// "cmd" or "powershell". Defaults to "cmd" on Windows and "sh"
+	// everywhere else.
+	EventHandlerShell string `mapstructure:"event_handler_shell"`
+
+	// EventHandlerNice, if set, is added to the nice level of the agent
+	// for the event handlers, from 1 to 19, so that heavy handlers don't
+	// starve the gossip and failure detection of the agent. It is ignored
+	// on Windows.
+	EventHandlerNice int `mapstructure:"event_handler_nice"`
+
+	// HandlerFailureLimit, if positive, is the number of consecutive
+	// failures of an event handler after which it is disabled for the
+	// HandlerCooldown, such as "1m". Once the cooldown has passed, the
+	// handler is tried again. This can be changed on reload.
+	HandlerFailureLimit int    `mapstructure:"handler_failure_limit"`
+	HandlerCooldown     string `mapstructure:"handler_cooldown"`
+
+	// DisableEvents is a list of event types, in the filter format of the
+	// event handlers such as "user" or "user:deploy", that the agent drops
+	// instead of delivering them to event handlers and RPC streams. Tag
+	// expressions and batch windows are not allowed. These can be updated
+	// during a reload.
+	DisableEvents []string `mapstructure:"disable_events"`
+
+	// UserEventOrigins maps user event names, or "*", to the members that
+	// may send them, see EventOrigins. Other user events are dropped
+	// instead of delivering them to event handlers and RPC streams. These
+	// can be updated during a reload.
+	UserEventOrigins map[string][]string `mapstructure:"user_event_origins"`
+
+	// ReconcileInterval, if set, causes a member-reconcile event with the
+	// full member list to be delivered to event handlers on this interval,
+	// such as "60s". This is disabled by default.
+	ReconcileInterval string `mapstructure:"reconcile_interval"`
+
+	// HealthCheck, if set, is a script that checks the health of the
+	// node, run by the EventHandlerShell every HealthCheckInterval. It is
+	// killed if it runs longer than the HealthCheckTimeout. While it
+	// fails, other members see the node with the "health=critical" tag,
+	// and leave it out of views. The interval defaults to "30s" and the
+	// timeout to "10s".
+	HealthCheck         string `mapstructure:"health_check"`
+	HealthCheckInterval string `mapstructure:"health_check_interval"`
+	HealthCheckTimeout  string `mapstructure:"health_check_timeout"`
+
+	// RTTNodes, if set, are the names of reference nodes that the agent
+	// measures the round trip time to every RTTInterval, which defaults
+	// to "30s". The times are shown by "serf info" and sent as metrics.
+	RTTNodes    []string `mapstructure:"rtt_nodes"`
+	RTTInterval string   `mapstructure:"rtt_interval"`
+
+	// Views are named member filters, given as whitespace separated
+	// "key=value" pairs such as "role=web dc=east status=alive". See
+	// View for the format. These can be updated during a reload.
+	Views map[string]string `mapstructure:"views"`
+
+	// CoalescePeriod and QuiescentPeriod control the batching of member
+	// events before they are delivered to event handlers and RPC streams.
+	// Events are delivered once no new member event happened for the
+	// QuiescentPeriod, but are held back no longer than the CoalescePeriod,
+	// so during mass churn handlers are invoked about once per
+	// CoalescePeriod. A CoalescePeriod of "0" disables batching.
+	CoalescePeriod  string `mapstructure:"coalesce_period"`
+	QuiescentPeriod string `mapstructure:"quiescent_period"`
+
+	// PushPullInterval is the interval between full state exchanges with
+	// a random member, such as "30s". These repair any state that gossip
+	// missed, so a longer interval saves bandwidth over slow links at the
+	// cost of slower convergence. Defaults to the value of the profile.
+	PushPullInterval string `mapstructure:"push_pull_interval"`
+
+	// GossipBandwidthLimit, if set, is the number of bytes of broadcasts
+	// that are sent per second. User events are delayed once it is used
+	// up. See serf.Config.GossipBandwidthLimit.
+	GossipBandwidthLimit int `mapstructure:"gossip_bandwidth_limit"`
+
+	// PushPullRateLimit, if set, is the number of joins and push/pulls per
+	// second that are accepted from each source address, with bursts of
+	// up to PushPullBurst. See serf.Config.PushPullRateLimit.
+	PushPullRateLimit float64 `mapstructure:"push_pull_rate_limit"`
+	PushPullBurst     int     `mapstructure:"push_pull_burst"`
+
+	// NameReuse is the policy for a failed or left member that comes back
+	// with a different address: "accept", "after-leave" or "epoch". See
+	// serf.Config.NameReuse.
+	NameReuse string `mapstructure:"name_reuse"`
+
+	// MaxMembers, if positive, is the number of members beyond which the
+	// agent refuses joins and new members. See serf.Config.MaxMembers.
+	MaxMembers int `mapstructure:"max_members"`
+
+	// StatsdAddr, if set, is the address of a statsd server, such as
+	// "127.0.0.1:8125", that the metrics of Serf and of the agent are
+	// sent to over UDP, prefixed with the node name.
+	StatsdAddr string `mapstructure:"statsd_addr"`
+
 	// Profile is used to select a timing profile for Serf. The supported choices
 	// are "wan", "lan", and "local". The default is "lan"
 	Profile string `mapstructure:"profile"`
@@ -92,6 +280,30 @@ type Config struct {
 	// re-joining a cluster on failure and avoids old message replay.
 	SnapshotPath string `mapstructure:"snapshot_path"`
 
+	// DataDir is the directory in which the agent keeps its persisted
+	// state. It is created if it doesn't exist. The snapshot is stored
+	// in it as "snapshot", unless SnapshotPath is set. See SnapshotFile.
+	DataDir string `mapstructure:"data_dir"`
+
+	// User and Group are the user and group the agent switches to once
+	// all the listeners are bound, but before any event handlers are
+	// invoked or RPC requests are served. If only User is given, the
+	// primary group of the user is used. Not supported on Windows.
+	User  string `mapstructure:"user"`
+	Group string `mapstructure:"group"`
+
+	// UserEventNames, if set, is a regular expression that the names of
+	// the user events sent through this agent must match, to enforce a
+	// naming convention. UserEventDeny is a list of regular expressions
+	// of names of user events that this agent refuses to send. Events
+	// received from other members are not affected.
+	UserEventNames string   `mapstructure:"user_event_names"`
+	UserEventDeny  []string `mapstructure:"user_event_deny"`
+
+	// EventChecksums adds checksums to the user events sent by this
+	// agent, see serf.Config.UserEventChecksums.
+	EventChecksums bool `mapstructure:"user_event_checksums"`
+
 	// LeaveOnTerm controls if Serf does a graceful leave when receiving
 	// the TERM signal. Defaults false. This can be changed on reload.
 	LeaveOnTerm bool `mapstructure:"leave_on_terminate"`
@@ -141,15 +353,243 @@ func (c *Config) EventScripts() []EventScript {
 	return result
 }
 
+// ReconcileDuration returns the parsed ReconcileInterval, or zero if
+// reconciling is disabled.
+func (c *Config) ReconcileDuration() (time.Duration, error) {
+	if c.ReconcileInterval == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(c.ReconcileInterval)
+}
+
+// HealthCheckDurations returns the parsed HealthCheckInterval and
+// HealthCheckTimeout, or their defaults if they are not set.
+func (c *Config) HealthCheckDurations() (interval, timeout time.Duration, err error) {
+	interval, timeout = 30*time.Second, 10*time.Second
+	if c.HealthCheckInterval != "" {
+		if interval, err = time.ParseDuration(c.HealthCheckInterval); err != nil {
+			return 0, 0, err
+		}
+	}
+	if c.HealthCheckTimeout != "" {
+		if timeout, err = time.ParseDuration(c.HealthCheckTimeout); err != nil {
+			return 0, 0, err
+		}
+	}
+	if interval <= 0 || timeout <= 0 {
+		return 0, 0, fmt.Errorf("interval and timeout must be positive")
+	}
+	return interval, timeout, nil
+}
+
+// RTTDuration returns the parsed RTTInterval, or its default if it is
+// not set.
+func (c *Config) RTTDuration() (time.Duration, error) {
+	if c.RTTInterval == "" {
+		return 30 * time.Second, nil
+	}
+	interval, err := time.ParseDuration(c.RTTInterval)
+	if err != nil {
+		return 0, err
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return interval, nil
+}
+
+// ParsedViews returns the parsed Views of the configuration.
+func (c *Config) ParsedViews() (map[string]View, error) {
+	result := make(map[string]View, len(c.Views))
+	for name, v := range c.Views {
+		view, err := ParseView(v)
+		if err != nil {
+			return nil, fmt.Errorf("view '%s': %s", name, err)
+		}
+		result[name] = view
+	}
+	return result, nil
+}
+
+// DisabledEvents returns the parsed DisableEvents of the configuration.
+func (c *Config) DisabledEvents() ([]EventFilter, error) {
+	var result []EventFilter
+	for _, v := range c.DisableEvents {
+		for _, filter := range ParseEventFilter(v) {
+			if v == "" || filter.Tag != "" || filter.Batch != "" || !filter.Valid() {
+				return nil, fmt.Errorf("Invalid disabled event: %s", v)
+			}
+			result = append(result, filter)
+		}
+	}
+	return result, nil
+}
+
+// HandlerCooldownDuration returns the parsed HandlerCooldown.
+func (c *Config) HandlerCooldownDuration() (time.Duration, error) {
+	if c.HandlerCooldown == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(c.HandlerCooldown)
+}
+
+// UserEventVeto returns a function for serf.Config.UserEventVeto that
+// applies UserEventNames and UserEventDeny, or nil if neither is set. The
+// internal events of the agent are always allowed.
+func (c *Config) UserEventVeto() (func(string, []byte) error, error) {
+	if c.UserEventNames == "" && len(c.UserEventDeny) == 0 {
+		return nil, nil
+	}
+
+	var names *regexp.Regexp
+	if c.UserEventNames != "" {
+		re, err := regexp.Compile(c.UserEventNames)
+		if err != nil {
+			return nil, err
+		}
+		names = re
+	}
+
+	deny := make([]*regexp.Regexp, 0, len(c.UserEventDeny))
+	for _, v := range c.UserEventDeny {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, err
+		}
+		deny = append(deny, re)
+	}
+
+	return func(name string, payload []byte) error {
+		if strings.HasPrefix(name, internalEventPrefix) {
+			return nil
+		}
+		if names != nil && !names.MatchString(name) {
+			return fmt.Errorf("User event '%s' doesn't match '%s'", name, names)
+		}
+		for _, re := range deny {
+			if re.MatchString(name) {
+				return fmt.Errorf("User event '%s' is denied by '%s'", name, re)
+			}
+		}
+		return nil
+	}, nil
+}
+
+// CoalesceDurations returns the parsed CoalescePeriod and QuiescentPeriod.
+func (c *Config) CoalesceDurations() (coalesce, quiescent time.Duration, err error) {
+	if c.CoalescePeriod != "" {
+		if coalesce, err = time.ParseDuration(c.CoalescePeriod); err != nil {
+			return 0, 0, err
+		}
+	}
+	if c.QuiescentPeriod != "" {
+		if quiescent, err = time.ParseDuration(c.QuiescentPeriod); err != nil {
+			return 0, 0, err
+		}
+	}
+	if coalesce > 0 && quiescent <= 0 {
+		return 0, 0, fmt.Errorf("quiescent period must be positive if coalescing")
+	}
+	return coalesce, quiescent, nil
+}
+
+// NameReusePolicy returns the parsed NameReuse, which defaults to
+// accepting the new address.
+func (c *Config) NameReusePolicy() (serf.NameReusePolicy, error) {
+	switch c.NameReuse {
+	case "", "accept":
+		return serf.NameReuseAccept, nil
+	case "after-leave":
+		return serf.NameReuseAfterLeave, nil
+	case "epoch":
+		return serf.NameReuseEpoch, nil
+	default:
+		return 0, fmt.Errorf("Invalid name reuse policy: %s", c.NameReuse)
+	}
+}
+
+// PushPullDuration returns the parsed PushPullInterval, or zero if the
+// default of the profile should be used.
+func (c *Config) PushPullDuration() (time.Duration, error) {
+	if c.PushPullInterval == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(c.PushPullInterval)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return d, err
+}
+
+// SnapshotFile returns the path of the snapshot, which is SnapshotPath if
+// set, or the "snapshot" file in the DataDir. It is empty if neither is
+// set, in which case no snapshot is kept.
+func (c *Config) SnapshotFile() string {
+	if c.SnapshotPath != "" || c.DataDir == "" {
+		return c.SnapshotPath
+	}
+	return filepath.Join(c.DataDir, "snapshot")
+}
+
+// MaintenanceFile returns the path of the file that keeps the maintenance
+// mode of the agent across restarts, which is in the DataDir. It is empty
+// if there is no DataDir, in which case the mode is lost on restart.
+func (c *Config) MaintenanceFile() string {
+	if c.DataDir == "" {
+		return ""
+	}
+	return filepath.Join(c.DataDir, "maintenance")
+}
+
+// EventEnv returns the list of environment variables that should be
+// passed through to event handlers.
+func (c *Config) EventEnv() []string {
+	if len(c.EventHandlerEnv) == 0 {
+		return DefaultEventHandlerEnv
+	}
+	return c.EventHandlerEnv
+}
+
+// UnmarshalTags is used to turn a list of "key=value" pairs, as given
+// on the command line, into a map of tags.
+func UnmarshalTags(pairs []string) (map[string]string, error) {
+	tags := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid tag: '%s'. Must be in the form key=value", pair)
+		}
+		tags[parts[0]] = parts[1]
+	}
+	return tags, nil
+}
+
 // DecodeConfig reads the configuration from the given reader in JSON
-// format and decodes it into a proper Config structure.
+// format and decodes it into a proper Config structure. Unknown keys
+// are ignored.
 func DecodeConfig(r io.Reader) (*Config, error) {
+	return decodeConfig(r, false)
+}
+
+// DecodeConfigStrict is like DecodeConfig, but returns an error listing
+// the unknown keys, if any, so misspelled keys aren't silently ignored.
+func DecodeConfigStrict(r io.Reader) (*Config, error) {
+	return decodeConfig(r, true)
+}
+
+func decodeConfig(r io.Reader, strict bool) (*Config, error) {
 	var raw interface{}
 	dec := json.NewDecoder(r)
 	if err := dec.Decode(&raw); err != nil {
 		return nil, err
 	}
 
+	if strict {
+		if err := checkUnknownKeys(raw); err != nil {
+			return nil, err
+		}
+	}
+
 	// Decode
 	var md mapstructure.Metadata
 	var result Config
@@ -173,6 +613,87 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 	return &result, nil
 }
 
+// checkUnknownKeys returns an error listing the top-level keys of a raw
+// configuration that aren't configuration keys, with the closest known
+// key as a suggestion if there is one.
+func checkUnknownKeys(raw interface{}) error {
+	fields, ok := raw.(map[string]interface{})
+	if !ok {
+		// Decoding reports the error
+		return nil
+	}
+
+	known := configKeys()
+	var unknown []string
+	for key := range fields {
+		if containsKey(known, key) {
+			continue
+		}
+		if match := closestKey(known, key); match != "" {
+			key = fmt.Sprintf("%s (did you mean \"%s\"?)", key, match)
+		}
+		unknown = append(unknown, key)
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	sort.Strings(unknown)
+	return fmt.Errorf("Unknown configuration keys: %s", strings.Join(unknown, ", "))
+}
+
+// configKeys returns the keys of the configuration file format
+func configKeys() []string {
+	t := reflect.TypeOf(Config{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("mapstructure"); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// closestKey returns the known key that is closest to the given one, as
+// long as it is only a few edits away, or "" if there is none.
+func closestKey(known []string, key string) string {
+	best, bestDist := "", 3
+	for _, k := range known {
+		if d := editDistance(k, key); d < bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
 // containsKey is used to check if a slice of string keys contains
 // another key
 func containsKey(keys []string, key string) bool {
@@ -196,6 +717,21 @@ func MergeConfig(a, b *Config) *Config {
 	if b.Role != "" {
 		result.Role = b.Role
 	}
+	if b.RoleTag != "" {
+		result.RoleTag = b.RoleTag
+	}
+	if b.EventHandlerFormat != "" {
+		result.EventHandlerFormat = b.EventHandlerFormat
+	}
+	if b.EventHandlerShell != "" {
+		result.EventHandlerShell = b.EventHandlerShell
+	}
+	if b.EventHandlerNice != 0 {
+		result.EventHandlerNice = b.EventHandlerNice
+	}
+	if b.Datacenter != "" {
+		result.Datacenter = b.Datacenter
+	}
 	if b.BindAddr != "" {
 		result.BindAddr = b.BindAddr
 	}
@@ -223,6 +759,78 @@ func MergeConfig(a, b *Config) *Config {
 	if b.SnapshotPath != "" {
 		result.SnapshotPath = b.SnapshotPath
 	}
+	if b.DataDir != "" {
+		result.DataDir = b.DataDir
+	}
+	if b.User != "" {
+		result.User = b.User
+	}
+	if b.Group != "" {
+		result.Group = b.Group
+	}
+	if b.ProtocolUpgradeCheck != 0 {
+		result.ProtocolUpgradeCheck = b.ProtocolUpgradeCheck
+	}
+	if b.HandlerFailureLimit != 0 {
+		result.HandlerFailureLimit = b.HandlerFailureLimit
+	}
+	if b.HandlerCooldown != "" {
+		result.HandlerCooldown = b.HandlerCooldown
+	}
+	if b.ReconcileInterval != "" {
+		result.ReconcileInterval = b.ReconcileInterval
+	}
+	if b.HealthCheck != "" {
+		result.HealthCheck = b.HealthCheck
+	}
+	if b.HealthCheckInterval != "" {
+		result.HealthCheckInterval = b.HealthCheckInterval
+	}
+	if b.HealthCheckTimeout != "" {
+		result.HealthCheckTimeout = b.HealthCheckTimeout
+	}
+	if b.RTTInterval != "" {
+		result.RTTInterval = b.RTTInterval
+	}
+	if b.PushPullInterval != "" {
+		result.PushPullInterval = b.PushPullInterval
+	}
+	if b.GossipBandwidthLimit != 0 {
+		result.GossipBandwidthLimit = b.GossipBandwidthLimit
+	}
+	if b.PushPullRateLimit != 0 {
+		result.PushPullRateLimit = b.PushPullRateLimit
+	}
+	if b.PushPullBurst != 0 {
+		result.PushPullBurst = b.PushPullBurst
+	}
+	if b.StatsdAddr != "" {
+		result.StatsdAddr = b.StatsdAddr
+	}
+	if b.NameReuse != "" {
+		result.NameReuse = b.NameReuse
+	}
+	if b.MaxMembers != 0 {
+		result.MaxMembers = b.MaxMembers
+	}
+	if b.CoalescePeriod != "" {
+		result.CoalescePeriod = b.CoalescePeriod
+	}
+	if b.QuiescentPeriod != "" {
+		result.QuiescentPeriod = b.QuiescentPeriod
+	}
+	if b.TagMetadataRequired == true {
+		result.TagMetadataRequired = true
+	}
+	if b.Observer == true {
+		result.Observer = true
+	}
+	if b.UserEventNames != "" {
+		result.UserEventNames = b.UserEventNames
+	}
+	if b.EventChecksums == true {
+		result.EventChecksums = true
+	}
 	if b.LeaveOnTerm == true {
 		result.LeaveOnTerm = true
 	}
@@ -230,12 +838,86 @@ func MergeConfig(a, b *Config) *Config {
 		result.SkipLeaveOnInt = true
 	}
 
+	// Merge the tags, with b taking precedence
+	if len(a.Tags) > 0 || len(b.Tags) > 0 {
+		result.Tags = make(map[string]string, len(a.Tags)+len(b.Tags))
+		for k, v := range a.Tags {
+			result.Tags[k] = v
+		}
+		for k, v := range b.Tags {
+			result.Tags[k] = v
+		}
+	}
+
+	// Merge the tag sources, with b taking precedence
+	if len(a.TagsFrom) > 0 || len(b.TagsFrom) > 0 {
+		result.TagsFrom = make(map[string]string, len(a.TagsFrom)+len(b.TagsFrom))
+		for k, v := range a.TagsFrom {
+			result.TagsFrom[k] = v
+		}
+		for k, v := range b.TagsFrom {
+			result.TagsFrom[k] = v
+		}
+	}
+
+	// Merge the user event origins, with b taking precedence per event
+	if len(a.UserEventOrigins) > 0 || len(b.UserEventOrigins) > 0 {
+		result.UserEventOrigins = make(map[string][]string,
+			len(a.UserEventOrigins)+len(b.UserEventOrigins))
+		for k, v := range a.UserEventOrigins {
+			result.UserEventOrigins[k] = v
+		}
+		for k, v := range b.UserEventOrigins {
+			result.UserEventOrigins[k] = v
+		}
+	}
+
+	// Merge the views, with b taking precedence
+	if len(a.Views) > 0 || len(b.Views) > 0 {
+		result.Views = make(map[string]string, len(a.Views)+len(b.Views))
+		for k, v := range a.Views {
+			result.Views[k] = v
+		}
+		for k, v := range b.Views {
+			result.Views[k] = v
+		}
+	}
+
+	// Copy the metadata fetchers
+	result.TagMetadata = make([]string, 0, len(a.TagMetadata)+len(b.TagMetadata))
+	result.TagMetadata = append(result.TagMetadata, a.TagMetadata...)
+	result.TagMetadata = append(result.TagMetadata, b.TagMetadata...)
+
 	// Copy the event handlers
 	result.EventHandlers = make([]string, 0, len(a.EventHandlers)+len(b.EventHandlers))
 	result.EventHandlers = append(result.EventHandlers, a.EventHandlers...)
 	result.EventHandlers = append(result.EventHandlers, b.EventHandlers...)
 
+	// Copy the event handler environment
+	result.EventHandlerEnv = make([]string, 0, len(a.EventHandlerEnv)+len(b.EventHandlerEnv))
+	result.EventHandlerEnv = append(result.EventHandlerEnv, a.EventHandlerEnv...)
+	result.EventHandlerEnv = append(result.EventHandlerEnv, b.EventHandlerEnv...)
+
+	// Copy the denied user events
+	result.UserEventDeny = make([]string, 0, len(a.UserEventDeny)+len(b.UserEventDeny))
+	result.UserEventDeny = append(result.UserEventDeny, a.UserEventDeny...)
+	result.UserEventDeny = append(result.UserEventDeny, b.UserEventDeny...)
+
+	// Copy the disabled events
+	result.DisableEvents = make([]string, 0, len(a.DisableEvents)+len(b.DisableEvents))
+	result.DisableEvents = append(result.DisableEvents, a.DisableEvents...)
+	result.DisableEvents = append(result.DisableEvents, b.DisableEvents...)
+
+	// Copy the RTT reference nodes
+	result.RTTNodes = make([]string, 0, len(a.RTTNodes)+len(b.RTTNodes))
+	result.RTTNodes = append(result.RTTNodes, a.RTTNodes...)
+	result.RTTNodes = append(result.RTTNodes, b.RTTNodes...)
+
 	// Copy the start join addresses
+	result.ExtraBindAddrs = make([]string, 0, len(a.ExtraBindAddrs)+len(b.ExtraBindAddrs))
+	result.ExtraBindAddrs = append(result.ExtraBindAddrs, a.ExtraBindAddrs...)
+	result.ExtraBindAddrs = append(result.ExtraBindAddrs, b.ExtraBindAddrs...)
+
 	result.StartJoin = make([]string, 0, len(a.StartJoin)+len(b.StartJoin))
 	result.StartJoin = append(result.StartJoin, a.StartJoin...)
 	result.StartJoin = append(result.StartJoin, b.StartJoin...)
@@ -248,6 +930,16 @@ func MergeConfig(a, b *Config) *Config {
 // we read one directory deep and read any files ending in ".json" as
 // configuration files.
 func ReadConfigPaths(paths []string) (*Config, error) {
+	return readConfigPaths(paths, false)
+}
+
+// ReadConfigPathsStrict is like ReadConfigPaths, but every file is
+// decoded with DecodeConfigStrict.
+func ReadConfigPathsStrict(paths []string) (*Config, error) {
+	return readConfigPaths(paths, true)
+}
+
+func readConfigPaths(paths []string, strict bool) (*Config, error) {
 	result := new(Config)
 	for _, path := range paths {
 		f, err := os.Open(path)
@@ -262,7 +954,7 @@ func ReadConfigPaths(paths []string) (*Config, error) {
 		}
 
 		if !fi.IsDir() {
-			config, err := DecodeConfig(f)
+			config, err := decodeConfig(f, strict)
 			f.Close()
 
 			if err != nil {
@@ -299,7 +991,7 @@ func ReadConfigPaths(paths []string) (*Config, error) {
 				return nil, fmt.Errorf("Error reading '%s': %s", subpath, err)
 			}
 
-			config, err := DecodeConfig(f)
+			config, err := decodeConfig(f, strict)
 			f.Close()
 
 			if err != nil {
@@ -325,3 +1017,276 @@ func (d dirEnts) Less(i, j int) bool {
 func (d dirEnts) Swap(i, j int) {
 	d[i], d[j] = d[j], d[i]
 }
+
+// setDefaults fills in the settings that are derived from others, such
+// as the node name from the hostname and the tags of the datacenter and
+// of observers. It is applied after all the configurations are merged.
+func (c *Config) setDefaults() error {
+	if c.NodeName == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("Error determining hostname: %s", err)
+		}
+		c.NodeName = hostname
+	}
+
+	// The datacenter is advertised as a tag
+	if c.Datacenter != "" {
+		if c.Tags == nil {
+			c.Tags = make(map[string]string)
+		}
+		c.Tags["dc"] = c.Datacenter
+	}
+
+	// Observers are marked with a tag, so other members can tell them apart
+	if c.Observer {
+		if c.Tags == nil {
+			c.Tags = make(map[string]string)
+		}
+		c.Tags["observer"] = "true"
+	}
+
+	return nil
+}
+
+// Validate checks the settings that are only parsed when the agent
+// starts, so that a bad configuration is reported before anything runs.
+// Later uses of these settings don't check the errors again.
+func (c *Config) Validate() error {
+	if len(c.ExtraBindAddrs) > 0 {
+		bindIP, _, err := c.AddrParts(c.BindAddr)
+		if err != nil {
+			return fmt.Errorf("Invalid bind address: %s", err)
+		}
+		if net.ParseIP(bindIP).IsUnspecified() {
+			return fmt.Errorf("Extra bind addresses need a specific bind address, not %s", bindIP)
+		}
+	}
+	for _, addr := range c.ExtraBindAddrs {
+		if ip := net.ParseIP(addr); ip == nil || ip.IsUnspecified() {
+			return fmt.Errorf("Invalid extra bind address: %s. Must be an IP address", addr)
+		}
+	}
+
+	for _, name := range c.TagMetadata {
+		if _, ok := MetadataFetchers[name]; !ok {
+			return fmt.Errorf("Unknown tag metadata fetcher: %s", name)
+		}
+	}
+
+	// The tags from tags_from and tag_metadata are only known once they
+	// are fetched, and are checked by Serf when it starts
+	tags := make(map[string]string, len(c.Tags)+1)
+	for k, v := range c.Tags {
+		tags[k] = v
+	}
+	if c.Role != "" {
+		tags["role"] = c.Role
+	}
+	if err := serf.ValidateTags(tags); err != nil {
+		return fmt.Errorf("Invalid tags: %s", err)
+	}
+
+	for tag, source := range c.TagsFrom {
+		if !strings.HasPrefix(source, "file:") && !strings.HasPrefix(source, "cmd:") {
+			return fmt.Errorf("Invalid source of tag '%s': %s. Must start with file: or cmd:",
+				tag, source)
+		}
+	}
+
+	if c.ProtocolUpgradeCheck < 0 || c.ProtocolUpgradeCheck > serf.ProtocolVersionMax {
+		return fmt.Errorf("Invalid protocol upgrade check: %d. Must be at most %d",
+			c.ProtocolUpgradeCheck, serf.ProtocolVersionMax)
+	}
+
+	if _, err := c.UserEventVeto(); err != nil {
+		return fmt.Errorf("Invalid user event rule: %s", err)
+	}
+
+	switch c.EventHandlerFormat {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("Invalid event handler format: %s", c.EventHandlerFormat)
+	}
+
+	switch c.EventHandlerShell {
+	case "", "sh", "cmd", "powershell":
+	default:
+		return fmt.Errorf("Invalid event handler shell: %s", c.EventHandlerShell)
+	}
+
+	if c.EventHandlerNice < 0 || c.EventHandlerNice > 19 {
+		return fmt.Errorf("Invalid event handler nice level: %d", c.EventHandlerNice)
+	}
+
+	if c.GossipBandwidthLimit < 0 {
+		return fmt.Errorf("Invalid gossip bandwidth limit: %d", c.GossipBandwidthLimit)
+	}
+
+	if c.PushPullRateLimit < 0 || c.PushPullBurst < 0 {
+		return fmt.Errorf("Invalid push/pull rate limit: %v with a burst of %d",
+			c.PushPullRateLimit, c.PushPullBurst)
+	}
+
+	if _, err := c.NameReusePolicy(); err != nil {
+		return err
+	}
+
+	if c.MaxMembers < 0 {
+		return fmt.Errorf("Invalid max members: %d", c.MaxMembers)
+	}
+
+	if _, err := c.HandlerCooldownDuration(); err != nil {
+		return fmt.Errorf("Invalid handler cooldown: %s", err)
+	}
+
+	if _, err := c.ReconcileDuration(); err != nil {
+		return fmt.Errorf("Invalid reconcile interval: %s", err)
+	}
+
+	if _, _, err := c.HealthCheckDurations(); err != nil {
+		return fmt.Errorf("Invalid health check: %s", err)
+	}
+
+	if _, err := c.RTTDuration(); err != nil {
+		return fmt.Errorf("Invalid RTT interval: %s", err)
+	}
+
+	if _, err := c.PushPullDuration(); err != nil {
+		return fmt.Errorf("Invalid push/pull interval: %s", err)
+	}
+
+	if _, _, err := c.CoalesceDurations(); err != nil {
+		return fmt.Errorf("Invalid coalesce period: %s", err)
+	}
+
+	if _, err := c.ParsedViews(); err != nil {
+		return fmt.Errorf("Invalid %s", err)
+	}
+
+	if _, err := c.DisabledEvents(); err != nil {
+		return err
+	}
+
+	if _, err := ParseEventOrigins(c.UserEventOrigins); err != nil {
+		return err
+	}
+
+	eventScripts := c.EventScripts()
+	for _, script := range eventScripts {
+		if !script.Valid() {
+			return fmt.Errorf("Invalid event script: %s", script.String())
+		}
+	}
+
+	return nil
+}
+
+// AdvertisedTags returns the tags that the agent advertises, which are
+// the configured tags along with the ones of tags_from and tag_metadata.
+// Failures of the metadata fetchers that aren't required are logged to
+// the logger.
+func (c *Config) AdvertisedTags(logger *log.Logger) (map[string]string, error) {
+	tags, err := SourcedTags(c.TagsFrom, c.EventHandlerShell, c.Tags)
+	if err != nil {
+		return nil, err
+	}
+	return MetadataTags(c.TagMetadata, c.TagMetadataRequired, tags, logger)
+}
+
+// SerfConfig returns the configuration of the Serf of the agent. The
+// configuration must be validated with Validate first. Warnings, such as
+// of metadata that couldn't be fetched, are logged to the logger.
+func (c *Config) SerfConfig(logger *log.Logger) (*serf.Config, error) {
+	bindIP, bindPort, err := c.AddrParts(c.BindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid bind address: %s", err)
+	}
+
+	var advertiseIP string
+	var advertisePort int
+	if c.AdvertiseAddr != "" {
+		advertiseIP, advertisePort, err = c.AddrParts(c.AdvertiseAddr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid advertise address: %s", err)
+		}
+	}
+
+	encryptKey, err := c.EncryptBytes()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid encryption key: %s", err)
+	}
+
+	tags, err := c.AdvertisedTags(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	serfConfig := serf.DefaultConfig()
+	switch c.Profile {
+	case "lan":
+		serfConfig.MemberlistConfig = memberlist.DefaultLANConfig()
+	case "wan":
+		serfConfig.MemberlistConfig = memberlist.DefaultWANConfig()
+	case "local":
+		serfConfig.MemberlistConfig = memberlist.DefaultLocalConfig()
+	default:
+		return nil, fmt.Errorf("Unknown profile: %s", c.Profile)
+	}
+
+	// Validated already by Validate
+	if interval, _ := c.PushPullDuration(); interval > 0 {
+		serfConfig.MemberlistConfig.PushPullInterval = interval
+	}
+
+	serfConfig.MemberlistConfig.BindAddr = bindIP
+	serfConfig.MemberlistConfig.BindPort = bindPort
+	serfConfig.ExtraBindAddrs = c.ExtraBindAddrs
+	serfConfig.MemberlistConfig.AdvertiseAddr = advertiseIP
+	serfConfig.MemberlistConfig.AdvertisePort = advertisePort
+	serfConfig.MemberlistConfig.SecretKey = encryptKey
+	serfConfig.NodeName = c.NodeName
+	serfConfig.Role = c.Role
+	serfConfig.Tags = tags
+	serfConfig.SnapshotPath = c.SnapshotFile()
+	serfConfig.UserEventChecksums = c.EventChecksums
+	// Validated already by Validate
+	serfConfig.UserEventVeto, _ = c.UserEventVeto()
+	serfConfig.ProtocolVersion = uint8(c.Protocol)
+	serfConfig.UpgradeCheckVersion = uint8(c.ProtocolUpgradeCheck)
+	serfConfig.GossipBandwidthLimit = c.GossipBandwidthLimit
+	serfConfig.PushPullRateLimit = c.PushPullRateLimit
+	serfConfig.PushPullBurst = c.PushPullBurst
+	// Validated already by Validate
+	serfConfig.NameReuse, _ = c.NameReusePolicy()
+	serfConfig.MaxMembers = c.MaxMembers
+	// Validated already by Validate
+	serfConfig.CoalescePeriod, serfConfig.QuiescentPeriod, _ = c.CoalesceDurations()
+	serfConfig.UserCoalescePeriod = 3 * time.Second
+	serfConfig.UserQuiescentPeriod = time.Second
+
+	if c.StatsdAddr != "" {
+		sink, err := metrics.NewStatsdSink(c.StatsdAddr, c.NodeName)
+		if err != nil {
+			return nil, err
+		}
+		serfConfig.Metrics = sink
+	}
+
+	return serfConfig, nil
+}
+
+// createDataDir creates the DataDir, if one is set, readable only by
+// the agent.
+func (c *Config) createDataDir() error {
+	if c.DataDir == "" {
+		return nil
+	}
+
+	// Only the agent should be able to read its state, which includes
+	// the addresses of all the members
+	if err := os.MkdirAll(c.DataDir, 0700); err != nil {
+		return fmt.Errorf("Error creating data directory: %s", err)
+	}
+	return nil
+}
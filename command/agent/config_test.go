@@ -3,11 +3,15 @@ package agent
 import (
 	"bytes"
 	"encoding/base64"
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestConfigBindAddrParts(t *testing.T) {
@@ -83,8 +87,8 @@ func TestConfigEventScripts(t *testing.T) {
 	}
 
 	expected := []EventScript{
-		{EventFilter{"*", ""}, "foo.sh"},
-		{EventFilter{"bar", ""}, "blah.sh"},
+		{EventFilter{"*", "", "", ""}, "foo.sh"},
+		{EventFilter{"bar", "", "", ""}, "blah.sh"},
 	}
 
 	if !reflect.DeepEqual(result, expected) {
@@ -92,6 +96,230 @@ func TestConfigEventScripts(t *testing.T) {
 	}
 }
 
+func TestConfigEventEnv(t *testing.T) {
+	c := &Config{}
+	if !reflect.DeepEqual(c.EventEnv(), DefaultEventHandlerEnv) {
+		t.Fatalf("bad: %#v", c.EventEnv())
+	}
+
+	c = &Config{EventHandlerEnv: []string{"FOO", "BAR_*"}}
+	expected := []string{"FOO", "BAR_*"}
+	if !reflect.DeepEqual(c.EventEnv(), expected) {
+		t.Fatalf("bad: %#v", c.EventEnv())
+	}
+}
+
+func TestDefaultEventHandlerEnv(t *testing.T) {
+	env := defaultEventHandlerEnv("windows")
+	expected := []string{"PATH", "PATHEXT", "SystemRoot", "COMSPEC", "TEMP",
+		"TMP", "USERPROFILE", "SERF_*"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("bad: %#v", env)
+	}
+
+	env = defaultEventHandlerEnv("linux")
+	expected = []string{"PATH", "HOME", "USER", "LANG", "TMPDIR", "TZ", "SERF_*"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("bad: %#v", env)
+	}
+}
+
+func TestConfigReconcileDuration(t *testing.T) {
+	c := &Config{}
+	d, err := c.ReconcileDuration()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if d != 0 {
+		t.Fatalf("bad: %v", d)
+	}
+
+	c = &Config{ReconcileInterval: "90s"}
+	d, err = c.ReconcileDuration()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if d != 90*time.Second {
+		t.Fatalf("bad: %v", d)
+	}
+
+	c = &Config{ReconcileInterval: "soon"}
+	if _, err := c.ReconcileDuration(); err == nil {
+		t.Fatalf("should error")
+	}
+}
+
+func TestConfigHealthCheckDurations(t *testing.T) {
+	c := &Config{}
+	interval, timeout, err := c.HealthCheckDurations()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if interval != 30*time.Second || timeout != 10*time.Second {
+		t.Fatalf("bad: %v %v", interval, timeout)
+	}
+
+	c = &Config{HealthCheckTimeout: "soon"}
+	if _, _, err := c.HealthCheckDurations(); err == nil {
+		t.Fatalf("should error")
+	}
+
+	c = &Config{HealthCheckInterval: "0s"}
+	if _, _, err := c.HealthCheckDurations(); err == nil {
+		t.Fatalf("should error")
+	}
+}
+
+func TestConfigPushPullDuration(t *testing.T) {
+	c := &Config{}
+	if d, err := c.PushPullDuration(); err != nil || d != 0 {
+		t.Fatalf("bad: %v %v", d, err)
+	}
+
+	c = &Config{PushPullInterval: "2m"}
+	if d, err := c.PushPullDuration(); err != nil || d != 2*time.Minute {
+		t.Fatalf("bad: %v %v", d, err)
+	}
+
+	c = &Config{PushPullInterval: "-1s"}
+	if _, err := c.PushPullDuration(); err == nil {
+		t.Fatalf("should error")
+	}
+}
+
+func TestConfigValidate_extraBind(t *testing.T) {
+	c := *DefaultConfig
+	c.BindAddr = "10.0.0.1"
+	c.ExtraBindAddrs = []string{"10.1.0.1"}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c.BindAddr = "0.0.0.0"
+	if err := c.Validate(); err == nil {
+		t.Fatalf("should error")
+	}
+
+	c.BindAddr = "10.0.0.1"
+	c.ExtraBindAddrs = []string{"10.1.0.1:7000"}
+	if err := c.Validate(); err == nil {
+		t.Fatalf("should error")
+	}
+}
+
+func TestConfigValidate_tagsTooLarge(t *testing.T) {
+	c := *DefaultConfig
+	c.Tags = map[string]string{"big": strings.Repeat("x", memberlist.MetaMaxSize)}
+	if err := c.Validate(); err == nil {
+		t.Fatalf("should error")
+	}
+}
+
+func TestConfigCoalesceDurations(t *testing.T) {
+	c, q, err := DefaultConfig.CoalesceDurations()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if c != 3*time.Second || q != time.Second {
+		t.Fatalf("bad: %v %v", c, q)
+	}
+
+	config := &Config{CoalescePeriod: "0"}
+	if c, _, err := config.CoalesceDurations(); err != nil || c != 0 {
+		t.Fatalf("bad: %v %v", c, err)
+	}
+
+	config = &Config{CoalescePeriod: "10s", QuiescentPeriod: "0"}
+	if _, _, err := config.CoalesceDurations(); err == nil {
+		t.Fatalf("should error")
+	}
+
+	config = &Config{CoalescePeriod: "later"}
+	if _, _, err := config.CoalesceDurations(); err == nil {
+		t.Fatalf("should error")
+	}
+}
+
+func TestConfigUserEventVeto(t *testing.T) {
+	c := &Config{}
+	veto, err := c.UserEventVeto()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if veto != nil {
+		t.Fatalf("should not veto")
+	}
+
+	c = &Config{
+		UserEventNames: "^[a-z]+\\.[a-z-]+$",
+		UserEventDeny:  []string{"^db\\.drop"},
+	}
+	veto, err = c.UserEventVeto()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cases := []struct {
+		name string
+		ok   bool
+	}{
+		{"web.deploy", true},
+		{"deploy", false},
+		{"db.drop-tables", false},
+		{annotationEvent, true},
+	}
+	for _, tc := range cases {
+		if err := veto(tc.name, nil); (err == nil) != tc.ok {
+			t.Fatalf("bad: %s %v", tc.name, err)
+		}
+	}
+
+	c = &Config{UserEventDeny: []string{"("}}
+	if _, err := c.UserEventVeto(); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestUnmarshalTags(t *testing.T) {
+	tags, err := UnmarshalTags([]string{"role=web", "dc=east", "empty="})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := map[string]string{"role": "web", "dc": "east", "empty": ""}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("bad: %#v", tags)
+	}
+
+	if _, err := UnmarshalTags([]string{"nope"}); err == nil {
+		t.Fatalf("should error")
+	}
+}
+
+func TestDecodeConfig_tags(t *testing.T) {
+	input := `{"tags": {"dc": "east", "version": "1.2"}}`
+	config, err := DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := map[string]string{"dc": "east", "version": "1.2"}
+	if !reflect.DeepEqual(config.Tags, expected) {
+		t.Fatalf("bad: %#v", config.Tags)
+	}
+}
+
+func TestMergeConfig_tags(t *testing.T) {
+	a := &Config{Tags: map[string]string{"dc": "east", "rack": "1"}}
+	b := &Config{Tags: map[string]string{"dc": "west"}}
+
+	c := MergeConfig(a, b)
+	expected := map[string]string{"dc": "west", "rack": "1"}
+	if !reflect.DeepEqual(c.Tags, expected) {
+		t.Fatalf("bad: %#v", c.Tags)
+	}
+}
+
 func TestDecodeConfig(t *testing.T) {
 	// Without a protocol
 	input := `{"node_name": "foo"}`
@@ -174,6 +402,363 @@ func TestDecodeConfig(t *testing.T) {
 	if config.SkipLeaveOnInt != true {
 		t.Fatalf("bad: %#v", config)
 	}
+
+	// datacenter
+	input = `{"datacenter": "east"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.Datacenter != "east" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// event_handler_env
+	input = `{"event_handler_env": ["PATH", "APP_*"]}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !reflect.DeepEqual(config.EventHandlerEnv, []string{"PATH", "APP_*"}) {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// push_pull_interval
+	input = `{"push_pull_interval": "2m"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.PushPullInterval != "2m" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// gossip_bandwidth_limit
+	input = `{"gossip_bandwidth_limit": 65536}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.GossipBandwidthLimit != 65536 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// statsd_addr
+	input = `{"statsd_addr": "127.0.0.1:8125"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.StatsdAddr != "127.0.0.1:8125" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// push_pull_rate_limit, push_pull_burst
+	input = `{"push_pull_rate_limit": 0.5, "push_pull_burst": 5}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.PushPullRateLimit != 0.5 || config.PushPullBurst != 5 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// name_reuse
+	input = `{"name_reuse": "epoch"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	policy, err := config.NameReusePolicy()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if policy != serf.NameReuseEpoch {
+		t.Fatalf("bad: %s", policy)
+	}
+
+	config.NameReuse = "sometimes"
+	if _, err := config.NameReusePolicy(); err == nil {
+		t.Fatalf("should err")
+	}
+
+	// max_members
+	input = `{"max_members": 500}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.MaxMembers != 500 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// coalesce_period, quiescent_period
+	input = `{"coalesce_period": "10s", "quiescent_period": "2s"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.CoalescePeriod != "10s" || config.QuiescentPeriod != "2s" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// observer
+	input = `{"observer": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.Observer {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// user_event_checksums
+	input = `{"user_event_checksums": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.EventChecksums {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// tag_metadata
+	input = `{"tag_metadata": ["ec2"], "tag_metadata_required": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !reflect.DeepEqual(config.TagMetadata, []string{"ec2"}) {
+		t.Fatalf("bad: %#v", config)
+	}
+	if !config.TagMetadataRequired {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// tags_from
+	input = `{"tags_from": {"build": "file:/etc/build-id", "kernel": "cmd:uname -r"}}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expectedSources := map[string]string{"build": "file:/etc/build-id", "kernel": "cmd:uname -r"}
+	if !reflect.DeepEqual(config.TagsFrom, expectedSources) {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// user_event_names
+	input = `{"user_event_names": "^web\\.", "user_event_deny": ["drop"]}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.UserEventNames != "^web\\." {
+		t.Fatalf("bad: %#v", config)
+	}
+	if !reflect.DeepEqual(config.UserEventDeny, []string{"drop"}) {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// protocol_upgrade_check
+	input = `{"protocol_upgrade_check": 3}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.ProtocolUpgradeCheck != 3 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// handler_failure_limit
+	input = `{"handler_failure_limit": 5, "handler_cooldown": "30s"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.HandlerFailureLimit != 5 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	cooldown, err := config.HandlerCooldownDuration()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if cooldown != 30*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// health_check
+	input = `{"health_check": "check.sh", "health_check_interval": "5s", "health_check_timeout": "2s"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.HealthCheck != "check.sh" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	interval, timeout, err := config.HealthCheckDurations()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if interval != 5*time.Second || timeout != 2*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// rtt_nodes
+	input = `{"rtt_nodes": ["seed1", "seed2"], "rtt_interval": "10s"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !reflect.DeepEqual(config.RTTNodes, []string{"seed1", "seed2"}) {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	if interval, err := config.RTTDuration(); err != nil || interval != 10*time.Second {
+		t.Fatalf("bad: %v %v", interval, err)
+	}
+
+	// role_tag
+	input = `{"role_tag": "service"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.RoleTag != "service" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// event_handler_format
+	input = `{"event_handler_format": "json"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.EventHandlerFormat != "json" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// event_handler_shell
+	input = `{"event_handler_shell": "powershell"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.EventHandlerShell != "powershell" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// event_handler_nice
+	input = `{"event_handler_nice": 10}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.EventHandlerNice != 10 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// views
+	input = `{"views": {"web-east": "role=web dc=east"}}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	views, err := config.ParsedViews()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(views["web-east"], View{"role": "web", "dc": "east"}) {
+		t.Fatalf("bad: %#v", views)
+	}
+
+	// data_dir
+	input = `{"data_dir": "/var/lib/serf"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.DataDir != "/var/lib/serf" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// disable_events
+	input = `{"disable_events": ["user:deploy", "member-failed"]}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	disabled, err := config.DisabledEvents()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expectedDisabled := []EventFilter{
+		{Event: "user", UserEvent: "deploy"},
+		{Event: "member-failed"},
+	}
+	if !reflect.DeepEqual(disabled, expectedDisabled) {
+		t.Fatalf("bad: %#v", disabled)
+	}
+
+	config.DisableEvents = []string{"member-failed@dc=east"}
+	if _, err := config.DisabledEvents(); err == nil {
+		t.Fatal("should error")
+	}
+
+	// user_event_origins
+	input = `{"user_event_origins": {"deploy": ["ci", "team=ops"]}}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expectedOrigins := map[string][]string{"deploy": []string{"ci", "team=ops"}}
+	if !reflect.DeepEqual(config.UserEventOrigins, expectedOrigins) {
+		t.Fatalf("bad: %#v", config.UserEventOrigins)
+	}
+}
+
+func TestConfigSnapshotFile(t *testing.T) {
+	c := &Config{}
+	if c.SnapshotFile() != "" {
+		t.Fatalf("bad: %s", c.SnapshotFile())
+	}
+
+	c.DataDir = "/var/lib/serf"
+	if c.SnapshotFile() != filepath.Join("/var/lib/serf", "snapshot") {
+		t.Fatalf("bad: %s", c.SnapshotFile())
+	}
+
+	c.SnapshotPath = "/tmp/snap"
+	if c.SnapshotFile() != "/tmp/snap" {
+		t.Fatalf("bad: %s", c.SnapshotFile())
+	}
 }
 
 func TestMergeConfig(t *testing.T) {
@@ -184,6 +769,8 @@ func TestMergeConfig(t *testing.T) {
 		EventHandlers: []string{"foo"},
 		StartJoin:     []string{"foo"},
 		ReplayOnJoin:  true,
+
+		ExtraBindAddrs: []string{"foo"},
 	}
 
 	b := &Config{
@@ -194,6 +781,7 @@ func TestMergeConfig(t *testing.T) {
 		StartJoin:      []string{"bar"},
 		LeaveOnTerm:    true,
 		SkipLeaveOnInt: true,
+		ExtraBindAddrs: []string{"bar"},
 	}
 
 	c := MergeConfig(a, b)
@@ -234,6 +822,38 @@ func TestMergeConfig(t *testing.T) {
 	if !reflect.DeepEqual(c.StartJoin, expected) {
 		t.Fatalf("bad: %#v", c)
 	}
+
+	if !reflect.DeepEqual(c.ExtraBindAddrs, expected) {
+		t.Fatalf("bad: %#v", c)
+	}
+}
+
+func TestDecodeConfigStrict(t *testing.T) {
+	input := `{"node_name": "foo", "event_handers": ["foo.sh"], "bogus_thing": 1}`
+	_, err := DecodeConfigStrict(bytes.NewReader([]byte(input)))
+	if err == nil {
+		t.Fatalf("should err")
+	}
+
+	expected := `Unknown configuration keys: bogus_thing, event_handers (did you mean "event_handlers"?)`
+	if err.Error() != expected {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// Unknown keys are ignored when not strict
+	config, err := DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if config.NodeName != "foo" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Every known key is accepted
+	input = `{"node_name": "foo", "role": "web", "tags": {"dc": "east"}}`
+	if _, err := DecodeConfigStrict(bytes.NewReader([]byte(input))); err != nil {
+		t.Fatalf("err: %s", err)
+	}
 }
 
 func TestReadConfigPaths_badPath(t *testing.T) {
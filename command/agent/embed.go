@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/hashicorp/logutils"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// Embedded is a complete agent that runs inside another program: Serf,
+// the event handler scripts and the RPC server, configured the same way
+// as "serf agent". Unlike Agent, which only wraps Serf, it needs no
+// further setup.
+//
+// The lifecycle is New, then Start, then optionally Leave, and finally
+// Shutdown, which must also be called if Start fails. Other event
+// handlers can be registered on Agent before Start, so that they see
+// every event.
+type Embedded struct {
+	config    *Config
+	agent     *Agent
+	scripts   *ScriptEventHandler
+	ipc       *AgentIPC
+	logOutput io.Writer
+	logWriter *logWriter
+}
+
+// New creates an agent from the configuration, which is merged on top
+// of DefaultConfig and validated the same as the configuration files of
+// "serf agent". The logs of the agent, at the configured LogLevel, are
+// written to logOutput, or to stderr if it is nil, as well as streamed
+// to RPC clients that monitor the agent. Nothing is bound until Start.
+//
+// Settings left at their zero value take the default. This includes a
+// Protocol of zero, which is the latest version rather than version 0.
+func New(config *Config, logOutput io.Writer) (*Embedded, error) {
+	protocol := config.Protocol
+	config = MergeConfig(DefaultConfig, config)
+	if protocol == 0 {
+		config.Protocol = DefaultConfig.Protocol
+	}
+	if err := config.setDefaults(); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	if logOutput == nil {
+		logOutput = os.Stderr
+	}
+	logFilter := LevelFilter()
+	logFilter.MinLevel = logutils.LogLevel(strings.ToUpper(config.LogLevel))
+	logFilter.Writer = logOutput
+	if !ValidateLevelFilter(logFilter.MinLevel, logFilter) {
+		return nil, fmt.Errorf("Invalid log level: %s. Valid log levels are: %v",
+			logFilter.MinLevel, logFilter.Levels)
+	}
+	logWriter := NewLogWriter(512)
+	logOutput = io.MultiWriter(logFilter, logWriter)
+
+	serfConfig, err := config.SerfConfig(log.New(logOutput, "", log.LstdFlags))
+	if err != nil {
+		return nil, err
+	}
+	if err := config.createDataDir(); err != nil {
+		return nil, err
+	}
+
+	agent, err := Create(serfConfig, logOutput)
+	if err != nil {
+		return nil, err
+	}
+	if path := config.MaintenanceFile(); path != "" {
+		if err := agent.LoadMaintenance(path); err != nil {
+			return nil, err
+		}
+	}
+
+	e := &Embedded{
+		config:    config,
+		agent:     agent,
+		scripts:   newScriptEventHandler(config, agent, logOutput),
+		logOutput: logOutput,
+		logWriter: logWriter,
+	}
+	agent.RegisterEventHandler(e.scripts)
+	return e, nil
+}
+
+// Agent returns the underlying Agent, to register other event handlers
+// or to use the Serf of the agent once it is started.
+func (e *Embedded) Agent() *Agent {
+	return e.agent
+}
+
+// Start binds the listeners of Serf and of the RPC server, starts
+// delivering events to the handlers, and joins the StartJoin addresses.
+func (e *Embedded) Start() error {
+	if err := e.agent.startSerf(); err != nil {
+		return err
+	}
+
+	rpcListener, err := net.Listen("tcp", e.config.RPCAddr)
+	if err != nil {
+		return fmt.Errorf("Error starting RPC listener: %s", err)
+	}
+
+	e.agent.startEventLoop()
+
+	// Validated already by Validate
+	if interval, _ := e.config.ReconcileDuration(); interval > 0 {
+		e.agent.StartReconcile(interval)
+	}
+	if e.config.HealthCheck != "" {
+		interval, timeout, _ := e.config.HealthCheckDurations()
+		e.agent.StartHealthCheck(e.config.HealthCheck, e.config.EventHandlerShell, interval, timeout)
+	}
+	if len(e.config.RTTNodes) > 0 {
+		interval, _ := e.config.RTTDuration()
+		e.agent.StartRTT(e.config.RTTNodes, interval)
+	}
+	e.agent.applyConfig(e.config)
+
+	e.ipc = NewAgentIPC(e.agent, rpcListener, e.logOutput, e.logWriter)
+
+	if len(e.config.StartJoin) > 0 {
+		if _, err := e.agent.Join(e.config.StartJoin, e.config.ReplayOnJoin); err != nil {
+			return err
+		}
+	}
+
+	e.agent.LogTuningHints()
+	return nil
+}
+
+// Leave gracefully leaves the cluster. It should be followed by Shutdown.
+func (e *Embedded) Leave() error {
+	return e.agent.Leave()
+}
+
+// Shutdown stops the RPC server and the agent. Event handler scripts
+// that are running are not waited for.
+func (e *Embedded) Shutdown() error {
+	if e.ipc != nil {
+		e.ipc.Shutdown()
+	}
+	return e.agent.Shutdown()
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"bytes"
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingHandler struct {
+	events chan serf.Event
+}
+
+func (h *recordingHandler) HandleEvent(e serf.Event) {
+	h.events <- e
+}
+
+func TestEmbedded(t *testing.T) {
+	config := &Config{
+		NodeName: "embedded",
+		BindAddr: testutil.GetBindAddr().String(),
+		RPCAddr:  getRPCAddr(),
+		Role:     "web",
+
+		CoalescePeriod:  "100ms",
+		QuiescentPeriod: "50ms",
+	}
+
+	var logs bytes.Buffer
+	e, err := New(config, &logs)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer e.Shutdown()
+
+	h := &recordingHandler{events: make(chan serf.Event, 4)}
+	e.Agent().RegisterEventHandler(h)
+
+	if err := e.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The handler sees the join of the agent itself
+	select {
+	case ev := <-h.events:
+		me, ok := ev.(serf.MemberEvent)
+		if !ok || me.Type != serf.EventMemberJoin || me.Members[0].Name != "embedded" {
+			t.Fatalf("bad: %#v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no event")
+	}
+
+	// The RPC server is running
+	client, err := NewRPCClient(config.RPCAddr)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer client.Close()
+
+	members, err := client.Members()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(members) != 1 || members[0].Role != "web" {
+		t.Fatalf("bad: %#v", members)
+	}
+
+	if err := e.Shutdown(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(logs.String(), "Serf agent starting") {
+		t.Fatalf("bad: %s", logs.String())
+	}
+}
+
+func TestEmbedded_invalidConfig(t *testing.T) {
+	config := &Config{
+		BindAddr:           testutil.GetBindAddr().String(),
+		EventHandlerFormat: "xml",
+	}
+	if _, err := New(config, nil); err == nil || !strings.Contains(err.Error(), "event handler format") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	config = &Config{
+		BindAddr: testutil.GetBindAddr().String(),
+		LogLevel: "chatty",
+	}
+	if _, err := New(config, nil); err == nil || !strings.Contains(err.Error(), "log level") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestEmbedded_selfTags(t *testing.T) {
+	MetadataFetchers["mock"] = mockMetadataFetcher{"az": "east-1a"}
+	defer delete(MetadataFetchers, "mock")
+
+	config := &Config{
+		NodeName:    "embedded",
+		BindAddr:    testutil.GetBindAddr().String(),
+		Tags:        map[string]string{"dc": "east"},
+		TagMetadata: []string{"mock"},
+		TagsFrom:    map[string]string{"kernel": "cmd:echo 3.2.0"},
+	}
+	e, err := New(config, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer e.Shutdown()
+
+	// The handlers see the tags of the local node that are advertised
+	tags := e.scripts.Self.Tags
+	if tags["az"] != "east-1a" || tags["kernel"] != "3.2.0" || tags["dc"] != "east" {
+		t.Fatalf("bad: %#v", tags)
+	}
+}
@@ -3,10 +3,12 @@ package agent
 import (
 	"fmt"
 	"github.com/hashicorp/serf/serf"
+	"io"
 	"log"
 	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 // EventHandler is a handler that does things when events happen.
@@ -14,14 +16,114 @@ type EventHandler interface {
 	HandleEvent(serf.Event)
 }
 
+// eventHandlerStopper is implemented by the event handlers that defer
+// some of their work, which the agent stops when it shuts down.
+type eventHandlerStopper interface {
+	Stop()
+}
+
 // ScriptEventHandler invokes scripts for the events that it receives.
 type ScriptEventHandler struct {
 	Self    serf.Member
 	Scripts []EventScript
 	Logger  *log.Logger
 
+	// Env is the list of environment variables of the agent that are
+	// passed through to the scripts. See FilterEnv for the format.
+	Env []string
+
+	// RoleTag, if set, is the name of the tag that is given to the
+	// scripts as the role of members, instead of the role itself.
+	RoleTag string
+
+	// Format is the format of the event data on the stdin of the
+	// scripts, "json" or "text". Defaults to "text".
+	Format string
+
+	// Shell runs the scripts, see scriptCommand. Defaults to "cmd" on
+	// Windows and "sh" elsewhere.
+	Shell string
+
+	// Nice, if positive, is added to the nice level of the agent for the
+	// scripts, so that busy scripts don't delay the gossip and failure
+	// detection of the agent. It is ignored on Windows.
+	Nice int
+
+	// Maintenance, if set, reports whether the local node is in
+	// maintenance mode. User events don't invoke scripts while it is,
+	// but member events still do, so that scripts keep track of the
+	// membership.
+	Maintenance func() bool
+
+	// Metrics, if set, receives the durations and the failures of the
+	// scripts
+	Metrics serf.MetricsSink
+
 	scriptLock sync.Mutex
 	newScripts []EventScript
+
+	// failures track the consecutive failures of the scripts, see
+	// SetFailureLimit
+	failureLock     sync.Mutex
+	failureLimit    int
+	failureCooldown time.Duration
+	failures        map[string]*scriptFailures
+
+	// batches are the pending user events of scripts with a batch window.
+	// Once stopped, no more batches are started, see Stop.
+	batchLock    sync.Mutex
+	batches      map[batchKey]*pendingBatch
+	batchWg      sync.WaitGroup
+	batchStopped bool
+}
+
+// newScriptEventHandler returns the handler that invokes the event
+// scripts of the configuration for the agent. The local node is taken
+// from the Serf configuration of the agent, so that its tags include the
+// ones from tag_metadata and tags_from, the same as advertised.
+func newScriptEventHandler(config *Config, agent *Agent, logOutput io.Writer) *ScriptEventHandler {
+	serfConfig := agent.SerfConfig()
+	h := &ScriptEventHandler{
+		Self: serf.Member{
+			Name: serfConfig.NodeName,
+			Role: serfConfig.Role,
+			Tags: serfConfig.Tags,
+		},
+		Scripts:     config.EventScripts(),
+		Logger:      log.New(logOutput, "", log.LstdFlags),
+		Env:         config.EventEnv(),
+		RoleTag:     config.RoleTag,
+		Format:      config.EventHandlerFormat,
+		Shell:       config.EventHandlerShell,
+		Nice:        config.EventHandlerNice,
+		Maintenance: agent.InMaintenance,
+		Metrics:     agent.metrics(),
+	}
+	// Validated already by Validate
+	cooldown, _ := config.HandlerCooldownDuration()
+	h.SetFailureLimit(config.HandlerFailureLimit, cooldown)
+	return h
+}
+
+// scriptFailures are the consecutive failures of a script
+type scriptFailures struct {
+	Count         int
+	DisabledUntil time.Time
+}
+
+// batchKey identifies the pending batch of user events for a script
+type batchKey struct {
+	Script  string
+	Name    string
+	Version uint8
+}
+
+// pendingBatch is a batch of user events waiting for the end of the
+// batch window of its script
+type pendingBatch struct {
+	Event serf.UserEvent
+	Env   []string
+	Timer *time.Timer
 }
 
 func (h *ScriptEventHandler) HandleEvent(e serf.Event) {
@@ -37,17 +139,236 @@ func (h *ScriptEventHandler) HandleEvent(e serf.Event) {
 		h.Logger = log.New(os.Stderr, "", log.LstdFlags)
 	}
 
+	if _, ok := e.(serf.UserEvent); ok && h.Maintenance != nil && h.Maintenance() {
+		h.Logger.Printf("[DEBUG] agent: Not invoking scripts in maintenance mode: %s", e)
+		return
+	}
+
+	// Events for another member are only delivered so that they can be
+	// gossiped, see Agent.UserEventNode
+	if ue, ok := e.(serf.UserEvent); ok && ue.Target != "" && ue.Target != h.Self.Name {
+		h.Logger.Printf("[DEBUG] agent: Not invoking scripts for event of %s: %s", ue.Target, e)
+		return
+	}
+
+	// The tags of the local node can change while the agent runs
+	if me, ok := e.(serf.MemberEvent); ok && me.Type == serf.EventMemberUpdate {
+		for _, m := range me.Members {
+			if m.Name == h.Self.Name {
+				h.Self.Role = m.Role
+				h.Self.Tags = m.Tags
+			}
+		}
+	}
+
+	self := h.self()
+	if h.RoleTag != "" {
+		e = roleFromTag(e, h.RoleTag)
+	}
+
+	env := FilterEnv(os.Environ(), h.Env)
 	for _, script := range h.Scripts {
 		if !script.Invoke(e) {
 			continue
 		}
 
-		err := invokeEventScript(h.Logger, script.Script, h.Self, e)
-		if err != nil {
-			h.Logger.Printf("[ERR] agent: Error invoking script '%s': %s",
-				script.Script, err)
+		event, ok := script.FilterTags(e, self)
+		if !ok {
+			continue
+		}
+
+		if userEvent, ok := event.(serf.UserEvent); ok && script.Batch != "" {
+			h.batchEvent(script, env, userEvent)
+			continue
+		}
+
+		h.invoke(script.Script, env, self, event)
+	}
+}
+
+// invoke invokes a script unless it is disabled because of failures,
+// and records the result.
+func (h *ScriptEventHandler) invoke(script string, env []string, self serf.Member, e serf.Event) {
+	if h.disabled(script) {
+		h.Logger.Printf("[DEBUG] agent: Skipping disabled script '%s'", script)
+		return
+	}
+
+	start := time.Now()
+	err := invokeEventScript(h.Logger, script, h.Shell, h.Format, h.Nice, env, self, e)
+	if h.Metrics != nil {
+		h.Metrics.MeasureSince([]string{"agent", "handler"}, start)
+	}
+	if err != nil {
+		h.Logger.Printf("[ERR] agent: Error invoking script '%s' for event %s: %s",
+			script, EventID(e), err)
+		if h.Metrics != nil {
+			h.Metrics.IncrCounter([]string{"agent", "handler", "failed"}, 1)
+		}
+	}
+	h.recordResult(script, err)
+}
+
+// SetFailureLimit sets the number of consecutive failures after which a
+// script is disabled for the cooldown. A limit of zero never disables
+// scripts.
+func (h *ScriptEventHandler) SetFailureLimit(limit int, cooldown time.Duration) {
+	h.failureLock.Lock()
+	defer h.failureLock.Unlock()
+	h.failureLimit = limit
+	h.failureCooldown = cooldown
+}
+
+// disabled checks if a script is disabled because of failures
+func (h *ScriptEventHandler) disabled(script string) bool {
+	h.failureLock.Lock()
+	defer h.failureLock.Unlock()
+
+	f, ok := h.failures[script]
+	return ok && time.Now().Before(f.DisabledUntil)
+}
+
+// recordResult counts the consecutive failures of a script, and disables
+// it once there are too many. A script that fails again when it is
+// retried after the cooldown is disabled right away, and one that
+// succeeds is enabled again.
+func (h *ScriptEventHandler) recordResult(script string, err error) {
+	h.failureLock.Lock()
+	defer h.failureLock.Unlock()
+
+	if err == nil {
+		if f, ok := h.failures[script]; ok && !f.DisabledUntil.IsZero() {
+			h.Logger.Printf("[INFO] agent: Re-enabling script '%s' after it succeeded", script)
+			if h.Metrics != nil {
+				h.Metrics.IncrCounter([]string{"agent", "handler", "enabled"}, 1)
+			}
+		}
+		delete(h.failures, script)
+		return
+	}
+
+	if h.failures == nil {
+		h.failures = make(map[string]*scriptFailures)
+	}
+	f, ok := h.failures[script]
+	if !ok {
+		f = new(scriptFailures)
+		h.failures[script] = f
+	}
+	f.Count++
+
+	if h.failureLimit > 0 && f.Count >= h.failureLimit {
+		f.DisabledUntil = time.Now().Add(h.failureCooldown)
+		h.Logger.Printf("[WARN] agent: Disabling script '%s' for %s after %d consecutive failures",
+			script, h.failureCooldown, f.Count)
+		if h.Metrics != nil {
+			h.Metrics.IncrCounter([]string{"agent", "handler", "disabled"}, 1)
+		}
+	}
+}
+
+// batchEvent adds a user event to the pending batch of the script, and
+// schedules the invocation if it starts a new batch. The batched event
+// has the payloads of all the events, separated by newlines, and the
+// LTime of the latest one.
+func (h *ScriptEventHandler) batchEvent(script EventScript, env []string, e serf.UserEvent) {
+	h.batchLock.Lock()
+	defer h.batchLock.Unlock()
+
+	if h.batchStopped {
+		h.Logger.Printf("[DEBUG] agent: Not batching event after stop: %s", e)
+		return
+	}
+
+	key := batchKey{Script: script.Script, Name: e.Name, Version: e.Version}
+	if batch, ok := h.batches[key]; ok {
+		batch.Event.Payload = append(append(batch.Event.Payload, '\n'), e.Payload...)
+		if e.LTime > batch.Event.LTime {
+			batch.Event.LTime = e.LTime
+		}
+		return
+	}
+
+	// The payload is copied since it is appended to
+	batch := &pendingBatch{Event: e, Env: env}
+	batch.Event.Payload = append([]byte(nil), e.Payload...)
+	if h.batches == nil {
+		h.batches = make(map[batchKey]*pendingBatch)
+	}
+	h.batches[key] = batch
+
+	window, _ := script.BatchWindow()
+	h.batchWg.Add(1)
+	batch.Timer = time.AfterFunc(window, func() {
+		defer h.batchWg.Done()
+
+		h.batchLock.Lock()
+		batch, ok := h.batches[key]
+		delete(h.batches, key)
+		h.batchLock.Unlock()
+
+		// The batch was flushed by Stop
+		if !ok {
+			return
 		}
+		h.invoke(script.Script, batch.Env, h.self(), batch.Event)
+	})
+}
+
+// Stop invokes the scripts of the pending batches right away, instead of
+// at the end of their windows, and waits for the batches being invoked.
+// Events that would start a new batch are ignored afterwards, so no
+// script is invoked for a batch once Stop returns.
+func (h *ScriptEventHandler) Stop() {
+	h.batchLock.Lock()
+	h.batchStopped = true
+	batches := h.batches
+	h.batches = nil
+	h.batchLock.Unlock()
+
+	for key, batch := range batches {
+		if batch.Timer.Stop() {
+			h.batchWg.Done()
+		}
+		h.invoke(key.Script, batch.Env, h.self(), batch.Event)
+	}
+	h.batchWg.Wait()
+}
+
+// self returns the local member as it is given to the scripts
+func (h *ScriptEventHandler) self() serf.Member {
+	self := h.Self
+	if h.RoleTag != "" {
+		self.Role = self.Tags[h.RoleTag]
 	}
+	return self
+}
+
+// roleFromTag returns the event with the role of the members of a member
+// or reconcile event replaced by the value of the given tag. Other events
+// are returned as they are.
+func roleFromTag(e serf.Event, tag string) serf.Event {
+	switch event := e.(type) {
+	case serf.MemberEvent:
+		event.Members = membersRoleFromTag(event.Members, tag)
+		return event
+	case ReconcileEvent:
+		event.Members = membersRoleFromTag(event.Members, tag)
+		return event
+	default:
+		return e
+	}
+}
+
+// membersRoleFromTag returns a copy of members with the role replaced by
+// the value of the given tag.
+func membersRoleFromTag(members []serf.Member, tag string) []serf.Member {
+	result := make([]serf.Member, len(members))
+	for i, m := range members {
+		m.Role = m.Tags[tag]
+		result[i] = m
+	}
+	return result
 }
 
 // UpdateScripts is used to safely update the scripts we invoke in
@@ -62,6 +383,16 @@ func (h *ScriptEventHandler) UpdateScripts(scripts []EventScript) {
 type EventFilter struct {
 	Event     string
 	UserEvent string
+
+	// Tag is an optional "key=value" expression. Only member events
+	// concerning members with the tag, or user events received by a
+	// node with the tag, are processed. See FilterTags.
+	Tag string
+
+	// Batch is an optional duration, such as "10s". User events with the
+	// same name that are received within this window are processed
+	// together, as a single event with all the payloads.
+	Batch string
 }
 
 // Invoke tests whether or not this event script should be invoked
@@ -71,7 +402,7 @@ func (s *EventFilter) Invoke(e serf.Event) bool {
 		return true
 	}
 
-	if e.EventType().String() != s.Event {
+	if EventName(e) != s.Event {
 		return false
 	}
 
@@ -89,12 +420,96 @@ func (s *EventFilter) Invoke(e serf.Event) bool {
 	return true
 }
 
+// FilterTags applies the tag expression of the filter, if any, to an
+// event that the filter already invokes. Member and reconcile events are
+// reduced to the members with the tag. User events are only accepted if the local
+// node, given by self, has the tag. If nothing is left the event should
+// not be processed, which is indicated by returning false.
+func (s *EventFilter) FilterTags(e serf.Event, self serf.Member) (serf.Event, bool) {
+	if s.Tag == "" {
+		return e, true
+	}
+
+	parts := strings.SplitN(s.Tag, "=", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	name, value := parts[0], parts[1]
+
+	switch event := e.(type) {
+	case serf.MemberEvent:
+		event.Members = membersWithTag(event.Members, name, value)
+		if len(event.Members) == 0 {
+			return nil, false
+		}
+		return event, true
+
+	case ReconcileEvent:
+		event.Members = membersWithTag(event.Members, name, value)
+		if len(event.Members) == 0 {
+			return nil, false
+		}
+		return event, true
+
+	default:
+		return e, memberTag(self, name) == value
+	}
+}
+
+// membersWithTag returns the members that have the given tag value.
+func membersWithTag(members []serf.Member, name, value string) []serf.Member {
+	result := make([]serf.Member, 0, len(members))
+	for _, m := range members {
+		if memberTag(m, name) == value {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// memberTag returns the value of a tag of a member. The role is also
+// available as the "role" tag.
+func memberTag(m serf.Member, name string) string {
+	if v, ok := m.Tags[name]; ok {
+		return v
+	}
+	if name == "role" {
+		return m.Role
+	}
+	return ""
+}
+
+// BatchWindow returns the parsed Batch duration, or zero if user events
+// are not batched.
+func (s *EventFilter) BatchWindow() (time.Duration, error) {
+	if s.Batch == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s.Batch)
+}
+
 // Valid checks if this is a valid agent event script.
 func (s *EventFilter) Valid() bool {
+	if s.Batch != "" {
+		window, err := s.BatchWindow()
+		if err != nil || window <= 0 || s.Event != "user" {
+			return false
+		}
+	}
+
+	if s.Tag != "" {
+		parts := strings.SplitN(s.Tag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return false
+		}
+	}
+
 	switch s.Event {
 	case "member-join":
 	case "member-leave":
 	case "member-failed":
+	case "member-update":
+	case "member-reconcile":
 	case "user":
 	case "*":
 	default:
@@ -112,22 +527,46 @@ type EventScript struct {
 }
 
 func (s *EventScript) String() string {
+	event := s.Event
 	if s.UserEvent != "" {
-		return fmt.Sprintf("Event 'user:%s' invoking '%s'", s.UserEvent, s.Script)
+		event = "user:" + s.UserEvent
+	}
+	if s.Batch != "" {
+		event += "~" + s.Batch
+	}
+	if s.Tag != "" {
+		event += "@" + s.Tag
 	}
-	return fmt.Sprintf("Event '%s' invoking '%s'", s.Event, s.Script)
+	return fmt.Sprintf("Event '%s' invoking '%s'", event, s.Script)
 }
 
 // ParseEventScript takes a string in the format of "type=script" and
-// parses it into an EventScript struct, if it can.
+// parses it into an EventScript struct, if it can. Each type may have
+// a tag expression, as in "member-failed@dc=east=script", and user
+// events may have a batch window, as in "user:metrics~10s=script".
 func ParseEventScript(v string) []EventScript {
 	var filter, script string
-	parts := strings.SplitN(v, "=", 2)
-	if len(parts) == 1 {
-		script = parts[0]
+
+	// Each "@key=value" tag expression uses up one "=", the next one
+	// separates the filter from the script
+	idx, tags := -1, 0
+	for i, c := range v {
+		if c == '@' {
+			tags++
+		} else if c == '=' {
+			if tags == 0 {
+				idx = i
+				break
+			}
+			tags--
+		}
+	}
+
+	if idx == -1 {
+		script = v
 	} else {
-		filter = parts[0]
-		script = parts[1]
+		filter = v[:idx]
+		script = v[idx+1:]
 	}
 
 	filters := ParseEventFilter(filter)
@@ -156,6 +595,16 @@ func ParseEventFilter(v string) []EventFilter {
 		var result EventFilter
 		var userEvent string
 
+		if idx := strings.Index(event, "@"); idx >= 0 {
+			result.Tag = event[idx+1:]
+			event = event[:idx]
+		}
+
+		if idx := strings.Index(event, "~"); idx >= 0 {
+			result.Batch = event[idx+1:]
+			event = event[:idx]
+		}
+
 		if strings.HasPrefix(event, "user:") {
 			userEvent = event[len("user:"):]
 			event = "user"
@@ -2,10 +2,16 @@ package agent
 
 import (
 	"fmt"
+	"github.com/hashicorp/serf/metrics"
 	"github.com/hashicorp/serf/serf"
 	"io/ioutil"
 	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 const eventScript = `#!/bin/sh
@@ -27,6 +33,24 @@ while read line; do
 done
 `
 
+const batchEventScript = `#!/bin/sh
+RESULT_FILE="%s"
+echo $SERF_USER_EVENT $SERF_USER_LTIME >>${RESULT_FILE}
+cat >>${RESULT_FILE}
+echo >>${RESULT_FILE}
+`
+
+const stdinEventScript = `#!/bin/sh
+RESULT_FILE="%s"
+cat >>${RESULT_FILE}
+`
+
+const failingEventScript = `#!/bin/sh
+RESULT_FILE="%s"
+echo $SERF_EVENT >>${RESULT_FILE}
+exit 1
+`
+
 // testEventScript creates an event script that can be used with the
 // agent. It returns the path to the event script itself and a path to
 // the file that will contain the events that that script receives.
@@ -35,29 +59,604 @@ func testEventScript(t *testing.T, script string) (string, string) {
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	defer scriptFile.Close()
+	defer scriptFile.Close()
+
+	if err := scriptFile.Chmod(0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	resultFile, err := ioutil.TempFile("", "serf-result")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resultFile.Close()
+
+	_, err = scriptFile.Write([]byte(
+		fmt.Sprintf(script, resultFile.Name())))
+	if err != nil {
+		t.Fatalf("err: %s")
+	}
+
+	return scriptFile.Name(), resultFile.Name()
+}
+
+func TestScriptEventHandler(t *testing.T) {
+	script, results := testEventScript(t, eventScript)
+
+	h := &ScriptEventHandler{
+		Self: serf.Member{
+			Name: "ourname",
+			Role: "ourrole",
+		},
+		Scripts: []EventScript{
+			{
+				EventFilter: EventFilter{
+					Event: "*",
+				},
+				Script: script,
+			},
+		},
+	}
+
+	event := serf.MemberEvent{
+		Type: serf.EventMemberJoin,
+		Members: []serf.Member{
+			{
+				Name: "foo",
+				Addr: net.ParseIP("1.2.3.4"),
+				Role: "bar",
+			},
+		},
+	}
+
+	h.HandleEvent(event)
+
+	result, err := ioutil.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "ourname ourrole\nmember-join\nfoo\t1.2.3.4\tbar\n"
+	if string(result) != expected {
+		t.Fatalf("bad: %#v. Expected: %#v", string(result), expected)
+	}
+}
+
+func TestScriptEventHandler_reconcile(t *testing.T) {
+	script, results := testEventScript(t, eventScript)
+
+	h := &ScriptEventHandler{
+		Self: serf.Member{
+			Name: "ourname",
+			Role: "ourrole",
+		},
+		Scripts: []EventScript{
+			{
+				EventFilter: EventFilter{
+					Event: "member-reconcile",
+				},
+				Script: script,
+			},
+		},
+	}
+
+	h.HandleEvent(ReconcileEvent{
+		Members: []serf.Member{
+			{
+				Name: "foo",
+				Addr: net.ParseIP("1.2.3.4"),
+				Role: "bar",
+			},
+		},
+	})
+
+	result, err := ioutil.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "ourname ourrole\nmember-reconcile\nfoo\t1.2.3.4\tbar\n"
+	if string(result) != expected {
+		t.Fatalf("bad: %#v. Expected: %#v", string(result), expected)
+	}
+}
+
+func TestScriptEventHandler_failureLimit(t *testing.T) {
+	script, results := testEventScript(t, failingEventScript)
+
+	h := &ScriptEventHandler{
+		Scripts: []EventScript{
+			{
+				EventFilter: EventFilter{
+					Event: "*",
+				},
+				Script: script,
+			},
+		},
+	}
+	h.SetFailureLimit(2, time.Hour)
+
+	event := serf.UserEvent{Name: "deploy"}
+	for i := 0; i < 3; i++ {
+		h.HandleEvent(event)
+	}
+
+	result, err := ioutil.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(result) != "user\nuser\n" {
+		t.Fatalf("bad: %#v", string(result))
+	}
+
+	// Once the cooldown has passed the script is retried
+	h.failures[script].DisabledUntil = time.Now()
+	h.HandleEvent(event)
+
+	result, err = ioutil.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(result) != "user\nuser\nuser\n" {
+		t.Fatalf("bad: %#v", string(result))
+	}
+}
+
+func TestScriptEventHandler_metrics(t *testing.T) {
+	script, _ := testEventScript(t, failingEventScript)
+
+	sink := metrics.NewPrometheusSink()
+	h := &ScriptEventHandler{
+		Scripts: []EventScript{
+			{
+				EventFilter: EventFilter{
+					Event: "*",
+				},
+				Script: script,
+			},
+		},
+		Metrics: sink,
+	}
+	h.HandleEvent(serf.UserEvent{Name: "deploy"})
+
+	out := sink.String()
+	if !strings.Contains(out, "agent_handler_failed_total 1\n") ||
+		!strings.Contains(out, "agent_handler_seconds_count 1\n") {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestScriptEventHandler_failureLimitMetrics(t *testing.T) {
+	script, results := testEventScript(t, failingEventScript)
+
+	sink := metrics.NewPrometheusSink()
+	h := &ScriptEventHandler{
+		Scripts: []EventScript{
+			{
+				EventFilter: EventFilter{
+					Event: "*",
+				},
+				Script: script,
+			},
+		},
+		Metrics: sink,
+	}
+	h.SetFailureLimit(1, time.Hour)
+
+	event := serf.UserEvent{Name: "deploy"}
+	h.HandleEvent(event)
+
+	out := sink.String()
+	if !strings.Contains(out, "agent_handler_disabled_total 1\n") {
+		t.Fatalf("bad: %s", out)
+	}
+	if strings.Contains(out, "agent_handler_enabled_total") {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// Fix the script, and retry it once the cooldown has passed
+	fixed := fmt.Sprintf(eventScript, results)
+	if err := ioutil.WriteFile(script, []byte(fixed), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	h.failures[script].DisabledUntil = time.Now()
+	h.HandleEvent(event)
+
+	out = sink.String()
+	if !strings.Contains(out, "agent_handler_enabled_total 1\n") {
+		t.Fatalf("bad: %s", out)
+	}
+	if _, ok := h.failures[script]; ok {
+		t.Fatalf("should be enabled")
+	}
+}
+
+func TestScriptEventHandler_maintenance(t *testing.T) {
+	script, results := testEventScript(t, eventScript)
+
+	maintenance := true
+	h := &ScriptEventHandler{
+		Self: serf.Member{
+			Name: "ourname",
+			Role: "ourrole",
+		},
+		Scripts: []EventScript{
+			{
+				EventFilter: EventFilter{
+					Event: "*",
+				},
+				Script: script,
+			},
+		},
+		Maintenance: func() bool { return maintenance },
+	}
+
+	// User events are skipped in maintenance mode, member events are not
+	h.HandleEvent(serf.UserEvent{Name: "deploy"})
+	h.HandleEvent(serf.MemberEvent{
+		Type: serf.EventMemberJoin,
+		Members: []serf.Member{
+			{
+				Name: "foo",
+				Addr: net.ParseIP("1.2.3.4"),
+				Role: "bar",
+			},
+		},
+	})
+
+	result, err := ioutil.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "ourname ourrole\nmember-join\nfoo\t1.2.3.4\tbar\n"
+	if string(result) != expected {
+		t.Fatalf("bad: %#v. Expected: %#v", string(result), expected)
+	}
+}
+
+func TestScriptEventHandler_target(t *testing.T) {
+	script, results := testEventScript(t, eventScript)
+
+	h := &ScriptEventHandler{
+		Self: serf.Member{
+			Name: "ourname",
+			Role: "ourrole",
+		},
+		Scripts: []EventScript{
+			{
+				EventFilter: EventFilter{
+					Event: "user",
+				},
+				Script: script,
+			},
+		},
+	}
+
+	// Only the events for all members and for ourname invoke the script
+	h.HandleEvent(serf.UserEvent{Name: "restart", Target: "other"})
+	h.HandleEvent(serf.UserEvent{Name: "restart", Target: "ourname"})
+	h.HandleEvent(serf.UserEvent{Name: "deploy"})
+
+	result, err := ioutil.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "ourname ourrole\nuser restart\nourname ourrole\nuser deploy\n"
+	if string(result) != expected {
+		t.Fatalf("bad: %#v. Expected: %#v", string(result), expected)
+	}
+}
+
+func TestScriptEventHandler_jsonFormat(t *testing.T) {
+	script, results := testEventScript(t, stdinEventScript)
+
+	h := &ScriptEventHandler{
+		Self: serf.Member{
+			Name: "ourname",
+			Role: "ourrole",
+		},
+		Scripts: []EventScript{
+			{
+				EventFilter: EventFilter{
+					Event: "*",
+				},
+				Script: script,
+			},
+		},
+		Format: "json",
+	}
+
+	h.HandleEvent(serf.MemberEvent{
+		Type: serf.EventMemberJoin,
+		Members: []serf.Member{
+			{
+				Name:   "foo",
+				Addr:   net.ParseIP("1.2.3.4"),
+				Port:   7946,
+				Role:   "bar",
+				Tags:   map[string]string{"dc": "east"},
+				Status: serf.StatusAlive,
+			},
+		},
+	})
+	h.HandleEvent(serf.UserEvent{
+		LTime:   3,
+		Name:    "deploy",
+		Payload: []byte("v1"),
+	})
+
+	result, err := ioutil.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := `{"Event":"member-join","ID":"member-join-c1365106","Self":{"Name":"ourname","Role":"ourrole"},` +
+		`"Members":[{"Name":"foo","Addr":"1.2.3.4","Port":7946,"Role":"bar","Tags":{"dc":"east"},"Status":"alive"}]}` + "\n" +
+		`{"Event":"user","ID":"user-3-c93da413","Self":{"Name":"ourname","Role":"ourrole"},"Name":"deploy","LTime":3,"Payload":"v1"}` + "\n"
+	if string(result) != expected {
+		t.Fatalf("bad: %s. Expected: %s", result, expected)
+	}
+}
+
+func TestScriptCommand(t *testing.T) {
+	cmd, err := scriptCommand("sh", "echo hi")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := []string{"serf-event", "-c", "echo hi"}
+	if cmd.Path != "/bin/sh" || !reflect.DeepEqual(cmd.Args, expected) {
+		t.Fatalf("bad: %s %#v", cmd.Path, cmd.Args)
+	}
+
+	cmd, err = scriptCommand("powershell", "Write-Output $input")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if last := cmd.Args[len(cmd.Args)-1]; !strings.HasSuffix(last, "; Write-Output $input") {
+		t.Fatalf("bad: %#v", cmd.Args)
+	}
+
+	if _, err := scriptCommand("csh", "echo hi"); err == nil {
+		t.Fatalf("should err")
+	}
+}
+
+func TestScriptEventHandler_roleTag(t *testing.T) {
+	script, results := testEventScript(t, eventScript)
+
+	h := &ScriptEventHandler{
+		Self: serf.Member{
+			Name: "ourname",
+			Role: "ourrole",
+			Tags: map[string]string{"service": "ourservice"},
+		},
+		Scripts: []EventScript{
+			{
+				EventFilter: EventFilter{
+					Event: "*",
+				},
+				Script: script,
+			},
+		},
+		RoleTag: "service",
+	}
+
+	event := serf.MemberEvent{
+		Type: serf.EventMemberJoin,
+		Members: []serf.Member{
+			{
+				Name: "foo",
+				Addr: net.ParseIP("1.2.3.4"),
+				Role: "bar",
+				Tags: map[string]string{"service": "web"},
+			},
+		},
+	}
+
+	h.HandleEvent(event)
+
+	result, err := ioutil.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "ourname ourservice\nmember-join\nfoo\t1.2.3.4\tweb\tservice=web\n"
+	if string(result) != expected {
+		t.Fatalf("bad: %#v. Expected: %#v", string(result), expected)
+	}
+
+	// The event itself is unchanged
+	if event.Members[0].Role != "bar" {
+		t.Fatalf("bad: %#v", event)
+	}
+}
+
+func TestScriptUserEventHandler(t *testing.T) {
+	script, results := testEventScript(t, userEventScript)
+
+	h := &ScriptEventHandler{
+		Self: serf.Member{
+			Name: "ourname",
+			Role: "ourrole",
+		},
+		Scripts: []EventScript{
+			{
+				EventFilter: EventFilter{
+					Event: "*",
+				},
+				Script: script,
+			},
+		},
+	}
+
+	userEvent := serf.UserEvent{
+		LTime:    1,
+		Name:     "baz",
+		Payload:  []byte("foobar"),
+		Coalesce: true,
+	}
+
+	h.HandleEvent(userEvent)
+
+	result, err := ioutil.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "ourname ourrole\nuser baz\nuser 1\n"
+	if string(result) != expected {
+		t.Fatalf("bad: %#v. Expected: %#v", string(result), expected)
+	}
+}
+
+const tagsEventScript = `#!/bin/sh
+RESULT_FILE="%s"
+printf "%%s\n" "$SERF_MEMBER_TAGS" >>${RESULT_FILE}
+cat >>${RESULT_FILE}
+`
+
+const prevTagsEventScript = `#!/bin/sh
+RESULT_FILE="%s"
+printf "%%s %%s\n" "$SERF_MEMBER_PREV_TAGS" "$SERF_MEMBER_TAGS" >>${RESULT_FILE}
+`
+
+func TestScriptEventHandler_memberUpdate(t *testing.T) {
+	script, results := testEventScript(t, prevTagsEventScript)
+
+	h := &ScriptEventHandler{
+		Self: serf.Member{
+			Name: "ourname",
+			Tags: map[string]string{"dc": "east"},
+		},
+		Scripts: []EventScript{
+			{
+				EventFilter: EventFilter{
+					Event: "member-update",
+					Tag:   "dc=west",
+				},
+				Script: script,
+			},
+		},
+	}
+
+	self := serf.Member{
+		Name: "ourname",
+		Tags: map[string]string{"dc": "west"},
+	}
+	h.HandleEvent(serf.MemberEvent{
+		Type:     serf.EventMemberUpdate,
+		Members:  []serf.Member{self},
+		PrevTags: map[string]map[string]string{"ourname": {"dc": "east"}},
+	})
+
+	result, err := ioutil.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
 
-	if err := scriptFile.Chmod(0755); err != nil {
-		t.Fatalf("err: %s", err)
+	expected := "dc=east dc=west\n"
+	if string(result) != expected {
+		t.Fatalf("bad: %#v. Expected: %#v", string(result), expected)
 	}
 
-	resultFile, err := ioutil.TempFile("", "serf-result")
+	// The local node is kept current for the scripts
+	if h.Self.Tags["dc"] != "west" {
+		t.Fatalf("bad: %#v", h.Self)
+	}
+}
+
+func TestScriptEventHandler_memberTags(t *testing.T) {
+	script, results := testEventScript(t, tagsEventScript)
+
+	h := &ScriptEventHandler{
+		Self: serf.Member{
+			Name: "ourname",
+			Role: "ourrole",
+		},
+		Scripts: []EventScript{
+			{
+				EventFilter: EventFilter{
+					Event: "*",
+				},
+				Script: script,
+			},
+		},
+	}
+
+	foo := serf.Member{
+		Name: "foo",
+		Addr: net.ParseIP("1.2.3.4"),
+		Role: "web",
+		Tags: map[string]string{"role": "web", "dc": "east", "note": "a\tb"},
+	}
+	bar := serf.Member{
+		Name: "bar",
+		Addr: net.ParseIP("1.2.3.5"),
+		Role: "db",
+	}
+
+	h.HandleEvent(serf.MemberEvent{Type: serf.EventMemberJoin, Members: []serf.Member{foo}})
+	h.HandleEvent(serf.MemberEvent{Type: serf.EventMemberJoin, Members: []serf.Member{foo, bar}})
+
+	result, err := ioutil.ReadFile(results)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	defer resultFile.Close()
 
-	_, err = scriptFile.Write([]byte(
-		fmt.Sprintf(script, resultFile.Name())))
+	tags := "dc=east,note=a\\tb,role=web"
+	expected := tags + "\nfoo\t1.2.3.4\tweb\t" + tags + "\n" +
+		"\nfoo\t1.2.3.4\tweb\t" + tags + "\nbar\t1.2.3.5\tdb\t\n"
+	if string(result) != expected {
+		t.Fatalf("bad: %#v. Expected: %#v", string(result), expected)
+	}
+}
+
+const versionEventScript = `#!/bin/sh
+RESULT_FILE="%s"
+echo $SERF_USER_EVENT $SERF_USER_VERSION >>${RESULT_FILE}
+`
+
+func TestScriptEventHandler_userVersion(t *testing.T) {
+	script, results := testEventScript(t, versionEventScript)
+
+	h := &ScriptEventHandler{
+		Self: serf.Member{
+			Name: "ourname",
+			Role: "ourrole",
+		},
+		Scripts: []EventScript{
+			{
+				EventFilter: EventFilter{
+					Event: "*",
+				},
+				Script: script,
+			},
+		},
+	}
+
+	h.HandleEvent(serf.UserEvent{Name: "old"})
+	h.HandleEvent(serf.UserEvent{Name: "new", Version: 2})
+
+	result, err := ioutil.ReadFile(results)
 	if err != nil {
-		t.Fatalf("err: %s")
+		t.Fatalf("err: %s", err)
 	}
 
-	return scriptFile.Name(), resultFile.Name()
+	expected := "old 0\nnew 2\n"
+	if string(result) != expected {
+		t.Fatalf("bad: %#v. Expected: %#v", string(result), expected)
+	}
 }
 
-func TestScriptEventHandler(t *testing.T) {
-	script, results := testEventScript(t, eventScript)
+const niceEventScript = `#!/bin/sh
+RESULT_FILE="%s"
+nice >>${RESULT_FILE}
+`
+
+func TestScriptEventHandler_nice(t *testing.T) {
+	script, results := testEventScript(t, niceEventScript)
 
 	h := &ScriptEventHandler{
 		Self: serf.Member{
@@ -72,34 +671,76 @@ func TestScriptEventHandler(t *testing.T) {
 				Script: script,
 			},
 		},
+		Nice: 7,
 	}
 
-	event := serf.MemberEvent{
-		Type: serf.EventMemberJoin,
-		Members: []serf.Member{
+	h.HandleEvent(serf.UserEvent{Name: "baz"})
+
+	result, err := ioutil.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The tests may already run at a higher level
+	if n, err := strconv.Atoi(strings.TrimSpace(string(result))); err != nil || n < 7 {
+		t.Fatalf("bad: %#v", string(result))
+	}
+}
+
+const envEventScript = `#!/bin/sh
+RESULT_FILE="%s"
+echo "$SERF_TEST_ALLOWED:$SERF_TEST_SECRET" >>${RESULT_FILE}
+`
+
+func TestScriptEventHandler_env(t *testing.T) {
+	script, results := testEventScript(t, envEventScript)
+
+	os.Setenv("SERF_TEST_ALLOWED", "yes")
+	os.Setenv("SERF_TEST_SECRET", "hunter2")
+	defer os.Unsetenv("SERF_TEST_ALLOWED")
+	defer os.Unsetenv("SERF_TEST_SECRET")
+
+	h := &ScriptEventHandler{
+		Self: serf.Member{
+			Name: "ourname",
+			Role: "ourrole",
+		},
+		Scripts: []EventScript{
 			{
-				Name: "foo",
-				Addr: net.ParseIP("1.2.3.4"),
-				Role: "bar",
+				EventFilter: EventFilter{
+					Event: "*",
+				},
+				Script: script,
 			},
 		},
+		Env: []string{"PATH", "SERF_TEST_ALLOWED"},
 	}
 
-	h.HandleEvent(event)
+	h.HandleEvent(serf.UserEvent{Name: "baz"})
 
 	result, err := ioutil.ReadFile(results)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
 
-	expected := "ourname ourrole\nmember-join\nfoo\t1.2.3.4\tbar\n"
+	expected := "yes:\n"
 	if string(result) != expected {
 		t.Fatalf("bad: %#v. Expected: %#v", string(result), expected)
 	}
 }
 
-func TestScriptUserEventHandler(t *testing.T) {
-	script, results := testEventScript(t, userEventScript)
+const defaultEnvEventScript = `#!/bin/sh
+RESULT_FILE="%s"
+echo "$SERF_TEST_ALLOWED:$TEST_AGENT_SECRET" >>${RESULT_FILE}
+`
+
+func TestScriptEventHandler_envDefault(t *testing.T) {
+	script, results := testEventScript(t, defaultEnvEventScript)
+
+	os.Setenv("SERF_TEST_ALLOWED", "yes")
+	os.Setenv("TEST_AGENT_SECRET", "hunter2")
+	defer os.Unsetenv("SERF_TEST_ALLOWED")
+	defer os.Unsetenv("TEST_AGENT_SECRET")
 
 	h := &ScriptEventHandler{
 		Self: serf.Member{
@@ -114,23 +755,199 @@ func TestScriptUserEventHandler(t *testing.T) {
 				Script: script,
 			},
 		},
+		Env: (&Config{}).EventEnv(),
 	}
 
-	userEvent := serf.UserEvent{
-		LTime:    1,
-		Name:     "baz",
-		Payload:  []byte("foobar"),
-		Coalesce: true,
+	h.HandleEvent(serf.UserEvent{Name: "baz"})
+
+	result, err := ioutil.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
 
-	h.HandleEvent(userEvent)
+	// Variables outside of the default allow-list are not passed
+	expected := "yes:\n"
+	if string(result) != expected {
+		t.Fatalf("bad: %#v. Expected: %#v", string(result), expected)
+	}
+}
+
+func TestFilterEnv(t *testing.T) {
+	environ := []string{
+		"PATH=/bin",
+		"PATHEXT=.exe",
+		"AWS_SECRET_ACCESS_KEY=secret",
+		"SERF_FOO=bar",
+		"SERF_BAR=",
+	}
+
+	result := FilterEnv(environ, []string{"PATH", "SERF_*"})
+	expected := []string{"PATH=/bin", "SERF_FOO=bar", "SERF_BAR="}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	result = FilterEnv(environ, nil)
+	if len(result) != 0 {
+		t.Fatalf("bad: %#v", result)
+	}
+}
+
+func TestFilterEnv_foldCase(t *testing.T) {
+	environ := []string{
+		"Path=C:\\Windows",
+		"SYSTEMROOT=C:\\Windows",
+		"ComSpec=cmd.exe",
+		"Secret=hunter2",
+	}
+
+	allowed := defaultEventHandlerEnv("windows")
+	result := filterEnv(environ, allowed, true)
+	expected := []string{"Path=C:\\Windows", "SYSTEMROOT=C:\\Windows", "ComSpec=cmd.exe"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	result = filterEnv(environ, allowed, false)
+	if len(result) != 0 {
+		t.Fatalf("bad: %#v", result)
+	}
+}
+
+func TestEventFilterFilterTags(t *testing.T) {
+	self := serf.Member{
+		Name: "self",
+		Role: "web",
+		Tags: map[string]string{"dc": "east"},
+	}
+	event := serf.MemberEvent{
+		Type: serf.EventMemberFailed,
+		Members: []serf.Member{
+			{Name: "a", Tags: map[string]string{"dc": "east"}},
+			{Name: "b", Tags: map[string]string{"dc": "west"}},
+		},
+	}
+
+	f := ParseEventFilter("member-failed@dc=west")[0]
+	result, ok := f.FilterTags(event, self)
+	if !ok {
+		t.Fatalf("should match")
+	}
+	members := result.(serf.MemberEvent).Members
+	if len(members) != 1 || members[0].Name != "b" {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	f = ParseEventFilter("member-failed@dc=north")[0]
+	if _, ok := f.FilterTags(event, self); ok {
+		t.Fatalf("should not match")
+	}
+
+	f = ParseEventFilter("member-failed")[0]
+	if result, ok := f.FilterTags(event, self); !ok || len(result.(serf.MemberEvent).Members) != 2 {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	reconcile := ReconcileEvent{Members: event.Members}
+	f = ParseEventFilter("member-reconcile@dc=east")[0]
+	result, ok = f.FilterTags(reconcile, self)
+	if !ok {
+		t.Fatalf("should match")
+	}
+	members = result.(ReconcileEvent).Members
+	if len(members) != 1 || members[0].Name != "a" {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	user := serf.UserEvent{Name: "restart"}
+	f = ParseEventFilter("user:restart@role=web")[0]
+	if _, ok := f.FilterTags(user, self); !ok {
+		t.Fatalf("should match")
+	}
+
+	f = ParseEventFilter("user:restart@role=db")[0]
+	if _, ok := f.FilterTags(user, self); ok {
+		t.Fatalf("should not match")
+	}
+}
+
+func TestScriptUserEventHandler_batch(t *testing.T) {
+	script, results := testEventScript(t, batchEventScript)
+
+	h := &ScriptEventHandler{
+		Scripts: []EventScript{
+			{
+				EventFilter: EventFilter{
+					Event: "user",
+					Batch: "100ms",
+				},
+				Script: script,
+			},
+		},
+	}
 
+	h.HandleEvent(serf.UserEvent{LTime: 1, Name: "metrics", Payload: []byte("a=1")})
+	h.HandleEvent(serf.UserEvent{LTime: 3, Name: "metrics", Payload: []byte("a=2")})
+
+	// Nothing is invoked until the window has passed
 	result, err := ioutil.ReadFile(results)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
+	if len(result) != 0 {
+		t.Fatalf("bad: %#v", string(result))
+	}
 
-	expected := "ourname ourrole\nuser baz\nuser 1\n"
+	time.Sleep(500 * time.Millisecond)
+
+	result, err = ioutil.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "metrics 3\na=1\na=2\n"
+	if string(result) != expected {
+		t.Fatalf("bad: %#v. Expected: %#v", string(result), expected)
+	}
+}
+
+func TestScriptUserEventHandler_batchStop(t *testing.T) {
+	script, results := testEventScript(t, batchEventScript)
+
+	h := &ScriptEventHandler{
+		Scripts: []EventScript{
+			{
+				EventFilter: EventFilter{
+					Event: "user",
+					Batch: "100ms",
+				},
+				Script: script,
+			},
+		},
+	}
+
+	h.HandleEvent(serf.UserEvent{LTime: 1, Name: "metrics", Payload: []byte("a=1")})
+
+	// Stopping invokes the pending batch right away
+	h.Stop()
+
+	expected := "metrics 1\na=1\n"
+	result, err := ioutil.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(result) != expected {
+		t.Fatalf("bad: %#v. Expected: %#v", string(result), expected)
+	}
+
+	// No batch is started afterwards
+	h.HandleEvent(serf.UserEvent{LTime: 2, Name: "metrics", Payload: []byte("a=2")})
+	time.Sleep(500 * time.Millisecond)
+
+	result, err = ioutil.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
 	if string(result) != expected {
 		t.Fatalf("bad: %#v. Expected: %#v", string(result), expected)
 	}
@@ -143,35 +960,45 @@ func TestEventScriptInvoke(t *testing.T) {
 		invoke bool
 	}{
 		{
-			EventScript{EventFilter{"*", ""}, "script.sh"},
+			EventScript{EventFilter{"*", "", "", ""}, "script.sh"},
 			serf.MemberEvent{},
 			true,
 		},
 		{
-			EventScript{EventFilter{"user", ""}, "script.sh"},
+			EventScript{EventFilter{"user", "", "", ""}, "script.sh"},
 			serf.MemberEvent{},
 			false,
 		},
 		{
-			EventScript{EventFilter{"user", "deploy"}, "script.sh"},
+			EventScript{EventFilter{"user", "deploy", "", ""}, "script.sh"},
 			serf.UserEvent{Name: "deploy"},
 			true,
 		},
 		{
-			EventScript{EventFilter{"user", "deploy"}, "script.sh"},
+			EventScript{EventFilter{"user", "deploy", "", ""}, "script.sh"},
 			serf.UserEvent{Name: "restart"},
 			false,
 		},
 		{
-			EventScript{EventFilter{"member-join", ""}, "script.sh"},
+			EventScript{EventFilter{"member-join", "", "", ""}, "script.sh"},
 			serf.MemberEvent{Type: serf.EventMemberJoin},
 			true,
 		},
 		{
-			EventScript{EventFilter{"member-join", ""}, "script.sh"},
+			EventScript{EventFilter{"member-join", "", "", ""}, "script.sh"},
 			serf.MemberEvent{Type: serf.EventMemberLeave},
 			false,
 		},
+		{
+			EventScript{EventFilter{"member-reconcile", "", "", ""}, "script.sh"},
+			ReconcileEvent{},
+			true,
+		},
+		{
+			EventScript{EventFilter{"member-join", "", "", ""}, "script.sh"},
+			ReconcileEvent{},
+			false,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -190,14 +1017,24 @@ func TestEventScriptValid(t *testing.T) {
 		{"member-join", true},
 		{"member-leave", true},
 		{"member-failed", true},
+		{"member-update", true},
+		{"member-reconcile", true},
 		{"user", true},
 		{"User", false},
 		{"member", false},
+		{"member-join@dc=east", true},
+		{"member-join@dc", false},
+		{"user:deploy@=east", false},
+		{"user:metrics~10s", true},
+		{"user~1m@dc=east", true},
+		{"user:metrics~soon", false},
+		{"user:metrics~0s", false},
+		{"member-join~10s", false},
 		{"*", true},
 	}
 
 	for _, tc := range testCases {
-		script := EventScript{EventFilter: EventFilter{Event: tc.Event}}
+		script := EventScript{EventFilter: ParseEventFilter(tc.Event)[0]}
 		if script.Valid() != tc.Valid {
 			t.Errorf("bad: %#v", tc)
 		}
@@ -213,39 +1050,60 @@ func TestParseEventScript(t *testing.T) {
 		{
 			"script.sh",
 			false,
-			[]EventScript{{EventFilter{"*", ""}, "script.sh"}},
+			[]EventScript{{EventFilter{"*", "", "", ""}, "script.sh"}},
 		},
 
 		{
 			"member-join=script.sh",
 			false,
-			[]EventScript{{EventFilter{"member-join", ""}, "script.sh"}},
+			[]EventScript{{EventFilter{"member-join", "", "", ""}, "script.sh"}},
 		},
 
 		{
 			"foo,bar=script.sh",
 			false,
 			[]EventScript{
-				{EventFilter{"foo", ""}, "script.sh"},
-				{EventFilter{"bar", ""}, "script.sh"},
+				{EventFilter{"foo", "", "", ""}, "script.sh"},
+				{EventFilter{"bar", "", "", ""}, "script.sh"},
 			},
 		},
 
 		{
 			"user:deploy=script.sh",
 			false,
-			[]EventScript{{EventFilter{"user", "deploy"}, "script.sh"}},
+			[]EventScript{{EventFilter{"user", "deploy", "", ""}, "script.sh"}},
 		},
 
 		{
 			"foo,user:blah,bar=script.sh",
 			false,
 			[]EventScript{
-				{EventFilter{"foo", ""}, "script.sh"},
-				{EventFilter{"user", "blah"}, "script.sh"},
-				{EventFilter{"bar", ""}, "script.sh"},
+				{EventFilter{"foo", "", "", ""}, "script.sh"},
+				{EventFilter{"user", "blah", "", ""}, "script.sh"},
+				{EventFilter{"bar", "", "", ""}, "script.sh"},
 			},
 		},
+
+		{
+			"user:restart@role=web=script.sh",
+			false,
+			[]EventScript{{EventFilter{"user", "restart", "role=web", ""}, "script.sh"}},
+		},
+
+		{
+			"member-failed@dc=us-east,member-join=script.sh --opt=1",
+			false,
+			[]EventScript{
+				{EventFilter{"member-failed", "", "dc=us-east", ""}, "script.sh --opt=1"},
+				{EventFilter{"member-join", "", "", ""}, "script.sh --opt=1"},
+			},
+		},
+
+		{
+			"user:metrics~10s@role=web=script.sh",
+			false,
+			[]EventScript{{EventFilter{"user", "metrics", "role=web", "10s"}, "script.sh"}},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -271,6 +1129,10 @@ func TestParseEventScript(t *testing.T) {
 				t.Errorf("User events not equal: %s %s", r.UserEvent, expected.UserEvent)
 			}
 
+			if r.Tag != expected.Tag {
+				t.Errorf("Tags not equal: %s %s", r.Tag, expected.Tag)
+			}
+
 			if r.Script != expected.Script {
 				t.Errorf("Scripts not equal: %s %s", r.Script, expected.Script)
 			}
@@ -285,33 +1147,33 @@ func TestParseEventFilter(t *testing.T) {
 	}{
 		{
 			"",
-			[]EventFilter{EventFilter{"*", ""}},
+			[]EventFilter{EventFilter{"*", "", "", ""}},
 		},
 
 		{
 			"member-join",
-			[]EventFilter{EventFilter{"member-join", ""}},
+			[]EventFilter{EventFilter{"member-join", "", "", ""}},
 		},
 
 		{
 			"foo,bar",
 			[]EventFilter{
-				EventFilter{"foo", ""},
-				EventFilter{"bar", ""},
+				EventFilter{"foo", "", "", ""},
+				EventFilter{"bar", "", "", ""},
 			},
 		},
 
 		{
 			"user:deploy",
-			[]EventFilter{EventFilter{"user", "deploy"}},
+			[]EventFilter{EventFilter{"user", "deploy", "", ""}},
 		},
 
 		{
 			"foo,user:blah,bar",
 			[]EventFilter{
-				EventFilter{"foo", ""},
-				EventFilter{"user", "blah"},
-				EventFilter{"bar", ""},
+				EventFilter{"foo", "", "", ""},
+				EventFilter{"user", "blah", "", ""},
+				EventFilter{"bar", "", "", ""},
 			},
 		},
 	}
@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/hashicorp/serf/serf"
+	"hash/crc32"
+	"sort"
+)
+
+// EventID returns the correlation ID of an event, which is the same on
+// every node that receives the event, so that the handlers invoked for
+// it across the cluster can be matched up in centralized logging.
+//
+// A user event is identified by its Lamport time, with a checksum of its
+// name, payload and origin so that different events sent at the same
+// time don't share an ID. Events from older members have no origin, and
+// their checksum covers only the name and payload. A member or reconcile
+// event is identified by its type and a checksum of its members. Member
+// events are coalesced on each node, so nodes that batched the changes
+// differently see different IDs, and a member that joins again later
+// reuses the ID of its earlier join.
+func EventID(e serf.Event) string {
+	hash := crc32.NewIEEE()
+
+	switch e := e.(type) {
+	case serf.UserEvent:
+		hash.Write([]byte(e.Name))
+		hash.Write([]byte{0})
+		hash.Write(e.Payload)
+		if e.Origin != "" {
+			hash.Write([]byte{0})
+			hash.Write([]byte(e.Origin))
+		}
+		return fmt.Sprintf("user-%d-%08x", e.LTime, hash.Sum32())
+
+	case serf.MemberEvent, ReconcileEvent:
+		list, _ := eventMembers(e)
+		members := make([]string, len(list))
+		for i, m := range list {
+			members[i] = fmt.Sprintf("%s@%s:%d", m.Name, m.Addr, m.Port)
+		}
+		sort.Strings(members)
+		for _, m := range members {
+			hash.Write([]byte(m))
+			hash.Write([]byte{0})
+		}
+		return fmt.Sprintf("%s-%08x", EventName(e), hash.Sum32())
+
+	default:
+		return ""
+	}
+}
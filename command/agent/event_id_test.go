@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"github.com/hashicorp/serf/serf"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestEventID_user(t *testing.T) {
+	e := serf.UserEvent{LTime: 42, Name: "deploy", Payload: []byte("v1")}
+
+	id := EventID(e)
+	if !strings.HasPrefix(id, "user-42-") {
+		t.Fatalf("bad: %s", id)
+	}
+	if EventID(e) != id {
+		t.Fatalf("not stable: %s", EventID(e))
+	}
+
+	other := e
+	other.Payload = []byte("v2")
+	if EventID(other) == id {
+		t.Fatalf("same id for a different payload: %s", id)
+	}
+
+	// The name and payload may not be shifted into each other
+	shifted := serf.UserEvent{LTime: 42, Name: "deployv", Payload: []byte("1")}
+	if EventID(shifted) == id {
+		t.Fatalf("same id for a different name: %s", id)
+	}
+
+	// Events sent at the same time by different members differ
+	a := e
+	a.Origin = "foo"
+	b := e
+	b.Origin = "bar"
+	if EventID(a) == id || EventID(a) == EventID(b) {
+		t.Fatalf("same id for a different origin: %s %s", EventID(a), EventID(b))
+	}
+	if !strings.HasPrefix(EventID(a), "user-42-") {
+		t.Fatalf("bad: %s", EventID(a))
+	}
+}
+
+func TestEventID_member(t *testing.T) {
+	a := serf.Member{Name: "foo", Addr: net.IPv4(127, 0, 0, 1), Port: 7946}
+	b := serf.Member{Name: "bar", Addr: net.IPv4(127, 0, 0, 2), Port: 7946}
+
+	e1 := serf.MemberEvent{Type: serf.EventMemberJoin, Members: []serf.Member{a, b}}
+	e2 := serf.MemberEvent{Type: serf.EventMemberJoin, Members: []serf.Member{b, a}}
+
+	id := EventID(e1)
+	if !strings.HasPrefix(id, "member-join-") {
+		t.Fatalf("bad: %s", id)
+	}
+	if EventID(e2) != id {
+		t.Fatalf("depends on the order of members: %s %s", id, EventID(e2))
+	}
+
+	e2.Type = serf.EventMemberFailed
+	if EventID(e2) == id || !strings.HasPrefix(EventID(e2), "member-failed-") {
+		t.Fatalf("bad: %s", EventID(e2))
+	}
+
+	e3 := serf.MemberEvent{Type: serf.EventMemberJoin, Members: []serf.Member{a}}
+	if EventID(e3) == id {
+		t.Fatalf("same id for different members: %s", id)
+	}
+
+	e4 := ReconcileEvent{Members: []serf.Member{b, a}}
+	if !strings.HasPrefix(EventID(e4), "member-reconcile-") {
+		t.Fatalf("bad: %s", EventID(e4))
+	}
+	if strings.TrimPrefix(EventID(e4), "member-reconcile-") != strings.TrimPrefix(id, "member-join-") {
+		t.Fatalf("bad: %s %s", EventID(e4), id)
+	}
+}
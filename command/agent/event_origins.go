@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/hashicorp/serf/serf"
+	"strings"
+)
+
+// EventOrigins restricts which members may send the user events that
+// reach the event handlers and RPC streams of an agent. It maps a user
+// event name, or "*" for every user event without an entry of its own,
+// to the allowed origins. An origin is either a node name, or a
+// "key=value" tag expression that the sending member must match. User
+// events that have no entry are not restricted.
+//
+// The origin of an event is set by the sender, so it can only be trusted
+// as far as the members that can gossip, such as those with the
+// encryption key, are trusted.
+type EventOrigins map[string][]string
+
+// ParseEventOrigins checks the given origins of the configuration and
+// returns them as EventOrigins.
+func ParseEventOrigins(origins map[string][]string) (EventOrigins, error) {
+	for name, allowed := range origins {
+		if name == "" {
+			return nil, fmt.Errorf("Invalid user event origins: missing event name")
+		}
+		if len(allowed) == 0 {
+			return nil, fmt.Errorf("Invalid user event origins for %s: no origins", name)
+		}
+		for _, origin := range allowed {
+			if origin == "" || strings.HasPrefix(origin, "=") || strings.HasSuffix(origin, "=") {
+				return nil, fmt.Errorf("Invalid user event origin for %s: %#v", name, origin)
+			}
+		}
+	}
+	return EventOrigins(origins), nil
+}
+
+// Allow tests whether a user event may be delivered. The origin member
+// is looked up in members to match tag expressions, so an event from a
+// member that isn't known only matches by node name.
+func (o EventOrigins) Allow(e serf.UserEvent, members []serf.Member) bool {
+	allowed, ok := o[e.Name]
+	if !ok {
+		allowed, ok = o["*"]
+	}
+	if !ok {
+		return true
+	}
+
+	// Events of older members have no origin, so there is nothing to
+	// match against
+	if e.Origin == "" {
+		return false
+	}
+
+	var origin *serf.Member
+	for i := range members {
+		if members[i].Name == e.Origin {
+			origin = &members[i]
+			break
+		}
+	}
+
+	for _, expr := range allowed {
+		parts := strings.SplitN(expr, "=", 2)
+		if len(parts) == 1 {
+			if expr == e.Origin {
+				return true
+			}
+		} else if origin != nil && memberTag(*origin, parts[0]) == parts[1] {
+			return true
+		}
+	}
+	return false
+}
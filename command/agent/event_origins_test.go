@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"github.com/hashicorp/serf/serf"
+	"testing"
+)
+
+func TestParseEventOrigins(t *testing.T) {
+	valid := map[string][]string{
+		"deploy": []string{"ci", "team=ops"},
+		"*":      []string{"role=admin"},
+	}
+	if _, err := ParseEventOrigins(valid); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, bad := range []map[string][]string{
+		{"": []string{"ci"}},
+		{"deploy": []string{}},
+		{"deploy": []string{""}},
+		{"deploy": []string{"=ops"}},
+		{"deploy": []string{"team="}},
+	} {
+		if _, err := ParseEventOrigins(bad); err == nil {
+			t.Fatalf("should err: %#v", bad)
+		}
+	}
+}
+
+func TestEventOrigins_Allow(t *testing.T) {
+	origins := EventOrigins{
+		"deploy": []string{"ci", "team=ops"},
+		"*":      []string{"role=admin"},
+	}
+	members := []serf.Member{
+		serf.Member{Name: "ci"},
+		serf.Member{Name: "ops1", Tags: map[string]string{"team": "ops"}},
+		serf.Member{Name: "web1", Tags: map[string]string{"team": "web"}},
+		serf.Member{Name: "admin1", Role: "admin"},
+	}
+
+	cases := []struct {
+		name   string
+		origin string
+		allow  bool
+	}{
+		{"deploy", "ci", true},
+		{"deploy", "ops1", true},
+		{"deploy", "web1", false},
+		{"deploy", "admin1", false},
+		{"deploy", "unknown", false},
+		{"deploy", "", false},
+		{"restart", "admin1", true},
+		{"restart", "ci", false},
+	}
+	for _, c := range cases {
+		e := serf.UserEvent{Name: c.name, Origin: c.origin}
+		if origins.Allow(e, members) != c.allow {
+			t.Fatalf("bad: %#v", c)
+		}
+	}
+
+	// Events without an entry are not restricted
+	if !(EventOrigins{"deploy": []string{"ci"}}).Allow(serf.UserEvent{Name: "restart"}, nil) {
+		t.Fatalf("should allow")
+	}
+}
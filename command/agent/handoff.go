@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// handoffEnv is set in the environment of an agent process started by a
+// handoff, which inherits the RPC listener as file descriptor handoffFd,
+// and the write end of a pipe as handoffReadyFd. The new process reports
+// on the pipe once it is running, see signalHandoffReady.
+const handoffEnv = "SERF_HANDOFF"
+
+const (
+	handoffFd      = 3
+	handoffReadyFd = 4
+)
+
+// handoffTimeout is how long the old agent process waits for the new one
+// to be running, before it takes over again
+var handoffTimeout = 30 * time.Second
+
+// handedOffListener returns the RPC listener passed by the agent that
+// handed off to this process, along with the pipe to report on once the
+// agent is running, or nil if there was no handoff. The variable is
+// unset once it is used, so it isn't inherited by child processes.
+func handedOffListener() (net.Listener, *os.File, error) {
+	if os.Getenv(handoffEnv) == "" {
+		return nil, nil, nil
+	}
+	os.Unsetenv(handoffEnv)
+
+	// The listener has its own copy of the descriptor
+	f := os.NewFile(handoffFd, handoffEnv)
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return l, os.NewFile(handoffReadyFd, handoffEnv+"_READY"), nil
+}
+
+// signalHandoffReady reports to the old agent process that the agent of
+// this process is running, and closes the pipe
+func signalHandoffReady(ready *os.File) error {
+	defer ready.Close()
+	_, err := ready.Write([]byte{1})
+	return err
+}
+
+// listenerFile returns a copy of the descriptor of the RPC listener, to
+// pass it on in a handoff
+func listenerFile(l net.Listener) (*os.File, error) {
+	fl, ok := l.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("RPC listener %s can't be handed off", l.Addr())
+	}
+	return fl.File()
+}
+
+// startHandoff starts a new agent process from the current executable
+// with the given arguments, which takes over the RPC listener in f. The
+// agent must be shut down without leaving before, so that the new
+// process can bind the gossip ports and open the snapshot. It rejoins
+// the members in the snapshot with the same node name and continues the
+// Lamport clocks saved in it, and refutes the suspicion of the cluster if
+// the old process was already suspected, so that a handoff within the
+// suspicion timeout is never seen as a failure. It returns the read end
+// of the pipe that the new process reports on, see waitHandoffReady.
+func startHandoff(f *os.File, args []string) (*exec.Cmd, *os.File, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer w.Close()
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), handoffEnv+"=1")
+	cmd.ExtraFiles = []*os.File{f, w}
+	if err := cmd.Start(); err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return cmd, r, nil
+}
+
+// waitHandoffReady waits until the new agent process reports on the pipe
+// that it is running. It fails if the process exits first, which closes
+// the pipe, or if it takes longer than the timeout.
+func waitHandoffReady(ready *os.File, timeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := io.ReadFull(ready, buf)
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return fmt.Errorf("new agent process exited before it was running")
+		}
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("new agent process isn't running after %s", timeout)
+	}
+}
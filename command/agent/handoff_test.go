@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandedOffListener_none(t *testing.T) {
+	os.Unsetenv(handoffEnv)
+	if l, ready, err := handedOffListener(); l != nil || ready != nil || err != nil {
+		t.Fatalf("bad: %v %v %v", l, ready, err)
+	}
+}
+
+func TestListenerFile(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	f, err := listenerFile(l)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+
+	// The copy keeps listening after the original is closed
+	l.Close()
+	copied, err := net.FileListener(f)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer copied.Close()
+
+	conn, err := net.Dial("tcp", copied.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	conn.Close()
+}
+
+func TestWaitHandoffReady(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer r.Close()
+
+	if err := signalHandoffReady(w); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := waitHandoffReady(r, time.Second); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestWaitHandoffReady_exited(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer r.Close()
+
+	// The pipe is closed when the new process exits
+	w.Close()
+	err = waitHandoffReady(r, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "exited") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestWaitHandoffReady_timeout(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	err = waitHandoffReady(r, 10*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "isn't running") {
+		t.Fatalf("bad: %v", err)
+	}
+}
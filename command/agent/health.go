@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/serf/serf"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// healthEvent is the name of the user event used to gossip the result
+// of the health checks of members. Like annotation events, these are
+// consumed by the agent and are never delivered to event handlers.
+const healthEvent = internalEventPrefix + "health"
+
+// healthTag is the tag that the agent adds to the members whose health
+// check fails, with the value healthCritical.
+const (
+	healthTag      = "health"
+	healthCritical = "critical"
+)
+
+// healthRebroadcastInterval is how often the health of a critical node
+// is broadcast again, for the members that joined since or missed the
+// event
+var healthRebroadcastInterval = 30 * time.Second
+
+// healthState is the health of a member. The state of a member whose
+// check passes again is kept with Critical unset, so that older events
+// delivered late don't mark it critical again.
+type healthState struct {
+	Critical bool
+	Output   string
+
+	// ltime is the Lamport time of the user event that set the state,
+	// used to ignore events delivered out of order
+	ltime serf.LamportTime
+}
+
+// healthPayload is the payload of a health user event
+type healthPayload struct {
+	Node     string
+	Critical bool
+	Output   string `json:",omitempty"`
+}
+
+// StartHealthCheck periodically runs the health check script with the
+// given shell, see scriptCommand. A check that exits non-zero or runs
+// longer than the timeout marks the local node as critical, which other
+// members see as the "health=critical" tag, until a check passes again.
+// Critical members are left out of views, unless the view selects them
+// by the health tag. It must be called after Start.
+func (a *Agent) StartHealthCheck(script, shell string, interval, timeout time.Duration) {
+	go a.healthCheckLoop(script, shell, interval, timeout)
+}
+
+// healthCheckLoop runs the health check until shutdown, and broadcasts
+// the first result and whenever the result changes. The first result is
+// always broadcast, since the members may still know the node as critical
+// from before it restarted. While the node is critical, the result is
+// also broadcast every healthRebroadcastInterval.
+func (a *Agent) healthCheckLoop(script, shell string, interval, timeout time.Duration) {
+	var critical, known bool
+	var lastBroadcast time.Time
+	for {
+		select {
+		case <-time.After(interval):
+		case <-a.shutdownCh:
+			return
+		}
+
+		output, err := runHealthCheck(shell, script, timeout)
+		if known && (err != nil) == critical {
+			if !critical || time.Since(lastBroadcast) < healthRebroadcastInterval {
+				continue
+			}
+		} else if err != nil {
+			a.logger.Printf("[WARN] agent: Health check failed: %s: %s", err, output)
+		} else {
+			a.logger.Printf("[INFO] agent: Health check passing again")
+		}
+
+		if err := a.setHealth(err != nil, output); err != nil {
+			a.logger.Printf("[ERR] agent: Failed to broadcast the health: %s", err)
+			continue
+		}
+		critical, known = err != nil, true
+		lastBroadcast = time.Now()
+	}
+}
+
+// runHealthCheck runs the health check script and returns its combined
+// stdout and stderr, trimmed. A script that fails or times out is an
+// error.
+func runHealthCheck(shell, script string, timeout time.Duration) (string, error) {
+	cmd, err := scriptCommand(shell, script)
+	if err != nil {
+		return "", err
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	setProcessGroup(cmd)
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	timer := time.AfterFunc(timeout, func() {
+		killScript(cmd)
+	})
+	defer timer.Stop()
+
+	err = cmd.Wait()
+	if err != nil && time.Since(start) >= timeout {
+		err = fmt.Errorf("Health check timed out after %s", timeout)
+	}
+	return strings.TrimSpace(output.String()), err
+}
+
+// setHealth broadcasts the health of the local node
+func (a *Agent) setHealth(critical bool, output string) error {
+	payload, err := healthEventPayload(a.conf.NodeName, critical, output)
+	if err != nil {
+		return err
+	}
+
+	// The events of different nodes share the name, so they must not
+	// be coalesced
+	return a.serf.UserEvent(healthEvent, payload, false)
+}
+
+// healthEventPayload returns the payload of a health event. The output
+// of the check is truncated, and marked with "...", so that the event
+// fits within the size limit of user events.
+func healthEventPayload(node string, critical bool, output string) ([]byte, error) {
+	text := output
+	for {
+		payload, err := json.Marshal(&healthPayload{
+			Node:     node,
+			Critical: critical,
+			Output:   output,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		over := len(healthEvent) + len(payload) - serf.UserEventSizeLimit
+		if over <= 0 || output == "" {
+			return payload, nil
+		}
+
+		// Escaped characters take more room, so this may take a few
+		// rounds
+		n := len(text) - over - len("...")
+		if n <= 0 {
+			text, output = "", ""
+			continue
+		}
+		for n > 0 && !utf8.RuneStart(text[n]) {
+			n--
+		}
+		text = text[:n]
+		output = text + "..."
+	}
+}
+
+// CriticalMembers returns the output of the failing health checks of
+// the members known to this agent, keyed by node name.
+func (a *Agent) CriticalMembers() map[string]string {
+	a.healthLock.Lock()
+	defer a.healthLock.Unlock()
+
+	result := make(map[string]string, len(a.health))
+	for node, state := range a.health {
+		if state.Critical {
+			result[node] = state.Output
+		}
+	}
+	return result
+}
+
+// withHealth returns the members with the health tag added to those
+// whose health check is failing. The tags of the given members are not
+// modified.
+func (a *Agent) withHealth(members []serf.Member) []serf.Member {
+	critical := a.CriticalMembers()
+	if len(critical) == 0 {
+		return members
+	}
+
+	result := make([]serf.Member, len(members))
+	for i, m := range members {
+		if _, ok := critical[m.Name]; ok {
+			tags := make(map[string]string, len(m.Tags)+1)
+			for k, v := range m.Tags {
+				tags[k] = v
+			}
+			tags[healthTag] = healthCritical
+			m.Tags = tags
+		}
+		result[i] = m
+	}
+	return result
+}
+
+// handleHealth stores the state from a health user event. Like with
+// handleAnnotation, a member may only set its own health.
+func (a *Agent) handleHealth(e serf.UserEvent) {
+	var p healthPayload
+	if err := json.Unmarshal(e.Payload, &p); err != nil {
+		a.logger.Printf("[WARN] agent: Invalid health event: %s", err)
+		return
+	}
+	if e.Origin != "" && e.Origin != p.Node {
+		a.logger.Printf("[WARN] agent: Ignoring health event of %s sent by %s", p.Node, e.Origin)
+		return
+	}
+
+	a.healthLock.Lock()
+	defer a.healthLock.Unlock()
+
+	if old, ok := a.health[p.Node]; ok && old.ltime > e.LTime {
+		return
+	}
+
+	a.health[p.Node] = healthState{
+		Critical: p.Critical,
+		Output:   p.Output,
+		ltime:    e.LTime,
+	}
+}
@@ -2,13 +2,16 @@ package agent
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/serf/serf"
 	"io"
 	"log"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strings"
+	"time"
 )
 
 const (
@@ -20,27 +23,50 @@ const (
 // are a bit different. For all events, the SERF_EVENT environmental
 // variable is the type of the event. For user events, the SERF_USER_EVENT
 // environmental variable is also set, containing the name of the user
-// event that was fired.
+// event that was fired, and SERF_USER_VERSION the schema version of its
+// payload. SERF_EVENT_ID is the correlation ID of the event, see
+// EventID. For member events with a single member, the
+// SERF_MEMBER_TAGS environmental variable is the tags of that member,
+// formatted as by eventTags.
+//
+// The script is run by the given shell, see scriptCommand. The only
+// environmental variables of the agent that the script inherits
+// are those given in env, which should already be filtered with FilterEnv.
+// If nice is positive, it is added to the nice level of the script, see
+// setNice.
 //
 // In all events, data is passed in via stdin to faciliate piping. See
-// the various stdin functions below for more information.
-func invokeEventScript(logger *log.Logger, script string, self serf.Member, event serf.Event) error {
+// the various stdin functions below for more information. If the format
+// is "json", the data is a single JSON document instead, as written by
+// jsonEventStdin.
+func invokeEventScript(logger *log.Logger, script string, shell string, format string,
+	nice int, env []string, self serf.Member, event serf.Event) error {
+	output, err := runEventScript(logger, script, shell, format, nice, env, self, event, 0)
+	logger.Printf("[DEBUG] Event '%s' (id %s) script output: %s",
+		EventName(event), EventID(event), output)
+	return err
+}
+
+// RunEventScript runs an event script exactly as invokeEventScript does,
+// and returns the combined stdout and stderr of the script. If timeout
+// is positive, the script is killed once it has run for that long.
+func RunEventScript(logger *log.Logger, script string, shell string, format string,
+	env []string, self serf.Member, event serf.Event, timeout time.Duration) ([]byte, error) {
+	return runEventScript(logger, script, shell, format, 0, env, self, event, timeout)
+}
+
+func runEventScript(logger *log.Logger, script string, shell string, format string,
+	nice int, env []string, self serf.Member, event serf.Event, timeout time.Duration) ([]byte, error) {
 	var output bytes.Buffer
 
-	// Determine the shell invocation based on OS
-	var shell, flag string
-	if runtime.GOOS == windows {
-		shell = "cmd"
-		flag = "/C"
-	} else {
-		shell = "/bin/sh"
-		flag = "-c"
+	cmd, err := scriptCommand(shell, script)
+	if err != nil {
+		return nil, err
 	}
-
-	cmd := exec.Command(shell, flag, script)
-	cmd.Args[0] = "serf-event"
+	cmd.Env = append(cmd.Env, env...)
 	cmd.Env = append(cmd.Env,
-		"SERF_EVENT="+event.EventType().String(),
+		"SERF_EVENT="+EventName(event),
+		"SERF_EVENT_ID="+EventID(event),
 		"SERF_SELF_NAME="+self.Name,
 		"SERF_SELF_ROLE="+self.Role,
 	)
@@ -49,33 +75,140 @@ func invokeEventScript(logger *log.Logger, script string, self serf.Member, even
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	switch e := event.(type) {
 	case serf.MemberEvent:
-		go memberEventStdin(logger, stdin, &e)
+		if len(e.Members) == 1 {
+			cmd.Env = append(cmd.Env, "SERF_MEMBER_TAGS="+eventTags(e.Members[0].Tags))
+			if e.Type == serf.EventMemberUpdate {
+				prev := e.PrevTags[e.Members[0].Name]
+				cmd.Env = append(cmd.Env, "SERF_MEMBER_PREV_TAGS="+eventTags(prev))
+			}
+		}
+		if format != "json" {
+			go memberEventStdin(logger, stdin, e.Members)
+		}
+	case ReconcileEvent:
+		if len(e.Members) == 1 {
+			cmd.Env = append(cmd.Env, "SERF_MEMBER_TAGS="+eventTags(e.Members[0].Tags))
+		}
+		if format != "json" {
+			go memberEventStdin(logger, stdin, e.Members)
+		}
 	case serf.UserEvent:
 		cmd.Env = append(cmd.Env, "SERF_USER_EVENT="+e.Name)
 		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_USER_LTIME=%d", e.LTime))
-		go userEventStdin(logger, stdin, &e)
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_USER_VERSION=%d", e.Version))
+		if format != "json" {
+			go userEventStdin(logger, stdin, &e)
+		}
 	default:
-		return fmt.Errorf("Unknown event type: %s", event.EventType().String())
+		return nil, fmt.Errorf("Unknown event type: %s", EventName(event))
+	}
+	if format == "json" {
+		go jsonEventStdin(logger, stdin, self, event)
+	}
+
+	if timeout > 0 {
+		setProcessGroup(cmd)
+	}
+
+	// The script and the programs it starts shouldn't compete with the
+	// agent for the CPU
+	if nice > 0 {
+		if err := setNice(cmd, nice); err != nil {
+			logger.Printf("[WARN] agent: Failed to set the nice level of a script: %s", err)
+		}
 	}
 
+	start := time.Now()
 	if err := cmd.Start(); err != nil {
-		return err
+		return nil, err
+	}
+
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			killScript(cmd)
+		})
+		defer timer.Stop()
 	}
 
 	err = cmd.Wait()
-	logger.Printf("[DEBUG] Event '%s' script output: %s",
-		event.EventType().String(), output.String())
+	if err != nil && timeout > 0 && time.Since(start) >= timeout {
+		err = fmt.Errorf("Script timed out after %s", timeout)
+	}
+	return output.Bytes(), err
+}
 
-	if err != nil {
-		return err
+// scriptCommand returns the command that runs an event script with the
+// given shell: "sh", "cmd" or "powershell". An empty shell is "cmd" on
+// Windows and "sh" everywhere else.
+func scriptCommand(shell, script string) (*exec.Cmd, error) {
+	if shell == "" {
+		shell = "sh"
+		if runtime.GOOS == windows {
+			shell = "cmd"
+		}
 	}
 
-	return nil
+	var cmd *exec.Cmd
+	switch shell {
+	case "sh":
+		cmd = exec.Command("/bin/sh", "-c", script)
+		cmd.Args[0] = "serf-event"
+	case "cmd":
+		// Code page 65001 makes the output and the piped data UTF-8. cmd
+		// doesn't unquote its arguments like other programs, so on Windows
+		// the command line is passed as it is, see setCommandLine.
+		cmd = exec.Command("cmd", "/S", "/C", "chcp 65001 >NUL & "+script)
+		setCommandLine(cmd, `cmd /S /C "chcp 65001 >NUL & `+script+`"`)
+	case "powershell":
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command",
+			"[Console]::InputEncoding = [Console]::OutputEncoding = "+
+				"[Text.Encoding]::UTF8; "+script)
+	default:
+		return nil, fmt.Errorf("Unknown event handler shell: %s", shell)
+	}
+	return cmd, nil
+}
+
+// FilterEnv returns the variables of environ, in the "key=value" form
+// of os.Environ, whose names are in the allowed list. An allowed name
+// with a trailing "*" matches any name with that prefix. Names are case
+// insensitive on Windows, where PATH is usually spelled "Path".
+func FilterEnv(environ []string, allowed []string) []string {
+	return filterEnv(environ, allowed, runtime.GOOS == windows)
+}
+
+func filterEnv(environ []string, allowed []string, foldCase bool) []string {
+	result := make([]string, 0, len(allowed))
+	for _, kv := range environ {
+		name := kv
+		if idx := strings.Index(kv, "="); idx >= 0 {
+			name = kv[:idx]
+		}
+		if foldCase {
+			name = strings.ToUpper(name)
+		}
+
+		for _, allow := range allowed {
+			if foldCase {
+				allow = strings.ToUpper(allow)
+			}
+			if strings.HasSuffix(allow, "*") {
+				if strings.HasPrefix(name, allow[:len(allow)-1]) {
+					result = append(result, kv)
+					break
+				}
+			} else if name == allow {
+				result = append(result, kv)
+				break
+			}
+		}
+	}
+	return result
 }
 
 // eventClean cleans a value to be a parameter in an event line.
@@ -85,21 +218,35 @@ func eventClean(v string) string {
 	return v
 }
 
-// Sends data on stdin for a member event.
+// eventTags formats the tags of a member as a sorted, comma separated
+// list of key=value pairs, cleaned to be a parameter in an event line.
+func eventTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, eventClean(k)+"="+eventClean(v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Sends data on stdin for a member or reconcile event.
 //
 // The format for the data is unix tool friendly, separated by whitespace
 // and newlines. The structure of each line for any member event is:
-// "NAME    ADDRESS    ROLE" where the whitespace is actually tabs.
+// "NAME    ADDRESS    ROLE    TAGS" where the whitespace is actually tabs.
 // The name and role are cleaned so that newlines and tabs are replaced
-// with "\n" and "\t" respectively.
-func memberEventStdin(logger *log.Logger, stdin io.WriteCloser, e *serf.MemberEvent) {
+// with "\n" and "\t" respectively, and the tags are formatted by
+// eventTags. Scripts that read only the first three fields should split
+// on tabs, since the tags field is empty for members without tags.
+func memberEventStdin(logger *log.Logger, stdin io.WriteCloser, members []serf.Member) {
 	defer stdin.Close()
-	for _, member := range e.Members {
+	for _, member := range members {
 		_, err := stdin.Write([]byte(fmt.Sprintf(
-			"%s\t%s\t%s\n",
+			"%s\t%s\t%s\t%s\n",
 			eventClean(member.Name),
 			member.Addr.String(),
-			eventClean(member.Role))))
+			eventClean(member.Role),
+			eventTags(member.Tags))))
 		if err != nil {
 			return
 		}
@@ -123,3 +270,89 @@ func userEventStdin(logger *log.Logger, stdin io.WriteCloser, e *serf.UserEvent)
 		return
 	}
 }
+
+// jsonEvent is the JSON document that is given to event scripts on stdin
+// if they use the "json" format. Only the fields that apply to the type
+// of the event are set.
+type jsonEvent struct {
+	Event string
+	ID    string
+	Self  jsonMember
+
+	// Members are the members of a member event
+	Members []jsonMember `json:",omitempty"`
+
+	// Name, LTime, Coalesce, Version and Payload describe a user event
+	Name     string `json:",omitempty"`
+	LTime    uint64 `json:",omitempty"`
+	Coalesce bool   `json:",omitempty"`
+	Version  uint8  `json:",omitempty"`
+	Payload  string `json:",omitempty"`
+}
+
+// jsonMember is a member in a jsonEvent
+type jsonMember struct {
+	Name   string
+	Addr   string `json:",omitempty"`
+	Port   uint16 `json:",omitempty"`
+	Role   string
+	Tags   map[string]string `json:",omitempty"`
+	Status string            `json:",omitempty"`
+
+	// PrevTags are the tags of the member before a member-update event
+	PrevTags map[string]string `json:",omitempty"`
+}
+
+func newJSONMember(m serf.Member) jsonMember {
+	result := jsonMember{
+		Name: m.Name,
+		Port: m.Port,
+		Role: m.Role,
+		Tags: m.Tags,
+	}
+	if m.Addr != nil {
+		result.Addr = m.Addr.String()
+	}
+	if m.Status != serf.StatusNone {
+		result.Status = m.Status.String()
+	}
+	return result
+}
+
+// Sends data on stdin for any event as a single JSON document, followed
+// by a newline. The payload of user events is given as a string, so
+// binary payloads should use the text format instead.
+func jsonEventStdin(logger *log.Logger, stdin io.WriteCloser, self serf.Member, event serf.Event) {
+	defer stdin.Close()
+
+	doc := jsonEvent{
+		Event: EventName(event),
+		ID:    EventID(event),
+		Self:  newJSONMember(self),
+	}
+	switch e := event.(type) {
+	case serf.MemberEvent:
+		doc.Members = make([]jsonMember, len(e.Members))
+		for i, m := range e.Members {
+			doc.Members[i] = newJSONMember(m)
+			if e.Type == serf.EventMemberUpdate {
+				doc.Members[i].PrevTags = e.PrevTags[m.Name]
+			}
+		}
+	case ReconcileEvent:
+		doc.Members = make([]jsonMember, len(e.Members))
+		for i, m := range e.Members {
+			doc.Members[i] = newJSONMember(m)
+		}
+	case serf.UserEvent:
+		doc.Name = e.Name
+		doc.LTime = uint64(e.LTime)
+		doc.Coalesce = e.Coalesce
+		doc.Version = e.Version
+		doc.Payload = string(e.Payload)
+	}
+
+	if err := json.NewEncoder(stdin).Encode(&doc); err != nil {
+		logger.Printf("[ERR] Error writing event data: %s", err)
+	}
+}
@@ -0,0 +1,41 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// setCommandLine is only needed on Windows, where programs parse their
+// own command line
+func setCommandLine(cmd *exec.Cmd, line string) {}
+
+// setProcessGroup starts the command in its own process group, so that
+// killScript also kills the programs started by the shell.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killScript kills the process group of a command started with
+// setProcessGroup.
+func killScript(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// setNice makes a command that isn't started yet run with the given
+// increment of the nice level, which the programs that it starts
+// inherit. The command is run by the nice program, since the level of a
+// started process can't be set before it runs.
+func setNice(cmd *exec.Cmd, nice int) error {
+	path, err := exec.LookPath("nice")
+	if err != nil {
+		return err
+	}
+	args := []string{"nice", "-n", strconv.Itoa(nice), cmd.Path}
+	cmd.Args = append(args, cmd.Args[1:]...)
+	cmd.Path = path
+	return nil
+}
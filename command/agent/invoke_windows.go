@@ -0,0 +1,26 @@
+package agent
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setCommandLine passes the command line to the program as it is, instead
+// of quoting the arguments of the command
+func setCommandLine(cmd *exec.Cmd, line string) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: line}
+}
+
+// setProcessGroup is not supported on Windows
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killScript kills the shell of the command. Programs started by the
+// shell are not killed on Windows.
+func killScript(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+// setNice is not supported on Windows
+func setNice(cmd *exec.Cmd, nice int) error {
+	return nil
+}
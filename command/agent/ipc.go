@@ -23,6 +23,9 @@ package agent
 
 import (
 	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/hashicorp/logutils"
 	"github.com/hashicorp/serf/serf"
@@ -31,35 +34,50 @@ import (
 	"log"
 	"net"
 	"os"
+	"regexp"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	MinIPCVersion = 1
-	MaxIPCVersion = 1
+	MaxIPCVersion = 3
 )
 
 const (
-	handshakeCommand  = "handshake"
-	eventCommand      = "event"
-	forceLeaveCommand = "force-leave"
-	joinCommand       = "join"
-	membersCommand    = "members"
-	streamCommand     = "stream"
-	stopCommand       = "stop"
-	monitorCommand    = "monitor"
-	leaveCommand      = "leave"
+	handshakeCommand       = "handshake"
+	eventCommand           = "event"
+	eventNodeCommand       = "event-node"
+	forceLeaveCommand      = "force-leave"
+	joinCommand            = "join"
+	membersCommand         = "members"
+	membersFilteredCommand = "members-filtered"
+	streamCommand          = "stream"
+	stopCommand            = "stop"
+	monitorCommand         = "monitor"
+	leaveCommand           = "leave"
+	dumpCommand            = "dump"
+	annotateCommand        = "annotate"
+	traceCommand           = "trace"
+	viewCommand            = "view"
+	maintenanceCommand     = "maintenance"
+	runtimeDumpCommand     = "runtime-dump"
+	recentEventsCommand    = "recent-events"
+	forceLeaveBulkCommand  = "force-leave-bulk"
+	snapshotSaveCommand    = "snapshot-save"
 )
 
 const (
-	unsupportedCommand    = "Unsupported command"
-	unsupportedIPCVersion = "Unsupported IPC version"
-	duplicateHandshake    = "Handshake already performed"
-	handshakeRequired     = "Handshake required"
-	monitorExists         = "Monitor already exists"
-	invalidFilter         = "Invalid event filter"
-	streamExists          = "Stream with given sequence exists"
+	unsupportedCommand     = "Unsupported command"
+	unsupportedIPCVersion  = "Unsupported IPC version"
+	duplicateHandshake     = "Handshake already performed"
+	handshakeRequired      = "Handshake required"
+	monitorExists          = "Monitor already exists"
+	invalidFilter          = "Invalid event filter"
+	streamExists           = "Stream with given sequence exists"
+	resumeExpired          = "Resume token is outside the buffered events"
+	unsupportedCompression = "Unsupported compression"
 )
 
 // Request header is sent before each request
@@ -76,16 +94,69 @@ type responseHeader struct {
 
 type handshakeRequest struct {
 	Version int32
+
+	// Compression, if set, makes the agent compress everything it sends
+	// after the handshake response. Only "gzip" is supported, and it
+	// requires version 3.
+	Compression string `codec:",omitempty"`
 }
 
 type eventRequest struct {
-	Name     string
-	Payload  []byte
-	Coalesce bool
+	Name       string
+	Payload    []byte
+	Coalesce   bool
+	Quorum     int32
+	QuorumTags map[string]string
+	Version    uint8  `codec:",omitempty"`
+	Node       string `codec:",omitempty"`
+}
+
+type annotateRequest struct {
+	Text string
+	TTL  time.Duration
+}
+
+type maintenanceRequest struct {
+	Enable bool
+	Reason string
+}
+
+type traceRequest struct {
+	Duration time.Duration
 }
 
 type forceLeaveRequest struct {
 	Node string
+
+	// Addr, if set, selects the members by address instead of by Node.
+	// All must be set to remove several members with the address.
+	Addr string `codec:",omitempty"`
+	All  bool   `codec:",omitempty"`
+}
+
+// forceLeaveBulkRequest selects the members to force leave by the
+// regular expression of their status, and how long they have had it
+type forceLeaveBulkRequest struct {
+	Status    string
+	OlderThan time.Duration `codec:",omitempty"`
+	DryRun    bool          `codec:",omitempty"`
+}
+
+type forceLeaveBulkResponse struct {
+	Nodes []string
+}
+
+type viewRequest struct {
+	View string
+}
+
+// membersFilteredRequest selects the members whose role and status
+// match the regular expressions, within the view if one is given. Empty
+// filters match all members.
+type membersFilteredRequest struct {
+	View   string `codec:",omitempty"`
+	Role   string `codec:",omitempty"`
+	Status string `codec:",omitempty"`
 }
 
 type joinRequest struct {
@@ -101,12 +172,79 @@ type membersResponse struct {
 	Members []Member
 }
 
+// StateDump is a point-in-time capture of the state of an agent and
+// its view of the cluster, used for offline analysis.
+type StateDump struct {
+	Members []Member
+	Stats   map[string]string
+	Config  DumpConfig
+
+	// Tuning are the OS limits that are too low for the cluster, see
+	// Agent.TuningHints.
+	Tuning map[string]string `codec:",omitempty"`
+
+	// RTT are the round trip times to the reference nodes, see
+	// Agent.RTT.
+	RTT map[string]string `codec:",omitempty"`
+}
+
+// DumpConfig is the subset of the agent configuration included in a
+// StateDump. Secrets are never included, only an identifier of the
+// encryption key in use.
+type DumpConfig struct {
+	NodeName      string
+	Role          string
+	Tags          map[string]string
+	Protocol      uint8
+	BindAddr      string
+	BindPort      int
+	AdvertiseAddr string
+	AdvertisePort int
+	SnapshotPath  string
+	EncryptKeyID  string
+}
+
+type runtimeDumpResponse struct {
+	Dump string
+}
+
+type snapshotSaveResponse struct {
+	Path string
+	Size int64
+}
+
+type recentEventsRequest struct {
+	Count int
+}
+
+type recentEventsResponse struct {
+	Events []RecentEvent
+}
+
+// RecentEvent is a user event from the history of the agent, see
+// Agent.RecentUserEvents. Origin is the member that sent the event, and
+// is empty for events of older members.
+type RecentEvent struct {
+	LTime    serf.LamportTime
+	Name     string
+	Payload  []byte
+	Origin   string
+	Target   string `codec:",omitempty"`
+	Coalesce bool
+	Version  uint8 `codec:",omitempty"`
+}
+
 type monitorRequest struct {
 	LogLevel string
 }
 
 type streamRequest struct {
-	Type string
+	Type   string
+	Resume uint64
+
+	// Since, if positive, replays the buffered events that the agent
+	// handled within that long, after Resume if it is also set.
+	Since time.Duration `codec:",omitempty"`
 }
 
 type stopRequest struct {
@@ -119,35 +257,108 @@ type logRecord struct {
 
 type userEventRecord struct {
 	Event    string
+	ID       string `codec:",omitempty"`
+	Token    uint64
 	LTime    serf.LamportTime
 	Name     string
 	Payload  []byte
 	Coalesce bool
+	Version  uint8  `codec:",omitempty"`
+	Target   string `codec:",omitempty"`
 }
 
 type Member struct {
-	Name        string
-	Addr        net.IP
-	Port        uint16
-	Role        string
-	Status      string
+	Name   string
+	Addr   net.IP
+	Port   uint16
+	Role   string
+	Tags   map[string]string
+	Status string
+
+	// Protocols are the protocol versions of the member
+	Protocols MemberProtocols
+
+	// The Protocol fields are the memberlist protocol versions and the
+	// Delegate fields are the Serf protocol versions. They are the same
+	// as in Protocols, and are kept for older clients.
 	ProtocolMin uint8
 	ProtocolMax uint8
 	ProtocolCur uint8
 	DelegateMin uint8
 	DelegateMax uint8
 	DelegateCur uint8
+
+	// Annotation is the unexpired annotation of the member, if any.
+	// It is only set in responses to the members command.
+	Annotation string
+
+	// Maintenance is the reason of a member in maintenance mode, or
+	// "maintenance" if no reason was given. It is empty otherwise, and
+	// is only set in responses to the members command.
+	Maintenance string `codec:",omitempty"`
+
+	// StatusTime and TagsTime are the Unix times at which the agent saw
+	// the status or the tags of the member change. They are only set in
+	// responses to the members command, for clients of IPC version 2.
+	StatusTime int64 `codec:",omitempty"`
+	TagsTime   int64 `codec:",omitempty"`
+
+	// PreviousAddrs are the last few addresses of the member before it
+	// changed to the current one, oldest first. They are only set in
+	// responses to the members command, for clients of IPC version 2.
+	PreviousAddrs []PreviousAddr `codec:",omitempty"`
+}
+
+// PreviousAddr is an address that a member advertised until the Unix
+// time Until.
+type PreviousAddr struct {
+	Addr  net.IP
+	Port  uint16
+	Until int64
+}
+
+// MemberProtocols are the versions of the Serf protocol and of the
+// underlying memberlist protocol that a member understands and speaks.
+type MemberProtocols struct {
+	Serf       ProtocolRange
+	Memberlist ProtocolRange
+}
+
+// ProtocolRange is the range of versions of a protocol that a member
+// understands, and the version that it currently speaks.
+type ProtocolRange struct {
+	Min uint8
+	Max uint8
+	Cur uint8
 }
 
 type memberEventRecord struct {
 	Event   string
+	ID      string `codec:",omitempty"`
+	Token   uint64
 	Members []Member
+
+	// Added, Updated and Removed describe how this event changed the
+	// members, relative to the previous events sent on the same stream
+	Added   []Member
+	Updated []memberUpdate
+	Removed []Member
+
+	// PrevTags are the tags of the members of a member-update event
+	// before the update, keyed by member name
+	PrevTags map[string]map[string]string `codec:",omitempty"`
+}
+
+type memberUpdate struct {
+	Old Member
+	New Member
 }
 
 type AgentIPC struct {
 	sync.Mutex
 	agent     *Agent
 	clients   map[string]*IPCClient
+	events    *eventBuffer
 	listener  net.Listener
 	logger    *log.Logger
 	logWriter *logWriter
@@ -155,15 +366,48 @@ type AgentIPC struct {
 	stopCh    chan struct{}
 }
 
+// maxIPCRequestSize is the most that is read for a single request, its
+// header and body together. Even a join with many addresses is far
+// smaller, so a client that sends more is broken or malicious.
+const maxIPCRequestSize = 1024 * 1024
+
+// errRequestTooLarge is returned when a request exceeds maxIPCRequestSize
+var errRequestTooLarge = fmt.Errorf("request exceeds limit of %d bytes", maxIPCRequestSize)
+
+// requestLimitReader limits how much of a client's connection is read
+// for a single request. It is reset before every request header.
+type requestLimitReader struct {
+	r io.Reader
+	n int
+}
+
+func (l *requestLimitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errRequestTooLarge
+	}
+	if len(p) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= n
+	return n, err
+}
+
+func (l *requestLimitReader) reset() {
+	l.n = maxIPCRequestSize
+}
+
 type IPCClient struct {
 	name         string
 	conn         net.Conn
 	reader       *bufio.Reader
 	writer       *bufio.Writer
+	limit        *requestLimitReader
 	dec          *codec.Decoder
 	enc          *codec.Encoder
 	writeLock    sync.Mutex
-	version      int32 // From the handshake, 0 before
+	gzip         *gzip.Writer // Set if compression was negotiated
+	version      int32        // From the handshake, 0 before
 	logStreamer  *logStream
 	eventStreams map[uint64]*eventStream
 }
@@ -184,6 +428,12 @@ func (c *IPCClient) Send(header *responseHeader, obj interface{}) error {
 		}
 	}
 
+	if c.gzip != nil {
+		if err := c.gzip.Flush(); err != nil {
+			return err
+		}
+	}
+
 	if err := c.writer.Flush(); err != nil {
 		return err
 	}
@@ -191,6 +441,34 @@ func (c *IPCClient) Send(header *responseHeader, obj interface{}) error {
 	return nil
 }
 
+// decode reads the next part of a request from the client. Requests
+// come from the network, so whatever the decoder does with malformed
+// ones must not crash the agent.
+func (c *IPCClient) decode(out interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decoder panic: %v", r)
+		}
+	}()
+	return c.dec.Decode(out)
+}
+
+// compress makes the client compress everything that is sent from now on
+func (c *IPCClient) compress() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.gzip = gzip.NewWriter(c.writer)
+	c.enc = codec.NewEncoder(c.gzip,
+		&codec.MsgpackHandle{RawToString: true, WriteExt: true})
+
+	// Send the gzip header right away, the other end waits for it
+	if err := c.gzip.Flush(); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
 func (c *IPCClient) String() string {
 	return fmt.Sprintf("ipc.client: %v", c.conn)
 }
@@ -204,11 +482,13 @@ func NewAgentIPC(agent *Agent, listener net.Listener,
 	ipc := &AgentIPC{
 		agent:     agent,
 		clients:   make(map[string]*IPCClient),
+		events:    newEventBuffer(eventBufferSize),
 		listener:  listener,
 		logger:    log.New(logOutput, "", log.LstdFlags),
 		logWriter: logWriter,
 		stopCh:    make(chan struct{}),
 	}
+	agent.RegisterEventHandler(ipc.events)
 	go ipc.listen()
 	return ipc
 }
@@ -225,6 +505,7 @@ func (i *AgentIPC) Shutdown() {
 	i.stop = true
 	close(i.stopCh)
 	i.listener.Close()
+	i.agent.DeregisterEventHandler(i.events)
 
 	// Close the existing connections
 	for _, client := range i.clients {
@@ -253,7 +534,8 @@ func (i *AgentIPC) listen() {
 			writer:       bufio.NewWriter(conn),
 			eventStreams: make(map[uint64]*eventStream),
 		}
-		client.dec = codec.NewDecoder(client.reader,
+		client.limit = &requestLimitReader{r: client.reader, n: maxIPCRequestSize}
+		client.dec = codec.NewDecoder(client.limit,
 			&codec.MsgpackHandle{RawToString: true, WriteExt: true})
 		client.enc = codec.NewEncoder(client.writer,
 			&codec.MsgpackHandle{RawToString: true, WriteExt: true})
@@ -293,7 +575,7 @@ func (i *AgentIPC) deregisterClient(client *IPCClient) {
 
 	// Remove from event handlers
 	for _, es := range client.eventStreams {
-		i.agent.DeregisterEventHandler(es)
+		i.events.Unsubscribe(es)
 		es.Stop()
 	}
 }
@@ -304,7 +586,8 @@ func (i *AgentIPC) handleClient(client *IPCClient) {
 	var reqHeader requestHeader
 	for {
 		// Decode the header
-		if err := client.dec.Decode(&reqHeader); err != nil {
+		client.limit.reset()
+		if err := client.decode(&reqHeader); err != nil {
 			if err != io.EOF && !i.stop {
 				i.logger.Printf("[ERR] agent.ipc: failed to decode request header: %v", err)
 			}
@@ -332,17 +615,22 @@ func (i *AgentIPC) handleRequest(client *IPCClient, reqHeader *requestHeader) er
 		return fmt.Errorf(handshakeRequired)
 	}
 
+	i.agent.metrics().IncrCounter([]string{"agent", "rpc"}, 1)
+
 	// Dispatch command specific handlers
 	switch command {
 	case handshakeCommand:
 		return i.handleHandshake(client, seq)
 
-	case eventCommand:
+	case eventCommand, eventNodeCommand:
 		return i.handleEvent(client, seq)
 
 	case membersCommand:
 		return i.handleMembers(client, seq)
 
+	case membersFilteredCommand:
+		return i.handleMembersFiltered(client, seq)
+
 	case streamCommand:
 		return i.handleStream(client, seq)
 
@@ -361,6 +649,33 @@ func (i *AgentIPC) handleRequest(client *IPCClient, reqHeader *requestHeader) er
 	case leaveCommand:
 		return i.handleLeave(client, seq)
 
+	case dumpCommand:
+		return i.handleDump(client, seq)
+
+	case annotateCommand:
+		return i.handleAnnotate(client, seq)
+
+	case traceCommand:
+		return i.handleTrace(client, seq)
+
+	case viewCommand:
+		return i.handleView(client, seq)
+
+	case maintenanceCommand:
+		return i.handleMaintenance(client, seq)
+
+	case runtimeDumpCommand:
+		return i.handleRuntimeDump(client, seq)
+
+	case recentEventsCommand:
+		return i.handleRecentEvents(client, seq)
+
+	case forceLeaveBulkCommand:
+		return i.handleForceLeaveBulk(client, seq)
+
+	case snapshotSaveCommand:
+		return i.handleSnapshotSave(client, seq)
+
 	default:
 		respHeader := responseHeader{Seq: seq, Error: unsupportedCommand}
 		client.Send(&respHeader, nil)
@@ -370,7 +685,7 @@ func (i *AgentIPC) handleRequest(client *IPCClient, reqHeader *requestHeader) er
 
 func (i *AgentIPC) handleHandshake(client *IPCClient, seq uint64) error {
 	var req handshakeRequest
-	if err := client.dec.Decode(&req); err != nil {
+	if err := client.decode(&req); err != nil {
 		return fmt.Errorf("decode failed: %v", err)
 	}
 
@@ -384,20 +699,37 @@ func (i *AgentIPC) handleHandshake(client *IPCClient, seq uint64) error {
 		resp.Error = unsupportedIPCVersion
 	} else if client.version != 0 {
 		resp.Error = duplicateHandshake
+	} else if req.Compression != "" && (req.Version < 3 || req.Compression != "gzip") {
+		resp.Error = unsupportedCompression
 	} else {
 		client.version = req.Version
 	}
-	return client.Send(&resp, nil)
+
+	if err := client.Send(&resp, nil); err != nil {
+		return err
+	}
+	if resp.Error != "" || req.Compression == "" {
+		return nil
+	}
+	return client.compress()
 }
 
 func (i *AgentIPC) handleEvent(client *IPCClient, seq uint64) error {
 	var req eventRequest
-	if err := client.dec.Decode(&req); err != nil {
+	if err := client.decode(&req); err != nil {
 		return fmt.Errorf("decode failed: %v", err)
 	}
 
-	// Attempt the send
-	err := i.agent.UserEvent(req.Name, req.Payload, req.Coalesce)
+	// Check the quorum if requested, and attempt the send
+	var err error
+	if req.Quorum > 0 {
+		err = i.agent.CheckQuorum(req.QuorumTags, int(req.Quorum))
+	}
+	if err == nil && req.Node != "" {
+		err = i.agent.UserEventNode(req.Name, req.Payload, req.Version, req.Node, req.Coalesce)
+	} else if err == nil {
+		err = i.agent.UserEventVersion(req.Name, req.Payload, req.Version, req.Coalesce)
+	}
 
 	// Respond
 	resp := responseHeader{
@@ -407,14 +739,64 @@ func (i *AgentIPC) handleEvent(client *IPCClient, seq uint64) error {
 	return client.Send(&resp, nil)
 }
 
+func (i *AgentIPC) handleAnnotate(client *IPCClient, seq uint64) error {
+	var req annotateRequest
+	if err := client.decode(&req); err != nil {
+		return fmt.Errorf("decode failed: %v", err)
+	}
+
+	err := i.agent.Annotate(req.Text, req.TTL)
+
+	resp := responseHeader{
+		Seq:   seq,
+		Error: errToString(err),
+	}
+	return client.Send(&resp, nil)
+}
+
+func (i *AgentIPC) handleMaintenance(client *IPCClient, seq uint64) error {
+	var req maintenanceRequest
+	if err := client.decode(&req); err != nil {
+		return fmt.Errorf("decode failed: %v", err)
+	}
+
+	err := i.agent.SetMaintenance(req.Enable, req.Reason)
+
+	resp := responseHeader{
+		Seq:   seq,
+		Error: errToString(err),
+	}
+	return client.Send(&resp, nil)
+}
+
+func (i *AgentIPC) handleTrace(client *IPCClient, seq uint64) error {
+	var req traceRequest
+	if err := client.decode(&req); err != nil {
+		return fmt.Errorf("decode failed: %v", err)
+	}
+
+	i.agent.Serf().TraceMessages(req.Duration)
+
+	resp := responseHeader{
+		Seq:   seq,
+		Error: "",
+	}
+	return client.Send(&resp, nil)
+}
+
 func (i *AgentIPC) handleForceLeave(client *IPCClient, seq uint64) error {
 	var req forceLeaveRequest
-	if err := client.dec.Decode(&req); err != nil {
+	if err := client.decode(&req); err != nil {
 		return fmt.Errorf("decode failed: %v", err)
 	}
 
 	// Attempt leave
-	err := i.agent.ForceLeave(req.Node)
+	var err error
+	if req.Addr != "" {
+		_, err = i.agent.ForceLeaveAddr(req.Addr, req.All)
+	} else {
+		err = i.agent.ForceLeave(req.Node)
+	}
 
 	// Respond
 	resp := responseHeader{
@@ -424,9 +806,27 @@ func (i *AgentIPC) handleForceLeave(client *IPCClient, seq uint64) error {
 	return client.Send(&resp, nil)
 }
 
+func (i *AgentIPC) handleForceLeaveBulk(client *IPCClient, seq uint64) error {
+	var req forceLeaveBulkRequest
+	if err := client.decode(&req); err != nil {
+		return fmt.Errorf("decode failed: %v", err)
+	}
+
+	nodes, err := i.agent.ForceLeaveMatching(req.Status, req.OlderThan, req.DryRun)
+
+	header := responseHeader{
+		Seq:   seq,
+		Error: errToString(err),
+	}
+	resp := forceLeaveBulkResponse{
+		Nodes: nodes,
+	}
+	return client.Send(&header, &resp)
+}
+
 func (i *AgentIPC) handleJoin(client *IPCClient, seq uint64) error {
 	var req joinRequest
-	if err := client.dec.Decode(&req); err != nil {
+	if err := client.decode(&req); err != nil {
 		return fmt.Errorf("decode failed: %v", err)
 	}
 
@@ -445,33 +845,205 @@ func (i *AgentIPC) handleJoin(client *IPCClient, seq uint64) error {
 }
 
 func (i *AgentIPC) handleMembers(client *IPCClient, seq uint64) error {
-	serf := i.agent.Serf()
-	raw := serf.Members()
+	header := responseHeader{
+		Seq:   seq,
+		Error: "",
+	}
+	resp := membersResponse{
+		Members: i.members(client, i.agent.Serf().Members()),
+	}
+	return client.Send(&header, &resp)
+}
 
-	members := make([]Member, 0, len(raw))
-	for _, m := range raw {
-		sm := Member{
-			Name:        m.Name,
-			Addr:        m.Addr,
-			Port:        m.Port,
-			Role:        m.Role,
-			Status:      m.Status.String(),
-			ProtocolMin: m.ProtocolMin,
-			ProtocolMax: m.ProtocolMax,
-			ProtocolCur: m.ProtocolCur,
-			DelegateMin: m.DelegateMin,
-			DelegateMax: m.DelegateMax,
-			DelegateCur: m.DelegateCur,
+func (i *AgentIPC) handleMembersFiltered(client *IPCClient, seq uint64) error {
+	var req membersFilteredRequest
+	if err := client.decode(&req); err != nil {
+		return fmt.Errorf("decode failed: %v", err)
+	}
+
+	var raw []serf.Member
+	var err error
+	if req.View != "" {
+		raw, err = i.agent.ViewMembers(req.View)
+	} else {
+		raw = i.agent.Serf().Members()
+	}
+	if err == nil {
+		raw, err = filterMembers(raw, req.Role, req.Status)
+	}
+
+	header := responseHeader{
+		Seq:   seq,
+		Error: errToString(err),
+	}
+	resp := membersResponse{
+		Members: i.members(client, raw),
+	}
+	return client.Send(&header, &resp)
+}
+
+// filterMembers returns the members whose role and status match the
+// regular expressions. The expressions are compiled once, before any
+// member is matched, and an empty one matches all members.
+func filterMembers(members []serf.Member, role, status string) ([]serf.Member, error) {
+	if role == "" && status == "" {
+		return members, nil
+	}
+
+	roleRe, err := regexp.Compile(role)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid role filter: %v", err)
+	}
+	statusRe, err := regexp.Compile(status)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid status filter: %v", err)
+	}
+
+	result := make([]serf.Member, 0, len(members))
+	for _, m := range members {
+		if roleRe.MatchString(m.Role) && statusRe.MatchString(m.Status.String()) {
+			result = append(result, m)
 		}
-		members = append(members, sm)
 	}
+	return result, nil
+}
+
+func (i *AgentIPC) handleView(client *IPCClient, seq uint64) error {
+	var req viewRequest
+	if err := client.decode(&req); err != nil {
+		return fmt.Errorf("decode failed: %v", err)
+	}
+
+	raw, err := i.agent.ViewMembers(req.View)
 
 	header := responseHeader{
 		Seq:   seq,
-		Error: "",
+		Error: errToString(err),
 	}
 	resp := membersResponse{
-		Members: members,
+		Members: i.members(client, raw),
+	}
+	return client.Send(&header, &resp)
+}
+
+// members converts a list of Serf members into their IPC representation
+// for the client, including the information known only to the agent.
+func (i *AgentIPC) members(client *IPCClient, raw []serf.Member) []Member {
+	members := ipcMembers(i.agent.withHealth(raw))
+
+	annotations := i.agent.Annotations()
+	maintenance := i.agent.Maintenance()
+	for idx := range members {
+		members[idx].Annotation = annotations[members[idx].Name].Text
+		if reason, ok := maintenance[members[idx].Name]; ok {
+			if reason == "" {
+				reason = "maintenance"
+			}
+			members[idx].Maintenance = reason
+		}
+	}
+
+	// Version 1 clients don't know about the change times
+	if client.version >= 2 {
+		times := i.agent.Serf().MemberTimes()
+		history := i.agent.Serf().AddrHistory()
+		for idx := range members {
+			t := times[members[idx].Name]
+			members[idx].StatusTime = unixTime(t.Status)
+			members[idx].TagsTime = unixTime(t.Tags)
+			for _, change := range history[members[idx].Name] {
+				members[idx].PreviousAddrs = append(members[idx].PreviousAddrs, PreviousAddr{
+					Addr:  change.Addr,
+					Port:  change.Port,
+					Until: unixTime(change.Until),
+				})
+			}
+		}
+	}
+	return members
+}
+
+func (i *AgentIPC) handleDump(client *IPCClient, seq uint64) error {
+	serf := i.agent.Serf()
+	conf := i.agent.SerfConfig()
+
+	resp := StateDump{
+		Members: ipcMembers(serf.Members()),
+		Stats:   serf.Stats(),
+		Config: DumpConfig{
+			NodeName:      conf.NodeName,
+			Role:          conf.Role,
+			Tags:          conf.Tags,
+			Protocol:      conf.ProtocolVersion,
+			BindAddr:      conf.MemberlistConfig.BindAddr,
+			BindPort:      conf.MemberlistConfig.BindPort,
+			AdvertiseAddr: conf.MemberlistConfig.AdvertiseAddr,
+			AdvertisePort: conf.MemberlistConfig.AdvertisePort,
+			SnapshotPath:  conf.SnapshotPath,
+			EncryptKeyID:  keyID(conf.MemberlistConfig.SecretKey),
+		},
+		Tuning: i.agent.TuningHints(),
+		RTT:    i.agent.RTT(),
+	}
+
+	header := responseHeader{
+		Seq:   seq,
+		Error: "",
+	}
+	return client.Send(&header, &resp)
+}
+
+func (i *AgentIPC) handleRuntimeDump(client *IPCClient, seq uint64) error {
+	resp := runtimeDumpResponse{
+		Dump: i.agent.RuntimeDump(),
+	}
+
+	header := responseHeader{
+		Seq:   seq,
+		Error: "",
+	}
+	return client.Send(&header, &resp)
+}
+
+func (i *AgentIPC) handleSnapshotSave(client *IPCClient, seq uint64) error {
+	path, size, err := i.agent.Serf().SaveSnapshot()
+
+	header := responseHeader{
+		Seq:   seq,
+		Error: errToString(err),
+	}
+	resp := snapshotSaveResponse{
+		Path: path,
+		Size: size,
+	}
+	return client.Send(&header, &resp)
+}
+
+func (i *AgentIPC) handleRecentEvents(client *IPCClient, seq uint64) error {
+	var req recentEventsRequest
+	if err := client.decode(&req); err != nil {
+		return fmt.Errorf("decode failed: %v", err)
+	}
+
+	events := i.agent.RecentUserEvents(req.Count)
+	resp := recentEventsResponse{
+		Events: make([]RecentEvent, 0, len(events)),
+	}
+	for _, e := range events {
+		resp.Events = append(resp.Events, RecentEvent{
+			LTime:    e.LTime,
+			Name:     e.Name,
+			Payload:  e.Payload,
+			Origin:   e.Origin,
+			Target:   e.Target,
+			Coalesce: e.Coalesce,
+			Version:  e.Version,
+		})
+	}
+
+	header := responseHeader{
+		Seq:   seq,
+		Error: "",
 	}
 	return client.Send(&header, &resp)
 }
@@ -479,7 +1051,7 @@ func (i *AgentIPC) handleMembers(client *IPCClient, seq uint64) error {
 func (i *AgentIPC) handleStream(client *IPCClient, seq uint64) error {
 	var es *eventStream
 	var req streamRequest
-	if err := client.dec.Decode(&req); err != nil {
+	if err := client.decode(&req); err != nil {
 		return fmt.Errorf("decode failed: %v", err)
 	}
 
@@ -491,7 +1063,8 @@ func (i *AgentIPC) handleStream(client *IPCClient, seq uint64) error {
 	// Create the event filters
 	filters := ParseEventFilter(req.Type)
 	for _, f := range filters {
-		if !f.Valid() {
+		// Tag expressions and batching are only supported by event handlers
+		if !f.Valid() || f.Tag != "" || f.Batch != "" {
 			resp.Error = invalidFilter
 			goto SEND
 		}
@@ -503,13 +1076,19 @@ func (i *AgentIPC) handleStream(client *IPCClient, seq uint64) error {
 		goto SEND
 	}
 
-	// Create an event streamer
+	// Create an event streamer, and subscribe it to the events, replaying
+	// any since the resume token or within the requested time. This fails
+	// if the events to resume from are no longer buffered.
 	es = newEventStream(client, filters, seq, i.logger)
+	if !i.events.Subscribe(es, req.Resume, req.Since, i.agent.Serf().Members) {
+		resp.Error = resumeExpired
+		goto SEND
+	}
 	client.eventStreams[seq] = es
 
-	// Register with the agent. Defer so that we can respond before
-	// registration, avoids any possible race condition
-	defer i.agent.RegisterEventHandler(es)
+	// The events are queued until the stream starts. Defer so that we
+	// respond before any event is sent.
+	defer es.Start()
 
 SEND:
 	return client.Send(&resp, nil)
@@ -517,7 +1096,7 @@ SEND:
 
 func (i *AgentIPC) handleMonitor(client *IPCClient, seq uint64) error {
 	var req monitorRequest
-	if err := client.dec.Decode(&req); err != nil {
+	if err := client.decode(&req); err != nil {
 		return fmt.Errorf("decode failed: %v", err)
 	}
 
@@ -556,7 +1135,7 @@ SEND:
 
 func (i *AgentIPC) handleStop(client *IPCClient, seq uint64) error {
 	var req stopRequest
-	if err := client.dec.Decode(&req); err != nil {
+	if err := client.decode(&req); err != nil {
 		return fmt.Errorf("decode failed: %v", err)
 	}
 
@@ -569,7 +1148,7 @@ func (i *AgentIPC) handleStop(client *IPCClient, seq uint64) error {
 
 	// Remove an event stream if any
 	if es, ok := client.eventStreams[req.Stop]; ok {
-		i.agent.DeregisterEventHandler(es)
+		i.events.Unsubscribe(es)
 		es.Stop()
 		delete(client.eventStreams, req.Stop)
 	}
@@ -599,6 +1178,59 @@ func (i *AgentIPC) handleLeave(client *IPCClient, seq uint64) error {
 	return err
 }
 
+// ipcMembers converts a list of Serf members into their IPC representation
+func ipcMembers(raw []serf.Member) []Member {
+	members := make([]Member, 0, len(raw))
+	for _, m := range raw {
+		sm := Member{
+			Name:   m.Name,
+			Addr:   m.Addr,
+			Port:   m.Port,
+			Role:   m.Role,
+			Tags:   m.Tags,
+			Status: m.Status.String(),
+			Protocols: MemberProtocols{
+				Serf: ProtocolRange{
+					Min: m.DelegateMin,
+					Max: m.DelegateMax,
+					Cur: m.DelegateCur,
+				},
+				Memberlist: ProtocolRange{
+					Min: m.ProtocolMin,
+					Max: m.ProtocolMax,
+					Cur: m.ProtocolCur,
+				},
+			},
+			ProtocolMin: m.ProtocolMin,
+			ProtocolMax: m.ProtocolMax,
+			ProtocolCur: m.ProtocolCur,
+			DelegateMin: m.DelegateMin,
+			DelegateMax: m.DelegateMax,
+			DelegateCur: m.DelegateCur,
+		}
+		members = append(members, sm)
+	}
+	return members
+}
+
+// unixTime converts a time to Unix seconds, keeping the zero time as 0
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// keyID returns a short identifier for an encryption key that can be
+// shared without revealing the key itself.
+func keyID(key []byte) string {
+	if len(key) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
 // Used to convert an error to a string representation
 func errToString(err error) string {
 	if err == nil {
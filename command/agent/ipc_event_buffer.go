@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"github.com/hashicorp/serf/serf"
+	"sync"
+	"time"
+)
+
+// eventBufferSize is the number of recent events kept so that streams
+// can be resumed after a brief disconnect
+const eventBufferSize = 256
+
+// streamEvent is an event along with the token identifying it, and the
+// time at which the agent handled it
+type streamEvent struct {
+	Token uint64
+	Event serf.Event
+	Time  time.Time
+}
+
+// eventBuffer is registered with the agent and assigns every event an
+// increasing token. It keeps the most recent events, so that a client
+// that reconnects can resume its stream after the last token it saw,
+// or backfill the events of the last few minutes, and fans the events
+// out to the subscribed streams.
+type eventBuffer struct {
+	sync.Mutex
+	size    int
+	token   uint64
+	events  []streamEvent
+	streams map[*eventStream]struct{}
+}
+
+func newEventBuffer(size int) *eventBuffer {
+	return &eventBuffer{
+		size:    size,
+		events:  make([]streamEvent, 0, size),
+		streams: make(map[*eventStream]struct{}),
+	}
+}
+
+func (b *eventBuffer) HandleEvent(e serf.Event) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.token++
+	se := streamEvent{Token: b.token, Event: e, Time: time.Now()}
+	if len(b.events) == b.size {
+		copy(b.events, b.events[1:])
+		b.events = b.events[:b.size-1]
+	}
+	b.events = append(b.events, se)
+
+	for es := range b.streams {
+		es.Handle(se.Token, se.Event)
+	}
+}
+
+// CanResume checks if every event after the given token is still
+// buffered. A token of zero means no events should be replayed.
+func (b *eventBuffer) CanResume(token uint64) bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.canResume(token)
+}
+
+func (b *eventBuffer) canResume(token uint64) bool {
+	if token == 0 {
+		return true
+	}
+	if token > b.token {
+		return false
+	}
+	return token >= b.token-uint64(len(b.events))
+}
+
+// Subscribe registers a stream for new events, first replaying the
+// buffered events after the given token. If since is positive, only the
+// buffered events handled within that long are replayed, even without a
+// token. It returns false, without subscribing, if the events after the
+// token are no longer buffered.
+//
+// The members, if given, return the current members, which the stream
+// computes its diffs against. They are read while no event can be
+// handled, so that no change is missed or counted twice between the
+// members and the replayed and new events.
+func (b *eventBuffer) Subscribe(es *eventStream, token uint64, since time.Duration,
+	members func() []serf.Member) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if !b.canResume(token) {
+		return false
+	}
+
+	// The replayed events are the newest ones, since the tokens and the
+	// times increase along the buffer
+	start := len(b.events)
+	if token > 0 || since > 0 {
+		now := time.Now()
+		for start > 0 {
+			se := b.events[start-1]
+			if se.Token <= token || (since > 0 && now.Sub(se.Time) > since) {
+				break
+			}
+			start--
+		}
+	}
+
+	var current []serf.Member
+	if members != nil {
+		current = members()
+	}
+	es.seed(current, b.events[:start], b.events[start:])
+
+	for _, se := range b.events[start:] {
+		es.Handle(se.Token, se.Event)
+	}
+	b.streams[es] = struct{}{}
+	return true
+}
+
+// Unsubscribe stops delivering events to a stream
+func (b *eventBuffer) Unsubscribe(es *eventStream) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.streams, es)
+}
@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"github.com/hashicorp/serf/serf"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEventBuffer(t *testing.T) {
+	b := newEventBuffer(2)
+	for i := 0; i < 3; i++ {
+		b.HandleEvent(serf.UserEvent{Name: "foo"})
+	}
+
+	if b.token != 3 {
+		t.Fatalf("bad: %d", b.token)
+	}
+	if len(b.events) != 2 || b.events[0].Token != 2 || b.events[1].Token != 3 {
+		t.Fatalf("bad: %#v", b.events)
+	}
+
+	testCases := []struct {
+		Token  uint64
+		Resume bool
+	}{
+		{0, true},
+		{1, true},
+		{2, true},
+		{3, true},
+		{4, false},
+	}
+	for _, tc := range testCases {
+		if b.CanResume(tc.Token) != tc.Resume {
+			t.Errorf("bad: %#v", tc)
+		}
+	}
+
+	b = newEventBuffer(2)
+	b.HandleEvent(serf.UserEvent{Name: "foo"})
+	b.HandleEvent(serf.UserEvent{Name: "foo"})
+	b.HandleEvent(serf.UserEvent{Name: "foo"})
+	if b.CanResume(0) != true || b.CanResume(1) != true {
+		t.Fatalf("should resume")
+	}
+
+	b.HandleEvent(serf.UserEvent{Name: "foo"})
+	if b.CanResume(1) {
+		t.Fatalf("should not resume")
+	}
+}
+
+func TestEventBuffer_Subscribe(t *testing.T) {
+	b := newEventBuffer(16)
+	b.HandleEvent(serf.UserEvent{Name: "first"})
+	b.HandleEvent(serf.UserEvent{Name: "second"})
+
+	sc := &MockStreamClient{}
+	es := newEventStream(sc, ParseEventFilter("*"), 42,
+		log.New(os.Stderr, "", log.LstdFlags))
+	es.Start()
+	defer es.Stop()
+
+	b.Subscribe(es, 1, 0, nil)
+	b.HandleEvent(serf.UserEvent{Name: "third"})
+
+	time.Sleep(5 * time.Millisecond)
+
+	if len(sc.objs) != 2 {
+		t.Fatalf("bad: %#v", sc.objs)
+	}
+
+	rec := sc.objs[0].(*userEventRecord)
+	if rec.Name != "second" || rec.Token != 2 {
+		t.Fatalf("bad: %#v", rec)
+	}
+
+	rec = sc.objs[1].(*userEventRecord)
+	if rec.Name != "third" || rec.Token != 3 {
+		t.Fatalf("bad: %#v", rec)
+	}
+
+	b.Unsubscribe(es)
+	b.HandleEvent(serf.UserEvent{Name: "fourth"})
+	time.Sleep(5 * time.Millisecond)
+
+	if len(sc.objs) != 2 {
+		t.Fatalf("bad: %#v", sc.objs)
+	}
+}
+
+func TestEventBuffer_SubscribeSince(t *testing.T) {
+	b := newEventBuffer(16)
+	b.HandleEvent(serf.UserEvent{Name: "old"})
+	b.HandleEvent(serf.UserEvent{Name: "recent"})
+	b.HandleEvent(serf.UserEvent{Name: "latest"})
+	b.events[0].Time = time.Now().Add(-time.Hour)
+
+	sc := &MockStreamClient{}
+	es := newEventStream(sc, ParseEventFilter("*"), 42,
+		log.New(os.Stderr, "", log.LstdFlags))
+	es.Start()
+	defer es.Stop()
+
+	b.Subscribe(es, 0, 10*time.Minute, nil)
+	time.Sleep(5 * time.Millisecond)
+
+	if len(sc.objs) != 2 {
+		t.Fatalf("bad: %#v", sc.objs)
+	}
+	if rec := sc.objs[0].(*userEventRecord); rec.Name != "recent" || rec.Token != 2 {
+		t.Fatalf("bad: %#v", rec)
+	}
+
+	// The events must also be after the resume token
+	sc2 := &MockStreamClient{}
+	es2 := newEventStream(sc2, ParseEventFilter("*"), 43,
+		log.New(os.Stderr, "", log.LstdFlags))
+	es2.Start()
+	defer es2.Stop()
+
+	b.Subscribe(es2, 2, 10*time.Minute, nil)
+	time.Sleep(5 * time.Millisecond)
+
+	if len(sc2.objs) != 1 {
+		t.Fatalf("bad: %#v", sc2.objs)
+	}
+	if rec := sc2.objs[0].(*userEventRecord); rec.Name != "latest" {
+		t.Fatalf("bad: %#v", rec)
+	}
+}
+
+func TestEventBuffer_SubscribeExpired(t *testing.T) {
+	b := newEventBuffer(2)
+	for i := 0; i < 4; i++ {
+		b.HandleEvent(serf.UserEvent{Name: "foo"})
+	}
+
+	sc := &MockStreamClient{}
+	es := newEventStream(sc, ParseEventFilter("*"), 42,
+		log.New(os.Stderr, "", log.LstdFlags))
+	defer es.Stop()
+
+	if b.Subscribe(es, 1, 0, nil) {
+		t.Fatalf("should not resume")
+	}
+	if len(b.streams) != 0 {
+		t.Fatalf("bad: %#v", b.streams)
+	}
+}
+
+func TestEventBuffer_SubscribeDiff(t *testing.T) {
+	b := newEventBuffer(16)
+	b.HandleEvent(serf.MemberEvent{
+		Type:    serf.EventMemberJoin,
+		Members: []serf.Member{serf.Member{Name: "foo", Status: serf.StatusAlive}},
+	})
+	b.HandleEvent(serf.MemberEvent{
+		Type:    serf.EventMemberFailed,
+		Members: []serf.Member{serf.Member{Name: "foo", Status: serf.StatusFailed}},
+	})
+	b.HandleEvent(serf.MemberEvent{
+		Type:    serf.EventMemberJoin,
+		Members: []serf.Member{serf.Member{Name: "bar", Status: serf.StatusAlive}},
+	})
+
+	// The current members already include the replayed changes
+	current := func() []serf.Member {
+		return []serf.Member{
+			serf.Member{Name: "foo", Status: serf.StatusFailed},
+			serf.Member{Name: "bar", Status: serf.StatusAlive},
+			serf.Member{Name: "baz", Status: serf.StatusAlive},
+		}
+	}
+
+	sc := &MockStreamClient{}
+	es := newEventStream(sc, ParseEventFilter("*"), 42,
+		log.New(os.Stderr, "", log.LstdFlags))
+	es.Start()
+	defer es.Stop()
+
+	if !b.Subscribe(es, 1, 0, current) {
+		t.Fatalf("should resume")
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if len(sc.objs) != 2 {
+		t.Fatalf("bad: %#v", sc.objs)
+	}
+
+	failed := sc.objs[0].(*memberEventRecord)
+	if len(failed.Updated) != 1 || failed.Updated[0].Old.Status != "alive" ||
+		failed.Updated[0].New.Status != "failed" {
+		t.Fatalf("bad: %#v", failed)
+	}
+
+	join := sc.objs[1].(*memberEventRecord)
+	if len(join.Added) != 1 || join.Added[0].Name != "bar" || len(join.Updated) != 0 {
+		t.Fatalf("bad: %#v", join)
+	}
+}
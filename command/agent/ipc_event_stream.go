@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/hashicorp/serf/serf"
 	"log"
+	"reflect"
 )
 
 type streamClient interface {
@@ -13,25 +14,85 @@ type streamClient interface {
 // eventStream is used to stream events to a client over IPC
 type eventStream struct {
 	client  streamClient
-	eventCh chan serf.Event
+	eventCh chan streamEvent
 	filters []EventFilter
 	logger  *log.Logger
 	seq     uint64
+
+	// members is the state of each member as last sent on this stream,
+	// used to send member events as a diff
+	members map[string]Member
 }
 
-func newEventStream(client streamClient, filters []EventFilter, seq uint64, logger *log.Logger) *eventStream {
-	es := &eventStream{
+// newEventStream creates a stream for events matching the filters. The
+// events are queued until Start, and the members that the diffs of the
+// member events are computed against are set by eventBuffer.Subscribe.
+func newEventStream(client streamClient, filters []EventFilter, seq uint64,
+	logger *log.Logger) *eventStream {
+	return &eventStream{
 		client:  client,
-		eventCh: make(chan serf.Event, 512),
+		eventCh: make(chan streamEvent, 512),
 		filters: filters,
 		logger:  logger,
 		seq:     seq,
+		members: make(map[string]Member),
 	}
+}
+
+// Start starts sending the queued events, such as once the response to
+// the stream request is sent.
+func (es *eventStream) Start() {
 	go es.stream()
-	return es
 }
 
-func (es *eventStream) HandleEvent(e serf.Event) {
+// seed sets the member states that the diffs are computed against, for
+// a stream that is about to replay the given events. The members are the
+// current ones, which already include the changes of the replayed
+// events. The members that the replayed events change are instead taken
+// as of the earlier buffered events, so that the replayed events are
+// diffed against the state that the client saw before them. Members that
+// no buffered event describes are left out, and are added by the replay.
+func (es *eventStream) seed(members []serf.Member, earlier, replay []streamEvent) {
+	replayed := make(map[string]struct{})
+	for _, se := range replay {
+		if members, ok := eventMembers(se.Event); ok {
+			for _, m := range members {
+				replayed[m.Name] = struct{}{}
+			}
+		}
+	}
+
+	for _, m := range ipcMembers(members) {
+		if _, ok := replayed[m.Name]; ok {
+			continue
+		}
+		if m.Status != serf.StatusLeft.String() {
+			es.members[m.Name] = m
+		}
+	}
+
+	for _, se := range earlier {
+		members, ok := eventMembers(se.Event)
+		if !ok {
+			continue
+		}
+		for _, m := range ipcMembers(members) {
+			if _, ok := replayed[m.Name]; !ok {
+				continue
+			}
+			if se.Event.EventType() == serf.EventMemberLeave || m.Status == serf.StatusLeft.String() {
+				delete(es.members, m.Name)
+			} else {
+				es.members[m.Name] = m
+			}
+		}
+	}
+}
+
+// Handle queues an event to be sent on the stream if it matches
+// the filters. The token is sent along with the event so the client
+// can later resume the stream after it.
+func (es *eventStream) Handle(token uint64, e serf.Event) {
 	// Check the event
 	for _, f := range es.filters {
 		if f.Invoke(e) {
@@ -43,7 +104,7 @@ func (es *eventStream) HandleEvent(e serf.Event) {
 	// Do a non-blocking send
 HANDLE:
 	select {
-	case es.eventCh <- e:
+	case es.eventCh <- streamEvent{Token: token, Event: e}:
 	default:
 		es.logger.Printf("[WARN] Dropping event to %v", es.client)
 	}
@@ -55,14 +116,16 @@ func (es *eventStream) Stop() {
 
 func (es *eventStream) stream() {
 	var err error
-	for event := range es.eventCh {
-		switch e := event.(type) {
+	for se := range es.eventCh {
+		switch e := se.Event.(type) {
 		case serf.MemberEvent:
-			err = es.sendMemberEvent(e)
+			err = es.sendMemberEvent(se.Token, e, e.Members, e.PrevTags)
+		case ReconcileEvent:
+			err = es.sendMemberEvent(se.Token, e, e.Members, nil)
 		case serf.UserEvent:
-			err = es.sendUserEvent(e)
+			err = es.sendUserEvent(se.Token, e)
 		default:
-			err = fmt.Errorf("Unknown event type: %s", event.EventType().String())
+			err = fmt.Errorf("Unknown event type: %s", EventName(se.Event))
 		}
 		if err != nil {
 			es.logger.Printf("[ERR] Failed to stream event to %v: %v",
@@ -72,49 +135,67 @@ func (es *eventStream) stream() {
 	}
 }
 
-// sendMemberEvent is used to send a single member event
-func (es *eventStream) sendMemberEvent(me serf.MemberEvent) error {
-	members := make([]Member, 0, len(me.Members))
-	for _, m := range me.Members {
-		sm := Member{
-			Name:        m.Name,
-			Addr:        m.Addr,
-			Port:        m.Port,
-			Role:        m.Role,
-			Status:      m.Status.String(),
-			ProtocolMin: m.ProtocolMin,
-			ProtocolMax: m.ProtocolMax,
-			ProtocolCur: m.ProtocolCur,
-			DelegateMin: m.DelegateMin,
-			DelegateMax: m.DelegateMax,
-			DelegateCur: m.DelegateCur,
-		}
-		members = append(members, sm)
-	}
+// sendMemberEvent is used to send a single member or reconcile event
+func (es *eventStream) sendMemberEvent(token uint64, e serf.Event,
+	list []serf.Member, prevTags map[string]map[string]string) error {
+	members := ipcMembers(list)
 
 	header := responseHeader{
 		Seq:   es.seq,
 		Error: "",
 	}
 	rec := memberEventRecord{
-		Event:   me.String(),
-		Members: members,
+		Event:    EventName(e),
+		ID:       EventID(e),
+		Token:    token,
+		Members:  members,
+		PrevTags: prevTags,
 	}
+	es.diffMembers(e.EventType(), members, &rec)
 	return es.client.Send(&header, &rec)
 }
 
+// diffMembers fills in the Added, Updated and Removed members of the
+// record, relative to the member states previously sent on this stream.
+// Members that leave are removed. Members that fail are only updated,
+// since they may still reconnect.
+func (es *eventStream) diffMembers(t serf.EventType, members []Member,
+	rec *memberEventRecord) {
+	for _, m := range members {
+		old, ok := es.members[m.Name]
+		if t == serf.EventMemberLeave || m.Status == serf.StatusLeft.String() {
+			if ok {
+				rec.Removed = append(rec.Removed, m)
+				delete(es.members, m.Name)
+			}
+			continue
+		}
+
+		if !ok {
+			rec.Added = append(rec.Added, m)
+		} else if !reflect.DeepEqual(old, m) {
+			rec.Updated = append(rec.Updated, memberUpdate{Old: old, New: m})
+		}
+		es.members[m.Name] = m
+	}
+}
+
 // sendUserEvent is used to send a single user event
-func (es *eventStream) sendUserEvent(ue serf.UserEvent) error {
+func (es *eventStream) sendUserEvent(token uint64, ue serf.UserEvent) error {
 	header := responseHeader{
 		Seq:   es.seq,
 		Error: "",
 	}
 	rec := userEventRecord{
 		Event:    ue.EventType().String(),
+		ID:       EventID(ue),
+		Token:    token,
 		LTime:    ue.LTime,
 		Name:     ue.Name,
 		Payload:  ue.Payload,
 		Coalesce: ue.Coalesce,
+		Version:  ue.Version,
+		Target:   ue.Target,
 	}
 	return es.client.Send(&header, &rec)
 }
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -26,21 +27,22 @@ func TestIPCEventStream(t *testing.T) {
 	sc := &MockStreamClient{}
 	filters := ParseEventFilter("user:foobar,member-join")
 	es := newEventStream(sc, filters, 42, log.New(os.Stderr, "", log.LstdFlags))
+	es.Start()
 	defer es.Stop()
 
-	es.HandleEvent(serf.UserEvent{
+	es.Handle(1, serf.UserEvent{
 		LTime:    123,
 		Name:     "foobar",
 		Payload:  []byte("test"),
 		Coalesce: true,
 	})
-	es.HandleEvent(serf.UserEvent{
+	es.Handle(2, serf.UserEvent{
 		LTime:    124,
 		Name:     "ignore",
 		Payload:  []byte("test"),
 		Coalesce: true,
 	})
-	es.HandleEvent(serf.MemberEvent{
+	es.Handle(3, serf.MemberEvent{
 		Type: serf.EventMemberJoin,
 		Members: []serf.Member{
 			serf.Member{
@@ -77,9 +79,15 @@ func TestIPCEventStream(t *testing.T) {
 	if obj1.Event != "user" {
 		t.Fatalf("bad event: %#v", obj1)
 	}
+	if obj1.Token != 1 {
+		t.Fatalf("bad event: %#v", obj1)
+	}
 	if obj1.LTime != 123 {
 		t.Fatalf("bad event: %#v", obj1)
 	}
+	if !strings.HasPrefix(obj1.ID, "user-123-") {
+		t.Fatalf("bad event: %#v", obj1)
+	}
 	if obj1.Name != "foobar" {
 		t.Fatalf("bad event: %#v", obj1)
 	}
@@ -94,6 +102,9 @@ func TestIPCEventStream(t *testing.T) {
 	if obj2.Event != "member-join" {
 		t.Fatalf("bad event: %#v", obj2)
 	}
+	if obj2.Token != 3 {
+		t.Fatalf("bad event: %#v", obj2)
+	}
 	mem1 := obj2.Members[0]
 	if mem1.Name != "TestNode" {
 		t.Fatalf("bad member: %#v", mem1)
@@ -125,4 +136,106 @@ func TestIPCEventStream(t *testing.T) {
 	if mem1.DelegateCur != 0 {
 		t.Fatalf("bad member: %#v", mem1)
 	}
+	if len(obj2.Added) != 1 || obj2.Added[0].Name != "TestNode" {
+		t.Fatalf("bad added: %#v", obj2)
+	}
+}
+
+func TestIPCEventStream_diff(t *testing.T) {
+	sc := &MockStreamClient{}
+	filters := ParseEventFilter("*")
+	existing := []serf.Member{
+		serf.Member{Name: "foo", Status: serf.StatusAlive},
+		serf.Member{Name: "gone", Status: serf.StatusLeft},
+	}
+	es := newEventStream(sc, filters, 42, log.New(os.Stderr, "", log.LstdFlags))
+	es.seed(existing, nil, nil)
+	es.Start()
+	defer es.Stop()
+
+	es.Handle(1, serf.MemberEvent{
+		Type: serf.EventMemberJoin,
+		Members: []serf.Member{
+			serf.Member{Name: "foo", Status: serf.StatusAlive},
+			serf.Member{Name: "bar", Status: serf.StatusAlive},
+		},
+	})
+	es.Handle(2, serf.MemberEvent{
+		Type: serf.EventMemberFailed,
+		Members: []serf.Member{
+			serf.Member{Name: "foo", Status: serf.StatusFailed},
+		},
+	})
+	es.Handle(3, serf.MemberEvent{
+		Type: serf.EventMemberLeave,
+		Members: []serf.Member{
+			serf.Member{Name: "bar", Status: serf.StatusLeft},
+		},
+	})
+
+	time.Sleep(5 * time.Millisecond)
+
+	if len(sc.objs) != 3 {
+		t.Fatalf("expected 3 messages!")
+	}
+
+	join := sc.objs[0].(*memberEventRecord)
+	if len(join.Added) != 1 || join.Added[0].Name != "bar" {
+		t.Fatalf("bad: %#v", join)
+	}
+	if len(join.Updated) != 0 || len(join.Removed) != 0 {
+		t.Fatalf("bad: %#v", join)
+	}
+
+	failed := sc.objs[1].(*memberEventRecord)
+	if len(failed.Updated) != 1 {
+		t.Fatalf("bad: %#v", failed)
+	}
+	if failed.Updated[0].Old.Status != "alive" || failed.Updated[0].New.Status != "failed" {
+		t.Fatalf("bad: %#v", failed.Updated[0])
+	}
+
+	leave := sc.objs[2].(*memberEventRecord)
+	if len(leave.Removed) != 1 || leave.Removed[0].Name != "bar" {
+		t.Fatalf("bad: %#v", leave)
+	}
+}
+
+func TestIPCEventStream_update(t *testing.T) {
+	sc := &MockStreamClient{}
+	filters := ParseEventFilter("member-update")
+	existing := []serf.Member{
+		serf.Member{Name: "foo", Status: serf.StatusAlive,
+			Tags: map[string]string{"version": "1"}},
+	}
+	es := newEventStream(sc, filters, 42, log.New(os.Stderr, "", log.LstdFlags))
+	es.seed(existing, nil, nil)
+	es.Start()
+	defer es.Stop()
+
+	es.Handle(1, serf.MemberEvent{
+		Type: serf.EventMemberUpdate,
+		Members: []serf.Member{
+			serf.Member{Name: "foo", Status: serf.StatusAlive,
+				Tags: map[string]string{"version": "2"}},
+		},
+		PrevTags: map[string]map[string]string{"foo": {"version": "1"}},
+	})
+
+	time.Sleep(5 * time.Millisecond)
+
+	if len(sc.objs) != 1 {
+		t.Fatalf("expected 1 message!")
+	}
+
+	update := sc.objs[0].(*memberEventRecord)
+	if update.Event != "member-update" {
+		t.Fatalf("bad: %#v", update)
+	}
+	if update.PrevTags["foo"]["version"] != "1" {
+		t.Fatalf("bad: %#v", update.PrevTags)
+	}
+	if len(update.Updated) != 1 || update.Updated[0].New.Tags["version"] != "2" {
+		t.Fatalf("bad: %#v", update)
+	}
 }
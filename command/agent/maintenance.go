@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// maintenanceTag is the tag that the members in maintenance mode
+// advertise, with the reason as its value.
+const maintenanceTag = "maintenance"
+
+// maintenanceState is the maintenance mode of the local node. It is
+// persisted in the data directory, if there is one, so that the node is
+// still in maintenance mode after the agent restarts.
+type maintenanceState struct {
+	Enabled bool
+	Reason  string
+}
+
+// LoadMaintenance restores the maintenance mode of the local node from
+// the file at path, and persists it there from now on. It must be called
+// before the agent is started, so that the node is advertised with the
+// maintenance tag as soon as it joins. A missing file is not an error.
+func (a *Agent) LoadMaintenance(path string) error {
+	a.tagLock.Lock()
+	defer a.tagLock.Unlock()
+	a.maintenancePath = path
+
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Error reading maintenance state: %s", err)
+	}
+
+	var state maintenanceState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return fmt.Errorf("Error decoding maintenance state: %s", err)
+	}
+
+	a.maintenanceLock.Lock()
+	a.maintenance = state
+	a.maintenanceLock.Unlock()
+
+	if state.Enabled {
+		a.logger.Printf("[INFO] agent: Restored maintenance mode: %#v", state.Reason)
+	}
+	a.conf.Tags = a.advertisedTags()
+	return nil
+}
+
+// SetMaintenance enables or disables the maintenance mode of the local
+// node. While it is enabled, user events don't invoke the event scripts
+// of the agent, and the node advertises the maintenance tag, so that
+// other members, including those that join later, show it as under
+// maintenance.
+func (a *Agent) SetMaintenance(enable bool, reason string) error {
+	a.tagLock.Lock()
+	defer a.tagLock.Unlock()
+
+	// The tag always has a value, so that tag filters can match it
+	if enable && reason == "" {
+		reason = "maintenance"
+	}
+	state := maintenanceState{Enabled: enable}
+	if enable {
+		state.Reason = reason
+	}
+
+	a.maintenanceLock.Lock()
+	old := a.maintenance
+	a.maintenance = state
+	a.maintenanceLock.Unlock()
+
+	a.logger.Printf("[INFO] agent: Setting maintenance mode: %v %#v", enable, reason)
+	if err := a.serf.SetTags(a.advertisedTags()); err != nil {
+		a.maintenanceLock.Lock()
+		a.maintenance = old
+		a.maintenanceLock.Unlock()
+		return err
+	}
+	return a.saveMaintenance(state)
+}
+
+// saveMaintenance persists the maintenance mode of the local node, if it
+// has a path, see LoadMaintenance. The tagLock must be held.
+func (a *Agent) saveMaintenance(state maintenanceState) error {
+	if a.maintenancePath == "" {
+		return nil
+	}
+
+	if !state.Enabled {
+		if err := os.Remove(a.maintenancePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error removing maintenance state: %s", err)
+		}
+		return nil
+	}
+
+	raw, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(a.maintenancePath, raw, 0600); err != nil {
+		return fmt.Errorf("Error writing maintenance state: %s", err)
+	}
+	return nil
+}
+
+// InMaintenance returns true if the local node is in maintenance mode.
+func (a *Agent) InMaintenance() bool {
+	a.maintenanceLock.Lock()
+	defer a.maintenanceLock.Unlock()
+	return a.maintenance.Enabled
+}
+
+// Maintenance returns the reasons of the members in maintenance mode,
+// which are those with the maintenance tag, keyed by node name.
+func (a *Agent) Maintenance() map[string]string {
+	result := make(map[string]string)
+	for _, m := range a.serf.Members() {
+		if reason, ok := m.Tags[maintenanceTag]; ok {
+			result[m.Name] = reason
+		}
+	}
+	return result
+}
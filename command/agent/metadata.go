@@ -0,0 +1,261 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tagSourceTimeout is how long a command of tags_from may run before it
+// is killed, so that a hung command doesn't block the agent from starting.
+const tagSourceTimeout = 10 * time.Second
+
+// MetadataFetcher retrieves tags for the local node from an instance
+// metadata service, such as the ones provided by cloud platforms.
+type MetadataFetcher interface {
+	FetchTags() (map[string]string, error)
+}
+
+// MetadataFetchers are the fetchers that can be selected by name with
+// the tag_metadata configuration. Programs embedding the agent may add
+// their own before the configuration is read.
+var MetadataFetchers = map[string]MetadataFetcher{
+	"ec2": &HTTPMetadataFetcher{
+		BaseURL:        "http://169.254.169.254/latest/meta-data/",
+		TokenURL:       "http://169.254.169.254/latest/api/token",
+		TokenTTLHeader: "X-aws-ec2-metadata-token-ttl-seconds",
+		TokenHeader:    "X-aws-ec2-metadata-token",
+		Paths: map[string]string{
+			"az":            "placement/availability-zone",
+			"instance_type": "instance-type",
+			"instance_id":   "instance-id",
+		},
+	},
+	"gce": &HTTPMetadataFetcher{
+		BaseURL: "http://metadata.google.internal/computeMetadata/v1/instance/",
+		Header:  map[string]string{"Metadata-Flavor": "Google"},
+		Paths: map[string]string{
+			"az":            "zone",
+			"instance_type": "machine-type",
+			"instance_id":   "id",
+		},
+	},
+}
+
+// HTTPMetadataFetcher fetches each tag with a GET request to a path
+// relative to BaseURL. Only the last path segment of a value is used,
+// so "projects/1234/zones/us-east1-b" becomes "us-east1-b".
+type HTTPMetadataFetcher struct {
+	BaseURL string
+
+	// Header are extra headers sent with every request
+	Header map[string]string
+
+	// TokenURL, if set, is where a session token is requested with a PUT
+	// before the tags are fetched, as the EC2 IMDSv2 requires. The token
+	// is valid for a minute, which is sent in the TokenTTLHeader, and is
+	// sent along with every request in the TokenHeader. If no token can
+	// be obtained, such as from an IMDSv1 only service, the tags are
+	// fetched without one.
+	TokenURL       string
+	TokenTTLHeader string
+	TokenHeader    string
+
+	// Paths maps the tag names to the paths they are fetched from
+	Paths map[string]string
+
+	// Timeout applies to each request. Defaults to 2 seconds.
+	Timeout time.Duration
+}
+
+func (f *HTTPMetadataFetcher) FetchTags() (map[string]string, error) {
+	timeout := f.Timeout
+	if timeout == 0 {
+		timeout = 2 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+
+	var token string
+	if f.TokenURL != "" {
+		token, _ = f.fetchToken(client)
+	}
+
+	tags := make(map[string]string, len(f.Paths))
+	for tag, path := range f.Paths {
+		value, err := f.fetch(client, path, token)
+		if err != nil {
+			return nil, fmt.Errorf("Error fetching tag '%s': %s", tag, err)
+		}
+		tags[tag] = value
+	}
+	return tags, nil
+}
+
+// fetchToken requests a session token from the TokenURL
+func (f *HTTPMetadataFetcher) fetchToken(client *http.Client) (string, error) {
+	req, err := http.NewRequest("PUT", f.TokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range f.Header {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set(f.TokenTTLHeader, "60")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// fetch retrieves a single value from the metadata service, with the
+// session token if there is one
+func (f *HTTPMetadataFetcher) fetch(client *http.Client, path, token string) (string, error) {
+	req, err := http.NewRequest("GET", f.BaseURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range f.Header {
+		req.Header.Set(k, v)
+	}
+	if token != "" {
+		req.Header.Set(f.TokenHeader, token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	value := strings.TrimSpace(string(body))
+	if idx := strings.LastIndex(value, "/"); idx >= 0 {
+		value = value[idx+1:]
+	}
+	return value, nil
+}
+
+// MetadataTags fetches the tags from the named metadata fetchers and
+// merges the given tags over them, so tags that are configured
+// explicitly take precedence. If a fetcher fails, it is an error if
+// required is set. Otherwise the failure is logged as a warning and the
+// agent goes on without the tags of that fetcher.
+func MetadataTags(fetchers []string, required bool, tags map[string]string,
+	logger *log.Logger) (map[string]string, error) {
+	if len(fetchers) == 0 {
+		return tags, nil
+	}
+
+	result := make(map[string]string)
+	for _, name := range fetchers {
+		fetcher, ok := MetadataFetchers[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown metadata fetcher: %s", name)
+		}
+
+		fetched, err := fetcher.FetchTags()
+		if err != nil && required {
+			return nil, fmt.Errorf("Error fetching %s metadata: %s", name, err)
+		} else if err != nil {
+			logger.Printf("[WARN] agent: Error fetching %s metadata, "+
+				"continuing without its tags: %s", name, err)
+			continue
+		}
+		for k, v := range fetched {
+			result[k] = v
+		}
+	}
+
+	for k, v := range tags {
+		result[k] = v
+	}
+	return result, nil
+}
+
+// SourcedTags reads the tags from their sources, as given by the
+// tags_from configuration, and merges the given tags over them. A source
+// is either "file:<path>" or "cmd:<command>", and the command is run with
+// the given shell, the same as event handlers. Surrounding whitespace is
+// trimmed from the values.
+func SourcedTags(sources map[string]string, shell string, tags map[string]string) (map[string]string, error) {
+	if len(sources) == 0 {
+		return tags, nil
+	}
+
+	result := make(map[string]string, len(sources)+len(tags))
+	for tag, source := range sources {
+		var value []byte
+		var err error
+		switch {
+		case strings.HasPrefix(source, "file:"):
+			value, err = ioutil.ReadFile(strings.TrimPrefix(source, "file:"))
+		case strings.HasPrefix(source, "cmd:"):
+			value, err = tagCommandOutput(shell, strings.TrimPrefix(source, "cmd:"))
+		default:
+			err = fmt.Errorf("unknown source: %s", source)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading tag '%s': %s", tag, err)
+		}
+		result[tag] = strings.TrimSpace(string(value))
+	}
+
+	for k, v := range tags {
+		result[k] = v
+	}
+	return result, nil
+}
+
+// tagCommandOutput runs the command of a tag source and returns its
+// standard output. A command that fails or times out is an error.
+func tagCommandOutput(shell, command string) ([]byte, error) {
+	cmd, err := scriptCommand(shell, command)
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	setProcessGroup(cmd)
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	timer := time.AfterFunc(tagSourceTimeout, func() {
+		killScript(cmd)
+	})
+	defer timer.Stop()
+
+	if err := cmd.Wait(); err != nil {
+		if time.Since(start) >= tagSourceTimeout {
+			return nil, fmt.Errorf("command timed out after %s", tagSourceTimeout)
+		}
+		return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,224 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHTTPMetadataFetcher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/instance/zone":
+			w.Write([]byte("projects/1234/zones/us-east1-b"))
+		case "/instance/id":
+			w.Write([]byte("5678\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	f := &HTTPMetadataFetcher{
+		BaseURL: server.URL + "/instance/",
+		Header:  map[string]string{"Metadata-Flavor": "Google"},
+		Paths: map[string]string{
+			"az":          "zone",
+			"instance_id": "id",
+		},
+	}
+
+	tags, err := f.FetchTags()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := map[string]string{"az": "us-east1-b", "instance_id": "5678"}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("bad: %#v", tags)
+	}
+
+	f.Paths["instance_type"] = "machine-type"
+	if _, err := f.FetchTags(); err == nil {
+		t.Fatalf("should err")
+	}
+}
+
+func TestHTTPMetadataFetcher_token(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/token" && r.Method == "PUT":
+			if r.Header.Get("X-Token-TTL") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte("secret"))
+		case r.URL.Path == "/meta-data/instance-id":
+			if r.Header.Get("X-Token") != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("i-1234"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	f := &HTTPMetadataFetcher{
+		BaseURL:        server.URL + "/meta-data/",
+		TokenURL:       server.URL + "/api/token",
+		TokenTTLHeader: "X-Token-TTL",
+		TokenHeader:    "X-Token",
+		Paths:          map[string]string{"instance_id": "instance-id"},
+	}
+
+	tags, err := f.FetchTags()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if tags["instance_id"] != "i-1234" {
+		t.Fatalf("bad: %#v", tags)
+	}
+}
+
+func TestHTTPMetadataFetcher_tokenFallback(t *testing.T) {
+	// A service without tokens, like the EC2 IMDSv1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path == "/meta-data/instance-id" && r.Header.Get("X-Token") == "" {
+			w.Write([]byte("i-1234"))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	f := &HTTPMetadataFetcher{
+		BaseURL:        server.URL + "/meta-data/",
+		TokenURL:       server.URL + "/api/token",
+		TokenTTLHeader: "X-Token-TTL",
+		TokenHeader:    "X-Token",
+		Paths:          map[string]string{"instance_id": "instance-id"},
+	}
+
+	tags, err := f.FetchTags()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if tags["instance_id"] != "i-1234" {
+		t.Fatalf("bad: %#v", tags)
+	}
+}
+
+type mockMetadataFetcher map[string]string
+
+func (m mockMetadataFetcher) FetchTags() (map[string]string, error) {
+	return m, nil
+}
+
+type failingMetadataFetcher struct{}
+
+func (failingMetadataFetcher) FetchTags() (map[string]string, error) {
+	return nil, fmt.Errorf("unreachable")
+}
+
+func TestMetadataTags(t *testing.T) {
+	MetadataFetchers["mock"] = mockMetadataFetcher{"az": "east-1a", "dc": "east"}
+	defer delete(MetadataFetchers, "mock")
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	tags, err := MetadataTags([]string{"mock"}, false, map[string]string{"dc": "west"}, logger)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := map[string]string{"az": "east-1a", "dc": "west"}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("bad: %#v", tags)
+	}
+
+	if _, err := MetadataTags([]string{"nope"}, false, nil, logger); err == nil {
+		t.Fatalf("should err")
+	}
+}
+
+func TestMetadataTags_failure(t *testing.T) {
+	MetadataFetchers["mock"] = mockMetadataFetcher{"az": "east-1a"}
+	MetadataFetchers["failing"] = failingMetadataFetcher{}
+	defer delete(MetadataFetchers, "mock")
+	defer delete(MetadataFetchers, "failing")
+
+	// A failure is a warning by default
+	var out bytes.Buffer
+	logger := log.New(&out, "", 0)
+	tags, err := MetadataTags([]string{"failing", "mock"}, false,
+		map[string]string{"dc": "west"}, logger)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := map[string]string{"az": "east-1a", "dc": "west"}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("bad: %#v", tags)
+	}
+	if !strings.Contains(out.String(), "[WARN] agent: Error fetching failing metadata") {
+		t.Fatalf("bad: %s", out.String())
+	}
+
+	// Unless the metadata is required
+	if _, err := MetadataTags([]string{"failing", "mock"}, true, nil, logger); err == nil {
+		t.Fatalf("should err")
+	}
+}
+
+func TestSourcedTags(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	path := filepath.Join(td, "build-id")
+	if err := ioutil.WriteFile(path, []byte("1234\n"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	sources := map[string]string{
+		"build":  "file:" + path,
+		"kernel": "cmd:echo 3.2.0",
+		"dc":     "cmd:echo east",
+	}
+	tags, err := SourcedTags(sources, "", map[string]string{"dc": "west"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := map[string]string{"build": "1234", "kernel": "3.2.0", "dc": "west"}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("bad: %#v", tags)
+	}
+
+	if _, err := SourcedTags(map[string]string{"build": "file:" + path + ".nope"}, "", nil); err == nil {
+		t.Fatalf("should err")
+	}
+	if _, err := SourcedTags(map[string]string{"fail": "cmd:exit 1"}, "", nil); err == nil {
+		t.Fatalf("should err")
+	}
+}
@@ -0,0 +1,81 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to the given user and group. Either
+// may be a name or a numeric ID. If the group is empty, the primary group
+// of the user is used. The group is always switched first, since it can
+// no longer be changed once the user is unprivileged.
+func dropPrivileges(username, group string) error {
+	uid, gid := -1, -1
+
+	if username != "" {
+		u, err := lookupUser(username)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+
+	if group != "" {
+		id, err := lookupGroup(group)
+		if err != nil {
+			return err
+		}
+		gid = id
+	}
+
+	// Processes started by a handoff, and agents that take over again
+	// after one failed, already run as the user
+	if (uid < 0 || uid == os.Getuid()) && (gid < 0 || gid == os.Getgid()) {
+		return nil
+	}
+
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("Error setting groups: %s", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("Error setting group to %d: %s", gid, err)
+		}
+	}
+
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("Error setting user to %d: %s", uid, err)
+		}
+	}
+
+	return nil
+}
+
+// lookupUser finds a user by name or numeric ID
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+// lookupGroup finds the ID of a group given by name or numeric ID
+func lookupGroup(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
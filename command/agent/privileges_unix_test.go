@@ -0,0 +1,40 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestDropPrivileges_unknown(t *testing.T) {
+	// These must fail the lookup before any privileges are changed
+	if err := dropPrivileges("serf-no-such-user", ""); err == nil {
+		t.Fatalf("should error")
+	}
+
+	if err := dropPrivileges("", "serf-no-such-group"); err == nil {
+		t.Fatalf("should error")
+	}
+}
+
+func TestLookupGroup_numeric(t *testing.T) {
+	id, err := lookupGroup("1234")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if id != 1234 {
+		t.Fatalf("bad: %d", id)
+	}
+}
+
+func TestDropPrivileges_current(t *testing.T) {
+	// Already running as the user, such as after a handoff
+	uid := strconv.Itoa(os.Getuid())
+	gid := strconv.Itoa(os.Getgid())
+	if err := dropPrivileges(uid, gid); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
@@ -0,0 +1,10 @@
+package agent
+
+import (
+	"fmt"
+)
+
+// dropPrivileges is not supported on Windows
+func dropPrivileges(username, group string) error {
+	return fmt.Errorf("Switching user and group is not supported on Windows")
+}
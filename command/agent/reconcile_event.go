@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"github.com/hashicorp/serf/serf"
+)
+
+// eventMemberReconcile is the event type of a ReconcileEvent. Serf
+// doesn't know it, so its String method panics; use EventName instead.
+const eventMemberReconcile serf.EventType = 1000
+
+// ReconcileEvent is delivered by the agent itself, never by Serf, to
+// periodically pass the full member list to the event handlers and RPC
+// streams even if nothing has changed, see Agent.StartReconcile. It is
+// handled like a member event named "member-reconcile".
+type ReconcileEvent struct {
+	Members []serf.Member
+}
+
+func (e ReconcileEvent) EventType() serf.EventType {
+	return eventMemberReconcile
+}
+
+func (e ReconcileEvent) String() string {
+	return "member-reconcile"
+}
+
+// EventName returns the name of the type of an event, such as
+// "member-join" or "user", as used by event filters, scripts and RPC
+// streams. Unlike EventType().String(), it also knows the events of the
+// agent itself.
+func EventName(e serf.Event) string {
+	if _, ok := e.(ReconcileEvent); ok {
+		return "member-reconcile"
+	}
+	return e.EventType().String()
+}
+
+// eventMembers returns the members of a member or reconcile event, and
+// false for other events.
+func eventMembers(e serf.Event) ([]serf.Member, bool) {
+	switch e := e.(type) {
+	case serf.MemberEvent:
+		return e.Members, true
+	case ReconcileEvent:
+		return e.Members, true
+	default:
+		return nil, false
+	}
+}
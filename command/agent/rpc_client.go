@@ -2,6 +2,7 @@ package agent
 
 import (
 	"bufio"
+	"compress/gzip"
 	"fmt"
 	"github.com/hashicorp/logutils"
 	"github.com/ugorji/go/codec"
@@ -9,10 +10,12 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var (
-	clientClosed = fmt.Errorf("client closed")
+	clientClosed   = fmt.Errorf("client closed")
+	requestTimeout = fmt.Errorf("timeout waiting for response")
 )
 
 type seqCallback struct {
@@ -44,6 +47,8 @@ type RPCClient struct {
 	dispatch     map[uint64]seqHandler
 	dispatchLock sync.Mutex
 
+	timeout time.Duration
+
 	shutdown     bool
 	shutdownCh   chan struct{}
 	shutdownLock sync.Mutex
@@ -76,11 +81,40 @@ func (c *RPCClient) send(header *requestHeader, obj interface{}) error {
 	return nil
 }
 
+// RPCClientConfig is the configuration of an RPCClient
+type RPCClientConfig struct {
+	// Addr is the address of the RPC server of the agent
+	Addr string
+
+	// Compression, if set, asks the agent to compress everything it
+	// sends. Only "gzip" is supported. This saves bandwidth when
+	// monitoring or streaming from a busy agent over a slow link. Agents
+	// that are too old to support compression are spoken to without it.
+	Compression string
+
+	// Timeout, if set, limits the time to connect to the agent and to
+	// wait for the response of each request. Streams are not limited
+	// once they are started.
+	Timeout time.Duration
+}
+
 // NewRPCClient is used to create a new RPC client given the address.
 // This will properly dial, handshake, and start listening
 func NewRPCClient(addr string) (*RPCClient, error) {
+	return NewRPCClientConfig(&RPCClientConfig{Addr: addr})
+}
+
+// NewRPCClientConfig is used to create a new RPC client with the given
+// configuration. This will properly dial, handshake, and start listening
+func NewRPCClientConfig(config *RPCClientConfig) (*RPCClient, error) {
 	// Try to dial to serf
-	conn, err := net.Dial("tcp", addr)
+	var conn net.Conn
+	var err error
+	if config.Timeout > 0 {
+		conn, err = net.DialTimeout("tcp", config.Addr, config.Timeout)
+	} else {
+		conn, err = net.Dial("tcp", config.Addr)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -92,6 +126,7 @@ func NewRPCClient(addr string) (*RPCClient, error) {
 		reader:     bufio.NewReader(conn),
 		writer:     bufio.NewWriter(conn),
 		dispatch:   make(map[uint64]seqHandler),
+		timeout:    config.Timeout,
 		shutdownCh: make(chan struct{}),
 	}
 	client.dec = codec.NewDecoder(client.reader,
@@ -101,7 +136,7 @@ func NewRPCClient(addr string) (*RPCClient, error) {
 	go client.listen()
 
 	// Do the initial handshake
-	if err := client.handshake(); err != nil {
+	if err := client.handshake(config.Compression); err != nil {
 		client.Close()
 		return nil, err
 	}
@@ -125,6 +160,17 @@ func (c *RPCClient) Close() error {
 	return nil
 }
 
+// isClosed checks if the client was closed, or closed itself because
+// its connection failed
+func (c *RPCClient) isClosed() bool {
+	select {
+	case <-c.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
 // ForceLeave is used to ask the agent to issue a leave command for
 // a given node
 func (c *RPCClient) ForceLeave(node string) error {
@@ -138,6 +184,41 @@ func (c *RPCClient) ForceLeave(node string) error {
 	return c.genericRPC(&header, &req, nil)
 }
 
+// ForceLeaveAddr is like ForceLeave, but selects the members by their
+// address, either an IP or an IP and port. It fails if several members
+// have the address, unless all is true.
+func (c *RPCClient) ForceLeaveAddr(addr string, all bool) error {
+	header := requestHeader{
+		Command: forceLeaveCommand,
+		Seq:     c.getSeq(),
+	}
+	req := forceLeaveRequest{
+		Addr: addr,
+		All:  all,
+	}
+	return c.genericRPC(&header, &req, nil)
+}
+
+// ForceLeaveBulk force leaves, in one request, all the members whose
+// status matches the regular expression and that have had it for longer
+// than olderThan if it is positive. With dryRun, nothing is changed. It
+// returns the names of the matching members.
+func (c *RPCClient) ForceLeaveBulk(status string, olderThan time.Duration, dryRun bool) ([]string, error) {
+	header := requestHeader{
+		Command: forceLeaveBulkCommand,
+		Seq:     c.getSeq(),
+	}
+	req := forceLeaveBulkRequest{
+		Status:    status,
+		OlderThan: olderThan,
+		DryRun:    dryRun,
+	}
+	var resp forceLeaveBulkResponse
+
+	err := c.genericRPC(&header, &req, &resp)
+	return resp.Nodes, err
+}
+
 // Join is used to instruct the agent to attempt a join
 func (c *RPCClient) Join(addrs []string, replay bool) (int, error) {
 	header := requestHeader{
@@ -166,6 +247,141 @@ func (c *RPCClient) Members() ([]Member, error) {
 	return resp.Members, err
 }
 
+// ViewMembers is used to fetch the members of a view configured in
+// the agent
+func (c *RPCClient) ViewMembers(view string) ([]Member, error) {
+	header := requestHeader{
+		Command: viewCommand,
+		Seq:     c.getSeq(),
+	}
+	req := viewRequest{
+		View: view,
+	}
+	var resp membersResponse
+
+	err := c.genericRPC(&header, &req, &resp)
+	return resp.Members, err
+}
+
+// MembersFiltered is used to fetch the members whose role and status
+// match the regular expressions, within the given view if it isn't
+// empty. The agent does the filtering, so that large clusters aren't
+// sent in full, and returns an error for invalid expressions. Empty
+// expressions match all members.
+func (c *RPCClient) MembersFiltered(view, role, status string) ([]Member, error) {
+	header := requestHeader{
+		Command: membersFilteredCommand,
+		Seq:     c.getSeq(),
+	}
+	req := membersFilteredRequest{
+		View:   view,
+		Role:   role,
+		Status: status,
+	}
+	var resp membersResponse
+
+	err := c.genericRPC(&header, &req, &resp)
+	return resp.Members, err
+}
+
+// Dump is used to fetch a capture of the agent state, including the
+// members of the cluster, internal stats and the agent configuration.
+func (c *RPCClient) Dump() (*StateDump, error) {
+	header := requestHeader{
+		Command: dumpCommand,
+		Seq:     c.getSeq(),
+	}
+	var resp StateDump
+
+	err := c.genericRPC(&header, nil, &resp)
+	return &resp, err
+}
+
+// RuntimeDump returns the Agent.RuntimeDump of the agent, which includes
+// the stacks of all its goroutines.
+func (c *RPCClient) RuntimeDump() (string, error) {
+	header := requestHeader{
+		Command: runtimeDumpCommand,
+		Seq:     c.getSeq(),
+	}
+	var resp runtimeDumpResponse
+
+	err := c.genericRPC(&header, nil, &resp)
+	return resp.Dump, err
+}
+
+// SnapshotSave makes the agent compact its snapshot and sync it to disk
+// right away, such as before a planned reboot or a backup. It returns the
+// path and the size of the snapshot.
+func (c *RPCClient) SnapshotSave() (string, int64, error) {
+	header := requestHeader{
+		Command: snapshotSaveCommand,
+		Seq:     c.getSeq(),
+	}
+	var resp snapshotSaveResponse
+
+	err := c.genericRPC(&header, nil, &resp)
+	return resp.Path, resp.Size, err
+}
+
+// RecentEvents returns up to count of the most recent user events that
+// the agent received, oldest first, or all of those it keeps if count
+// isn't positive.
+func (c *RPCClient) RecentEvents(count int) ([]RecentEvent, error) {
+	header := requestHeader{
+		Command: recentEventsCommand,
+		Seq:     c.getSeq(),
+	}
+	req := recentEventsRequest{
+		Count: count,
+	}
+	var resp recentEventsResponse
+
+	err := c.genericRPC(&header, &req, &resp)
+	return resp.Events, err
+}
+
+// Annotate attaches an annotation to the agent's node that expires
+// after the given ttl. An empty text clears the annotation.
+func (c *RPCClient) Annotate(text string, ttl time.Duration) error {
+	header := requestHeader{
+		Command: annotateCommand,
+		Seq:     c.getSeq(),
+	}
+	req := annotateRequest{
+		Text: text,
+		TTL:  ttl,
+	}
+	return c.genericRPC(&header, &req, nil)
+}
+
+// Maintenance enables or disables the maintenance mode of the agent's
+// node, with an optional reason.
+func (c *RPCClient) Maintenance(enable bool, reason string) error {
+	header := requestHeader{
+		Command: maintenanceCommand,
+		Seq:     c.getSeq(),
+	}
+	req := maintenanceRequest{
+		Enable: enable,
+		Reason: reason,
+	}
+	return c.genericRPC(&header, &req, nil)
+}
+
+// Trace makes the agent log every gossip message it sends or receives
+// for the given duration. A duration of zero stops tracing.
+func (c *RPCClient) Trace(d time.Duration) error {
+	header := requestHeader{
+		Command: traceCommand,
+		Seq:     c.getSeq(),
+	}
+	req := traceRequest{
+		Duration: d,
+	}
+	return c.genericRPC(&header, &req, nil)
+}
+
 // UserEvent is used to trigger sending an event
 func (c *RPCClient) UserEvent(name string, payload []byte, coalesce bool) error {
 	header := requestHeader{
@@ -180,6 +396,68 @@ func (c *RPCClient) UserEvent(name string, payload []byte, coalesce bool) error
 	return c.genericRPC(&header, &req, nil)
 }
 
+// UserEventQuorum is like UserEvent, but the agent will refuse to send
+// the event unless at least quorum alive members have all of the given
+// tags, according to the agent's view of the cluster.
+func (c *RPCClient) UserEventQuorum(name string, payload []byte, coalesce bool,
+	tags map[string]string, quorum int) error {
+	header := requestHeader{
+		Command: eventCommand,
+		Seq:     c.getSeq(),
+	}
+	req := eventRequest{
+		Name:       name,
+		Payload:    payload,
+		Coalesce:   coalesce,
+		Quorum:     int32(quorum),
+		QuorumTags: tags,
+	}
+	return c.genericRPC(&header, &req, nil)
+}
+
+// UserEventVersion is like UserEventQuorum, but also sets the schema
+// version of the payload, see serf.UserEvent. A quorum of zero sends
+// the event without checking the quorum. Older agents send the event
+// without the version.
+func (c *RPCClient) UserEventVersion(name string, payload []byte, version uint8,
+	coalesce bool, tags map[string]string, quorum int) error {
+	header := requestHeader{
+		Command: eventCommand,
+		Seq:     c.getSeq(),
+	}
+	req := eventRequest{
+		Name:       name,
+		Payload:    payload,
+		Coalesce:   coalesce,
+		Quorum:     int32(quorum),
+		QuorumTags: tags,
+		Version:    version,
+	}
+	return c.genericRPC(&header, &req, nil)
+}
+
+// UserEventNode is like UserEventVersion, but the event only invokes the
+// event handlers of the named member, see Agent.UserEventNode. It uses
+// its own command, so that older agents refuse the event instead of
+// sending it to every member.
+func (c *RPCClient) UserEventNode(name string, payload []byte, node string, version uint8,
+	coalesce bool, tags map[string]string, quorum int) error {
+	header := requestHeader{
+		Command: eventNodeCommand,
+		Seq:     c.getSeq(),
+	}
+	req := eventRequest{
+		Name:       name,
+		Payload:    payload,
+		Coalesce:   coalesce,
+		Quorum:     int32(quorum),
+		QuorumTags: tags,
+		Version:    version,
+		Node:       node,
+	}
+	return c.genericRPC(&header, &req, nil)
+}
+
 // Leave is used to trigger a graceful leave and shutdown
 func (c *RPCClient) Leave() error {
 	header := requestHeader{
@@ -313,15 +591,35 @@ func (sh *streamHandler) Cleanup() {
 
 // Stream is used to subscribe to events
 func (c *RPCClient) Stream(filter string, ch chan<- map[string]interface{}) (StreamHandle, error) {
+	return c.ResumeStream(filter, 0, ch)
+}
+
+// ResumeStream is like Stream, but first replays the events after the
+// given token. Every streamed event has a "Token" that can be used to
+// resume after it, as long as the agent still buffers the events after
+// it. A token of zero replays nothing.
+func (c *RPCClient) ResumeStream(filter string, token uint64,
+	ch chan<- map[string]interface{}) (StreamHandle, error) {
+	return c.stream(streamRequest{Type: filter, Resume: token}, ch)
+}
+
+// StreamSince is like Stream, but first replays the events that the
+// agent handled within the given duration, so that a client can
+// backfill recent events after it reconnects. Only the events that the
+// agent still buffers are replayed, so a long duration in a busy
+// cluster may not reach back as far.
+func (c *RPCClient) StreamSince(filter string, since time.Duration,
+	ch chan<- map[string]interface{}) (StreamHandle, error) {
+	return c.stream(streamRequest{Type: filter, Since: since}, ch)
+}
+
+func (c *RPCClient) stream(req streamRequest, ch chan<- map[string]interface{}) (StreamHandle, error) {
 	// Setup the request
 	seq := c.getSeq()
 	header := requestHeader{
 		Command: streamCommand,
 		Seq:     seq,
 	}
-	req := streamRequest{
-		Type: filter,
-	}
 
 	// Create a monitor handler
 	initCh := make(chan error, 1)
@@ -364,16 +662,63 @@ func (c *RPCClient) Stop(handle StreamHandle) error {
 	return c.genericRPC(&header, &req, nil)
 }
 
-// handshake is used to perform the initial handshake on connect
-func (c *RPCClient) handshake() error {
+// handshake is used to perform the initial handshake on connect. Agents
+// that don't support the newest IPC version are spoken to with the
+// newest one they support.
+func (c *RPCClient) handshake(compression string) error {
+	var err error
+	for version := int32(MaxIPCVersion); version >= MinIPCVersion; version-- {
+		err = c.handshakeVersion(version, compression)
+		if err == nil || err.Error() != unsupportedIPCVersion {
+			break
+		}
+	}
+	return err
+}
+
+// handshakeVersion performs the handshake with the given IPC version.
+// The compression is only requested from version 3.
+func (c *RPCClient) handshakeVersion(version int32, compression string) error {
 	header := requestHeader{
 		Command: handshakeCommand,
 		Seq:     c.getSeq(),
 	}
 	req := handshakeRequest{
-		Version: MaxIPCVersion,
+		Version: version,
 	}
-	return c.genericRPC(&header, &req, nil)
+	if version >= 3 {
+		req.Compression = compression
+	}
+
+	// The responses after the handshake are compressed, so the decoder
+	// must be replaced before the next response is read
+	errCh := make(chan error, 1)
+	handler := func(respHeader *responseHeader) {
+		err := strToError(respHeader.Error)
+		if err == nil && req.Compression != "" {
+			err = c.decompress()
+		}
+		errCh <- err
+	}
+	c.handleSeq(header.Seq, &seqCallback{handler: handler})
+	defer c.deregisterHandler(header.Seq)
+
+	if err := c.send(&header, &req); err != nil {
+		return err
+	}
+	return c.waitResponse(errCh)
+}
+
+// decompress makes the client decompress everything that is read from
+// now on. It must be called from the listen goroutine.
+func (c *RPCClient) decompress() error {
+	gz, err := gzip.NewReader(c.reader)
+	if err != nil {
+		return err
+	}
+	c.dec = codec.NewDecoder(bufio.NewReader(gz),
+		&codec.MsgpackHandle{RawToString: true, WriteExt: true})
+	return nil
 }
 
 // genericRPC is used to send a request and wait for an
@@ -400,9 +745,25 @@ func (c *RPCClient) genericRPC(header *requestHeader, req interface{}, resp inte
 	}
 
 	// Wait for a response
+	return c.waitResponse(errCh)
+}
+
+// waitResponse waits for the result of a response handler, giving up
+// after the timeout of the client, if any. The client is closed when it
+// gives up, since the agent may still answer later, and the body of that
+// response would be read as the header of the next one.
+func (c *RPCClient) waitResponse(errCh <-chan error) error {
+	var timeoutCh <-chan time.Time
+	if c.timeout > 0 {
+		timeoutCh = time.After(c.timeout)
+	}
+
 	select {
 	case err := <-errCh:
 		return err
+	case <-timeoutCh:
+		c.Close()
+		return requestTimeout
 	case <-c.shutdownCh:
 		return clientClosed
 	}
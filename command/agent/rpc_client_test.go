@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"github.com/hashicorp/serf/serf"
 	"github.com/hashicorp/serf/testutil"
+	"github.com/ugorji/go/codec"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
 	"os"
 	"strings"
@@ -34,6 +37,190 @@ func testRPCClient(t *testing.T) (*RPCClient, *Agent, *AgentIPC) {
 	return rpcClient, agent, ipc
 }
 
+func TestRPCClientTimeout(t *testing.T) {
+	// The listener accepts connections, but nothing ever responds
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer l.Close()
+
+	config := RPCClientConfig{
+		Addr:    l.Addr().String(),
+		Timeout: 50 * time.Millisecond,
+	}
+	start := time.Now()
+	_, err = NewRPCClientConfig(&config)
+	if err != requestTimeout {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("took too long")
+	}
+}
+
+func TestRPCClientTimeout_closes(t *testing.T) {
+	// The listener completes the handshake, but never answers a request
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		handle := &codec.MsgpackHandle{RawToString: true, WriteExt: true}
+		dec := codec.NewDecoder(conn, handle)
+		enc := codec.NewEncoder(conn, handle)
+
+		var header requestHeader
+		var req handshakeRequest
+		if dec.Decode(&header) != nil || dec.Decode(&req) != nil {
+			return
+		}
+		enc.Encode(&responseHeader{Seq: header.Seq})
+
+		var ignored interface{}
+		for dec.Decode(&ignored) == nil {
+		}
+	}()
+
+	config := RPCClientConfig{
+		Addr:    l.Addr().String(),
+		Timeout: 50 * time.Millisecond,
+	}
+	client, err := NewRPCClientConfig(&config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Members(); err != requestTimeout {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A late response would misalign the connection, so it is closed
+	if !client.isClosed() {
+		t.Fatalf("should be closed")
+	}
+	if _, err := client.Members(); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+// testIPCClosed waits for the agent to close conn, and returns what the
+// agent answered.
+func testIPCClosed(t *testing.T, conn net.Conn) []byte {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := ioutil.ReadAll(conn)
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		t.Fatalf("connection not closed")
+	}
+	return resp
+}
+
+func TestIPCMalformedRequests(t *testing.T) {
+	client, a1, ipc := testRPCClient(t)
+	defer ipc.Shutdown()
+	defer client.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var handshake bytes.Buffer
+	enc := codec.NewEncoder(&handshake, &codec.MsgpackHandle{RawToString: true, WriteExt: true})
+	enc.Encode(&requestHeader{Command: handshakeCommand, Seq: 1})
+	enc.Encode(&handshakeRequest{Version: MaxIPCVersion})
+
+	// Headers that are truncated, of the wrong type, claim lengths far
+	// beyond the input, or are random bytes after a handshake. None of
+	// them may crash the agent.
+	corpus := [][]byte{
+		{0x82, 0xa7, 'C', 'o', 'm', 'm', 'a', 'n', 'd'},
+		{0x82, 0xa7, 'C', 'o', 'm', 'm', 'a', 'n', 'd', 0x92, 0x01, 0x02},
+		{0x82, 0xa7, 'C', 'o', 'm', 'm', 'a', 'n', 'd', 0xdb, 0xff, 0xff, 0xff, 0xff},
+		{0xdf, 0xff, 0xff, 0xff, 0xff},
+		{0xdd, 0xff, 0xff, 0xff, 0xff},
+		{0xc1},
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		junk := make([]byte, r.Intn(64)+1)
+		r.Read(junk)
+		corpus = append(corpus, append(handshake.Bytes(), junk...))
+	}
+
+	for _, buf := range corpus {
+		conn, err := net.Dial("tcp", ipc.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		conn.Write(buf)
+		conn.(*net.TCPConn).CloseWrite()
+
+		testIPCClosed(t, conn)
+		conn.Close()
+	}
+
+	// The agent still serves well-behaved clients
+	if _, err := client.Members(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestIPCRequestTooLarge(t *testing.T) {
+	client, a1, ipc := testRPCClient(t)
+	defer ipc.Shutdown()
+	defer client.Close()
+	defer a1.Shutdown()
+
+	handler := new(MockEventHandler)
+	a1.RegisterEventHandler(handler)
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", ipc.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	enc := codec.NewEncoder(&buf, &codec.MsgpackHandle{RawToString: true, WriteExt: true})
+	enc.Encode(&requestHeader{Command: handshakeCommand, Seq: 1})
+	enc.Encode(&handshakeRequest{Version: MaxIPCVersion})
+	enc.Encode(&requestHeader{Command: eventCommand, Seq: 2})
+	enc.Encode(&eventRequest{Name: "deploy", Payload: make([]byte, 2*maxIPCRequestSize)})
+
+	// The agent stops reading once the limit is reached, so the write
+	// only finishes when the connection is closed
+	go conn.Write(buf.Bytes())
+
+	// Only the handshake is answered
+	if resp := testIPCClosed(t, conn); len(resp) > 32 {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	testutil.Yield()
+
+	handler.Lock()
+	defer handler.Unlock()
+	for _, e := range handler.Events {
+		if ue, ok := e.(serf.UserEvent); ok && ue.Name == "deploy" {
+			t.Fatalf("bad: %#v", e)
+		}
+	}
+}
+
 func TestRPCClientForceLeave(t *testing.T) {
 	client, a1, ipc := testRPCClient(t)
 	a2 := testAgent(nil)
@@ -151,6 +338,91 @@ func TestRPCClientMembers(t *testing.T) {
 	}
 }
 
+func TestRPCClientViewMembers(t *testing.T) {
+	client, a1, ipc := testRPCClient(t)
+	defer ipc.Shutdown()
+	defer client.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	a1.SetViews(map[string]View{
+		"alive":  View{"status": "alive"},
+		"failed": View{"status": "failed"},
+	})
+
+	testutil.Yield()
+
+	mem, err := client.ViewMembers("alive")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(mem) != 1 || mem[0].Name != a1.conf.NodeName {
+		t.Fatalf("bad: %#v", mem)
+	}
+
+	mem, err = client.ViewMembers("failed")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(mem) != 0 {
+		t.Fatalf("bad: %#v", mem)
+	}
+
+	if _, err := client.ViewMembers("nope"); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestRPCClientMembersFiltered(t *testing.T) {
+	client, a1, ipc := testRPCClient(t)
+	defer ipc.Shutdown()
+	defer client.Close()
+	defer a1.Shutdown()
+
+	a1.conf.Role = "web"
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	a1.SetViews(map[string]View{
+		"failed": View{"status": "failed"},
+	})
+
+	testutil.Yield()
+
+	mem, err := client.MembersFiltered("", "^we", "alive")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(mem) != 1 || mem[0].Name != a1.conf.NodeName {
+		t.Fatalf("bad: %#v", mem)
+	}
+
+	mem, err = client.MembersFiltered("", "db", "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(mem) != 0 {
+		t.Fatalf("bad: %#v", mem)
+	}
+
+	mem, err = client.MembersFiltered("failed", "", "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(mem) != 0 {
+		t.Fatalf("bad: %#v", mem)
+	}
+
+	_, err = client.MembersFiltered("", "", "(alive")
+	if err == nil || !strings.Contains(err.Error(), "Invalid status filter") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestRPCClientUserEvent(t *testing.T) {
 	client, a1, ipc := testRPCClient(t)
 	defer ipc.Shutdown()
@@ -214,6 +486,233 @@ func TestRPCClientLeave(t *testing.T) {
 	}
 }
 
+func TestRPCClientDump(t *testing.T) {
+	client, a1, ipc := testRPCClient(t)
+	defer ipc.Shutdown()
+	defer client.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	dump, err := client.Dump()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(dump.Members) != 1 {
+		t.Fatalf("bad: %#v", dump.Members)
+	}
+
+	if dump.Stats["members"] != "1" {
+		t.Fatalf("bad: %#v", dump.Stats)
+	}
+
+	if dump.Config.NodeName != a1.conf.NodeName {
+		t.Fatalf("bad: %#v", dump.Config)
+	}
+
+	if dump.Config.EncryptKeyID != "" {
+		t.Fatalf("bad: %#v", dump.Config)
+	}
+}
+
+func TestRPCClientRecentEvents(t *testing.T) {
+	client, a1, ipc := testRPCClient(t)
+	defer ipc.Shutdown()
+	defer client.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	for _, name := range []string{"deploy", "restart", "reload"} {
+		if err := client.UserEvent(name, []byte("foo"), false); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Internal events are not kept
+	if err := a1.Annotate("draining", time.Minute); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	events, err := client.RecentEvents(2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("bad: %#v", events)
+	}
+	if events[0].Name != "restart" || events[1].Name != "reload" {
+		t.Fatalf("bad: %#v", events)
+	}
+	if events[1].Origin != a1.conf.NodeName || string(events[1].Payload) != "foo" {
+		t.Fatalf("bad: %#v", events[1])
+	}
+
+	events, err = client.RecentEvents(0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("bad: %#v", events)
+	}
+}
+
+func TestRPCClientRuntimeDump(t *testing.T) {
+	client, a1, ipc := testRPCClient(t)
+	defer ipc.Shutdown()
+	defer client.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	dump, err := client.RuntimeDump()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !strings.Contains(dump, a1.conf.NodeName) {
+		t.Fatalf("bad: %s", dump)
+	}
+
+	if !strings.Contains(dump, "\talive = 1\n") {
+		t.Fatalf("bad: %s", dump)
+	}
+
+	if !strings.Contains(dump, "goroutine ") {
+		t.Fatalf("bad: %s", dump)
+	}
+}
+
+func TestRPCClientMembers_times(t *testing.T) {
+	client, a1, ipc := testRPCClient(t)
+	defer ipc.Shutdown()
+	defer client.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	mem, err := client.Members()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(mem) != 1 {
+		t.Fatalf("bad: %#v", mem)
+	}
+
+	p := mem[0].Protocols
+	if p.Serf.Cur != mem[0].DelegateCur || p.Serf.Max != mem[0].DelegateMax ||
+		p.Memberlist.Cur != mem[0].ProtocolCur || p.Memberlist.Min != mem[0].ProtocolMin {
+		t.Fatalf("bad: %#v", mem[0])
+	}
+
+	now := time.Now().Unix()
+	if mem[0].StatusTime <= 0 || mem[0].StatusTime > now {
+		t.Fatalf("bad: %#v", mem[0])
+	}
+	if mem[0].TagsTime <= 0 || mem[0].TagsTime > now {
+		t.Fatalf("bad: %#v", mem[0])
+	}
+}
+
+func TestRPCClientAnnotate(t *testing.T) {
+	client, a1, ipc := testRPCClient(t)
+	defer ipc.Shutdown()
+	defer client.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if err := client.Annotate("draining", time.Hour); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	mem, err := client.Members()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(mem) != 1 || mem[0].Annotation != "draining" {
+		t.Fatalf("bad: %#v", mem)
+	}
+
+	if err := client.Annotate("draining", 0); err == nil {
+		t.Fatalf("should err")
+	}
+}
+
+func TestRPCClientMaintenance(t *testing.T) {
+	client, a1, ipc := testRPCClient(t)
+	defer ipc.Shutdown()
+	defer client.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if err := client.Maintenance(true, "kernel patch"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	mem, err := client.Members()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(mem) != 1 || mem[0].Maintenance != "kernel patch" {
+		t.Fatalf("bad: %#v", mem)
+	}
+}
+
+func TestRPCClientTrace(t *testing.T) {
+	client, a1, ipc := testRPCClient(t)
+	defer ipc.Shutdown()
+	defer client.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := client.Trace(time.Minute); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := client.Trace(0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
 func TestRPCClientMonitor(t *testing.T) {
 	client, a1, ipc := testRPCClient(t)
 	defer ipc.Shutdown()
@@ -260,6 +759,63 @@ func TestRPCClientMonitor(t *testing.T) {
 	}
 }
 
+func TestRPCClientCompression(t *testing.T) {
+	client, a1, ipc := testRPCClient(t)
+	defer ipc.Shutdown()
+	defer client.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	addr := ipc.listener.Addr().String()
+	config := RPCClientConfig{Addr: addr, Compression: "snappy"}
+	if _, err := NewRPCClientConfig(&config); err == nil ||
+		err.Error() != unsupportedCompression {
+		t.Fatalf("err: %v", err)
+	}
+
+	config.Compression = "gzip"
+	gzClient, err := NewRPCClientConfig(&config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer gzClient.Close()
+
+	eventCh := make(chan string, 64)
+	if handle, err := gzClient.Monitor("debug", eventCh); err != nil {
+		t.Fatalf("err: %s", err)
+	} else {
+		defer gzClient.Stop(handle)
+	}
+
+	testutil.Yield()
+	drainEventCh(eventCh)
+
+	// Join a bad thing to generate more events
+	a1.Join(nil, false)
+
+	testutil.Yield()
+
+	select {
+	case e := <-eventCh:
+		if !strings.Contains(e, "joining") {
+			t.Fatalf("bad: %s", e)
+		}
+	default:
+		t.Fatalf("should have message")
+	}
+
+	mem, err := gzClient.Members()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(mem) != 1 {
+		t.Fatalf("bad: %#v", mem)
+	}
+}
+
 func TestRPCClientStream_User(t *testing.T) {
 	client, a1, ipc := testRPCClient(t)
 	defer ipc.Shutdown()
@@ -308,6 +864,112 @@ func TestRPCClientStream_User(t *testing.T) {
 	}
 }
 
+func TestRPCClientResumeStream(t *testing.T) {
+	client, a1, ipc := testRPCClient(t)
+	defer ipc.Shutdown()
+	defer client.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	eventCh := make(chan map[string]interface{}, 64)
+	handle, err := client.Stream("user", eventCh)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if err := client.UserEvent("first", nil, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := client.UserEvent("second", nil, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	var token uint64
+	select {
+	case e := <-eventCh:
+		if e["Name"].(string) != "first" {
+			t.Fatalf("bad event: %#v", e)
+		}
+		token = uint64(e["Token"].(int64))
+	default:
+		t.Fatalf("should have event")
+	}
+	client.Stop(handle)
+
+	// Resuming after the first event should replay the second
+	resumeCh := make(chan map[string]interface{}, 64)
+	if handle, err := client.ResumeStream("user", token, resumeCh); err != nil {
+		t.Fatalf("err: %s", err)
+	} else {
+		defer client.Stop(handle)
+	}
+
+	testutil.Yield()
+
+	select {
+	case e := <-resumeCh:
+		if e["Name"].(string) != "second" {
+			t.Fatalf("bad event: %#v", e)
+		}
+	default:
+		t.Fatalf("should have event")
+	}
+
+	// A token that was never handed out can't be resumed
+	badCh := make(chan map[string]interface{}, 64)
+	if _, err := client.ResumeStream("user", token+100, badCh); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestRPCClientStreamSince(t *testing.T) {
+	client, a1, ipc := testRPCClient(t)
+	defer ipc.Shutdown()
+	defer client.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := client.UserEvent("first", nil, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := client.UserEvent("second", nil, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	// The events before the stream are backfilled
+	eventCh := make(chan map[string]interface{}, 64)
+	if handle, err := client.StreamSince("user", time.Minute, eventCh); err != nil {
+		t.Fatalf("err: %s", err)
+	} else {
+		defer client.Stop(handle)
+	}
+
+	testutil.Yield()
+
+	for _, name := range []string{"first", "second"} {
+		select {
+		case e := <-eventCh:
+			if e["Name"].(string) != name {
+				t.Fatalf("bad event: %#v", e)
+			}
+		default:
+			t.Fatalf("should have event %s", name)
+		}
+	}
+}
+
 func TestRPCClientStream_Member(t *testing.T) {
 	client, a1, ipc := testRPCClient(t)
 	defer ipc.Shutdown()
@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+)
+
+// poolClosed is returned by an RPCPool after Close
+var poolClosed = fmt.Errorf("pool closed")
+
+// RPCPool keeps a few RPCClients connected to one agent, so that
+// programs that issue many concurrent requests don't connect and
+// handshake for each of them. Clients are connected on demand, up to
+// the size of the pool, and clients whose connection failed are
+// replaced by new ones.
+type RPCPool struct {
+	config RPCClientConfig
+
+	// tokens has an entry for every client that is in use
+	tokens  chan struct{}
+	closeCh chan struct{}
+
+	lock   sync.Mutex
+	idle   []*RPCClient
+	closed bool
+}
+
+// NewRPCPool creates a pool of at most size clients with the given
+// configuration, which is used for every client. Nothing is connected
+// until the first Get.
+func NewRPCPool(config *RPCClientConfig, size int) *RPCPool {
+	if size < 1 {
+		size = 1
+	}
+	return &RPCPool{
+		config:  *config,
+		tokens:  make(chan struct{}, size),
+		closeCh: make(chan struct{}),
+	}
+}
+
+// Get returns an idle client of the pool, or connects a new one if none
+// is idle. It blocks while all the clients of the pool are in use. The
+// client must be given back with Put, and must not have streams left
+// running then.
+func (p *RPCPool) Get() (*RPCClient, error) {
+	select {
+	case p.tokens <- struct{}{}:
+	case <-p.closeCh:
+		return nil, poolClosed
+	}
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		<-p.tokens
+		return nil, poolClosed
+	}
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if !c.isClosed() {
+			p.lock.Unlock()
+			return c, nil
+		}
+	}
+	p.lock.Unlock()
+
+	c, err := NewRPCClientConfig(&p.config)
+	if err != nil {
+		<-p.tokens
+		return nil, err
+	}
+	return c, nil
+}
+
+// Put gives a client from Get back to the pool. Clients whose connection
+// failed are closed instead of being kept for the next Get.
+func (p *RPCPool) Put(c *RPCClient) {
+	p.lock.Lock()
+	if p.closed || c.isClosed() {
+		c.Close()
+	} else {
+		p.idle = append(p.idle, c)
+	}
+	p.lock.Unlock()
+	<-p.tokens
+}
+
+// Do calls f with a client of the pool, and gives it back afterwards.
+// A client whose request timed out has closed itself, and is dropped.
+func (p *RPCPool) Do(f func(*RPCClient) error) error {
+	c, err := p.Get()
+	if err != nil {
+		return err
+	}
+	err = f(c)
+	p.Put(c)
+	return err
+}
+
+// Close closes the idle clients, and the clients in use once they are
+// given back. Get fails after Close.
+func (p *RPCPool) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.closeCh)
+	for _, c := range p.idle {
+		c.Close()
+	}
+	p.idle = nil
+	return nil
+}
@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func testRPCPool(t *testing.T, size int) (*RPCPool, *Agent, *AgentIPC) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	lw := NewLogWriter(512)
+	mult := io.MultiWriter(os.Stderr, lw)
+
+	agent := testAgent(mult)
+	ipc := NewAgentIPC(agent, l, mult, lw)
+
+	pool := NewRPCPool(&RPCClientConfig{Addr: l.Addr().String()}, size)
+	return pool, agent, ipc
+}
+
+func TestRPCPool_reuse(t *testing.T) {
+	pool, a1, ipc := testRPCPool(t, 2)
+	defer ipc.Shutdown()
+	defer pool.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c1, err := pool.Get()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := c1.Members(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	pool.Put(c1)
+
+	c2, err := pool.Get()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if c2 != c1 {
+		t.Fatalf("idle client not reused")
+	}
+
+	// A client that closed is replaced
+	c2.Close()
+	pool.Put(c2)
+
+	err = pool.Do(func(c *RPCClient) error {
+		if c == c2 {
+			t.Fatalf("closed client reused")
+		}
+		_, err := c.Members()
+		return err
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestRPCPool_size(t *testing.T) {
+	pool, a1, ipc := testRPCPool(t, 1)
+	defer ipc.Shutdown()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c1, err := pool.Get()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	doneCh := make(chan *RPCClient, 1)
+	go func() {
+		c, err := pool.Get()
+		if err != nil {
+			t.Errorf("err: %s", err)
+			return
+		}
+		doneCh <- c
+	}()
+
+	select {
+	case <-doneCh:
+		t.Fatalf("got a client over the size of the pool")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	pool.Put(c1)
+	select {
+	case c := <-doneCh:
+		if c != c1 {
+			t.Fatalf("idle client not reused")
+		}
+		pool.Put(c)
+	case <-time.After(time.Second):
+		t.Fatalf("no client after put")
+	}
+
+	pool.Close()
+	if _, err := pool.Get(); err != poolClosed {
+		t.Fatalf("bad: %v", err)
+	}
+	if !c1.isClosed() {
+		t.Fatalf("idle client not closed")
+	}
+}
@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"net"
+	"time"
+)
+
+// rttTimeout is the longest that connecting to a reference node may
+// take before the node is treated as unreachable
+const rttTimeout = 5 * time.Second
+
+// StartRTT periodically measures the round trip time to the reference
+// nodes, given by name, as the time it takes to open a TCP connection to
+// their gossip port. The last measurements are returned by RTT, and are
+// also set as the "agent.rtt.<node>" gauges in milliseconds. This is a
+// rough latency signal that needs no cooperation from the reference
+// nodes. It must be called after Start.
+func (a *Agent) StartRTT(nodes []string, interval time.Duration) {
+	go a.rttLoop(nodes, interval)
+}
+
+// rttLoop measures the round trip times until shutdown
+func (a *Agent) rttLoop(nodes []string, interval time.Duration) {
+	timeout := rttTimeout
+	if interval < timeout {
+		timeout = interval
+	}
+
+	for {
+		select {
+		case <-time.After(interval):
+		case <-a.shutdownCh:
+			return
+		}
+
+		addrs := a.rttAddrs(nodes)
+		for _, node := range nodes {
+			addr, ok := addrs[node]
+			if !ok {
+				a.setRTT(node, 0)
+				continue
+			}
+
+			rtt, err := measureRTT(addr, timeout)
+			if err != nil {
+				a.logger.Printf("[DEBUG] agent: Failed to measure the RTT to %s: %s", node, err)
+			}
+			a.setRTT(node, rtt)
+		}
+	}
+}
+
+// rttAddrs returns the gossip addresses of the reference nodes that are
+// alive, keyed by node name
+func (a *Agent) rttAddrs(nodes []string) map[string]string {
+	wanted := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		wanted[node] = true
+	}
+
+	addrs := make(map[string]string, len(nodes))
+	for _, m := range a.serf.Members() {
+		if wanted[m.Name] && m.Status.String() == "alive" {
+			addrs[m.Name] = (&net.TCPAddr{IP: m.Addr, Port: int(m.Port)}).String()
+		}
+	}
+	return addrs
+}
+
+// measureRTT returns the time it takes to connect to the address
+func measureRTT(addr string, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	conn.Close()
+	return rtt, nil
+}
+
+// setRTT stores the last round trip time to a reference node, or
+// forgets it if the node couldn't be reached
+func (a *Agent) setRTT(node string, rtt time.Duration) {
+	a.rttLock.Lock()
+	defer a.rttLock.Unlock()
+
+	if rtt == 0 {
+		delete(a.rtt, node)
+		return
+	}
+	a.rtt[node] = rtt
+	a.metrics().SetGauge([]string{"agent", "rtt", node},
+		float32(rtt.Seconds()*1000))
+}
+
+// RTT returns the last round trip times to the reference nodes that
+// could be reached, see StartRTT, formatted as durations and keyed by
+// node name.
+func (a *Agent) RTT() map[string]string {
+	a.rttLock.Lock()
+	defer a.rttLock.Unlock()
+
+	result := make(map[string]string, len(a.rtt))
+	for node, rtt := range a.rtt {
+		result[node] = rtt.String()
+	}
+	return result
+}
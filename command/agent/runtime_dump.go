@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// RuntimeDump returns a snapshot of the state of the running agent as
+// text: the members by status, the statistics of Serf including the
+// queue depths, and the stacks of all goroutines. It is a cheap first
+// diagnostic for an agent that misbehaves, and is logged on SIGUSR1.
+func (a *Agent) RuntimeDump() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Runtime dump of %s at %s\n\n", a.conf.NodeName,
+		time.Now().Format(time.RFC3339))
+
+	if a.serf != nil {
+		statuses := make(map[string]int)
+		for _, m := range a.serf.Members() {
+			statuses[m.Status.String()]++
+		}
+		names := make([]string, 0, len(statuses))
+		for status := range statuses {
+			names = append(names, status)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(&buf, "members:\n")
+		for _, status := range names {
+			fmt.Fprintf(&buf, "\t%s = %d\n", status, statuses[status])
+		}
+
+		stats := a.serf.Stats()
+		keys := make([]string, 0, len(stats))
+		for k := range stats {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(&buf, "serf:\n")
+		for _, k := range keys {
+			fmt.Fprintf(&buf, "\t%s = %s\n", k, stats[k])
+		}
+	}
+
+	fmt.Fprintf(&buf, "runtime:\n")
+	fmt.Fprintf(&buf, "\tgoroutines = %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(&buf, "\tversion = %s\n\n", runtime.Version())
+
+	// Grow the buffer until all the stacks fit
+	stacks := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(stacks, true)
+		if n < len(stacks) {
+			stacks = stacks[:n]
+			break
+		}
+		stacks = make([]byte, 2*len(stacks))
+	}
+	buf.Write(stacks)
+	return buf.String()
+}
+
+// LogRuntimeDump writes the RuntimeDump to the log of the agent.
+func (a *Agent) LogRuntimeDump() {
+	a.logger.Printf("[INFO] agent: %s", a.RuntimeDump())
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"os"
+	"syscall"
+)
+
+// dumpSignals are the signals that log a RuntimeDump
+var dumpSignals = []os.Signal{syscall.SIGUSR1}
+
+// handoffSignals are the signals that hand the agent off to a new
+// process, see Command.handoff
+var handoffSignals = []os.Signal{syscall.SIGUSR2}
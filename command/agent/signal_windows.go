@@ -0,0 +1,14 @@
+package agent
+
+import (
+	"os"
+)
+
+// dumpSignals are the signals that log a RuntimeDump. Windows has no
+// SIGUSR1, so the dump is only available through RPC.
+var dumpSignals = []os.Signal{}
+
+// handoffSignals are the signals that hand the agent off to a new
+// process. Handoff is not supported on Windows, where a process can't
+// inherit the RPC listener.
+var handoffSignals = []os.Signal{}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFdsStart is the first file descriptor that systemd passes to a
+// socket activated service
+const listenFdsStart = 3
+
+// activatedListener returns the listener passed to the agent by systemd
+// socket activation, or nil if the agent wasn't socket activated. Only a
+// single socket is supported, which is used for RPC. The variables are
+// unset once they are used, so they aren't inherited by child processes.
+func activatedListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+
+	if fds != 1 {
+		return nil, fmt.Errorf("Expected a single socket from systemd, got %d", fds)
+	}
+
+	// The listener has its own copy of the descriptor
+	f := os.NewFile(listenFdsStart, "LISTEN_FD_3")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// notifyMainPID tells systemd that the process with the given PID is now
+// the main process of the service, such as the new agent process after a
+// handoff, so that systemd doesn't stop the service when the old process
+// exits. The service needs NotifyAccess=main or all for systemd to accept
+// it. It does nothing if the agent isn't run by systemd.
+func notifyMainPID(pid int) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+
+	// Sockets in the abstract namespace start with a null byte
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("MAINPID=" + strconv.Itoa(pid)))
+	return err
+}
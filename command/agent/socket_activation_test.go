@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestActivatedListener_notActivated(t *testing.T) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	// Not set
+	if l, err := activatedListener(); l != nil || err != nil {
+		t.Fatalf("bad: %v %v", l, err)
+	}
+
+	// Meant for another process
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	if l, err := activatedListener(); l != nil || err != nil {
+		t.Fatalf("bad: %v %v", l, err)
+	}
+}
+
+func TestActivatedListener_tooMany(t *testing.T) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "2")
+	if _, err := activatedListener(); err == nil {
+		t.Fatalf("should err")
+	}
+
+	// The variables are used up
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Fatalf("should be unset")
+	}
+}
+
+func TestNotifyMainPID(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+	}
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	// Not run by systemd
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := notifyMainPID(1234); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	path := filepath.Join(td, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	if err := notifyMainPID(1234); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(buf[:n]) != "MAINPID=1234" {
+		t.Fatalf("bad: %q", buf[:n])
+	}
+}
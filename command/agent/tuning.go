@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+)
+
+// osLimits are the operating system limits that affect Serf. A value of
+// zero means the limit is unknown on this platform.
+type osLimits struct {
+	UDPReadBuffer  uint64 // Maximum socket receive buffer, in bytes
+	UDPWriteBuffer uint64 // Maximum socket send buffer, in bytes
+	OpenFiles      uint64 // Soft limit of open file descriptors
+	ConntrackCount uint64 // Tracked connections
+	ConntrackMax   uint64 // Maximum of tracked connections
+}
+
+const (
+	// udpBufferPerMember is the recommended socket buffer size for each
+	// member of the cluster, so bursts of gossip aren't dropped
+	udpBufferPerMember = 4096
+
+	// minOpenFiles and largeClusterOpenFiles are the recommended limits
+	// of open files, for clusters up to and beyond largeCluster members
+	minOpenFiles          = 1024
+	largeClusterOpenFiles = 4096
+	largeCluster          = 1000
+
+	// conntrackSaturation is the ratio of tracked connections at which
+	// new UDP flows are likely to be dropped
+	conntrackSaturation = 0.9
+)
+
+// tuningHints compares the limits with the recommendations for a cluster
+// with the given number of members. The result maps the name of each
+// limit that is too low to an explanation of the problem.
+func tuningHints(limits osLimits, members int) map[string]string {
+	hints := make(map[string]string)
+
+	udpBuffer := uint64(members) * udpBufferPerMember
+	if limits.UDPReadBuffer > 0 && limits.UDPReadBuffer < udpBuffer {
+		hints["udp_read_buffer"] = fmt.Sprintf(
+			"%d bytes, recommended at least %d for %d members (net.core.rmem_max)",
+			limits.UDPReadBuffer, udpBuffer, members)
+	}
+	if limits.UDPWriteBuffer > 0 && limits.UDPWriteBuffer < udpBuffer {
+		hints["udp_write_buffer"] = fmt.Sprintf(
+			"%d bytes, recommended at least %d for %d members (net.core.wmem_max)",
+			limits.UDPWriteBuffer, udpBuffer, members)
+	}
+
+	openFiles := uint64(minOpenFiles)
+	if members > largeCluster {
+		openFiles = largeClusterOpenFiles
+	}
+	if limits.OpenFiles > 0 && limits.OpenFiles < openFiles {
+		hints["open_files"] = fmt.Sprintf(
+			"%d, recommended at least %d for %d members (ulimit -n)",
+			limits.OpenFiles, openFiles, members)
+	}
+
+	if limits.ConntrackMax > 0 &&
+		float64(limits.ConntrackCount) >= conntrackSaturation*float64(limits.ConntrackMax) {
+		hints["conntrack"] = fmt.Sprintf(
+			"%d of %d connections tracked, gossip may be dropped (net.netfilter.nf_conntrack_max)",
+			limits.ConntrackCount, limits.ConntrackMax)
+	}
+	return hints
+}
+
+// TuningHints checks the limits of the operating system against the
+// recommendations for the current size of the cluster. The result maps
+// the name of each limit that is too low to an explanation.
+func (a *Agent) TuningHints() map[string]string {
+	return tuningHints(readOSLimits(), len(a.serf.Members()))
+}
+
+// LogTuningHints logs a warning for each of the TuningHints.
+func (a *Agent) LogTuningHints() {
+	hints := a.TuningHints()
+	names := make([]string, 0, len(hints))
+	for name := range hints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		a.logger.Printf("[WARN] agent: OS limit %s is low: %s", name, hints[name])
+	}
+}
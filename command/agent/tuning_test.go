@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTuningHints(t *testing.T) {
+	limits := osLimits{
+		UDPReadBuffer:  212992,
+		UDPWriteBuffer: 4 * 1024 * 1024,
+		OpenFiles:      1024,
+		ConntrackCount: 950,
+		ConntrackMax:   1000,
+	}
+
+	hints := tuningHints(limits, 100)
+	if len(hints) != 2 {
+		t.Fatalf("bad: %#v", hints)
+	}
+	if !strings.Contains(hints["udp_read_buffer"], "recommended at least 409600") {
+		t.Fatalf("bad: %#v", hints)
+	}
+	if !strings.Contains(hints["conntrack"], "950 of 1000") {
+		t.Fatalf("bad: %#v", hints)
+	}
+
+	// Large clusters need more open files
+	hints = tuningHints(limits, 2000)
+	if _, ok := hints["open_files"]; !ok {
+		t.Fatalf("bad: %#v", hints)
+	}
+
+	// Unknown limits are never reported
+	if hints := tuningHints(osLimits{}, 5000); len(hints) != 0 {
+		t.Fatalf("bad: %#v", hints)
+	}
+}
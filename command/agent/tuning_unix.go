@@ -0,0 +1,41 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// readOSLimits reads the limits from /proc, if available, and the limit
+// of open files of the process.
+func readOSLimits() osLimits {
+	var limits osLimits
+	limits.UDPReadBuffer = readProcValue("/proc/sys/net/core/rmem_max")
+	limits.UDPWriteBuffer = readProcValue("/proc/sys/net/core/wmem_max")
+	limits.ConntrackCount = readProcValue("/proc/sys/net/netfilter/nf_conntrack_count")
+	limits.ConntrackMax = readProcValue("/proc/sys/net/netfilter/nf_conntrack_max")
+
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err == nil {
+		limits.OpenFiles = uint64(rlimit.Cur)
+	}
+	return limits
+}
+
+// readProcValue reads a single number from a file in /proc, returning
+// zero if the file can't be read.
+func readProcValue(path string) uint64 {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(raw)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
@@ -0,0 +1,6 @@
+package agent
+
+// readOSLimits is not supported on Windows, so no limits are known
+func readOSLimits() osLimits {
+	return osLimits{}
+}
@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"github.com/hashicorp/serf/serf"
+)
+
+// userEventHistorySize is the number of recent user events that the
+// agent keeps, see RecentUserEvents
+const userEventHistorySize = 256
+
+// recordUserEvent adds a user event to the history, dropping the oldest
+// one once the history is full
+func (a *Agent) recordUserEvent(e serf.UserEvent) {
+	a.userEventsLock.Lock()
+	defer a.userEventsLock.Unlock()
+
+	if len(a.userEvents) == userEventHistorySize {
+		copy(a.userEvents, a.userEvents[1:])
+		a.userEvents = a.userEvents[:userEventHistorySize-1]
+	}
+	a.userEvents = append(a.userEvents, e)
+}
+
+// RecentUserEvents returns up to n of the most recent user events that
+// the agent received, oldest first, or all of those kept if n isn't
+// positive. The internal events of the agent are not included, but the
+// events that are disabled for the event handlers are.
+func (a *Agent) RecentUserEvents(n int) []serf.UserEvent {
+	a.userEventsLock.Lock()
+	defer a.userEventsLock.Unlock()
+
+	events := a.userEvents
+	if n > 0 && n < len(events) {
+		events = events[len(events)-n:]
+	}
+	result := make([]serf.UserEvent, len(events))
+	copy(result, events)
+	return result
+}
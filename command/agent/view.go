@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/hashicorp/serf/serf"
+	"strings"
+)
+
+// View is a named filter of members, configured in the agent so that
+// consumers of the member list don't have to duplicate the filtering.
+// It maps the names of tags to the values that members must have. The
+// role is available as the "role" tag, and the status of the member,
+// such as "alive", as the "status" tag. Members whose health check
+// fails have the "health=critical" tag, and are only part of views that
+// filter on the health tag.
+type View map[string]string
+
+// ParseView parses a view from a whitespace separated list of
+// "key=value" pairs, such as "role=web dc=east status=alive".
+func ParseView(v string) (View, error) {
+	view := make(View)
+	for _, pair := range strings.Fields(v) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid filter: '%s'. Must be in the form key=value", pair)
+		}
+		view[parts[0]] = parts[1]
+	}
+	return view, nil
+}
+
+// Match tests whether a member is part of the view.
+func (v View) Match(m serf.Member) bool {
+	for name, value := range v {
+		actual := memberTag(m, name)
+		if name == "status" {
+			actual = m.Status.String()
+		}
+		if actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// SetViews replaces the views of the agent. Views can be changed while
+// the agent is running, such as on a reload.
+func (a *Agent) SetViews(views map[string]View) {
+	a.viewLock.Lock()
+	defer a.viewLock.Unlock()
+	a.views = views
+}
+
+// ViewMembers returns the members of the named view.
+func (a *Agent) ViewMembers(name string) ([]serf.Member, error) {
+	a.viewLock.Lock()
+	view, ok := a.views[name]
+	a.viewLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown view: %s", name)
+	}
+
+	_, byHealth := view[healthTag]
+	members := a.withHealth(a.serf.Members())
+	result := make([]serf.Member, 0, len(members))
+	for _, m := range members {
+		if !byHealth && m.Tags[healthTag] == healthCritical {
+			continue
+		}
+		if view.Match(m) {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"github.com/hashicorp/serf/serf"
+	"reflect"
+	"testing"
+)
+
+func TestParseView(t *testing.T) {
+	view, err := ParseView("role=web  dc=east status=alive")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := View{"role": "web", "dc": "east", "status": "alive"}
+	if !reflect.DeepEqual(view, expected) {
+		t.Fatalf("bad: %#v", view)
+	}
+
+	if _, err := ParseView("role=web dc"); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestViewMatch(t *testing.T) {
+	m := serf.Member{
+		Role:   "web",
+		Tags:   map[string]string{"dc": "east"},
+		Status: serf.StatusAlive,
+	}
+
+	cases := []struct {
+		view  View
+		match bool
+	}{
+		{View{}, true},
+		{View{"role": "web"}, true},
+		{View{"role": "web", "dc": "east", "status": "alive"}, true},
+		{View{"role": "lb"}, false},
+		{View{"dc": "west"}, false},
+		{View{"status": "failed"}, false},
+		{View{"zone": "a"}, false},
+	}
+
+	for _, tc := range cases {
+		if tc.view.Match(m) != tc.match {
+			t.Fatalf("bad: %#v %v", tc.view, tc.match)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package command
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mitchellh/cli"
+	"strings"
+	"time"
+)
+
+// AnnotateCommand is a Command implementation that attaches an
+// annotation to the member of a running Serf agent.
+type AnnotateCommand struct {
+	Ui cli.Ui
+}
+
+func (c *AnnotateCommand) Run(args []string) int {
+	var ttl time.Duration
+	cmdFlags := flag.NewFlagSet("annotate", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.DurationVar(&ttl, "ttl", time.Hour, "annotation ttl")
+	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcTimeout := RPCTimeoutFlag(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	args = cmdFlags.Args()
+	if len(args) != 1 {
+		c.Ui.Error("The annotation text must be specified.")
+		c.Ui.Error("")
+		c.Ui.Error(c.Help())
+		return 1
+	}
+
+	client, err := RPCClient(*rpcAddr, *rpcTimeout)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
+		return 1
+	}
+	defer client.Close()
+
+	if err := client.Annotate(args[0], ttl); err != nil {
+		c.Ui.Error(fmt.Sprintf("Error annotating: %s", err))
+		return 1
+	}
+
+	return 0
+}
+
+func (c *AnnotateCommand) Synopsis() string {
+	return "Attach a short-lived annotation to this member"
+}
+
+func (c *AnnotateCommand) Help() string {
+	helpText := `
+Usage: serf annotate [options] text
+
+  Attaches an annotation, such as "draining for maintenance", to the
+  member of the agent. The annotation is gossiped to the cluster and is
+  shown by "serf members -detailed" until it expires. Annotating with an
+  empty text clears the annotation.
+
+Options:
+
+  -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
+
+  -timeout=0s               Timeout of connecting to the agent and of each
+                            request. Defaults to no timeout.
+
+  -ttl=1h                   How long the annotation is kept.
+
+`
+	return strings.TrimSpace(helpText)
+}
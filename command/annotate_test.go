@@ -0,0 +1,49 @@
+package command
+
+import (
+	"github.com/hashicorp/serf/testutil"
+	"github.com/mitchellh/cli"
+	"strings"
+	"testing"
+)
+
+func TestAnnotateCommand_implements(t *testing.T) {
+	var _ cli.Command = &AnnotateCommand{}
+}
+
+func TestAnnotateCommandRun(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &AnnotateCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-ttl=10m", "draining"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	testutil.Yield()
+
+	ann := a1.Annotations()[a1.SerfConfig().NodeName]
+	if ann.Text != "draining" {
+		t.Fatalf("bad: %#v", ann)
+	}
+}
+
+func TestAnnotateCommandRun_noText(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &AnnotateCommand{Ui: ui}
+
+	code := c.Run([]string{"-rpc-addr=127.0.0.1:0"})
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "text must be specified") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
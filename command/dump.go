@@ -0,0 +1,101 @@
+package command
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mitchellh/cli"
+	"io/ioutil"
+	"strings"
+)
+
+// DumpCommand is a Command implementation that captures the state of
+// a Serf agent and its view of the cluster for offline analysis.
+type DumpCommand struct {
+	Ui cli.Ui
+}
+
+func (c *DumpCommand) Help() string {
+	helpText := `
+Usage: serf dump [options]
+
+  Captures the state of the Serf agent as JSON, including all known
+  members and their tags, the internal clocks and queue depths, and the
+  agent configuration. Encryption keys are never included, only a key
+  identifier.
+
+  With -runtime, the runtime state of the agent is captured as text
+  instead: the members by status, the queue depths, and the stacks of all
+  goroutines. The agent also logs this on SIGUSR1.
+
+Options:
+
+  -output=state.json        File to write the dump to. Defaults to
+                            writing to stdout.
+  -runtime                  Dump the runtime state instead.
+  -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
+  -timeout=0s               Timeout of connecting to the agent and of each
+                            request. Defaults to no timeout.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *DumpCommand) Run(args []string) int {
+	var output string
+	var runtimeState bool
+	cmdFlags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&output, "output", "", "output file")
+	cmdFlags.BoolVar(&runtimeState, "runtime", false, "runtime state")
+	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcTimeout := RPCTimeoutFlag(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	client, err := RPCClient(*rpcAddr, *rpcTimeout)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
+		return 1
+	}
+	defer client.Close()
+
+	var raw []byte
+	if runtimeState {
+		dump, err := client.RuntimeDump()
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error dumping runtime state: %s", err))
+			return 1
+		}
+		raw = []byte(dump)
+	} else {
+		dump, err := client.Dump()
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error dumping state: %s", err))
+			return 1
+		}
+
+		raw, err = json.MarshalIndent(dump, "", "  ")
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error encoding dump: %s", err))
+			return 1
+		}
+	}
+
+	if output == "" {
+		c.Ui.Output(string(raw))
+		return 0
+	}
+
+	if err := ioutil.WriteFile(output, raw, 0600); err != nil {
+		c.Ui.Error(fmt.Sprintf("Error writing dump: %s", err))
+		return 1
+	}
+
+	c.Ui.Output(fmt.Sprintf("State written to %s", output))
+	return 0
+}
+
+func (c *DumpCommand) Synopsis() string {
+	return "Exports the state of the agent and cluster as JSON"
+}
@@ -0,0 +1,97 @@
+package command
+
+import (
+	"encoding/json"
+	"github.com/hashicorp/serf/command/agent"
+	"github.com/mitchellh/cli"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDumpCommand_implements(t *testing.T) {
+	var _ cli.Command = &DumpCommand{}
+}
+
+func TestDumpCommandRun(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &DumpCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	if !strings.Contains(ui.OutputWriter.String(), a1.SerfConfig().NodeName) {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+}
+
+func TestDumpCommandRun_output(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+	path := filepath.Join(td, "state.json")
+
+	ui := new(cli.MockUi)
+	c := &DumpCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-output=" + path}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var dump agent.StateDump
+	if err := json.Unmarshal(raw, &dump); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(dump.Members) != 1 {
+		t.Fatalf("bad: %#v", dump)
+	}
+
+	if dump.Config.NodeName != a1.SerfConfig().NodeName {
+		t.Fatalf("bad: %#v", dump.Config)
+	}
+}
+
+func TestDumpCommandRun_runtime(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &DumpCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-runtime"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	if !strings.Contains(ui.OutputWriter.String(), "goroutines = ") {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+}
@@ -3,6 +3,7 @@ package command
 import (
 	"flag"
 	"fmt"
+	"github.com/hashicorp/serf/command/agent"
 	"github.com/mitchellh/cli"
 	"strings"
 )
@@ -25,22 +26,74 @@ Options:
                             that repeated events of the same name within a
                             short period of time are ignored, except the last
                             one received. Default is true.
+  -format=text              Output format, "text" or "json".
+  -node=name                Only invoke the event handlers of the named
+                            member. The event is still gossiped to every
+                            member, which must all run Serf 0.3.1 or later.
+  -quorum=n                 If provided, the agent will refuse to send the
+                            event unless at least n alive members match the
+                            quorum tags. Defaults to 1 if a tag is given.
+  -quorum-tag key=value     Tag that members must have to count towards the
+                            quorum. This can be specified multiple times.
   -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
+  -schema-version=n         Schema version of the payload, from 1 to 255, so
+                            that handlers can tell payload formats apart.
+  -timeout=0s               Timeout of connecting to the agent and of each
+                            request. Defaults to no timeout.
 `
 	return strings.TrimSpace(helpText)
 }
 
+// EventResult is the result of the event command with -format=json.
+type EventResult struct {
+	Name        string
+	PayloadSize int
+	Coalesce    bool
+	Quorum      int    `json:",omitempty"`
+	Version     int    `json:",omitempty"`
+	Node        string `json:",omitempty"`
+	Error       string `json:",omitempty"`
+}
+
 func (c *EventCommand) Run(args []string) int {
 	var coalesce bool
+	var quorum, schemaVersion int
+	var quorumTags []string
+	var node string
 
 	cmdFlags := flag.NewFlagSet("event", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	format := FormatFlag(cmdFlags)
 	cmdFlags.BoolVar(&coalesce, "coalesce", true, "coalesce")
+	cmdFlags.StringVar(&node, "node", "", "target node")
+	cmdFlags.IntVar(&quorum, "quorum", 0, "quorum")
+	cmdFlags.Var((*agent.AppendSliceValue)(&quorumTags), "quorum-tag", "quorum tag")
+	cmdFlags.IntVar(&schemaVersion, "schema-version", 0, "schema version")
 	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcTimeout := RPCTimeoutFlag(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
+	if err := validFormat(*format); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	if schemaVersion < 0 || schemaVersion > 255 {
+		c.Ui.Error(fmt.Sprintf("Invalid schema version: %d", schemaVersion))
+		return 1
+	}
+
+	tags, err := agent.UnmarshalTags(quorumTags)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+	if len(tags) > 0 && quorum == 0 {
+		quorum = 1
+	}
+
 	args = cmdFlags.Args()
 	if len(args) < 1 {
 		c.Ui.Error("An event name must be specified.")
@@ -60,20 +113,51 @@ func (c *EventCommand) Run(args []string) int {
 		payload = []byte(args[1])
 	}
 
-	client, err := RPCClient(*rpcAddr)
+	client, err := RPCClient(*rpcAddr, *rpcTimeout)
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
 		return 1
 	}
 	defer client.Close()
 
-	if err := client.UserEvent(event, payload, coalesce); err != nil {
+	if node != "" {
+		err = client.UserEventNode(event, payload, node, uint8(schemaVersion), coalesce, tags, quorum)
+	} else if schemaVersion > 0 {
+		err = client.UserEventVersion(event, payload, uint8(schemaVersion), coalesce, tags, quorum)
+	} else if quorum > 0 {
+		err = client.UserEventQuorum(event, payload, coalesce, tags, quorum)
+	} else {
+		err = client.UserEvent(event, payload, coalesce)
+	}
+	if *format == "json" {
+		result := EventResult{
+			Name:        event,
+			PayloadSize: len(payload),
+			Coalesce:    coalesce,
+			Quorum:      quorum,
+			Version:     schemaVersion,
+			Node:        node,
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if err := outputJSON(c.Ui, result); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+	} else if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error sending event: %s", err))
-		return 1
+	} else if node != "" {
+		c.Ui.Output(fmt.Sprintf("Event '%s' dispatched for %s! Coalescing enabled: %#v",
+			event, node, coalesce))
+	} else {
+		c.Ui.Output(fmt.Sprintf("Event '%s' dispatched! Coalescing enabled: %#v",
+			event, coalesce))
 	}
 
-	c.Ui.Output(fmt.Sprintf("Event '%s' dispatched! Coalescing enabled: %#v",
-		event, coalesce))
+	if err != nil {
+		return 1
+	}
 	return 0
 }
 
@@ -1,6 +1,10 @@
 package command
 
 import (
+	"encoding/json"
+	"github.com/hashicorp/serf/command/agent"
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
 	"github.com/mitchellh/cli"
 	"strings"
 	"testing"
@@ -39,3 +43,144 @@ func TestEventCommandRun_tooMany(t *testing.T) {
 		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
 	}
 }
+
+func TestEventCommandRun_quorum(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &EventCommand{Ui: ui}
+	args := []string{
+		"-rpc-addr=" + rpcAddr,
+		"-quorum-tag=role=db",
+		"deploy",
+	}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "Quorum not met") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+
+	ui = new(cli.MockUi)
+	c = &EventCommand{Ui: ui}
+	args = []string{
+		"-rpc-addr=" + rpcAddr,
+		"-quorum-tag=role=test",
+		"deploy",
+	}
+
+	code = c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+}
+
+func TestEventCommandRun_schemaVersion(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	handler := new(agent.MockEventHandler)
+	a1.RegisterEventHandler(handler)
+
+	ui := new(cli.MockUi)
+	c := &EventCommand{Ui: ui}
+	code := c.Run([]string{"-rpc-addr=" + rpcAddr, "-schema-version=3", "deploy", "v3"})
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	testutil.Yield()
+
+	handler.Lock()
+	found := false
+	for _, raw := range handler.Events {
+		if e, ok := raw.(serf.UserEvent); ok {
+			found = e.Name == "deploy" && e.Version == 3
+		}
+	}
+	handler.Unlock()
+	if !found {
+		t.Fatalf("bad: %#v", handler.Events)
+	}
+
+	ui = new(cli.MockUi)
+	c = &EventCommand{Ui: ui}
+	if code := c.Run([]string{"-rpc-addr=" + rpcAddr, "-schema-version=256", "deploy"}); code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+}
+
+func TestEventCommandRun_node(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	handler := new(agent.MockEventHandler)
+	a1.RegisterEventHandler(handler)
+
+	node := a1.SerfConfig().NodeName
+	ui := new(cli.MockUi)
+	c := &EventCommand{Ui: ui}
+	code := c.Run([]string{"-rpc-addr=" + rpcAddr, "-node=" + node, "restart"})
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	testutil.Yield()
+
+	handler.Lock()
+	found := false
+	for _, raw := range handler.Events {
+		if e, ok := raw.(serf.UserEvent); ok {
+			found = e.Name == "restart" && e.Target == node
+		}
+	}
+	handler.Unlock()
+	if !found {
+		t.Fatalf("bad: %#v", handler.Events)
+	}
+
+	// Unknown members are refused
+	ui = new(cli.MockUi)
+	c = &EventCommand{Ui: ui}
+	if code := c.Run([]string{"-rpc-addr=" + rpcAddr, "-node=nope", "restart"}); code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "No alive member") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
+func TestEventCommandRun_json(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &EventCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-format=json", "deploy", "foo"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	var result EventResult
+	if err := json.Unmarshal([]byte(ui.OutputWriter.String()), &result); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := EventResult{Name: "deploy", PayloadSize: 3, Coalesce: true}
+	if result != expected {
+		t.Fatalf("bad: %#v", result)
+	}
+}
@@ -0,0 +1,121 @@
+package command
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mitchellh/cli"
+	"strings"
+)
+
+// EventsCommand is a Command implementation that lists the recent user
+// events received by a running Serf agent.
+type EventsCommand struct {
+	Ui cli.Ui
+}
+
+func (c *EventsCommand) Help() string {
+	helpText := `
+Usage: serf events [options]
+
+  Lists the most recent user events that the agent received, oldest
+  first, with the Lamport time, the name, the member that sent each event
+  and its payload. The agent keeps the last 256 user events.
+
+Options:
+
+  -format=text              Output format, "text" or "json".
+
+  -recent=50                Number of events to list. Zero lists all the
+                            events that the agent keeps.
+
+  -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
+
+  -timeout=0s               Timeout of connecting to the agent and of each
+                            request. Defaults to no timeout.
+`
+	return strings.TrimSpace(helpText)
+}
+
+// RecentEventResult is a user event as output by the events command with
+// -format=json. Origin is empty for events sent by older members, and
+// Target is empty for events that are meant for all members.
+type RecentEventResult struct {
+	LTime    uint64
+	Name     string
+	Origin   string `json:",omitempty"`
+	Target   string `json:",omitempty"`
+	Payload  []byte
+	Coalesce bool
+	Version  uint8 `json:",omitempty"`
+}
+
+func (c *EventsCommand) Run(args []string) int {
+	var recent int
+	cmdFlags := flag.NewFlagSet("events", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	format := FormatFlag(cmdFlags)
+	cmdFlags.IntVar(&recent, "recent", 50, "number of events")
+	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcTimeout := RPCTimeoutFlag(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	if err := validFormat(*format); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+	if recent < 0 {
+		c.Ui.Error("-recent can't be negative")
+		return 1
+	}
+
+	client, err := RPCClient(*rpcAddr, *rpcTimeout)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
+		return 1
+	}
+	defer client.Close()
+
+	events, err := client.RecentEvents(recent)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error retrieving events: %s", err))
+		return 1
+	}
+
+	if *format == "json" {
+		results := make([]RecentEventResult, 0, len(events))
+		for _, e := range events {
+			results = append(results, RecentEventResult{
+				LTime:    uint64(e.LTime),
+				Name:     e.Name,
+				Origin:   e.Origin,
+				Target:   e.Target,
+				Payload:  e.Payload,
+				Coalesce: e.Coalesce,
+				Version:  e.Version,
+			})
+		}
+		if err := outputJSON(c.Ui, results); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	for _, e := range events {
+		origin := e.Origin
+		if origin == "" {
+			origin = "(unknown)"
+		}
+		if e.Target != "" {
+			origin += " -> " + e.Target
+		}
+		c.Ui.Output(fmt.Sprintf("%d    %s    %s    %q", e.LTime, e.Name, origin, e.Payload))
+	}
+	return 0
+}
+
+func (c *EventsCommand) Synopsis() string {
+	return "Lists the recent user events of a Serf agent"
+}
@@ -0,0 +1,75 @@
+package command
+
+import (
+	"encoding/json"
+	"github.com/hashicorp/serf/testutil"
+	"github.com/mitchellh/cli"
+	"strings"
+	"testing"
+)
+
+func TestEventsCommand_implements(t *testing.T) {
+	var _ cli.Command = &EventsCommand{}
+}
+
+func TestEventsCommandRun(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	for _, name := range []string{"deploy", "restart"} {
+		if err := a1.UserEvent(name, []byte("v2"), false); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	testutil.Yield()
+
+	ui := new(cli.MockUi)
+	c := &EventsCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-recent=1"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	out := ui.OutputWriter.String()
+	if strings.Contains(out, "deploy") || !strings.Contains(out, "restart") {
+		t.Fatalf("bad: %#v", out)
+	}
+	if !strings.Contains(out, a1.SerfConfig().NodeName) {
+		t.Fatalf("bad origin: %#v", out)
+	}
+}
+
+func TestEventsCommandRun_json(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	if err := a1.UserEvent("deploy", []byte("v2"), false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	ui := new(cli.MockUi)
+	c := &EventsCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-format=json"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	var results []RecentEventResult
+	if err := json.Unmarshal([]byte(ui.OutputWriter.String()), &results); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(results) != 1 || results[0].Name != "deploy" || string(results[0].Payload) != "v2" {
+		t.Fatalf("bad: %#v", results)
+	}
+}
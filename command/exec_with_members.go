@@ -0,0 +1,186 @@
+package command
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/hashicorp/serf/command/agent"
+	"github.com/mitchellh/cli"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"text/template"
+)
+
+// ExecWithMembersCommand is a Command implementation that runs a local
+// command with the members of the cluster substituted into its
+// arguments.
+type ExecWithMembersCommand struct {
+	Ui cli.Ui
+}
+
+// memberList is a list of names or addresses of members, which a
+// template formats separated by spaces
+type memberList []string
+
+func (l memberList) String() string {
+	return strings.Join(l, " ")
+}
+
+// execMembers is the data of the templates of the command arguments
+type execMembers struct {
+	Names     memberList
+	Addrs     memberList // IPs only
+	HostPorts memberList // host:port of the gossip port
+}
+
+// execFuncs are the functions available to the templates of the command
+// arguments
+var execFuncs = template.FuncMap{
+	"join": func(l memberList, sep string) string {
+		return strings.Join(l, sep)
+	},
+}
+
+func (c *ExecWithMembersCommand) Help() string {
+	helpText := `
+Usage: serf exec-with-members [options] -- command [args...]
+
+  Runs a local command with the members of the cluster substituted into
+  its arguments, to hand the membership of Serf to existing tools:
+
+      serf exec-with-members -tag role=web -- pssh -H "{{.Addrs}}" uptime
+
+  Every argument is a Go template, in which {{.Names}}, {{.Addrs}} and
+  {{.HostPorts}} are the names, IP addresses and gossip addresses of the
+  selected members, separated by spaces. {{join .Addrs ","}} separates
+  them with another string. The command is run without a shell, and its
+  exit code is the exit code of serf.
+
+Options:
+
+  -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
+
+  -status=alive             Select the members whose status matches the
+                            regular expression.
+
+  -tag key=value            Select the members that have the tag. Can be
+                            given several times, and the members must have
+                            all of the tags. The role is available as the
+                            "role" tag.
+
+  -timeout=0s               Timeout of connecting to the agent and of each
+                            request. Defaults to no timeout.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *ExecWithMembersCommand) Run(args []string) int {
+	var tagPairs []string
+	var status string
+	cmdFlags := flag.NewFlagSet("exec-with-members", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.Var((*agent.AppendSliceValue)(&tagPairs), "tag", "tag filter")
+	cmdFlags.StringVar(&status, "status", "alive", "status filter")
+	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcTimeout := RPCTimeoutFlag(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	tags, err := agent.UnmarshalTags(tagPairs)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	args = cmdFlags.Args()
+	if len(args) < 1 {
+		c.Ui.Error("A command must be specified.")
+		c.Ui.Error("")
+		c.Ui.Error(c.Help())
+		return 1
+	}
+
+	// Parse all the templates before contacting the agent
+	templates := make([]*template.Template, len(args))
+	for i, arg := range args {
+		t, err := template.New("arg").Funcs(execFuncs).Parse(arg)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error parsing argument %q: %s", arg, err))
+			return 1
+		}
+		templates[i] = t
+	}
+
+	client, err := RPCClient(*rpcAddr, *rpcTimeout)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
+		return 1
+	}
+	defer client.Close()
+
+	members, err := client.MembersFiltered("", "", status)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error retrieving members: %s", err))
+		return 1
+	}
+
+	var data execMembers
+	for _, m := range members {
+		if !hasTags(m, tags) {
+			continue
+		}
+		data.Names = append(data.Names, m.Name)
+		data.Addrs = append(data.Addrs, m.Addr.String())
+		data.HostPorts = append(data.HostPorts,
+			(&net.TCPAddr{IP: m.Addr, Port: int(m.Port)}).String())
+	}
+
+	argv := make([]string, len(templates))
+	for i, t := range templates {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, &data); err != nil {
+			c.Ui.Error(fmt.Sprintf("Error formatting argument %q: %s", args[i], err))
+			return 1
+		}
+		argv[i] = buf.String()
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				return status.ExitStatus()
+			}
+			return 1
+		}
+		c.Ui.Error(fmt.Sprintf("Error running %s: %s", argv[0], err))
+		return 1
+	}
+	return 0
+}
+
+// hasTags checks if the member has all of the tags, where the role is
+// the "role" tag unless the member has such a tag
+func hasTags(m agent.Member, tags map[string]string) bool {
+	for k, v := range tags {
+		value, ok := m.Tags[k]
+		if !ok && k == "role" {
+			value = m.Role
+		}
+		if value != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *ExecWithMembersCommand) Synopsis() string {
+	return "Runs a command with the members of the cluster as arguments"
+}
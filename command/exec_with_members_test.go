@@ -0,0 +1,101 @@
+package command
+
+import (
+	"github.com/mitchellh/cli"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExecWithMembersCommand_implements(t *testing.T) {
+	var _ cli.Command = &ExecWithMembersCommand{}
+}
+
+func TestExecWithMembersCommandRun(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	dir, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	ui := new(cli.MockUi)
+	c := &ExecWithMembersCommand{Ui: ui}
+	args := []string{
+		"-rpc-addr=" + rpcAddr,
+		"--",
+		"sh", "-c", `echo "$0" > ` + out, `{{join .Names ","}} {{.Addrs}}`,
+	}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	raw, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	config := a1.SerfConfig()
+	expected := config.NodeName + " " + config.MemberlistConfig.BindAddr
+	if strings.TrimSpace(string(raw)) != expected {
+		t.Fatalf("bad: %q", raw)
+	}
+}
+
+func TestExecWithMembersCommandRun_tag(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &ExecWithMembersCommand{Ui: ui}
+	args := []string{
+		"-rpc-addr=" + rpcAddr,
+		"-tag=role=nope",
+		"--",
+		"test", "-z", "{{.Names}}",
+	}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+}
+
+func TestExecWithMembersCommandRun_exitCode(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &ExecWithMembersCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "--", "sh", "-c", "exit 3"}
+
+	code := c.Run(args)
+	if code != 3 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+}
+
+func TestExecWithMembersCommandRun_noCommand(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &ExecWithMembersCommand{Ui: ui}
+
+	code := c.Run([]string{"-rpc-addr=127.0.0.1:0"})
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "command must be specified") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
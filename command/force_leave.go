@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/mitchellh/cli"
 	"strings"
+	"time"
 )
 
 // ForceLeaveCommand is a Command implementation that tells a running Serf
@@ -13,35 +14,138 @@ type ForceLeaveCommand struct {
 	Ui cli.Ui
 }
 
+// ForceLeaveResult is the result of the force-leave command with
+// -format=json. Either Node or Addr is set, depending on -addr, unless
+// the members are selected by -status and -older-than, in which case
+// Nodes are the selected members.
+type ForceLeaveResult struct {
+	Node   string   `json:",omitempty"`
+	Addr   string   `json:",omitempty"`
+	All    bool     `json:",omitempty"`
+	Nodes  []string `json:",omitempty"`
+	DryRun bool     `json:",omitempty"`
+	Error  string   `json:",omitempty"`
+}
+
 func (c *ForceLeaveCommand) Run(args []string) int {
+	var byAddr, all, dryRun bool
+	var status string
+	var olderThan time.Duration
 	cmdFlags := flag.NewFlagSet("join", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	format := FormatFlag(cmdFlags)
+	cmdFlags.BoolVar(&byAddr, "addr", false, "select members by address")
+	cmdFlags.BoolVar(&all, "all", false, "remove all matching members")
+	cmdFlags.StringVar(&status, "status", "", "status filter")
+	cmdFlags.DurationVar(&olderThan, "older-than", 0, "minimum time in the status")
+	cmdFlags.BoolVar(&dryRun, "dry-run", false, "only list the matching members")
 	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcTimeout := RPCTimeoutFlag(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
+	if err := validFormat(*format); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	if status != "" || olderThan > 0 {
+		return c.forceLeaveBulk(status, olderThan, dryRun, byAddr,
+			len(cmdFlags.Args()), *format, *rpcAddr, *rpcTimeout)
+	}
+	if dryRun {
+		c.Ui.Error("-dry-run is only supported with -status or -older-than")
+		return 1
+	}
+
 	nodes := cmdFlags.Args()
 	if len(nodes) != 1 {
-		c.Ui.Error("A node name must be specified to force leave.")
+		c.Ui.Error("A node name or address must be specified to force leave.")
 		c.Ui.Error("")
 		c.Ui.Error(c.Help())
 		return 1
 	}
 
-	client, err := RPCClient(*rpcAddr)
+	client, err := RPCClient(*rpcAddr, *rpcTimeout)
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
 		return 1
 	}
 	defer client.Close()
 
-	err = client.ForceLeave(nodes[0])
-	if err != nil {
+	if byAddr {
+		err = client.ForceLeaveAddr(nodes[0], all)
+	} else {
+		err = client.ForceLeave(nodes[0])
+	}
+	if *format == "json" {
+		result := ForceLeaveResult{Node: nodes[0]}
+		if byAddr {
+			result = ForceLeaveResult{Addr: nodes[0], All: all}
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if err := outputJSON(c.Ui, result); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+	} else if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error force leaving: %s", err))
+	}
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// forceLeaveBulk force leaves all the members selected by -status and
+// -older-than, which default to the failed members.
+func (c *ForceLeaveCommand) forceLeaveBulk(status string, olderThan time.Duration,
+	dryRun, byAddr bool, nargs int, format, rpcAddr string, rpcTimeout time.Duration) int {
+	if byAddr || nargs != 0 {
+		c.Ui.Error("-status and -older-than can't be combined with a name or -addr")
 		return 1
 	}
+	if status == "" {
+		status = "failed"
+	}
 
+	client, err := RPCClient(rpcAddr, rpcTimeout)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
+		return 1
+	}
+	defer client.Close()
+
+	nodes, err := client.ForceLeaveBulk(status, olderThan, dryRun)
+	if format == "json" {
+		result := ForceLeaveResult{Nodes: nodes, DryRun: dryRun}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if err := outputJSON(c.Ui, result); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+	} else if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error force leaving: %s", err))
+	} else {
+		verb := "Force left"
+		if dryRun {
+			verb = "Would force leave"
+		}
+		for _, node := range nodes {
+			c.Ui.Output(fmt.Sprintf("%s: %s", verb, node))
+		}
+		c.Ui.Output(fmt.Sprintf("%d members matched", len(nodes)))
+	}
+
+	if err != nil {
+		return 1
+	}
 	return 0
 }
 
@@ -52,6 +156,8 @@ func (c *ForceLeaveCommand) Synopsis() string {
 func (c *ForceLeaveCommand) Help() string {
 	helpText := `
 Usage: serf force-leave [options] name
+       serf force-leave [options] -addr address
+       serf force-leave [options] -status=failed -older-than=6h
 
   Forces a member of a Serf cluster to enter the "left" state. Note
   that if the member is still actually alive, it will eventually rejoin
@@ -60,10 +166,41 @@ Usage: serf force-leave [options] name
   Serf will attempt to reconnect to those failed nodes for some period of
   time before eventually reaping them.
 
+  With -addr, the members are selected by their advertised address, such
+  as "10.0.0.5" or "10.0.0.5:7946", for when the name is ambiguous or
+  unknown. If several members have the address, none is removed unless
+  -all is given.
+
+  With -status or -older-than, all the members whose status matches and
+  that have had it for longer than the given time are removed at once,
+  which is useful after a large decommission. The status defaults to
+  "failed". Only members that failed or are leaving are ever removed, never
+  alive members or the agent itself. Use -dry-run first to list the
+  members that would be removed.
+
 Options:
 
+  -addr                     Select the members by address instead of name.
+
+  -all                      With -addr, remove every member that has the
+                            address.
+
+  -dry-run                  With -status or -older-than, only list the
+                            matching members.
+
+  -format=text              Output format, "text" or "json".
+
+  -older-than=6h            Select the members that have had their status
+                            for longer than this.
+
   -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
 
+  -status=failed            Select the members whose status matches the
+                            regular expression.
+
+  -timeout=0s               Timeout of connecting to the agent and of each
+                            request. Defaults to no timeout.
+
 `
 	return strings.TrimSpace(helpText)
 }
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"encoding/json"
 	"github.com/hashicorp/serf/serf"
 	"github.com/hashicorp/serf/testutil"
 	"github.com/mitchellh/cli"
@@ -57,6 +58,164 @@ func TestForceLeaveCommandRun(t *testing.T) {
 	}
 }
 
+func TestForceLeaveCommandRun_addr(t *testing.T) {
+	a1 := testAgent(t)
+	a2 := testAgent(t)
+	defer a1.Shutdown()
+	defer a2.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	a2Addr := a2.SerfConfig().MemberlistConfig.BindAddr
+	if _, err := a1.Join([]string{a2Addr}, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if err := a2.Serf().Shutdown(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	time.Sleep(a2.SerfConfig().MemberlistConfig.ProbeInterval * 5)
+
+	ui := new(cli.MockUi)
+	c := &ForceLeaveCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-addr", a2Addr}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	for _, m := range a1.Serf().Members() {
+		if m.Name == a2.SerfConfig().NodeName && m.Status != serf.StatusLeft {
+			t.Fatalf("should be left: %#v", m)
+		}
+	}
+
+	// Nothing else has the address
+	ui = new(cli.MockUi)
+	c = &ForceLeaveCommand{Ui: ui}
+	args = []string{"-rpc-addr=" + rpcAddr, "-addr", "10.255.255.1"}
+	if code := c.Run(args); code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "No member has the address") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
+func TestForceLeaveCommandRun_status(t *testing.T) {
+	a1 := testAgent(t)
+	a2 := testAgent(t)
+	defer a1.Shutdown()
+	defer a2.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	a2Addr := a2.SerfConfig().MemberlistConfig.BindAddr
+	if _, err := a1.Join([]string{a2Addr}, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if err := a2.Serf().Shutdown(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	time.Sleep(a2.SerfConfig().MemberlistConfig.ProbeInterval * 5)
+	a2Name := a2.SerfConfig().NodeName
+
+	// Not failed for long enough
+	ui := new(cli.MockUi)
+	c := &ForceLeaveCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-older-than=1h"}
+	if code := c.Run(args); code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+	if !strings.Contains(ui.OutputWriter.String(), "0 members matched") {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+
+	// A dry run changes nothing
+	ui = new(cli.MockUi)
+	c = &ForceLeaveCommand{Ui: ui}
+	args = []string{"-rpc-addr=" + rpcAddr, "-status=failed", "-dry-run"}
+	if code := c.Run(args); code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+	if !strings.Contains(ui.OutputWriter.String(), "Would force leave: "+a2Name) {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+	for _, m := range a1.Serf().Members() {
+		if m.Name == a2Name && m.Status != serf.StatusFailed {
+			t.Fatalf("should be failed: %#v", m)
+		}
+	}
+
+	ui = new(cli.MockUi)
+	c = &ForceLeaveCommand{Ui: ui}
+	args = []string{"-rpc-addr=" + rpcAddr, "-format=json", "-status=failed"}
+	if code := c.Run(args); code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	var result ForceLeaveResult
+	if err := json.Unmarshal([]byte(ui.OutputWriter.String()), &result); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(result.Nodes) != 1 || result.Nodes[0] != a2Name {
+		t.Fatalf("bad: %#v", result)
+	}
+	for _, m := range a1.Serf().Members() {
+		if m.Name == a2Name && m.Status != serf.StatusLeft {
+			t.Fatalf("should be left: %#v", m)
+		}
+	}
+}
+
+func TestForceLeaveCommandRun_statusWithName(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &ForceLeaveCommand{Ui: ui}
+	args := []string{"-rpc-addr=foo", "-status=failed", "node1"}
+
+	if code := c.Run(args); code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "can't be combined") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
+func TestForceLeaveCommandRun_json(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &ForceLeaveCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-format=json", "-addr", "10.255.255.1"}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	var result ForceLeaveResult
+	if err := json.Unmarshal([]byte(ui.OutputWriter.String()), &result); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result.Addr != "10.255.255.1" || result.Node != "" {
+		t.Fatalf("bad: %#v", result)
+	}
+	if !strings.Contains(result.Error, "No member has the address") {
+		t.Fatalf("bad: %#v", result)
+	}
+}
+
 func TestForceLeaveCommandRun_noAddrs(t *testing.T) {
 	ui := new(cli.MockUi)
 	c := &ForceLeaveCommand{Ui: ui}
@@ -0,0 +1,35 @@
+package command
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mitchellh/cli"
+)
+
+// FormatFlag returns a pointer to a string that will be populated
+// when the given flagset is parsed with the output format, "text" or
+// "json".
+func FormatFlag(f *flag.FlagSet) *string {
+	return f.String("format", "text", "output format")
+}
+
+// validFormat checks the value of a FormatFlag.
+func validFormat(format string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("Unknown output format: %s", format)
+	}
+	return nil
+}
+
+// outputJSON writes v to the Ui as indented JSON. The field names of
+// the results are part of the interface of the commands, so they
+// should not be changed once released.
+func outputJSON(ui cli.Ui, v interface{}) error {
+	raw, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding results: %s", err)
+	}
+	ui.Output(string(raw))
+	return nil
+}
@@ -0,0 +1,257 @@
+package command
+
+import (
+	"flag"
+	"fmt"
+	"github.com/hashicorp/serf/command/agent"
+	"github.com/hashicorp/serf/serf"
+	"github.com/mitchellh/cli"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// HandlerTestCommand is a Command implementation that invokes an event
+// handler with a made up event, the same way the agent would, so that
+// handlers can be developed without a running cluster.
+type HandlerTestCommand struct {
+	Ui cli.Ui
+}
+
+func (c *HandlerTestCommand) Help() string {
+	helpText := `
+Usage: serf handler-test [options] script
+
+  Invokes an event handler script with a made up event, exactly as the
+  agent would: with the same environmental variables, the same data on
+  stdin, and run by the same shell. The output and the exit code of the
+  script are reported. No agent needs to be running.
+
+Options:
+
+  -event=member-join        Type of the event: member-join, member-leave,
+                            member-failed, member-update, member-reconcile
+                            or user.
+  -member=name=web-1,addr=10.0.0.5
+                            Member of a membership event, given as comma
+                            separated key=value pairs. The keys name, addr,
+                            port, role and status are the fields of the
+                            member, any other key is a tag. This can be
+                            specified multiple times.
+  -name=deploy              Name of a user event.
+  -payload=data             Payload of a user event.
+  -ltime=1                  Lamport time of a user event.
+  -coalesce=true            Whether a user event can be coalesced.
+  -self=name=web-1,role=web Node that runs the handler, in the same format
+                            as -member. Defaults to the hostname.
+  -env=PATH                 Environmental variable passed through to the
+                            script, as the event_handler_env configuration.
+                            This can be specified multiple times.
+  -handler-format=text      Format of the stdin data, "text" or "json".
+  -shell=sh                 Shell that runs the script: "sh", "cmd" or
+                            "powershell". Defaults to "cmd" on Windows.
+  -timeout=30s              Time after which the script is killed. Zero
+                            doesn't limit the script.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *HandlerTestCommand) Run(args []string) int {
+	var eventType, name, payload, self, format, shell string
+	var ltime uint64
+	var coalesce bool
+	var members, env []string
+	var timeout time.Duration
+
+	cmdFlags := flag.NewFlagSet("handler-test", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&eventType, "event", "", "event type")
+	cmdFlags.Var((*agent.AppendSliceValue)(&members), "member", "member")
+	cmdFlags.StringVar(&name, "name", "", "user event name")
+	cmdFlags.StringVar(&payload, "payload", "", "user event payload")
+	cmdFlags.Uint64Var(&ltime, "ltime", 1, "user event ltime")
+	cmdFlags.BoolVar(&coalesce, "coalesce", true, "user event coalesce")
+	cmdFlags.StringVar(&self, "self", "", "self")
+	cmdFlags.Var((*agent.AppendSliceValue)(&env), "env", "environment")
+	cmdFlags.StringVar(&format, "handler-format", "text", "handler format")
+	cmdFlags.StringVar(&shell, "shell", "", "shell")
+	cmdFlags.DurationVar(&timeout, "timeout", 30*time.Second, "timeout")
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	scripts := cmdFlags.Args()
+	if len(scripts) != 1 {
+		c.Ui.Error("A single script must be specified.")
+		c.Ui.Error("")
+		c.Ui.Error(c.Help())
+		return 1
+	}
+
+	if format != "text" && format != "json" {
+		c.Ui.Error(fmt.Sprintf("Invalid handler format: %s", format))
+		return 1
+	}
+
+	selfMember := serf.Member{}
+	if self != "" {
+		m, err := parseTestMember(self)
+		if err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+		selfMember = m
+	}
+	if selfMember.Name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error determining hostname: %s", err))
+			return 1
+		}
+		selfMember.Name = hostname
+	}
+
+	var event serf.Event
+	switch eventType {
+	case "user":
+		if name == "" {
+			c.Ui.Error("A user event must have a -name.")
+			return 1
+		}
+		event = serf.UserEvent{
+			LTime:    serf.LamportTime(ltime),
+			Name:     name,
+			Payload:  []byte(payload),
+			Coalesce: coalesce,
+		}
+
+	case "member-join", "member-leave", "member-failed", "member-update", "member-reconcile":
+		if len(members) == 0 {
+			c.Ui.Error("A membership event must have at least one -member.")
+			return 1
+		}
+		var eventMembers []serf.Member
+		for _, v := range members {
+			m, err := parseTestMember(v)
+			if err != nil {
+				c.Ui.Error(err.Error())
+				return 1
+			}
+			eventMembers = append(eventMembers, m)
+		}
+
+		// Reconcile events are made up by the agent, not by Serf
+		if eventType == "member-reconcile" {
+			event = agent.ReconcileEvent{Members: eventMembers}
+		} else {
+			event = serf.MemberEvent{Type: memberEventTypes[eventType], Members: eventMembers}
+		}
+
+	default:
+		c.Ui.Error(fmt.Sprintf("Unknown event type: %s", eventType))
+		return 1
+	}
+
+	if len(env) == 0 {
+		env = agent.DefaultEventHandlerEnv
+	}
+
+	logger := log.New(ioutil.Discard, "", 0)
+	start := time.Now()
+	output, err := agent.RunEventScript(logger, scripts[0], shell, format,
+		agent.FilterEnv(os.Environ(), env), selfMember, event, timeout)
+	duration := time.Since(start)
+
+	if len(output) > 0 {
+		c.Ui.Output(strings.TrimRight(string(output), "\n"))
+	}
+
+	exitCode := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			exitCode = status.ExitStatus()
+		}
+	}
+
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Handler failed after %s: %s (exit code %d)",
+			duration, err, exitCode))
+		return 1
+	}
+
+	c.Ui.Info(fmt.Sprintf("Handler succeeded after %s (exit code 0)", duration))
+	return 0
+}
+
+func (c *HandlerTestCommand) Synopsis() string {
+	return "Invokes an event handler with a made up event"
+}
+
+// memberEventTypes maps the names of membership events to their types.
+var memberEventTypes = map[string]serf.EventType{
+	"member-join":   serf.EventMemberJoin,
+	"member-leave":  serf.EventMemberLeave,
+	"member-failed": serf.EventMemberFailed,
+	"member-update": serf.EventMemberUpdate,
+}
+
+// parseTestMember parses a member from comma separated "key=value" pairs,
+// such as "name=web-1,addr=10.0.0.5,dc=east". Keys other than the fields
+// of the member are tags.
+func parseTestMember(v string) (serf.Member, error) {
+	m := serf.Member{
+		Port:   7946,
+		Status: serf.StatusAlive,
+	}
+
+	for _, pair := range strings.Split(v, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return m, fmt.Errorf("Invalid member: '%s'. Must be in the form key=value,...", v)
+		}
+		key, value := parts[0], parts[1]
+
+		switch key {
+		case "name":
+			m.Name = value
+		case "addr":
+			m.Addr = net.ParseIP(value)
+			if m.Addr == nil {
+				return m, fmt.Errorf("Invalid member address: %s", value)
+			}
+		case "port":
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return m, fmt.Errorf("Invalid member port: %s", value)
+			}
+			m.Port = uint16(port)
+		case "role":
+			m.Role = value
+		case "status":
+			switch value {
+			case "alive":
+				m.Status = serf.StatusAlive
+			case "leaving":
+				m.Status = serf.StatusLeaving
+			case "left":
+				m.Status = serf.StatusLeft
+			case "failed":
+				m.Status = serf.StatusFailed
+			default:
+				return m, fmt.Errorf("Invalid member status: %s", value)
+			}
+		default:
+			if m.Tags == nil {
+				m.Tags = make(map[string]string)
+			}
+			m.Tags[key] = value
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,123 @@
+package command
+
+import (
+	"github.com/hashicorp/serf/serf"
+	"github.com/mitchellh/cli"
+	"net"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestHandlerTestCommand_implements(t *testing.T) {
+	var _ cli.Command = &HandlerTestCommand{}
+}
+
+func TestHandlerTestCommandRun_member(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+	}
+
+	ui := new(cli.MockUi)
+	c := &HandlerTestCommand{Ui: ui}
+	args := []string{
+		"-event=member-join",
+		"-member=name=web-1,addr=10.0.0.5,role=web",
+		"-self=name=db-1,role=db",
+		`echo "$SERF_EVENT $SERF_SELF_NAME"; cat`,
+	}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	output := ui.OutputWriter.String()
+	if !strings.Contains(output, "member-join db-1\nweb-1\t10.0.0.5\tweb") {
+		t.Fatalf("bad: %#v", output)
+	}
+}
+
+func TestHandlerTestCommandRun_user(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+	}
+
+	ui := new(cli.MockUi)
+	c := &HandlerTestCommand{Ui: ui}
+	args := []string{
+		"-event=user",
+		"-name=deploy",
+		"-payload=v1.2",
+		`echo "$SERF_USER_EVENT $(cat)"; exit 3`,
+	}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.OutputWriter.String(), "deploy v1.2") {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "exit code 3") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
+func TestHandlerTestCommandRun_timeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+	}
+
+	ui := new(cli.MockUi)
+	c := &HandlerTestCommand{Ui: ui}
+	args := []string{"-event=user", "-name=deploy", "-timeout=50ms", "sleep 5"}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "timed out") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
+func TestHandlerTestCommandRun_noMembers(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &HandlerTestCommand{Ui: ui}
+	args := []string{"-event=member-failed", "true"}
+
+	if code := c.Run(args); code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "at least one -member") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
+func TestParseTestMember(t *testing.T) {
+	m, err := parseTestMember("name=web-1,addr=10.0.0.5,port=8000,role=web,status=failed,dc=east")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := serf.Member{
+		Name:   "web-1",
+		Addr:   net.ParseIP("10.0.0.5"),
+		Port:   8000,
+		Role:   "web",
+		Tags:   map[string]string{"dc": "east"},
+		Status: serf.StatusFailed,
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Fatalf("bad: %#v", m)
+	}
+
+	for _, v := range []string{"name", "addr=foo", "port=70000", "status=gone"} {
+		if _, err := parseTestMember(v); err == nil {
+			t.Fatalf("%s: should error", v)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package command
+
+import (
+	"flag"
+	"fmt"
+	"github.com/hashicorp/serf/command/agent"
+	"github.com/mitchellh/cli"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// InfoCommand is a Command implementation that queries a running
+// Serf agent for various debugging statistics, and optionally checks
+// them against thresholds for monitoring.
+type InfoCommand struct {
+	Ui cli.Ui
+}
+
+func (c *InfoCommand) Help() string {
+	helpText := `
+Usage: serf info [options]
+
+  Provides debugging information for operators, such as the queue depths
+  and the internal clocks of the agent, and the OS limits that are too low
+  for the size of the cluster. With -fail-if, the statistics are checked
+  against thresholds and the exit code is 2 if any is exceeded, so the
+  command can be used as a simple monitoring check.
+
+Options:
+
+  -fail-if="event_queue>1000"  Threshold on a statistic of the "serf"
+                               section, with one of the operators >, >=,
+                               <, <=, == or !=. This can be specified
+                               multiple times.
+  -format=text                 Output format, "text" or "json".
+  -rpc-addr=127.0.0.1:7373     RPC address of the Serf agent.
+  -timeout=0s                  Timeout of connecting to the agent and of
+                               each request. Defaults to no timeout.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *InfoCommand) Run(args []string) int {
+	var failIf []string
+	cmdFlags := flag.NewFlagSet("info", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.Var((*agent.AppendSliceValue)(&failIf), "fail-if", "threshold")
+	format := FormatFlag(cmdFlags)
+	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcTimeout := RPCTimeoutFlag(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	if err := validFormat(*format); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	thresholds := make([]*threshold, 0, len(failIf))
+	for _, v := range failIf {
+		t, err := parseThreshold(v)
+		if err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+		thresholds = append(thresholds, t)
+	}
+
+	client, err := RPCClient(*rpcAddr, *rpcTimeout)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
+		return 1
+	}
+	defer client.Close()
+
+	dump, err := client.Dump()
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error querying agent: %s", err))
+		return 1
+	}
+
+	info := map[string]map[string]string{
+		"agent": map[string]string{
+			"name":      dump.Config.NodeName,
+			"role":      dump.Config.Role,
+			"protocol":  strconv.Itoa(int(dump.Config.Protocol)),
+			"bind":      fmt.Sprintf("%s:%d", dump.Config.BindAddr, dump.Config.BindPort),
+			"advertise": fmt.Sprintf("%s:%d", dump.Config.AdvertiseAddr, dump.Config.AdvertisePort),
+		},
+		"serf": dump.Stats,
+	}
+	if len(dump.Tuning) > 0 {
+		info["tuning"] = dump.Tuning
+	}
+	if len(dump.RTT) > 0 {
+		info["rtt"] = dump.RTT
+	}
+
+	// Check the thresholds before any output, so that a typo in a
+	// statistic name is an error rather than a passing check
+	var exceeded []string
+	for _, t := range thresholds {
+		ok, err := t.Exceeded(dump.Stats)
+		if err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+		if ok {
+			exceeded = append(exceeded, fmt.Sprintf("%s (%s = %s)",
+				t.String(), t.Key, dump.Stats[t.Key]))
+		}
+	}
+
+	if *format == "json" {
+		if err := outputJSON(c.Ui, info); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+	} else {
+		c.Ui.Output(formatInfo(info))
+	}
+
+	if len(exceeded) > 0 {
+		for _, e := range exceeded {
+			c.Ui.Error(fmt.Sprintf("Threshold exceeded: %s", e))
+		}
+		return 2
+	}
+	return 0
+}
+
+func (c *InfoCommand) Synopsis() string {
+	return "Provides debugging information for operators"
+}
+
+// formatInfo formats the sections of info as sorted "key = value" lines
+// under the name of each section.
+func formatInfo(info map[string]map[string]string) string {
+	sections := make([]string, 0, len(info))
+	for name := range info {
+		sections = append(sections, name)
+	}
+	sort.Strings(sections)
+
+	var lines []string
+	for _, name := range sections {
+		lines = append(lines, name+":")
+		keys := make([]string, 0, len(info[name]))
+		for k := range info[name] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			lines = append(lines, fmt.Sprintf("\t%s = %s", k, info[name][k]))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// threshold is a parsed -fail-if expression, such as "event_queue>1000".
+type threshold struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+// thresholdOps are the operators of a threshold, with the two character
+// operators first so that ">=" isn't parsed as ">".
+var thresholdOps = []string{">=", "<=", "==", "!=", ">", "<"}
+
+// parseThreshold parses a threshold in the form "key<op>value".
+func parseThreshold(v string) (*threshold, error) {
+	idx := strings.IndexAny(v, "<>=!")
+	if idx > 0 {
+		for _, op := range thresholdOps {
+			if strings.HasPrefix(v[idx:], op) && len(v) > idx+len(op) {
+				return &threshold{
+					Key:   strings.TrimSpace(v[:idx]),
+					Op:    op,
+					Value: strings.TrimSpace(v[idx+len(op):]),
+				}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Invalid threshold: '%s'. Must be in the form key>value", v)
+}
+
+func (t *threshold) String() string {
+	return t.Key + t.Op + t.Value
+}
+
+// Exceeded tests whether the statistic of the threshold matches it. The
+// values are compared as numbers, except for == and != which compare
+// non-numeric values as strings.
+func (t *threshold) Exceeded(stats map[string]string) (bool, error) {
+	actual, ok := stats[t.Key]
+	if !ok {
+		return false, fmt.Errorf("Unknown statistic: %s", t.Key)
+	}
+
+	a, errA := strconv.ParseFloat(actual, 64)
+	b, errB := strconv.ParseFloat(t.Value, 64)
+	if errA != nil || errB != nil {
+		switch t.Op {
+		case "==":
+			return actual == t.Value, nil
+		case "!=":
+			return actual != t.Value, nil
+		}
+		return false, fmt.Errorf("Can't compare %s = %s with %s", t.Key, actual, t.String())
+	}
+
+	switch t.Op {
+	case ">":
+		return a > b, nil
+	case ">=":
+		return a >= b, nil
+	case "<":
+		return a < b, nil
+	case "<=":
+		return a <= b, nil
+	case "==":
+		return a == b, nil
+	default:
+		return a != b, nil
+	}
+}
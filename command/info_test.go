@@ -0,0 +1,160 @@
+package command
+
+import (
+	"encoding/json"
+	"github.com/mitchellh/cli"
+	"strings"
+	"testing"
+)
+
+func TestInfoCommand_implements(t *testing.T) {
+	var _ cli.Command = &InfoCommand{}
+}
+
+func TestInfoCommandRun(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &InfoCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	output := ui.OutputWriter.String()
+	if !strings.Contains(output, "serf:") || !strings.Contains(output, "\tevent_queue = 0") {
+		t.Fatalf("bad: %#v", output)
+	}
+}
+
+func TestInfoCommandRun_json(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &InfoCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-format=json"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	var info map[string]map[string]string
+	if err := json.Unmarshal([]byte(ui.OutputWriter.String()), &info); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if info["agent"]["name"] != a1.SerfConfig().NodeName {
+		t.Fatalf("bad: %#v", info)
+	}
+	if info["serf"]["members"] != "1" {
+		t.Fatalf("bad: %#v", info)
+	}
+}
+
+func TestInfoCommandRun_failIf(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &InfoCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-fail-if=event_queue>1000"}
+	if code := c.Run(args); code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	ui = new(cli.MockUi)
+	c = &InfoCommand{Ui: ui}
+	args = []string{"-rpc-addr=" + rpcAddr, "-fail-if=event_queue>1000", "-fail-if=members<2"}
+	if code := c.Run(args); code != 2 {
+		t.Fatalf("bad: %d", code)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "Threshold exceeded: members<2 (members = 1)") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+
+	// Unknown statistics are errors
+	ui = new(cli.MockUi)
+	c = &InfoCommand{Ui: ui}
+	args = []string{"-rpc-addr=" + rpcAddr, "-fail-if=event_qeue>1000"}
+	if code := c.Run(args); code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "Unknown statistic") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
+func TestParseThreshold(t *testing.T) {
+	cases := []struct {
+		Input string
+		Key   string
+		Op    string
+		Value string
+		Err   bool
+	}{
+		{"event_queue>1000", "event_queue", ">", "1000", false},
+		{"event_queue >= 1000", "event_queue", ">=", "1000", false},
+		{"failed!=0", "failed", "!=", "0", false},
+		{"push_pull_interval==30s", "push_pull_interval", "==", "30s", false},
+		{"event_queue", "", "", "", true},
+		{">1000", "", "", "", true},
+		{"event_queue>", "", "", "", true},
+	}
+
+	for _, tc := range cases {
+		th, err := parseThreshold(tc.Input)
+		if (err != nil) != tc.Err {
+			t.Fatalf("%s: err: %s", tc.Input, err)
+		}
+		if err != nil {
+			continue
+		}
+		if th.Key != tc.Key || th.Op != tc.Op || th.Value != tc.Value {
+			t.Fatalf("%s: bad: %#v", tc.Input, th)
+		}
+	}
+}
+
+func TestThresholdExceeded(t *testing.T) {
+	stats := map[string]string{
+		"event_queue":        "1500",
+		"push_pull_interval": "30s",
+	}
+
+	cases := []struct {
+		Input    string
+		Exceeded bool
+		Err      bool
+	}{
+		{"event_queue>1000", true, false},
+		{"event_queue<=1000", false, false},
+		{"event_queue==1500", true, false},
+		{"push_pull_interval!=30s", false, false},
+		{"push_pull_interval>10", false, true},
+		{"members>1", false, true},
+	}
+
+	for _, tc := range cases {
+		th, err := parseThreshold(tc.Input)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		exceeded, err := th.Exceeded(stats)
+		if (err != nil) != tc.Err {
+			t.Fatalf("%s: err: %s", tc.Input, err)
+		}
+		if exceeded != tc.Exceeded {
+			t.Fatalf("%s: bad: %v", tc.Input, exceeded)
+		}
+	}
+}
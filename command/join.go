@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/mitchellh/cli"
 	"strings"
+	"time"
 )
 
 // JoinCommand is a Command implementation that tells a running Serf
@@ -18,27 +19,48 @@ func (c *JoinCommand) Help() string {
 Usage: serf join [options] address ...
 
   Tells a running Serf agent (with "serf agent") to join the cluster
-  by specifying at least one existing member.
+  by specifying at least one existing member. Each address is joined
+  separately and reported on its own. The exit code is 0 if all addresses
+  were joined, 2 if only some of them were, and 1 otherwise.
 
 Options:
 
+  -format=text              Output format, "text" or "json".
   -replay                   Replay past user events.
   -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
+  -timeout=0s               Timeout of connecting to the agent and of each
+                            request. Defaults to no timeout.
 `
 	return strings.TrimSpace(helpText)
 }
 
+// JoinResult is the result of joining a single address, as reported
+// by the join command.
+type JoinResult struct {
+	Address   string
+	Nodes     int
+	Error     string  `json:",omitempty"`
+	LatencyMs float64 // Including the round trip to the agent
+}
+
 func (c *JoinCommand) Run(args []string) int {
 	var replayEvents bool
 
 	cmdFlags := flag.NewFlagSet("join", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	format := FormatFlag(cmdFlags)
 	cmdFlags.BoolVar(&replayEvents, "replay", false, "replay")
 	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcTimeout := RPCTimeoutFlag(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
+	if err := validFormat(*format); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
 	addrs := cmdFlags.Args()
 	if len(addrs) == 0 {
 		c.Ui.Error("At least one address to join must be specified.")
@@ -47,22 +69,61 @@ func (c *JoinCommand) Run(args []string) int {
 		return 1
 	}
 
-	client, err := RPCClient(*rpcAddr)
+	client, err := RPCClient(*rpcAddr, *rpcTimeout)
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
 		return 1
 	}
 	defer client.Close()
 
-	n, err := client.Join(addrs, replayEvents)
-	if err != nil {
-		c.Ui.Error(fmt.Sprintf("Error joining the cluster: %s", err))
-		return 1
+	// Join the addresses one at a time, so that each can be reported
+	results := make([]JoinResult, 0, len(addrs))
+	joined := 0
+	for _, addr := range addrs {
+		start := time.Now()
+		n, err := client.Join([]string{addr}, replayEvents)
+		result := JoinResult{
+			Address:   addr,
+			Nodes:     n,
+			LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+		}
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			joined++
+		}
+		results = append(results, result)
+	}
+
+	if *format == "json" {
+		if err := outputJSON(c.Ui, results); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+	} else {
+		nodes := 0
+		for _, r := range results {
+			if r.Error != "" {
+				c.Ui.Error(fmt.Sprintf("Error joining %s: %s", r.Address, r.Error))
+				continue
+			}
+			nodes += r.Nodes
+			c.Ui.Output(fmt.Sprintf("Joined %s in %.1fms", r.Address, r.LatencyMs))
+		}
+		if joined > 0 {
+			c.Ui.Output(fmt.Sprintf(
+				"Successfully joined cluster by contacting %d nodes.", nodes))
+		}
 	}
 
-	c.Ui.Output(fmt.Sprintf(
-		"Successfully joined cluster by contacting %d nodes.", n))
-	return 0
+	switch joined {
+	case len(addrs):
+		return 0
+	case 0:
+		return 1
+	default:
+		return 2
+	}
 }
 
 func (c *JoinCommand) Synopsis() string {
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"encoding/json"
 	"github.com/mitchellh/cli"
 	"strings"
 	"testing"
@@ -49,3 +50,63 @@ func TestJoinCommandRun_noAddrs(t *testing.T) {
 		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
 	}
 }
+
+func TestJoinCommandRun_partial(t *testing.T) {
+	a1 := testAgent(t)
+	a2 := testAgent(t)
+	defer a1.Shutdown()
+	defer a2.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &JoinCommand{Ui: ui}
+	args := []string{
+		"-rpc-addr=" + rpcAddr,
+		"-format=json",
+		a2.SerfConfig().MemberlistConfig.BindAddr,
+		"127.0.0.1:1",
+	}
+
+	code := c.Run(args)
+	if code != 2 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	var results []JoinResult
+	if err := json.Unmarshal([]byte(ui.OutputWriter.String()), &results); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("bad: %#v", results)
+	}
+	if results[0].Error != "" || results[0].Nodes != 1 {
+		t.Fatalf("bad: %#v", results[0])
+	}
+	if results[1].Error == "" || results[1].Address != "127.0.0.1:1" {
+		t.Fatalf("bad: %#v", results[1])
+	}
+}
+
+func TestJoinCommandRun_allFailed(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &JoinCommand{Ui: ui}
+	args := []string{
+		"-rpc-addr=" + rpcAddr,
+		"127.0.0.1:1",
+	}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "Error joining 127.0.0.1:1") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
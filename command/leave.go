@@ -21,32 +21,61 @@ Usage: serf leave
 
 Options:
 
+  -format=text              Output format, "text" or "json".
   -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
+  -timeout=0s               Timeout of connecting to the agent and of each
+                            request. Defaults to no timeout.
 `
 	return strings.TrimSpace(helpText)
 }
 
+// LeaveResult is the result of the leave command with -format=json.
+type LeaveResult struct {
+	Left  bool
+	Error string `json:",omitempty"`
+}
+
 func (c *LeaveCommand) Run(args []string) int {
 	cmdFlags := flag.NewFlagSet("leave", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	format := FormatFlag(cmdFlags)
 	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcTimeout := RPCTimeoutFlag(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
-	client, err := RPCClient(*rpcAddr)
+	if err := validFormat(*format); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	client, err := RPCClient(*rpcAddr, *rpcTimeout)
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
 		return 1
 	}
 	defer client.Close()
 
-	if err := client.Leave(); err != nil {
+	err = client.Leave()
+	if *format == "json" {
+		result := LeaveResult{Left: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if err := outputJSON(c.Ui, result); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+	} else if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error leaving: %s", err))
-		return 1
+	} else {
+		c.Ui.Output("Graceful leave complete")
 	}
 
-	c.Ui.Output("Graceful leave complete")
+	if err != nil {
+		return 1
+	}
 	return 0
 }
 
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"encoding/json"
 	"github.com/mitchellh/cli"
 	"strings"
 	"testing"
@@ -29,3 +30,27 @@ func TestLeaveCommandRun(t *testing.T) {
 		t.Fatalf("bad: %#v", ui.OutputWriter.String())
 	}
 }
+
+func TestLeaveCommandRun_json(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &LeaveCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-format=json"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	var result LeaveResult
+	if err := json.Unmarshal([]byte(ui.OutputWriter.String()), &result); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !result.Left || result.Error != "" {
+		t.Fatalf("bad: %#v", result)
+	}
+}
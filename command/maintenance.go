@@ -0,0 +1,81 @@
+package command
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mitchellh/cli"
+	"strings"
+)
+
+// MaintenanceCommand is a Command implementation that enables or disables
+// the maintenance mode of a running Serf agent.
+type MaintenanceCommand struct {
+	Ui cli.Ui
+}
+
+func (c *MaintenanceCommand) Run(args []string) int {
+	var enable, disable bool
+	var reason string
+	cmdFlags := flag.NewFlagSet("maintenance", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.BoolVar(&enable, "enable", false, "enable maintenance mode")
+	cmdFlags.BoolVar(&disable, "disable", false, "disable maintenance mode")
+	cmdFlags.StringVar(&reason, "reason", "", "maintenance reason")
+	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcTimeout := RPCTimeoutFlag(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	if enable == disable {
+		c.Ui.Error("Exactly one of -enable or -disable must be specified.")
+		c.Ui.Error("")
+		c.Ui.Error(c.Help())
+		return 1
+	}
+
+	client, err := RPCClient(*rpcAddr, *rpcTimeout)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
+		return 1
+	}
+	defer client.Close()
+
+	if err := client.Maintenance(enable, reason); err != nil {
+		c.Ui.Error(fmt.Sprintf("Error setting maintenance mode: %s", err))
+		return 1
+	}
+
+	return 0
+}
+
+func (c *MaintenanceCommand) Synopsis() string {
+	return "Enable or disable maintenance mode of this member"
+}
+
+func (c *MaintenanceCommand) Help() string {
+	helpText := `
+Usage: serf maintenance [options]
+
+  Enables or disables the maintenance mode of the member of the agent.
+  While it is enabled, user events don't invoke the event handlers of the
+  agent, and "serf members" shows the member as under maintenance on
+  every node. Membership events still invoke the event handlers.
+
+Options:
+
+  -disable                  Disable maintenance mode.
+
+  -enable                   Enable maintenance mode.
+
+  -reason=""                Reason shown by "serf members -detailed",
+                            such as "kernel patch".
+
+  -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
+
+  -timeout=0s               Timeout of connecting to the agent and of each
+                            request. Defaults to no timeout.
+
+`
+	return strings.TrimSpace(helpText)
+}
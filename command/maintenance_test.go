@@ -0,0 +1,59 @@
+package command
+
+import (
+	"github.com/hashicorp/serf/testutil"
+	"github.com/mitchellh/cli"
+	"strings"
+	"testing"
+)
+
+func TestMaintenanceCommand_implements(t *testing.T) {
+	var _ cli.Command = &MaintenanceCommand{}
+}
+
+func TestMaintenanceCommandRun(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &MaintenanceCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-enable", "-reason=kernel patch"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	testutil.Yield()
+
+	if !a1.InMaintenance() {
+		t.Fatalf("should be in maintenance")
+	}
+
+	ui = new(cli.MockUi)
+	mc := &MembersCommand{Ui: ui}
+	if code := mc.Run([]string{"-rpc-addr=" + rpcAddr, "-detailed"}); code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	out := ui.OutputWriter.String()
+	if !strings.Contains(out, "(maintenance)") || !strings.Contains(out, "Maintenance: kernel patch") {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestMaintenanceCommandRun_noMode(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &MaintenanceCommand{Ui: ui}
+
+	code := c.Run([]string{"-rpc-addr=127.0.0.1:0"})
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "-enable or -disable") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
@@ -3,10 +3,12 @@ package command
 import (
 	"flag"
 	"fmt"
+	"github.com/hashicorp/serf/command/agent"
 	"github.com/mitchellh/cli"
 	"net"
-	"regexp"
+	"sort"
 	"strings"
+	"time"
 )
 
 // MembersCommand is a Command implementation that queries a running
@@ -26,76 +28,249 @@ Options:
   -detailed                 Additional information such as protocol verions
                             will be shown.
 
+  -format=text              Output format, "text" or "json".
+
   -role=<regexp>            If provided, output is filtered to only nodes matching
                             the regular expression for role
 
   -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
 
+  -summary                  Output the number of members by status and by
+                            the value of the -summary-tag, such as
+                            "alive=120 failed=3; role=web:80 role=db:12",
+                            instead of the members.
+
+  -summary-tag=role         Tag that -summary counts the members by.
+
   -status=<regexp>			If provided, output is filtered to only nodes matching
                             the regular expression for status
+
+  -timeout=0s               Timeout of connecting to the agent and of each
+                            request. Defaults to no timeout.
+
+  -view=<name>              If provided, output is filtered to only nodes in the
+                            view with the given name, as configured in the agent
 `
 	return strings.TrimSpace(helpText)
 }
 
+// MemberResult is a member as output by the members command with
+// -format=json.
+type MemberResult struct {
+	Name        string
+	Addr        string // host:port
+	Status      string
+	Role        string
+	Tags        map[string]string `json:",omitempty"`
+	Annotation  string            `json:",omitempty"`
+	Maintenance string            `json:",omitempty"`
+	Protocols   agent.MemberProtocols
+
+	// PreviousAddrs are the last few addresses of the member before
+	// the current one, as host:port, oldest first.
+	PreviousAddrs []string `json:",omitempty"`
+}
+
+// MembersSummary is the output of the members command with -summary
+// and -format=json. Tag is the -summary-tag that Values are counted by.
+type MembersSummary struct {
+	Statuses map[string]int
+	Tag      string
+	Values   map[string]int
+}
+
 func (c *MembersCommand) Run(args []string) int {
-	var detailed bool
-	var roleFilter, statusFilter string
+	var detailed, summary bool
+	var roleFilter, statusFilter, summaryTag, view string
 	cmdFlags := flag.NewFlagSet("members", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	format := FormatFlag(cmdFlags)
 	cmdFlags.BoolVar(&detailed, "detailed", false, "detailed output")
 	cmdFlags.StringVar(&roleFilter, "role", ".*", "role filter")
 	cmdFlags.StringVar(&statusFilter, "status", ".*", "status filter")
+	cmdFlags.StringVar(&view, "view", "", "view name")
+	cmdFlags.BoolVar(&summary, "summary", false, "summary output")
+	cmdFlags.StringVar(&summaryTag, "summary-tag", "role", "summary tag")
 	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcTimeout := RPCTimeoutFlag(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
-	// Compile the regexp
-	roleRe, err := regexp.Compile(roleFilter)
-	if err != nil {
-		c.Ui.Error(fmt.Sprintf("Failed to compile role regexp: %v", err))
-		return 1
-	}
-	statusRe, err := regexp.Compile(statusFilter)
-	if err != nil {
-		c.Ui.Error(fmt.Sprintf("Failed to compile status regexp: %v", err))
+	if err := validFormat(*format); err != nil {
+		c.Ui.Error(err.Error())
 		return 1
 	}
 
-	client, err := RPCClient(*rpcAddr)
+	client, err := RPCClient(*rpcAddr, *rpcTimeout)
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
 		return 1
 	}
 	defer client.Close()
 
-	members, err := client.Members()
+	// The agent filters the members, so that only the matching ones
+	// are sent
+	members, err := client.MembersFiltered(view, roleFilter, statusFilter)
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error retrieving members: %s", err))
 		return 1
 	}
 
+	statuses := make(map[string]int)
+	tagValues := make(map[string]int)
+	results := make([]MemberResult, 0, len(members))
 	for _, member := range members {
-		// Skip the non-matching members
-		if !roleRe.MatchString(member.Role) || !statusRe.MatchString(member.Status) {
+		if summary {
+			statuses[member.Status]++
+			value, ok := member.Tags[summaryTag]
+			if !ok && summaryTag == "role" {
+				value = member.Role
+			}
+			if value != "" {
+				tagValues[value]++
+			}
 			continue
 		}
 
 		addr := net.TCPAddr{IP: member.Addr, Port: int(member.Port)}
-		c.Ui.Output(fmt.Sprintf("%s    %s    %s    %s",
-			member.Name, addr.String(), member.Status, member.Role))
+		if *format == "json" {
+			results = append(results, MemberResult{
+				Name:          member.Name,
+				Addr:          addr.String(),
+				Status:        member.Status,
+				Role:          member.Role,
+				Tags:          member.Tags,
+				Annotation:    member.Annotation,
+				Maintenance:   member.Maintenance,
+				Protocols:     member.Protocols,
+				PreviousAddrs: previousAddrs(member),
+			})
+			continue
+		}
+
+		line := fmt.Sprintf("%s    %s    %s    %s",
+			member.Name, addr.String(), member.Status, member.Role)
+		if member.Tags["observer"] == "true" {
+			line += "    (observer)"
+		}
+		if member.Maintenance != "" {
+			line += "    (maintenance)"
+		}
+		c.Ui.Output(line)
 
 		if detailed {
-			c.Ui.Output(fmt.Sprintf("    Protocol Version: %d",
-				member.DelegateCur))
-			c.Ui.Output(fmt.Sprintf("    Available Protocol Range: [%d, %d]",
-				member.DelegateMin, member.DelegateMax))
+			if len(member.Tags) > 0 {
+				c.Ui.Output(fmt.Sprintf("    Tags: %s", formatTags(member.Tags)))
+			}
+			if member.Annotation != "" {
+				c.Ui.Output(fmt.Sprintf("    Annotation: %s", member.Annotation))
+			}
+			if member.Maintenance != "" {
+				c.Ui.Output(fmt.Sprintf("    Maintenance: %s", member.Maintenance))
+			}
+			if member.StatusTime > 0 {
+				c.Ui.Output(fmt.Sprintf("    Status Changed: %s ago", since(member.StatusTime)))
+			}
+			if member.TagsTime > 0 {
+				c.Ui.Output(fmt.Sprintf("    Tags Changed: %s ago", since(member.TagsTime)))
+			}
+			for i, addr := range previousAddrs(member) {
+				c.Ui.Output(fmt.Sprintf("    Previous Address: %s (until %s ago)",
+					addr, since(member.PreviousAddrs[i].Until)))
+			}
+			serf, ml := member.Protocols.Serf, member.Protocols.Memberlist
+			c.Ui.Output(fmt.Sprintf("    Serf Protocol: %d (understands %d to %d)",
+				serf.Cur, serf.Min, serf.Max))
+			c.Ui.Output(fmt.Sprintf("    Memberlist Protocol: %d (understands %d to %d)",
+				ml.Cur, ml.Min, ml.Max))
 		}
 	}
 
+	if *format == "json" {
+		var v interface{} = results
+		if summary {
+			v = MembersSummary{Statuses: statuses, Tag: summaryTag, Values: tagValues}
+		}
+		if err := outputJSON(c.Ui, v); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+	} else if summary {
+		line := formatCounts(statuses, "")
+		if len(tagValues) > 0 {
+			line += "; " + formatCounts(tagValues, summaryTag+"=")
+		}
+		c.Ui.Output(line)
+	}
+
 	return 0
 }
 
+// formatCounts formats the counts of values as space separated "value=n"
+// pairs, or "prefix+value:n" pairs if there is a prefix, ordered from the
+// highest count to the lowest.
+func formatCounts(counts map[string]int, prefix string) string {
+	values := make([]string, 0, len(counts))
+	for v := range counts {
+		values = append(values, v)
+	}
+	sort.Sort(&byCount{values, counts})
+
+	pairs := make([]string, len(values))
+	for i, v := range values {
+		if prefix == "" {
+			pairs[i] = fmt.Sprintf("%s=%d", v, counts[v])
+		} else {
+			pairs[i] = fmt.Sprintf("%s%s:%d", prefix, v, counts[v])
+		}
+	}
+	return strings.Join(pairs, " ")
+}
+
+// byCount sorts values by descending count, then by name
+type byCount struct {
+	values []string
+	counts map[string]int
+}
+
+func (b *byCount) Len() int      { return len(b.values) }
+func (b *byCount) Swap(i, j int) { b.values[i], b.values[j] = b.values[j], b.values[i] }
+func (b *byCount) Less(i, j int) bool {
+	ci, cj := b.counts[b.values[i]], b.counts[b.values[j]]
+	if ci != cj {
+		return ci > cj
+	}
+	return b.values[i] < b.values[j]
+}
+
+// formatTags formats a set of tags as a sorted, comma separated list
+// of key=value pairs.
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// previousAddrs formats the previous addresses of a member as host:port.
+func previousAddrs(member agent.Member) []string {
+	var addrs []string
+	for _, prev := range member.PreviousAddrs {
+		addr := net.TCPAddr{IP: prev.Addr, Port: int(prev.Port)}
+		addrs = append(addrs, addr.String())
+	}
+	return addrs
+}
+
+// since returns the time passed since the given Unix time, in seconds
+func since(unix int64) time.Duration {
+	d := time.Since(time.Unix(unix, 0))
+	return d - d%time.Second
+}
+
 func (c *MembersCommand) Synopsis() string {
 	return "Lists the members of a Serf cluster"
 }
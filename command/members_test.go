@@ -1,7 +1,10 @@
 package command
 
 import (
+	"encoding/json"
+	"github.com/hashicorp/serf/command/agent"
 	"github.com/mitchellh/cli"
+	"net"
 	"strings"
 	"testing"
 )
@@ -30,6 +33,86 @@ func TestMembersCommandRun(t *testing.T) {
 	}
 }
 
+func TestMembersCommandRun_json(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &MembersCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-format=json"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	var results []MemberResult
+	if err := json.Unmarshal([]byte(ui.OutputWriter.String()), &results); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("bad: %#v", results)
+	}
+	if results[0].Name != a1.SerfConfig().NodeName || results[0].Status != "alive" {
+		t.Fatalf("bad: %#v", results[0])
+	}
+
+	// Summary
+	ui = new(cli.MockUi)
+	c = &MembersCommand{Ui: ui}
+	args = []string{"-rpc-addr=" + rpcAddr, "-format=json", "-summary"}
+	if code := c.Run(args); code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	var summary MembersSummary
+	if err := json.Unmarshal([]byte(ui.OutputWriter.String()), &summary); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if summary.Statuses["alive"] != 1 || summary.Tag != "role" {
+		t.Fatalf("bad: %#v", summary)
+	}
+}
+
+func TestMembersCommandRun_badFormat(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &MembersCommand{Ui: ui}
+	args := []string{"-rpc-addr=foo", "-format=yaml"}
+
+	if code := c.Run(args); code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "Unknown output format") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
+func TestMembersCommandRun_detailed(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &MembersCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-detailed"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	out := ui.OutputWriter.String()
+	if !strings.Contains(out, "Serf Protocol: ") {
+		t.Fatalf("bad: %#v", out)
+	}
+	if !strings.Contains(out, "Memberlist Protocol: ") {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
 func TestMembersCommandRun_statusFilter(t *testing.T) {
 	a1 := testAgent(t)
 	defer a1.Shutdown()
@@ -99,6 +182,95 @@ func TestMembersCommandRun_roleFilter(t *testing.T) {
 	}
 }
 
+func TestMembersCommandRun_summary(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &MembersCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-summary"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	if out := ui.OutputWriter.String(); out != "alive=1; role=test:1\n" {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestFormatCounts(t *testing.T) {
+	counts := map[string]int{"db": 12, "web": 80, "cache": 12}
+	expected := "role=web:80 role=cache:12 role=db:12"
+	if out := formatCounts(counts, "role="); out != expected {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	counts = map[string]int{"alive": 120, "failed": 3}
+	if out := formatCounts(counts, ""); out != "alive=120 failed=3" {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestMembersCommandRun_view(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	a1.SetViews(map[string]agent.View{
+		"tests": agent.View{"role": "test"},
+	})
+
+	ui := new(cli.MockUi)
+	c := &MembersCommand{Ui: ui}
+	code := c.Run([]string{"-rpc-addr=" + rpcAddr, "-view=tests"})
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+	if !strings.Contains(ui.OutputWriter.String(), a1.SerfConfig().NodeName) {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+
+	ui = new(cli.MockUi)
+	c = &MembersCommand{Ui: ui}
+	code = c.Run([]string{"-rpc-addr=" + rpcAddr, "-view=unknown"})
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "Unknown view") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
+func TestMembersCommandRun_timeout(t *testing.T) {
+	// The listener accepts connections, but nothing ever responds
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer l.Close()
+
+	ui := new(cli.MockUi)
+	c := &MembersCommand{Ui: ui}
+	args := []string{
+		"-rpc-addr=" + l.Addr().String(),
+		"-timeout=50ms",
+	}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "timeout") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
 func TestMembersCommandRun_roleFilter_failed(t *testing.T) {
 	a1 := testAgent(t)
 	defer a1.Shutdown()
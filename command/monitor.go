@@ -1,14 +1,71 @@
 package command
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/hashicorp/logutils"
+	"github.com/hashicorp/serf/command/agent"
 	"github.com/mitchellh/cli"
 	"strings"
 	"sync"
+	"time"
 )
 
+// logTimeFormat is the time format of the log lines of the agent
+const logTimeFormat = "2006/01/02 15:04:05"
+
+// logRecord is a log line of the agent in the JSON output of monitor
+type logRecord struct {
+	Type      string
+	Time      string `json:",omitempty"`
+	Level     string `json:",omitempty"`
+	Subsystem string `json:",omitempty"`
+	Message   string
+}
+
+// parseLogLine splits a log line of the agent, such as
+// "2014/01/02 15:04:05 [INFO] serf: EventMemberJoin: foo", into a record.
+// Parts that can't be parsed are left in the message.
+func parseLogLine(line string) logRecord {
+	record := logRecord{Type: "log", Message: line}
+
+	if len(line) > len(logTimeFormat) {
+		t, err := time.ParseInLocation(logTimeFormat, line[:len(logTimeFormat)], time.Local)
+		if err == nil {
+			record.Time = t.Format(time.RFC3339)
+			line = strings.TrimPrefix(line[len(logTimeFormat):], " ")
+			record.Message = line
+		}
+	}
+
+	if strings.HasPrefix(line, "[") {
+		if end := strings.Index(line, "] "); end > 0 {
+			record.Level = line[1:end]
+			line = line[end+2:]
+			record.Message = line
+		}
+	}
+
+	if idx := strings.Index(line, ": "); idx > 0 && !strings.Contains(line[:idx], " ") {
+		record.Subsystem = line[:idx]
+		record.Message = line[idx+2:]
+	}
+	return record
+}
+
+// eventRecord returns a streamed event in the JSON output of monitor,
+// marked with the type "event" and the time at which it was received
+func eventRecord(event map[string]interface{}, received time.Time) map[string]interface{} {
+	record := make(map[string]interface{}, len(event)+2)
+	for k, v := range event {
+		record[k] = v
+	}
+	record["Type"] = "event"
+	record["Time"] = received.Format(time.RFC3339)
+	return record
+}
+
 // MonitorCommand is a Command implementation that queries a running
 // Serf agent what members are part of the cluster currently.
 type MonitorCommand struct {
@@ -29,25 +86,52 @@ Usage: serf monitor [options]
   example your agent may only be logging at INFO level, but with the monitor
   you can see the DEBUG level logs.
 
+  With -format=json, every log line and every event is output as a JSON
+  record on its own line, with a "Type" of "log" or "event" and a "Time",
+  so that a single monitor session is a machine-readable timeline. Log
+  records have a "Level", a "Subsystem" and a "Message". Event records
+  have the same fields as the events that are streamed over RPC.
+
 Options:
 
+  -compress                 Compress the logs and events sent by the agent.
+                            Useful when monitoring a busy agent over a slow link.
+  -format=text              Output format: "text" or "json".
   -log-level=info          Log level of the agent.
   -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
+  -timeout=0s               Timeout of connecting to the agent and of each
+                            request. Defaults to no timeout.
 `
 	return strings.TrimSpace(helpText)
 }
 
 func (c *MonitorCommand) Run(args []string) int {
 	var logLevel string
+	var compress bool
 	cmdFlags := flag.NewFlagSet("monitor", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.BoolVar(&compress, "compress", false, "compress")
 	cmdFlags.StringVar(&logLevel, "log-level", "INFO", "log level")
 	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcTimeout := RPCTimeoutFlag(cmdFlags)
+	format := FormatFlag(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
+	if err := validFormat(*format); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	config := agent.RPCClientConfig{
+		Addr:    *rpcAddr,
+		Timeout: *rpcTimeout,
+	}
+	if compress {
+		config.Compression = "gzip"
+	}
 
-	client, err := RPCClient(*rpcAddr)
+	client, err := agent.NewRPCClientConfig(&config)
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
 		return 1
@@ -80,11 +164,19 @@ func (c *MonitorCommand) Run(args []string) int {
 				if log == "" {
 					break OUTER
 				}
+				if *format == "json" {
+					c.outputRecord(parseLogLine(log))
+					continue
+				}
 				c.Ui.Info(log)
 			case event := <-eventCh:
 				if event == nil {
 					break OUTER
 				}
+				if *format == "json" {
+					c.outputRecord(eventRecord(event, time.Now()))
+					continue
+				}
 				c.Ui.Info("Event Info:")
 				for key, val := range event {
 					c.Ui.Info(fmt.Sprintf("\t%s: %#v", key, val))
@@ -95,9 +187,14 @@ func (c *MonitorCommand) Run(args []string) int {
 		c.lock.Lock()
 		defer c.lock.Unlock()
 		if !c.quitting {
-			c.Ui.Info("")
-			c.Ui.Output("Remote side ended the monitor! This usually means that the\n" +
-				"remote side has exited or crashed.")
+			msg := "Remote side ended the monitor! This usually means that the\n" +
+				"remote side has exited or crashed."
+			if *format == "json" {
+				c.Ui.Error(msg)
+			} else {
+				c.Ui.Info("")
+				c.Ui.Output(msg)
+			}
 		}
 	}()
 
@@ -113,6 +210,16 @@ func (c *MonitorCommand) Run(args []string) int {
 	return 0
 }
 
+// outputRecord writes a record of the JSON output on a line of its own
+func (c *MonitorCommand) outputRecord(record interface{}) {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error encoding record: %s", err))
+		return
+	}
+	c.Ui.Output(string(raw))
+}
+
 func (c *MonitorCommand) Synopsis() string {
 	return "Stream logs from a Serf agent"
 }
@@ -0,0 +1,65 @@
+package command
+
+import (
+	"github.com/mitchellh/cli"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMonitorCommand_implements(t *testing.T) {
+	var _ cli.Command = &MonitorCommand{}
+}
+
+func TestParseLogLine(t *testing.T) {
+	local := time.Date(2014, 1, 2, 15, 4, 5, 0, time.Local).Format(time.RFC3339)
+	cases := []struct {
+		Line     string
+		Expected logRecord
+	}{
+		{
+			"2014/01/02 15:04:05 [INFO] serf: EventMemberJoin: foo 127.0.0.1",
+			logRecord{Type: "log", Time: local, Level: "INFO", Subsystem: "serf",
+				Message: "EventMemberJoin: foo 127.0.0.1"},
+		},
+		{
+			"2014/01/02 15:04:05 [WARN] memberlist: Refuting a suspect message",
+			logRecord{Type: "log", Time: local, Level: "WARN", Subsystem: "memberlist",
+				Message: "Refuting a suspect message"},
+		},
+		{
+			"2014/01/02 15:04:05 [DEBUG] no subsystem here",
+			logRecord{Type: "log", Time: local, Level: "DEBUG",
+				Message: "no subsystem here"},
+		},
+		{
+			"    some continued output",
+			logRecord{Type: "log", Message: "    some continued output"},
+		},
+	}
+
+	for _, tc := range cases {
+		if record := parseLogLine(tc.Line); !reflect.DeepEqual(record, tc.Expected) {
+			t.Fatalf("bad: %#v, expected %#v", record, tc.Expected)
+		}
+	}
+}
+
+func TestEventRecord(t *testing.T) {
+	event := map[string]interface{}{"Event": "user", "Name": "deploy"}
+	received := time.Date(2014, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	record := eventRecord(event, received)
+	expected := map[string]interface{}{
+		"Type":  "event",
+		"Time":  "2014-01-02T15:04:05Z",
+		"Event": "user",
+		"Name":  "deploy",
+	}
+	if !reflect.DeepEqual(record, expected) {
+		t.Fatalf("bad: %#v", record)
+	}
+	if _, ok := event["Type"]; ok {
+		t.Fatalf("event modified: %#v", event)
+	}
+}
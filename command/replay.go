@@ -0,0 +1,260 @@
+package command
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/command/agent"
+	"github.com/hashicorp/serf/serf"
+	"github.com/mitchellh/cli"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayCommand is a Command implementation that loads the output of
+// `serf dump` into a cluster of agents running locally, so that problems
+// seen in a production topology can be reproduced offline.
+type ReplayCommand struct {
+	ShutdownCh <-chan struct{}
+	Ui         cli.Ui
+}
+
+func (c *ReplayCommand) Help() string {
+	helpText := `
+Usage: serf replay [options] state.json
+
+  Starts a local simulated cluster from the output of "serf dump". One
+  agent is started for every member in the dump, with the same name, role
+  and tags. Members that were failed or left in the dump are made to fail
+  or leave once the cluster has formed.
+
+  The agents gossip over an in-memory network, so they don't use any
+  ports. The agent for the node that produced the dump serves RPC, so the
+  other Serf commands can be used to inspect the simulated cluster. All
+  agents are shut down when the command is interrupted.
+
+Options:
+
+  -rpc-addr=127.0.0.1:7373  Address to serve RPC on.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *ReplayCommand) Run(args []string) int {
+	cmdFlags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	rpcAddr := RPCAddrFlag(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	args = cmdFlags.Args()
+	if len(args) != 1 {
+		c.Ui.Error("A single dump file must be specified")
+		c.Ui.Error("")
+		c.Ui.Error(c.Help())
+		return 1
+	}
+
+	raw, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error reading dump: %s", err))
+		return 1
+	}
+
+	var dump agent.StateDump
+	if err := json.Unmarshal(raw, &dump); err != nil {
+		c.Ui.Error(fmt.Sprintf("Error decoding dump: %s", err))
+		return 1
+	}
+
+	// The simulated agents only log to the buffer that is served over
+	// RPC, since interleaving the logs of every agent is unreadable.
+	logWriter := agent.NewLogWriter(512)
+	agents, err := replayDump(&dump, logWriter)
+	defer func() {
+		for _, a := range agents {
+			a.Shutdown()
+		}
+	}()
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error replaying dump: %s", err))
+		return 1
+	}
+
+	rpcListener, err := net.Listen("tcp", *rpcAddr)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error starting RPC listener: %s", err))
+		return 1
+	}
+	ipc := agent.NewAgentIPC(agents[0], rpcListener, logWriter, logWriter)
+	defer ipc.Shutdown()
+
+	c.Ui.Output(fmt.Sprintf("Replayed %d members from %s", len(agents), args[0]))
+	c.Ui.Output(fmt.Sprintf("RPC for '%s' available at %s",
+		agents[0].SerfConfig().NodeName, *rpcAddr))
+
+	select {
+	case <-c.ShutdownCh:
+	case <-agents[0].ShutdownCh():
+	}
+	return 0
+}
+
+func (c *ReplayCommand) Synopsis() string {
+	return "Starts a local simulated cluster from a dump"
+}
+
+// replayNetwork is the in-memory network of the simulated agents. An
+// agent that is shut down is cut off from it, since sending to the
+// memberlist MockTransport of a stopped agent blocks forever.
+type replayNetwork struct {
+	memberlist.MockNetwork
+
+	lock sync.Mutex
+	down map[string]bool
+}
+
+func (n *replayNetwork) isDown(addr string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.down[addr]
+}
+
+// NewTransport returns the transport of a new agent on the network
+func (n *replayNetwork) NewTransport(name string) (*replayTransport, error) {
+	mock := n.MockNetwork.NewTransport(name)
+	ip, port, err := mock.FinalAdvertiseAddr("", 0)
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(ip.String(), fmt.Sprintf("%d", port))
+	return &replayTransport{mock: mock, network: n, addr: addr}, nil
+}
+
+// replayTransport wraps a MockTransport, dropping what is sent to agents
+// that were shut down
+type replayTransport struct {
+	mock    *memberlist.MockTransport
+	network *replayNetwork
+	addr    string
+}
+
+func (t *replayTransport) FinalAdvertiseAddr(ip string, port int) (net.IP, int, error) {
+	return t.mock.FinalAdvertiseAddr(ip, port)
+}
+
+func (t *replayTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	if t.network.isDown(addr) {
+		return time.Now(), nil
+	}
+	return t.mock.WriteTo(b, addr)
+}
+
+func (t *replayTransport) PacketCh() <-chan *memberlist.Packet {
+	return t.mock.PacketCh()
+}
+
+func (t *replayTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	if t.network.isDown(addr) {
+		return nil, fmt.Errorf("%s is down", addr)
+	}
+	return t.mock.DialTimeout(addr, timeout)
+}
+
+func (t *replayTransport) StreamCh() <-chan net.Conn {
+	return t.mock.StreamCh()
+}
+
+func (t *replayTransport) Shutdown() error {
+	t.network.lock.Lock()
+	t.network.down[t.addr] = true
+	t.network.lock.Unlock()
+	return t.mock.Shutdown()
+}
+
+// replayDump starts an agent for every member in the dump and joins them
+// together over a replayNetwork. The agent for the node that produced the
+// dump is always first in the returned list. Once joined, members that
+// were failed are shut down and members that had left gracefully leave.
+// The agents that were started are returned even if an error occurs, so
+// they can be cleaned up.
+func replayDump(dump *agent.StateDump, logOutput io.Writer) ([]*agent.Agent, error) {
+	if len(dump.Members) == 0 {
+		return nil, fmt.Errorf("Dump contains no members")
+	}
+
+	// Order the members so that the dumping node comes first
+	members := make([]agent.Member, 0, len(dump.Members))
+	for _, m := range dump.Members {
+		if m.Name == dump.Config.NodeName {
+			members = append([]agent.Member{m}, members...)
+		} else {
+			members = append(members, m)
+		}
+	}
+
+	network := &replayNetwork{down: make(map[string]bool)}
+	agents := make([]*agent.Agent, 0, len(members))
+	var joinAddr string
+	for i, m := range members {
+		transport, err := network.NewTransport(m.Name)
+		if err != nil {
+			return agents, err
+		}
+
+		config := serf.DefaultConfig()
+		config.NodeName = m.Name
+		config.Role = m.Role
+		config.Tags = m.Tags
+		config.MemberlistConfig.Transport = transport
+		if dump.Config.Protocol != 0 {
+			config.ProtocolVersion = dump.Config.Protocol
+		}
+
+		a, err := agent.Create(config, logOutput)
+		if err != nil {
+			return agents, err
+		}
+		if err := a.Start(); err != nil {
+			return agents, err
+		}
+		agents = append(agents, a)
+
+		if i == 0 {
+			joinAddr = transport.addr
+			continue
+		}
+		if _, err := a.Join([]string{joinAddr}, false); err != nil {
+			return agents, fmt.Errorf("Error joining '%s': %s", m.Name, err)
+		}
+	}
+
+	// Reproduce the members that were no longer alive
+	for i, m := range members {
+		if i == 0 {
+			continue
+		}
+
+		switch m.Status {
+		case "failed":
+			if err := agents[i].Shutdown(); err != nil {
+				return agents, err
+			}
+		case "left", "leaving":
+			if err := agents[i].Leave(); err != nil {
+				return agents, err
+			}
+			if err := agents[i].Shutdown(); err != nil {
+				return agents, err
+			}
+		}
+	}
+
+	return agents, nil
+}
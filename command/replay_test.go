@@ -0,0 +1,93 @@
+package command
+
+import (
+	"github.com/hashicorp/serf/command/agent"
+	"github.com/hashicorp/serf/serf"
+	"github.com/mitchellh/cli"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayCommand_implements(t *testing.T) {
+	var _ cli.Command = &ReplayCommand{}
+}
+
+func TestReplayCommandRun_noDump(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &ReplayCommand{Ui: ui}
+
+	code := c.Run([]string{})
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "dump file") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
+func TestReplayDump(t *testing.T) {
+	dump := &agent.StateDump{
+		Members: []agent.Member{
+			{Name: "web", Role: "web", Status: "alive"},
+			{Name: "db", Role: "db", Tags: map[string]string{"role": "db", "dc": "east"}, Status: "alive"},
+			{Name: "old", Role: "web", Status: "left"},
+		},
+		Config: agent.DumpConfig{
+			NodeName: "db",
+			Protocol: 3,
+		},
+	}
+
+	agents, err := replayDump(dump, nil)
+	defer func() {
+		for _, a := range agents {
+			a.Shutdown()
+		}
+	}()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(agents) != 3 {
+		t.Fatalf("bad: %#v", agents)
+	}
+
+	if agents[0].SerfConfig().NodeName != "db" {
+		t.Fatalf("bad: %#v", agents[0].SerfConfig())
+	}
+
+	// Wait for the leave to propagate
+	var members []serf.Member
+	for i := 0; i < 100; i++ {
+		time.Sleep(20 * time.Millisecond)
+		members = agents[0].Serf().Members()
+		if len(members) == 3 && memberStatus(members, "old") == serf.StatusLeft {
+			break
+		}
+	}
+
+	if len(members) != 3 {
+		t.Fatalf("bad: %#v", members)
+	}
+
+	if memberStatus(members, "old") != serf.StatusLeft {
+		t.Fatalf("bad: %#v", members)
+	}
+
+	for _, m := range members {
+		if m.Name == "db" && m.Tags["dc"] != "east" {
+			t.Fatalf("bad: %#v", m)
+		}
+	}
+}
+
+func memberStatus(members []serf.Member, name string) serf.MemberStatus {
+	for _, m := range members {
+		if m.Name == name {
+			return m.Status
+		}
+	}
+	return serf.StatusNone
+}
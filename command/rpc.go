@@ -3,6 +3,7 @@ package command
 import (
 	"flag"
 	"github.com/hashicorp/serf/command/agent"
+	"time"
 )
 
 // RPCAddrFlag returns a pointer to a string that will be populated
@@ -12,7 +13,17 @@ func RPCAddrFlag(f *flag.FlagSet) *string {
 		"RPC address of the Serf agent")
 }
 
-// RPCClient returns a new Serf RPC client with the given address.
-func RPCClient(addr string) (*agent.RPCClient, error) {
-	return agent.NewRPCClient(addr)
+// RPCTimeoutFlag returns a pointer to a duration that will be populated
+// when the given flagset is parsed with the timeout of RPC requests.
+func RPCTimeoutFlag(f *flag.FlagSet) *time.Duration {
+	return f.Duration("timeout", 0, "RPC timeout")
+}
+
+// RPCClient returns a new Serf RPC client with the given address. The
+// timeout, if not zero, limits connecting and each request.
+func RPCClient(addr string, timeout time.Duration) (*agent.RPCClient, error) {
+	return agent.NewRPCClientConfig(&agent.RPCClientConfig{
+		Addr:    addr,
+		Timeout: timeout,
+	})
 }
@@ -0,0 +1,83 @@
+package command
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mitchellh/cli"
+	"strings"
+)
+
+// SnapshotSaveCommand is a Command implementation that makes the Serf
+// agent compact its snapshot and sync it to disk right away.
+type SnapshotSaveCommand struct {
+	Ui cli.Ui
+}
+
+func (c *SnapshotSaveCommand) Help() string {
+	helpText := `
+Usage: serf snapshot-save [options]
+
+  Makes the agent compact its snapshot and sync it to disk right away,
+  such as before a planned reboot of the host or a backup, and outputs
+  the path and size of the snapshot.
+
+Options:
+
+  -format=text              Output format, "text" or "json".
+  -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
+  -timeout=0s               Timeout of connecting to the agent and of each
+                            request. Defaults to no timeout.
+`
+	return strings.TrimSpace(helpText)
+}
+
+// SnapshotSaveResult is the result of the snapshot-save command with
+// -format=json.
+type SnapshotSaveResult struct {
+	Path string
+	Size int64
+}
+
+func (c *SnapshotSaveCommand) Run(args []string) int {
+	cmdFlags := flag.NewFlagSet("snapshot-save", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	format := FormatFlag(cmdFlags)
+	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcTimeout := RPCTimeoutFlag(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	if err := validFormat(*format); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	client, err := RPCClient(*rpcAddr, *rpcTimeout)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
+		return 1
+	}
+	defer client.Close()
+
+	path, size, err := client.SnapshotSave()
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error saving snapshot: %s", err))
+		return 1
+	}
+
+	if *format == "json" {
+		if err := outputJSON(c.Ui, SnapshotSaveResult{Path: path, Size: size}); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	c.Ui.Output(fmt.Sprintf("Snapshot saved to %s (%d bytes)", path, size))
+	return 0
+}
+
+func (c *SnapshotSaveCommand) Synopsis() string {
+	return "Compacts and syncs the snapshot of the agent to disk"
+}
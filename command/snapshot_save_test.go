@@ -0,0 +1,75 @@
+package command
+
+import (
+	"github.com/hashicorp/serf/command/agent"
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+	"github.com/mitchellh/cli"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotSaveCommand_implements(t *testing.T) {
+	var _ cli.Command = &SnapshotSaveCommand{}
+}
+
+func TestSnapshotSaveCommandRun(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+	path := filepath.Join(td, "snapshot")
+
+	config := serf.DefaultConfig()
+	config.MemberlistConfig.BindAddr = testutil.GetBindAddr().String()
+	config.NodeName = config.MemberlistConfig.BindAddr
+	config.SnapshotPath = path
+
+	a1, err := agent.Create(config, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &SnapshotSaveCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	if !strings.Contains(ui.OutputWriter.String(), path) {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+}
+
+func TestSnapshotSaveCommandRun_noSnapshot(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &SnapshotSaveCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "No snapshot") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
@@ -0,0 +1,74 @@
+package command
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mitchellh/cli"
+	"strings"
+	"time"
+)
+
+// TraceCommand is a Command implementation that makes a running Serf
+// agent log the gossip messages it sends and receives.
+type TraceCommand struct {
+	Ui cli.Ui
+}
+
+func (c *TraceCommand) Run(args []string) int {
+	var duration time.Duration
+	cmdFlags := flag.NewFlagSet("trace", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.DurationVar(&duration, "duration", time.Minute, "trace duration")
+	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcTimeout := RPCTimeoutFlag(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	client, err := RPCClient(*rpcAddr, *rpcTimeout)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
+		return 1
+	}
+	defer client.Close()
+
+	if err := client.Trace(duration); err != nil {
+		c.Ui.Error(fmt.Sprintf("Error enabling tracing: %s", err))
+		return 1
+	}
+
+	if duration <= 0 {
+		c.Ui.Output("Message tracing disabled")
+	} else {
+		c.Ui.Output(fmt.Sprintf(
+			"Message tracing enabled for %s, use 'serf monitor' to view it", duration))
+	}
+	return 0
+}
+
+func (c *TraceCommand) Synopsis() string {
+	return "Log the gossip messages of the agent for a while"
+}
+
+func (c *TraceCommand) Help() string {
+	helpText := `
+Usage: serf trace [options]
+
+  Makes the Serf agent log every gossip message it sends or receives,
+  with its type, size and decoded contents, for a limited time. The
+  trace is written to the agent logs at the INFO level and can be
+  viewed with "serf monitor".
+
+Options:
+
+  -duration=1m              How long to trace messages. A duration of 0
+                            stops tracing.
+
+  -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
+
+  -timeout=0s               Timeout of connecting to the agent and of each
+                            request. Defaults to no timeout.
+
+`
+	return strings.TrimSpace(helpText)
+}
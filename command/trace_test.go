@@ -0,0 +1,30 @@
+package command
+
+import (
+	"github.com/mitchellh/cli"
+	"strings"
+	"testing"
+)
+
+func TestTraceCommand_implements(t *testing.T) {
+	var _ cli.Command = &TraceCommand{}
+}
+
+func TestTraceCommandRun(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+	rpcAddr, ipc := testIPC(t, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &TraceCommand{Ui: ui}
+
+	code := c.Run([]string{"-rpc-addr=" + rpcAddr, "-duration=5m"})
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	if !strings.Contains(ui.OutputWriter.String(), "enabled for 5m0s") {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+}
@@ -22,18 +22,54 @@ func init() {
 			}, nil
 		},
 
+		"annotate": func() (cli.Command, error) {
+			return &command.AnnotateCommand{
+				Ui: ui,
+			}, nil
+		},
+
 		"event": func() (cli.Command, error) {
 			return &command.EventCommand{
 				Ui: ui,
 			}, nil
 		},
 
+		"dump": func() (cli.Command, error) {
+			return &command.DumpCommand{
+				Ui: ui,
+			}, nil
+		},
+
+		"events": func() (cli.Command, error) {
+			return &command.EventsCommand{
+				Ui: ui,
+			}, nil
+		},
+
+		"exec-with-members": func() (cli.Command, error) {
+			return &command.ExecWithMembersCommand{
+				Ui: ui,
+			}, nil
+		},
+
 		"force-leave": func() (cli.Command, error) {
 			return &command.ForceLeaveCommand{
 				Ui: ui,
 			}, nil
 		},
 
+		"handler-test": func() (cli.Command, error) {
+			return &command.HandlerTestCommand{
+				Ui: ui,
+			}, nil
+		},
+
+		"info": func() (cli.Command, error) {
+			return &command.InfoCommand{
+				Ui: ui,
+			}, nil
+		},
+
 		"join": func() (cli.Command, error) {
 			return &command.JoinCommand{
 				Ui: ui,
@@ -52,6 +88,12 @@ func init() {
 			}, nil
 		},
 
+		"maintenance": func() (cli.Command, error) {
+			return &command.MaintenanceCommand{
+				Ui: ui,
+			}, nil
+		},
+
 		"members": func() (cli.Command, error) {
 			return &command.MembersCommand{
 				Ui: ui,
@@ -65,6 +107,25 @@ func init() {
 			}, nil
 		},
 
+		"replay": func() (cli.Command, error) {
+			return &command.ReplayCommand{
+				ShutdownCh: makeShutdownCh(),
+				Ui:         ui,
+			}, nil
+		},
+
+		"snapshot-save": func() (cli.Command, error) {
+			return &command.SnapshotSaveCommand{
+				Ui: ui,
+			}, nil
+		},
+
+		"trace": func() (cli.Command, error) {
+			return &command.TraceCommand{
+				Ui: ui,
+			}, nil
+		},
+
 		"version": func() (cli.Command, error) {
 			return &command.VersionCommand{
 				Revision:          GitCommit,
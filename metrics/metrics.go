@@ -0,0 +1,30 @@
+// Package metrics provides adapters from the serf.MetricsSink interface
+// to statsd and Prometheus. Applications with a metrics library of their
+// own can implement the three methods of serf.MetricsSink instead.
+package metrics
+
+import (
+	"github.com/hashicorp/serf/serf"
+	"time"
+)
+
+// Fanout is a sink that sends every metric to all of its sinks
+type Fanout []serf.MetricsSink
+
+func (f Fanout) IncrCounter(key []string, val float32) {
+	for _, s := range f {
+		s.IncrCounter(key, val)
+	}
+}
+
+func (f Fanout) SetGauge(key []string, val float32) {
+	for _, s := range f {
+		s.SetGauge(key, val)
+	}
+}
+
+func (f Fanout) MeasureSince(key []string, start time.Time) {
+	for _, s := range f {
+		s.MeasureSince(key, start)
+	}
+}
@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrometheusSink keeps the metrics in memory and serves them over HTTP
+// in the text format of Prometheus, to be scraped by a Prometheus server.
+// The parts of a key are joined with underscores. Counters get a "_total"
+// suffix, and timers are summaries in seconds, with a "_seconds" suffix
+// and only their count and sum.
+type PrometheusSink struct {
+	lock     sync.Mutex
+	counters map[string]float64
+	gauges   map[string]float64
+	timers   map[string]*timerSummary
+}
+
+// timerSummary is the count and the sum of the samples of a timer
+type timerSummary struct {
+	Count uint64
+	Sum   float64
+}
+
+// NewPrometheusSink creates an empty sink. It implements http.Handler
+// and is typically served at "/metrics".
+func NewPrometheusSink() *PrometheusSink {
+	return &PrometheusSink{
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+		timers:   make(map[string]*timerSummary),
+	}
+}
+
+func (p *PrometheusSink) IncrCounter(key []string, val float32) {
+	name := prometheusName(key) + "_total"
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.counters[name] += float64(val)
+}
+
+func (p *PrometheusSink) SetGauge(key []string, val float32) {
+	name := prometheusName(key)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.gauges[name] = float64(val)
+}
+
+func (p *PrometheusSink) MeasureSince(key []string, start time.Time) {
+	name := prometheusName(key) + "_seconds"
+	elapsed := time.Since(start).Seconds()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	t, ok := p.timers[name]
+	if !ok {
+		t = new(timerSummary)
+		p.timers[name] = t
+	}
+	t.Count++
+	t.Sum += elapsed
+}
+
+// ServeHTTP writes all the metrics, sorted by name
+func (p *PrometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, p.String())
+}
+
+// String returns all the metrics in the text format of Prometheus
+func (p *PrometheusSink) String() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var out []string
+	for _, name := range sortedNames(p.counters) {
+		out = append(out, fmt.Sprintf("# TYPE %s counter\n%s %g\n",
+			name, name, p.counters[name]))
+	}
+	for _, name := range sortedNames(p.gauges) {
+		out = append(out, fmt.Sprintf("# TYPE %s gauge\n%s %g\n",
+			name, name, p.gauges[name]))
+	}
+
+	timers := make([]string, 0, len(p.timers))
+	for name := range p.timers {
+		timers = append(timers, name)
+	}
+	sort.Strings(timers)
+	for _, name := range timers {
+		t := p.timers[name]
+		out = append(out, fmt.Sprintf("# TYPE %s summary\n%s_sum %g\n%s_count %d\n",
+			name, name, t.Sum, name, t.Count))
+	}
+	return strings.Join(out, "")
+}
+
+// sortedNames returns the names of the metrics in order
+func sortedNames(metrics map[string]float64) []string {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// prometheusName joins the parts of a key with underscores, replacing
+// the characters that aren't allowed in the names of Prometheus metrics
+func prometheusName(key []string) string {
+	name := []byte(strings.Join(key, "_"))
+	for i, c := range name {
+		valid := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9' && i > 0)
+		if !valid {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
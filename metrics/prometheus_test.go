@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"github.com/hashicorp/serf/serf"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusSink_implements(t *testing.T) {
+	var _ serf.MetricsSink = &PrometheusSink{}
+}
+
+func TestPrometheusSink(t *testing.T) {
+	sink := NewPrometheusSink()
+	sink.IncrCounter([]string{"serf", "member", "join"}, 1)
+	sink.IncrCounter([]string{"serf", "member", "join"}, 2)
+	sink.SetGauge([]string{"serf", "queue", "intent"}, 12)
+	sink.SetGauge([]string{"serf", "queue", "intent"}, 3)
+	sink.MeasureSince([]string{"agent", "rpc.join"}, time.Now().Add(-time.Second))
+
+	server := httptest.NewServer(sink)
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	out := string(body)
+	for _, e := range []string{
+		"# TYPE serf_member_join_total counter\nserf_member_join_total 3\n",
+		"# TYPE serf_queue_intent gauge\nserf_queue_intent 3\n",
+		"# TYPE agent_rpc_join_seconds summary\n",
+		"agent_rpc_join_seconds_count 1\n",
+	} {
+		if !strings.Contains(out, e) {
+			t.Fatalf("missing %q in: %s", e, out)
+		}
+	}
+}
+
+func TestFanout(t *testing.T) {
+	a, b := NewPrometheusSink(), NewPrometheusSink()
+	Fanout{a, b}.IncrCounter([]string{"serf", "events"}, 1)
+
+	if a.String() != b.String() || !strings.Contains(a.String(), "serf_events_total 1") {
+		t.Fatalf("bad: %s %s", a, b)
+	}
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// StatsdSink sends metrics to a statsd server over UDP. The parts of a
+// key are joined with dots, after an optional prefix. Each metric is sent
+// in its own packet as soon as it is recorded, and lost if the server is
+// down, the same as with any statsd client.
+type StatsdSink struct {
+	prefix string
+	conn   net.Conn
+}
+
+// NewStatsdSink creates a sink that sends metrics to the statsd server at
+// the given address, such as "127.0.0.1:8125". The prefix, if any, is
+// prepended to every key, such as "web-1" for "web-1.serf.member.join".
+func NewStatsdSink(addr string, prefix string) (*StatsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to statsd: %s", err)
+	}
+	return &StatsdSink{prefix: prefix, conn: conn}, nil
+}
+
+func (s *StatsdSink) IncrCounter(key []string, val float32) {
+	s.send(key, val, "c")
+}
+
+func (s *StatsdSink) SetGauge(key []string, val float32) {
+	s.send(key, val, "g")
+}
+
+func (s *StatsdSink) MeasureSince(key []string, start time.Time) {
+	elapsed := float32(time.Since(start)) / float32(time.Millisecond)
+	s.send(key, elapsed, "ms")
+}
+
+// Close closes the connection to the server
+func (s *StatsdSink) Close() error {
+	return s.conn.Close()
+}
+
+// send writes a metric in the statsd line format. Errors are ignored,
+// since metrics are best effort.
+func (s *StatsdSink) send(key []string, val float32, kind string) {
+	s.conn.Write([]byte(fmt.Sprintf("%s:%g|%s", s.name(key), val, kind)))
+}
+
+// name joins the parts of a key with dots, replacing the characters that
+// have a meaning in the statsd format
+func (s *StatsdSink) name(key []string) string {
+	parts := key
+	if s.prefix != "" {
+		parts = append([]string{s.prefix}, key...)
+	}
+	name := strings.Join(parts, ".")
+	return strings.NewReplacer(":", "_", "|", "_", "@", "_", " ", "_").Replace(name)
+}
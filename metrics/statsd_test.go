@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"github.com/hashicorp/serf/serf"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdSink_implements(t *testing.T) {
+	var _ serf.MetricsSink = &StatsdSink{}
+}
+
+func TestStatsdSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer conn.Close()
+
+	sink, err := NewStatsdSink(conn.LocalAddr().String(), "web 1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer sink.Close()
+
+	sink.IncrCounter([]string{"serf", "member", "join"}, 1)
+	sink.SetGauge([]string{"serf", "queue", "intent"}, 12)
+	sink.MeasureSince([]string{"serf", "join"}, time.Now())
+
+	expected := []string{
+		"web_1.serf.member.join:1|c",
+		"web_1.serf.queue.intent:12|g",
+		"web_1.serf.join:",
+	}
+	buf := make([]byte, 512)
+	for _, e := range expected {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if line := string(buf[:n]); !strings.HasPrefix(line, e) {
+			t.Fatalf("bad: %s, expected %s", line, e)
+		}
+	}
+}
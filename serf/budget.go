@@ -0,0 +1,36 @@
+package serf
+
+import (
+	"sync"
+	"time"
+)
+
+// bandwidthBudget limits the number of bytes of broadcasts that are sent
+// per second, see Config.GossipBandwidthLimit.
+type bandwidthBudget struct {
+	limit int
+
+	lock        sync.Mutex
+	windowStart time.Time
+	used        int
+}
+
+// remaining returns the number of bytes that can still be sent in the
+// current one second window
+func (b *bandwidthBudget) remaining() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if time.Since(b.windowStart) >= time.Second {
+		b.windowStart = time.Now()
+		b.used = 0
+	}
+	return b.limit - b.used
+}
+
+// use records bytes that were sent in the current window
+func (b *bandwidthBudget) use(n int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.used += n
+}
@@ -3,6 +3,10 @@ package serf
 type coalesceEvent struct {
 	Type   EventType
 	Member *Member
+
+	// PrevTags are the tags of the member before the first of the
+	// coalesced updates, for member-update events
+	PrevTags map[string]string
 }
 
 type memberEventCoalescer struct {
@@ -18,6 +22,8 @@ func (c *memberEventCoalescer) Handle(e Event) bool {
 		return true
 	case EventMemberFailed:
 		return true
+	case EventMemberUpdate:
+		return true
 	default:
 		return false
 	}
@@ -26,10 +32,21 @@ func (c *memberEventCoalescer) Handle(e Event) bool {
 func (c *memberEventCoalescer) Coalesce(raw Event) {
 	e := raw.(MemberEvent)
 	for _, m := range e.Members {
-		c.latestEvents[m.Name] = coalesceEvent{
+		m := m
+		cevent := coalesceEvent{
 			Type:   e.Type,
 			Member: &m,
 		}
+
+		// Updates that are coalesced report the tags from before the
+		// first one
+		if e.Type == EventMemberUpdate {
+			cevent.PrevTags = e.PrevTags[m.Name]
+			if latest, ok := c.latestEvents[m.Name]; ok && latest.Type == EventMemberUpdate {
+				cevent.PrevTags = latest.PrevTags
+			}
+		}
+		c.latestEvents[m.Name] = cevent
 	}
 }
 
@@ -39,8 +56,9 @@ func (c *memberEventCoalescer) Flush(outCh chan<- Event) {
 	for name, cevent := range c.latestEvents {
 		previous, ok := c.lastEvents[name]
 
-		// If we sent the same event before, then ignore
-		if ok && previous == cevent.Type {
+		// If we sent the same event before, then ignore. Updates are
+		// always sent, since each one may change something else.
+		if ok && previous == cevent.Type && cevent.Type != EventMemberUpdate {
 			continue
 		}
 
@@ -54,10 +72,20 @@ func (c *memberEventCoalescer) Flush(outCh chan<- Event) {
 			events[cevent.Type] = newEvent
 		}
 		newEvent.Members = append(newEvent.Members, *cevent.Member)
+		if cevent.Type == EventMemberUpdate {
+			if newEvent.PrevTags == nil {
+				newEvent.PrevTags = make(map[string]map[string]string)
+			}
+			newEvent.PrevTags[name] = cevent.PrevTags
+		}
 	}
 
 	// Send out those events
 	for _, event := range events {
 		outCh <- *event
 	}
+
+	// The events are handled, and must not be sent again with the
+	// next ones
+	c.latestEvents = make(map[string]coalesceEvent)
 }
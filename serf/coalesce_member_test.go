@@ -75,6 +75,70 @@ MEMBEREVENTFORLOOP:
 	}
 }
 
+func TestMemberEventCoalesce_update(t *testing.T) {
+	outCh := make(chan Event, 64)
+	shutdownCh := make(chan struct{})
+	defer close(shutdownCh)
+
+	c := &memberEventCoalescer{
+		lastEvents:   make(map[string]EventType),
+		latestEvents: make(map[string]coalesceEvent),
+	}
+
+	inCh := coalescedEventCh(outCh, shutdownCh,
+		5*time.Millisecond, 5*time.Millisecond, c)
+
+	send := []Event{
+		MemberEvent{
+			Type:     EventMemberUpdate,
+			Members:  []Member{Member{Name: "foo", Tags: map[string]string{"v": "2"}}},
+			PrevTags: map[string]map[string]string{"foo": {"v": "1"}},
+		},
+		MemberEvent{
+			Type:     EventMemberUpdate,
+			Members:  []Member{Member{Name: "foo", Tags: map[string]string{"v": "3"}}},
+			PrevTags: map[string]map[string]string{"foo": {"v": "2"}},
+		},
+	}
+
+	for _, e := range send {
+		inCh <- e
+	}
+
+	select {
+	case e := <-outCh:
+		me := e.(MemberEvent)
+		if me.Type != EventMemberUpdate || len(me.Members) != 1 {
+			t.Fatalf("bad: %#v", me)
+		}
+		if me.Members[0].Tags["v"] != "3" {
+			t.Fatalf("bad: %#v", me.Members[0])
+		}
+		if me.PrevTags["foo"]["v"] != "1" {
+			t.Fatalf("bad: %#v", me.PrevTags)
+		}
+	case <-time.After(10 * time.Millisecond):
+		t.Fatalf("no event")
+	}
+
+	// A later update is sent again, even though the type is the same
+	inCh <- MemberEvent{
+		Type:     EventMemberUpdate,
+		Members:  []Member{Member{Name: "foo", Tags: map[string]string{"v": "4"}}},
+		PrevTags: map[string]map[string]string{"foo": {"v": "3"}},
+	}
+
+	select {
+	case e := <-outCh:
+		me := e.(MemberEvent)
+		if me.PrevTags["foo"]["v"] != "3" || me.Members[0].Tags["v"] != "4" {
+			t.Fatalf("bad: %#v", me)
+		}
+	case <-time.After(10 * time.Millisecond):
+		t.Fatalf("no event")
+	}
+}
+
 func TestMemberEventCoalesce_passThrough(t *testing.T) {
 	cases := []struct {
 		e      Event
@@ -84,6 +148,7 @@ func TestMemberEventCoalesce_passThrough(t *testing.T) {
 		{MemberEvent{Type: EventMemberJoin}, true},
 		{MemberEvent{Type: EventMemberLeave}, true},
 		{MemberEvent{Type: EventMemberFailed}, true},
+		{MemberEvent{Type: EventMemberUpdate}, true},
 	}
 
 	for _, tc := range cases {
@@ -5,9 +5,17 @@ type latestUserEvents struct {
 	Events []Event
 }
 
+// userEventKey identifies the user events that coalesce. Events meant
+// for different members never coalesce, so that each target gets its
+// latest event.
+type userEventKey struct {
+	Name   string
+	Target string
+}
+
 type userEventCoalescer struct {
-	// Maps an event name into the latest versions
-	events map[string]*latestUserEvents
+	// Maps an event name and target into the latest versions
+	events map[userEventKey]*latestUserEvents
 }
 
 func (c *userEventCoalescer) Handle(e Event) bool {
@@ -23,7 +31,8 @@ func (c *userEventCoalescer) Handle(e Event) bool {
 
 func (c *userEventCoalescer) Coalesce(e Event) {
 	user := e.(UserEvent)
-	latest, ok := c.events[user.Name]
+	key := userEventKey{Name: user.Name, Target: user.Target}
+	latest, ok := c.events[key]
 
 	// Create a new entry if there are none, or
 	// if this message has the newest LTime
@@ -32,7 +41,7 @@ func (c *userEventCoalescer) Coalesce(e Event) {
 			LTime:  user.LTime,
 			Events: []Event{e},
 		}
-		c.events[user.Name] = latest
+		c.events[key] = latest
 		return
 	}
 
@@ -48,5 +57,5 @@ func (c *userEventCoalescer) Flush(outChan chan<- Event) {
 			outChan <- e
 		}
 	}
-	c.events = make(map[string]*latestUserEvents)
+	c.events = make(map[userEventKey]*latestUserEvents)
 }
@@ -12,7 +12,7 @@ func TestUserEventCoalesce_Basic(t *testing.T) {
 	defer close(shutdownCh)
 
 	c := &userEventCoalescer{
-		events: make(map[string]*latestUserEvents),
+		events: make(map[userEventKey]*latestUserEvents),
 	}
 
 	inCh := coalescedEventCh(outCh, shutdownCh,
@@ -100,3 +100,26 @@ func TestUserEventCoalesce_passThrough(t *testing.T) {
 		}
 	}
 }
+
+func TestUserEventCoalesce_target(t *testing.T) {
+	c := &userEventCoalescer{
+		events: make(map[userEventKey]*latestUserEvents),
+	}
+	c.Coalesce(UserEvent{LTime: 1, Name: "foo", Target: "web-3", Coalesce: true})
+	c.Coalesce(UserEvent{LTime: 2, Name: "foo", Target: "web-4", Coalesce: true})
+	c.Coalesce(UserEvent{LTime: 3, Name: "foo", Target: "web-4", Coalesce: true})
+
+	outCh := make(chan Event, 4)
+	c.Flush(outCh)
+	close(outCh)
+
+	got := make(map[string]LamportTime)
+	for e := range outCh {
+		ue := e.(UserEvent)
+		got[ue.Target] = ue.LTime
+	}
+	expected := map[string]LamportTime{"web-3": 1, "web-4": 3}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad: %#v", got)
+	}
+}
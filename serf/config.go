@@ -3,6 +3,7 @@ package serf
 import (
 	"github.com/hashicorp/memberlist"
 	"io"
+	"math/rand"
 	"os"
 	"time"
 )
@@ -14,6 +15,7 @@ var ProtocolVersionMap map[uint8]uint8
 
 func init() {
 	ProtocolVersionMap = map[uint8]uint8{
+		3: 2,
 		2: 2,
 		1: 1,
 		0: 0,
@@ -34,6 +36,17 @@ type Config struct {
 	// balancers to the rotation, so it checks if the added nodes are "web".
 	Role string
 
+	// Tags are a set of key/value pairs that are gossiped along with the
+	// membership information of this node. They can be used to attach
+	// arbitrary metadata, such as the datacenter or version, to a member.
+	// If Role is set, it is advertised as the "role" tag. Tags other
+	// than "role" require protocol version 3 or higher.
+	//
+	// The "dc" tag is well-known and names the datacenter of the node.
+	// Failed nodes in other datacenters are given longer to reconnect
+	// before they are reaped, see RemoteReconnectTimeout.
+	Tags map[string]string
+
 	// EventCh is a channel that receives all the Serf events. The events
 	// are sent on this channel in proper ordering. Care must be taken that
 	// this channel doesn't block, either by processing the events quick
@@ -43,16 +56,92 @@ type Config struct {
 	// calling Members on Serf.
 	EventCh chan<- Event
 
+	// PullEvents keeps the events in Serf until they are retrieved with
+	// NextEvent, as an alternative to EventCh for applications with their
+	// own scheduling, such as a game loop, that would rather poll than
+	// dedicate a goroutine to the channel. The same care must be taken to
+	// retrieve the events often enough, since Serf blocks once
+	// PullEventBuffer events are waiting. EventCh must not be set as well.
+	PullEvents bool
+
 	// ProtocolVersion is the protocol version to speak. This must be between
 	// ProtocolVersionMin and ProtocolVersionMax.
 	ProtocolVersion uint8
 
+	// UpgradeCheckVersion, if greater than ProtocolVersion, is a protocol
+	// version the cluster is about to be upgraded to. Members that can't
+	// understand it are logged when they join, and the alive ones are
+	// counted in the "upgrade_blockers" stat, so operators can confirm
+	// that all members are ready before changing ProtocolVersion.
+	UpgradeCheckVersion uint8
+
 	// BroadcastTimeout is the amount of time to wait for a broadcast
 	// message to be sent to the cluster. Broadcast messages are used for
 	// things like leave messages and force remove messages. If this is not
 	// set, a timeout of 5 seconds will be set.
 	BroadcastTimeout time.Duration
 
+	// UserEventChecksums adds a CRC32 checksum to the user events sent
+	// by this member. Received events with a checksum are always
+	// verified, and corrupt ones are dropped and counted in the
+	// "corrupt_events" stat. This guards against corruption that isn't
+	// caught by the network, such as with broken UDP checksum offloading.
+	// Members that don't support checksums ignore them.
+	UserEventChecksums bool
+
+	// UserEventVeto, if set, is called with every user event that is
+	// submitted by this member, before it is sent. Returning an error
+	// rejects the event, and UserEvent returns that error. Events that
+	// are received from other members are not affected.
+	UserEventVeto func(name string, payload []byte) error
+
+	// Rand, if set, is the source of the random choices that Serf makes
+	// itself: which failed member to try to reconnect to, and the order in
+	// which the members in the snapshot are rejoined. A seeded source makes
+	// these reproducible in tests and simulations. Serf uses it from
+	// several goroutines behind a lock, so it must not be used elsewhere.
+	// The nodes that memberlist probes and gossips with are not affected.
+	Rand *rand.Rand
+
+	// GossipBandwidthLimit, if set, is the number of bytes of broadcasts
+	// that are sent per second. Membership intents are always sent, but
+	// count toward the limit. Once it is exceeded, user events stay queued
+	// until the next second, and the "throttled_broadcasts" stat counts
+	// the times they were held back.
+	GossipBandwidthLimit int
+
+	// Metrics receives the metrics of Serf: counters of the member events,
+	// user events and push/pulls, the depths of the broadcast queues, and
+	// the duration of joins. By default, metrics are discarded.
+	Metrics MetricsSink
+
+	// PushPullRateLimit, if set, is the number of stream connections per
+	// second that are accepted from each source address, with bursts of up
+	// to PushPullBurst connections. Joins and push/pull state exchanges use
+	// these connections, so this protects seeds from join storms when many
+	// nodes restart at once. Connections over the limit are closed right
+	// away, so the joining node tries its other seeds, and are counted by
+	// the "rejected_push_pulls" stat. Fallback probes are stream
+	// connections as well, so the limit should allow a few per second.
+	PushPullRateLimit float64
+	PushPullBurst     int
+
+	// NameReuse decides whether a failed or left member that wasn't reaped
+	// yet can come back with a different address, such as a newly
+	// provisioned node that recycles the name of an old one. By default,
+	// the new address takes over the name. Otherwise it is only accepted
+	// once the old member left, or if its "epoch" tag is increased, so that
+	// a stale node that comes back can't fight its replacement.
+	NameReuse NameReusePolicy
+
+	// MaxMembers, if positive, is the number of members that the cluster
+	// may grow to, not counting members that left. A join that would
+	// merge more members than that, such as with a much larger cluster
+	// through a misconfigured address, fails with an error, and new
+	// members that are gossiped over the limit are ignored. Refused
+	// members are counted by the "serf.member.refused" metric.
+	MaxMembers int
+
 	// The settings below relate to Serf's event coalescence feature. Serf
 	// is able to coalesce multiple events into single events in order to
 	// reduce the amount of noise that is sent along the EventCh. For example
@@ -95,13 +184,33 @@ type Config struct {
 	// ReconnectTimeout is the amount of time to attempt to reconnect to
 	// a failed node before giving up and considering it completely gone.
 	//
+	// RemoteReconnectTimeout is used instead of ReconnectTimeout for
+	// failed nodes whose "dc" tag differs from the "dc" tag of this node.
+	// Links between datacenters are usually less reliable, so this is
+	// typically longer. If this is zero, ReconnectTimeout is used. Only
+	// reaping is affected: probes and suspicion are the same for every
+	// member, so a remote node is marked failed as quickly as a local
+	// one. Use a memberlist config such as DefaultWANConfig if the
+	// cluster spans high-latency links.
+	//
+	// SmallClusterReconnectInterval is used instead of ReconnectInterval
+	// while no more than one other member is known, such as in a two node
+	// cluster whose only peer failed. With a single peer there are no other
+	// members to confirm a failure or to gossip that the peer is back, so
+	// a short network blip splits the cluster until it reconnects. If this
+	// is zero, ReconnectInterval is always used.
+	//
 	// TombstoneTimeout is the amount of time to keep around nodes
 	// that gracefully left as tombstones for syncing state with other
-	// Serf nodes.
-	ReapInterval      time.Duration
-	ReconnectInterval time.Duration
-	ReconnectTimeout  time.Duration
-	TombstoneTimeout  time.Duration
+	// Serf nodes. During this time, and across restarts if a snapshot is
+	// used, a node that left and is alive again is only admitted once it
+	// broadcasts a join that is newer than its leave.
+	ReapInterval                  time.Duration
+	ReconnectInterval             time.Duration
+	ReconnectTimeout              time.Duration
+	RemoteReconnectTimeout        time.Duration
+	SmallClusterReconnectInterval time.Duration
+	TombstoneTimeout              time.Duration
 
 	// QueueDepthWarning is used to generate warning message if the
 	// number of queued messages to broadcast exceeds this number. This
@@ -143,6 +252,13 @@ type Config struct {
 	//
 	MemberlistConfig *memberlist.Config
 
+	// ExtraBindAddrs are IP addresses that the gossip listeners are bound
+	// to in addition to the BindAddr of the MemberlistConfig, on the same
+	// port, such as the addresses of other networks of the host. Only
+	// the BindAddr, or the AdvertiseAddr if set, is advertised. They are
+	// ignored if the MemberlistConfig has a Transport.
+	ExtraBindAddrs []string
+
 	// LogOutput is the location to write logs to. If this is not set,
 	// logs will go to stderr.
 	LogOutput io.Writer
@@ -152,6 +268,13 @@ type Config struct {
 	// it will attempt to join all the previously known nodes until one
 	// succeeds and will also avoid replaying old user events.
 	SnapshotPath string
+
+	// ForceSnapshotIdentity starts Serf with a snapshot that was written
+	// by another node name or IP address, and takes the snapshot over.
+	// Otherwise Serf refuses to start with it, since the node was most
+	// likely cloned along with the snapshot of another node, and would
+	// rejoin the cluster as that node.
+	ForceSnapshotIdentity bool
 }
 
 // DefaultConfig returns a Config struct that contains reasonable defaults
@@ -163,18 +286,20 @@ func DefaultConfig() *Config {
 	}
 
 	return &Config{
-		NodeName:           hostname,
-		BroadcastTimeout:   5 * time.Second,
-		EventBuffer:        512,
-		LogOutput:          os.Stderr,
-		ProtocolVersion:    ProtocolVersionMax,
-		ReapInterval:       15 * time.Second,
-		RecentIntentBuffer: 128,
-		ReconnectInterval:  30 * time.Second,
-		ReconnectTimeout:   24 * time.Hour,
-		QueueDepthWarning:  128,
-		MaxQueueDepth:      4096,
-		TombstoneTimeout:   24 * time.Hour,
-		MemberlistConfig:   memberlist.DefaultLANConfig(),
+		NodeName:                      hostname,
+		BroadcastTimeout:              5 * time.Second,
+		EventBuffer:                   512,
+		LogOutput:                     os.Stderr,
+		ProtocolVersion:               ProtocolVersionMax,
+		ReapInterval:                  15 * time.Second,
+		RecentIntentBuffer:            128,
+		ReconnectInterval:             30 * time.Second,
+		ReconnectTimeout:              24 * time.Hour,
+		RemoteReconnectTimeout:        72 * time.Hour,
+		SmallClusterReconnectInterval: 5 * time.Second,
+		QueueDepthWarning:             128,
+		MaxQueueDepth:                 4096,
+		TombstoneTimeout:              24 * time.Hour,
+		MemberlistConfig:              memberlist.DefaultLANConfig(),
 	}
 }
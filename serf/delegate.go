@@ -2,6 +2,7 @@ package serf
 
 import (
 	"fmt"
+	"sync/atomic"
 )
 
 // delegate is the memberlist.Delegate implementation that Serf uses.
@@ -10,12 +11,16 @@ type delegate struct {
 }
 
 func (d *delegate) NodeMeta(limit int) []byte {
-	roleBytes := []byte(d.serf.config.Role)
-	if len(roleBytes) > limit {
-		panic(fmt.Errorf("role '%s' exceeds length limit of %d bytes", d.serf.config.Role, limit))
+	// Create and SetTags refuse tags that don't fit, see ValidateTags
+	meta, err := encodeTags(d.serf.localTags())
+	if err != nil {
+		panic(fmt.Errorf("failed to encode tags: %v", err))
+	}
+	if len(meta) > limit {
+		panic(fmt.Errorf("tags exceed length limit of %d bytes", limit))
 	}
 
-	return roleBytes
+	return meta
 }
 
 func (d *delegate) NotifyMsg(buf []byte) {
@@ -23,6 +28,11 @@ func (d *delegate) NotifyMsg(buf []byte) {
 	if len(buf) == 0 {
 		return
 	}
+	if len(buf) > maxGossipMessageSize {
+		d.serf.malformedMessage("gossip", fmt.Errorf("%d bytes is too large", len(buf)))
+		return
+	}
+	d.serf.traceMessage("received", buf)
 
 	rebroadcast := false
 	rebroadcastQueue := d.serf.broadcasts
@@ -31,7 +41,11 @@ func (d *delegate) NotifyMsg(buf []byte) {
 	case messageLeaveType:
 		var leave messageLeave
 		if err := decodeMessage(buf[1:], &leave); err != nil {
-			d.serf.logger.Printf("[ERR] serf: Error decoding leave message: %s", err)
+			d.serf.malformedMessage("leave", err)
+			break
+		}
+		if err := validLeave(&leave); err != nil {
+			d.serf.malformedMessage("leave", err)
 			break
 		}
 
@@ -41,7 +55,11 @@ func (d *delegate) NotifyMsg(buf []byte) {
 	case messageJoinType:
 		var join messageJoin
 		if err := decodeMessage(buf[1:], &join); err != nil {
-			d.serf.logger.Printf("[ERR] serf: Error decoding join message: %s", err)
+			d.serf.malformedMessage("join", err)
+			break
+		}
+		if err := validJoin(&join); err != nil {
+			d.serf.malformedMessage("join", err)
 			break
 		}
 
@@ -51,7 +69,11 @@ func (d *delegate) NotifyMsg(buf []byte) {
 	case messageUserEventType:
 		var event messageUserEvent
 		if err := decodeMessage(buf[1:], &event); err != nil {
-			d.serf.logger.Printf("[ERR] serf: Error decoding user event message: %s", err)
+			d.serf.malformedMessage("user event", err)
+			break
+		}
+		if err := validUserEvent(event.Name, event.Payload); err != nil {
+			d.serf.malformedMessage("user event", err)
 			break
 		}
 
@@ -84,10 +106,35 @@ func (d *delegate) GetBroadcasts(overhead, limit int) [][]byte {
 		bytesUsed += len(msg) + overhead
 	}
 
-	// Get any additional event broadcasts
-	eventMsgs := d.serf.eventBroadcasts.GetBroadcasts(overhead, limit-bytesUsed)
-	if eventMsgs != nil {
-		msgs = append(msgs, eventMsgs...)
+	// Get any additional event broadcasts, within the bandwidth budget.
+	// The intents are always sent since they are more important.
+	eventLimit := limit - bytesUsed
+	if budget := d.serf.budget; budget != nil {
+		if remaining := budget.remaining() - bytesUsed; remaining < eventLimit {
+			eventLimit = remaining
+		}
+		if eventLimit <= 0 && d.serf.eventBroadcasts.NumQueued() > 0 {
+			atomic.AddUint64(&d.serf.throttledBroadcasts, 1)
+			d.serf.config.Metrics.IncrCounter([]string{"serf", "broadcasts", "throttled"}, 1)
+		}
+	}
+
+	if eventLimit > 0 {
+		eventMsgs := d.serf.eventBroadcasts.GetBroadcasts(overhead, eventLimit)
+		for _, msg := range eventMsgs {
+			bytesUsed += len(msg) + overhead
+		}
+		if eventMsgs != nil {
+			msgs = append(msgs, eventMsgs...)
+		}
+	}
+
+	if d.serf.budget != nil {
+		d.serf.budget.use(bytesUsed)
+	}
+
+	for _, msg := range msgs {
+		d.serf.traceMessage("sent", msg)
 	}
 
 	return msgs
@@ -124,10 +171,21 @@ func (d *delegate) LocalState(join bool) []byte {
 		d.serf.logger.Printf("[ERR] serf: Failed to encode local state: %v", err)
 		return nil
 	}
+	d.serf.traceMessage("sent", buf)
 	return buf
 }
 
 func (d *delegate) MergeRemoteState(buf []byte, isJoin bool) {
+	if len(buf) == 0 {
+		d.serf.malformedMessage("remote state", fmt.Errorf("empty state"))
+		return
+	}
+	if len(buf) > maxRemoteStateSize {
+		d.serf.malformedMessage("remote state", fmt.Errorf("%d bytes is too large", len(buf)))
+		return
+	}
+	d.serf.traceMessage("received", buf)
+
 	// Check the message type
 	if messageType(buf[0]) != messagePushPullType {
 		d.serf.logger.Printf("[ERR] serf: Remote state has bad type prefix: %v", buf[0])
@@ -137,9 +195,15 @@ func (d *delegate) MergeRemoteState(buf []byte, isJoin bool) {
 	// Attempt a decode
 	pp := messagePushPull{}
 	if err := decodeMessage(buf[1:], &pp); err != nil {
-		d.serf.logger.Printf("[ERR] serf: Failed to decode remote state: %v", err)
+		d.serf.malformedMessage("remote state", err)
+		return
+	}
+	if err := validPushPull(&pp); err != nil {
+		d.serf.malformedMessage("remote state", err)
 		return
 	}
+	atomic.AddUint64(&d.serf.pushPulls, 1)
+	d.serf.config.Metrics.IncrCounter([]string{"serf", "push_pull"}, 1)
 
 	// Witness the Lamport clocks first.
 	// We subtract 1 since no message with that clock has been sent yet
@@ -192,6 +256,9 @@ func (d *delegate) MergeRemoteState(buf []byte, isJoin bool) {
 		for _, e := range events.Events {
 			userEvent.Name = e.Name
 			userEvent.Payload = e.Payload
+			userEvent.Target = e.Target
+			userEvent.Origin = e.Origin
+			userEvent.Version = e.Version
 			d.serf.handleUserEvent(&userEvent)
 		}
 	}
@@ -5,6 +5,7 @@ import (
 	"github.com/hashicorp/serf/testutil"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestDelegate_impl(t *testing.T) {
@@ -33,6 +34,20 @@ func TestDelegate_NodeMeta(t *testing.T) {
 	d.NodeMeta(1)
 }
 
+func TestDelegate_NodeMeta_tags(t *testing.T) {
+	c := testConfig()
+	c.Role = "test"
+	c.Tags = map[string]string{"dc": "east"}
+	d := &delegate{&Serf{config: c}}
+	meta := d.NodeMeta(32)
+
+	tags := decodeTags(meta)
+	expected := map[string]string{"role": "test", "dc": "east"}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("bad: %#v", tags)
+	}
+}
+
 // internals
 func TestDelegate_LocalState(t *testing.T) {
 	c1 := testConfig()
@@ -130,6 +145,9 @@ func TestDelegate_MergeRemoteState(t *testing.T) {
 					userEvent{
 						Name:    "test",
 						Payload: nil,
+						Target:  "web-3",
+						Origin:  "foo",
+						Version: 2,
 					},
 				},
 			},
@@ -167,7 +185,45 @@ func TestDelegate_MergeRemoteState(t *testing.T) {
 	if s1.eventBuffer[45] == nil {
 		t.Fatalf("missing event buffer for time")
 	}
-	if s1.eventBuffer[45].Events[0].Name != "test" {
-		t.Fatalf("missing event")
+	if e := s1.eventBuffer[45].Events[0]; e.Name != "test" || e.Target != "web-3" ||
+		e.Origin != "foo" || e.Version != 2 {
+		t.Fatalf("missing event: %#v", e)
+	}
+
+	if s1.Stats()["push_pulls"] != "1" {
+		t.Fatalf("bad: %#v", s1.Stats())
+	}
+}
+
+func TestDelegate_GetBroadcasts_budget(t *testing.T) {
+	c := testConfig()
+	c.GossipBandwidthLimit = 100
+	s, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s.Shutdown()
+
+	d := &delegate{s}
+	if err := s.UserEvent("deploy", []byte("v1"), false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Start a window and use it up, the event is held back
+	s.budget.remaining()
+	s.budget.use(100)
+	if msgs := d.GetBroadcasts(2, 1400); len(msgs) != 0 {
+		t.Fatalf("bad: %#v", msgs)
+	}
+	if s.Stats()["throttled_broadcasts"] != "1" {
+		t.Fatalf("bad: %#v", s.Stats())
+	}
+
+	// The next window has room again
+	s.budget.lock.Lock()
+	s.budget.windowStart = time.Now().Add(-time.Second)
+	s.budget.lock.Unlock()
+	if msgs := d.GetBroadcasts(2, 1400); len(msgs) != 1 {
+		t.Fatalf("bad: %#v", msgs)
 	}
 }
@@ -13,6 +13,10 @@ const (
 	EventMemberLeave
 	EventMemberFailed
 	EventUser
+
+	// EventMemberUpdate is emitted when a member changes its tags or its
+	// address while it is alive, see Serf.SetTags.
+	EventMemberUpdate
 )
 
 func (t EventType) String() string {
@@ -25,6 +29,8 @@ func (t EventType) String() string {
 		return "member-failed"
 	case EventUser:
 		return "user"
+	case EventMemberUpdate:
+		return "member-update"
 	default:
 		panic(fmt.Sprintf("unknown event type: %d", t))
 	}
@@ -43,6 +49,10 @@ type Event interface {
 type MemberEvent struct {
 	Type    EventType
 	Members []Member
+
+	// PrevTags are the tags that the members of a member-update event had
+	// before the update, keyed by member name. It is nil for other events.
+	PrevTags map[string]map[string]string
 }
 
 func (m MemberEvent) EventType() EventType {
@@ -57,6 +67,8 @@ func (m MemberEvent) String() string {
 		return "member-leave"
 	case EventMemberFailed:
 		return "member-failed"
+	case EventMemberUpdate:
+		return "member-update"
 	default:
 		panic(fmt.Sprintf("unknown event type: %d", m.Type))
 	}
@@ -69,6 +81,22 @@ type UserEvent struct {
 	Name     string
 	Payload  []byte
 	Coalesce bool
+
+	// Version is the schema version of the payload as set by the sender,
+	// so that the payload format can evolve while the members that send
+	// and handle the event are upgraded at different times. It is zero
+	// if it wasn't set, including for events sent by older members.
+	Version uint8
+
+	// Origin is the name of the member that sent the event. It is empty
+	// for events sent by older members.
+	Origin string
+
+	// Target is the name of the member the event is meant for, if it was
+	// sent with UserEventNode. The event is still gossiped to and
+	// delivered on every member, and it is up to the application to act
+	// on it only on the target.
+	Target string
 }
 
 func (u UserEvent) EventType() EventType {
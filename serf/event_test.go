@@ -126,7 +126,8 @@ func TestUserEvent(t *testing.T) {
 }
 
 func TestEventType_String(t *testing.T) {
-	events := []EventType{EventMemberJoin, EventMemberLeave, EventMemberFailed, EventUser}
+	events := []EventType{EventMemberJoin, EventMemberLeave, EventMemberFailed,
+		EventUser}
 	expect := []string{"member-join", "member-leave", "member-failed", "user"}
 
 	for idx, event := range events {
@@ -0,0 +1,35 @@
+package serf
+
+// UserEventFuture is returned by UserEventAsync to follow the delivery
+// of a user event. There are no acknowledgements of user events, so the
+// best the future can tell is whether the event was queued, and whether
+// it has since been transmitted as often as the retransmit limit allows,
+// at which point it has likely reached the cluster.
+type UserEventFuture struct {
+	queuedCh      chan struct{}
+	transmittedCh chan struct{}
+	err           error
+}
+
+// Queued returns a channel that is closed once the event has been handed
+// to the broadcast queue, or was refused, in which case Error returns
+// the reason.
+func (f *UserEventFuture) Queued() <-chan struct{} {
+	return f.queuedCh
+}
+
+// Transmitted returns a channel that is closed once the broadcast queue
+// is done with the event. Usually this means it was sent to as many
+// members as the retransmit limit allows, but the event may also have
+// been dropped because the queue grew beyond MaxQueueDepth. If the event
+// was refused, the channel is closed as well.
+func (f *UserEventFuture) Transmitted() <-chan struct{} {
+	return f.transmittedCh
+}
+
+// Error waits for the event to be queued and returns the error of
+// sending it, if any, such as exceeding the size limit.
+func (f *UserEventFuture) Error() error {
+	<-f.queuedCh
+	return f.err
+}
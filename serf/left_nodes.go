@@ -0,0 +1,82 @@
+package serf
+
+import (
+	"github.com/hashicorp/memberlist"
+	"time"
+)
+
+// leftNode is a member that left gracefully. Until the TombstoneTimeout
+// passes, it is only admitted again once it broadcasts a join that is
+// newer than LTime, so that a process on a decommissioned host that is
+// slow to die can't bring itself back. The left nodes are kept in the
+// snapshot, so that this also holds after a restart.
+type leftNode struct {
+	LTime LamportTime
+	Time  time.Time
+}
+
+// recordLeft remembers a member that just left. The memberLock must be
+// held.
+func (s *Serf) recordLeft(m *memberState) {
+	if m.Name == s.config.NodeName {
+		return
+	}
+	s.leftNodes[m.Name] = leftNode{LTime: m.statusLTime, Time: m.leaveTime}
+}
+
+// suppressRejoin checks if a node that memberlist reports alive left
+// and hasn't broadcast a newer join since. Such a node is held back
+// until admitSuppressed sees the join. The memberLock must be held.
+func (s *Serf) suppressRejoin(n *memberlist.Node) bool {
+	left, ok := s.leftNodes[n.Name]
+	if !ok {
+		return false
+	}
+
+	// A newer join intent either updated the member, or is buffered if
+	// the member was reaped or is not known since a restart
+	var joinLTime LamportTime
+	if member, ok := s.members[n.Name]; ok {
+		joinLTime = member.statusLTime
+	} else if join := recentIntent(s.recentJoin, n.Name); join != nil {
+		joinLTime = join.LTime
+	}
+	if joinLTime > left.LTime {
+		delete(s.leftNodes, n.Name)
+		return false
+	}
+
+	if _, ok := s.suppressed[n.Name]; !ok {
+		s.logger.Printf("[WARN] serf: Ignoring %s, which is alive again after it left, "+
+			"until it joins again", n.Name)
+	}
+	s.suppressed[n.Name] = n
+	return true
+}
+
+// admitSuppressed admits a suppressed node once a newer join intent of
+// it was handled. The memberLock must be held.
+func (s *Serf) admitSuppressed(name string) {
+	n, ok := s.suppressed[name]
+	if !ok || s.suppressRejoin(n) {
+		return
+	}
+	delete(s.suppressed, name)
+	s.nodeJoined(n)
+}
+
+// reapLeftNodes forgets the left nodes after the TombstoneTimeout, and
+// admits the ones of them that are alive. The memberLock must be held.
+func (s *Serf) reapLeftNodes() {
+	now := time.Now()
+	for name, left := range s.leftNodes {
+		if now.Sub(left.Time) <= s.config.TombstoneTimeout {
+			continue
+		}
+		delete(s.leftNodes, name)
+		if n, ok := s.suppressed[name]; ok {
+			delete(s.suppressed, name)
+			s.nodeJoined(n)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package serf
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile opens the file and takes an exclusive advisory lock on it,
+// failing right away if another process holds the lock. The lock is
+// released when the file is closed, or when the process exits.
+func lockFile(path string) (*os.File, error) {
+	fh, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(fh.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return fh, nil
+}
@@ -0,0 +1,79 @@
+package serf
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// maxGossipMessageSize is the largest gossip message that is decoded,
+// which is the most that fits in a UDP packet. Larger messages can only
+// come from a broken or malicious member.
+const maxGossipMessageSize = 65535
+
+// maxRemoteStateSize is the largest remote state of a push/pull that is
+// decoded. Even a cluster of many thousands of members with long names
+// stays well below it.
+const maxRemoteStateSize = 32 * 1024 * 1024
+
+// malformedMessage counts and logs a message that was dropped because
+// it couldn't be decoded or failed the checks of validMessage. The
+// sender isn't known, since memberlist doesn't pass it to the delegate.
+func (s *Serf) malformedMessage(kind string, err error) {
+	atomic.AddUint64(&s.malformedMessages, 1)
+	s.config.Metrics.IncrCounter([]string{"serf", "msg", "malformed"}, 1)
+	s.logger.Printf("[ERR] serf: Dropping malformed %s message: %s", kind, err)
+}
+
+// validJoin checks a decoded join intent
+func validJoin(msg *messageJoin) error {
+	if msg.Node == "" {
+		return fmt.Errorf("missing node name")
+	}
+	return nil
+}
+
+// validLeave checks a decoded leave intent
+func validLeave(msg *messageLeave) error {
+	if msg.Node == "" {
+		return fmt.Errorf("missing node name")
+	}
+	return nil
+}
+
+// validUserEvent checks a decoded user event against the limits that
+// every member applies to the events it sends
+func validUserEvent(name string, payload []byte) error {
+	if name == "" {
+		return fmt.Errorf("missing event name")
+	}
+	if len(name)+len(payload) > UserEventSizeLimit {
+		return fmt.Errorf("user event exceeds limit of %d bytes", UserEventSizeLimit)
+	}
+	return nil
+}
+
+// validPushPull checks a decoded remote state. A single bad entry
+// rejects the whole state, since it can't come from a working member.
+func validPushPull(pp *messagePushPull) error {
+	for name := range pp.StatusLTimes {
+		if name == "" {
+			return fmt.Errorf("missing node name")
+		}
+	}
+	for _, name := range pp.LeftMembers {
+		if name == "" {
+			return fmt.Errorf("missing node name")
+		}
+	}
+	for _, events := range pp.Events {
+		if events == nil {
+			continue
+		}
+		for _, e := range events.Events {
+			if err := validUserEvent(e.Name, e.Payload); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package serf
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestDelegate_NotifyMsg_malformed(t *testing.T) {
+	c := testConfig()
+	s, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s.Shutdown()
+	d := c.MemberlistConfig.Delegate
+
+	join, err := encodeMessage(messageJoinType, &messageJoin{LTime: 10})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	event, err := encodeMessage(messageUserEventType, &messageUserEvent{
+		LTime:   10,
+		Name:    "deploy",
+		Payload: make([]byte, UserEventSizeLimit),
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	garbage := []byte{byte(messageLeaveType), 0xc1, 0xff, 0x00}
+	huge := append([]byte{byte(messageUserEventType)}, make([]byte, maxGossipMessageSize)...)
+
+	for _, buf := range [][]byte{join, event, garbage, huge} {
+		d.NotifyMsg(buf)
+	}
+
+	if s.Stats()["malformed_messages"] != "4" {
+		t.Fatalf("bad: %#v", s.Stats())
+	}
+	if len(s.recentJoin) > 0 && s.recentJoin[0].LTime == 10 {
+		t.Fatalf("should drop the join")
+	}
+	if s.eventBuffer[10] != nil {
+		t.Fatalf("should drop the event")
+	}
+}
+
+func TestDelegate_MergeRemoteState_malformed(t *testing.T) {
+	c := testConfig()
+	s, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s.Shutdown()
+	d := c.MemberlistConfig.Delegate
+
+	pp := messagePushPull{
+		LTime:        42,
+		StatusLTimes: map[string]LamportTime{"test": 20, "": 15},
+	}
+	buf, err := encodeMessage(messagePushPullType, &pp)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	d.MergeRemoteState(nil, false)
+	d.MergeRemoteState(buf, false)
+
+	if s.Stats()["malformed_messages"] != "2" {
+		t.Fatalf("bad: %#v", s.Stats())
+	}
+	if s.clock.Time() == 42 {
+		t.Fatalf("should not witness the clock")
+	}
+}
+
+func TestDecodeMessage_hugeLength(t *testing.T) {
+	// An array header claiming 4 billion left members, without any
+	var buf bytes.Buffer
+	buf.Write([]byte{0x81, 0xab})
+	buf.WriteString("LeftMembers")
+	buf.Write([]byte{0xdd, 0xff, 0xff, 0xff, 0xff})
+
+	var pp messagePushPull
+	if err := decodeMessage(buf.Bytes(), &pp); err == nil {
+		t.Fatalf("should err")
+	}
+}
+
+func TestDecodeMessage_corpus(t *testing.T) {
+	// Inputs that have broken decoders: truncated headers, lengths far
+	// beyond the input and invalid format bytes
+	corpus := [][]byte{
+		{},
+		{0x81},
+		{0x81, 0xa5, 'L', 'T', 'i', 'm', 'e'},
+		{0x81, 0xa4, 'N', 'o', 'd', 'e', 0xdb, 0xff, 0xff, 0xff, 0xff},
+		{0x81, 0xa7, 'P', 'a', 'y', 'l', 'o', 'a', 'd', 0xc6, 0xff, 0xff, 0xff, 0xff},
+		{0x81, 0xac, 'S', 't', 'a', 't', 'u', 's', 'L', 'T', 'i', 'm', 'e', 's',
+			0xdf, 0xff, 0xff, 0xff, 0xff},
+		{0x81, 0xa6, 'E', 'v', 'e', 'n', 't', 's', 0x91, 0x81, 0xa6, 'E', 'v', 'e',
+			'n', 't', 's', 0xdd, 0xff, 0xff, 0xff, 0xff},
+		{0xdf, 0xff, 0xff, 0xff, 0xff},
+		{0xc1},
+		{0xd9},
+	}
+
+	for _, buf := range corpus {
+		for _, out := range []interface{}{
+			&messageJoin{},
+			&messageLeave{},
+			&messageUserEvent{},
+			&messagePushPull{},
+		} {
+			if err := decodeMessage(buf, out); err == nil {
+				t.Fatalf("should err: %v %T", buf, out)
+			}
+		}
+	}
+}
+
+func TestDelegate_randomMessages(t *testing.T) {
+	c := testConfig()
+	s, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s.Shutdown()
+	d := c.MemberlistConfig.Delegate
+
+	var valid [][]byte
+	for _, m := range []struct {
+		t   messageType
+		msg interface{}
+	}{
+		{messageJoinType, &messageJoin{LTime: 1, Node: "foo"}},
+		{messageLeaveType, &messageLeave{LTime: 1, Node: "foo"}},
+		{messageUserEventType, &messageUserEvent{LTime: 1, Name: "deploy", Payload: []byte("v1")}},
+		{messagePushPullType, &messagePushPull{
+			LTime:        1,
+			StatusLTimes: map[string]LamportTime{"foo": 1},
+			LeftMembers:  []string{"foo"},
+			Events: []*userEvents{
+				&userEvents{LTime: 1, Events: []userEvent{userEvent{Name: "deploy"}}},
+			},
+		}},
+	} {
+		buf, err := encodeMessage(m.t, m.msg)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		valid = append(valid, buf)
+	}
+
+	// Corrupt, truncate and extend valid messages at random. None of
+	// them may crash Serf.
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		buf := append([]byte(nil), valid[r.Intn(len(valid))]...)
+		switch r.Intn(3) {
+		case 0:
+			for n := r.Intn(4) + 1; n > 0; n-- {
+				buf[r.Intn(len(buf))] = byte(r.Intn(256))
+			}
+		case 1:
+			buf = buf[:r.Intn(len(buf))+1]
+		case 2:
+			extra := make([]byte, r.Intn(16))
+			r.Read(extra)
+			buf = append(buf, extra...)
+		}
+
+		if messageType(buf[0]) == messagePushPullType {
+			d.MergeRemoteState(buf, false)
+		} else {
+			d.NotifyMsg(buf)
+		}
+	}
+}
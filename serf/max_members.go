@@ -0,0 +1,59 @@
+package serf
+
+import (
+	"fmt"
+	"github.com/hashicorp/memberlist"
+)
+
+// mergeDelegate is the memberlist.MergeDelegate of Serf, which cancels
+// joins that would grow the cluster over Config.MaxMembers.
+type mergeDelegate struct {
+	serf *Serf
+}
+
+func (m *mergeDelegate) NotifyMerge(peers []*memberlist.Node) error {
+	names := make([]string, len(peers))
+	for i, peer := range peers {
+		names[i] = peer.Name
+	}
+	return m.serf.checkMaxMembers(names)
+}
+
+// checkMaxMembers returns an error if admitting the given nodes would
+// grow the cluster over the MaxMembers. Members that left don't count,
+// and nodes that are already known are always admitted.
+func (s *Serf) checkMaxMembers(names []string) error {
+	if s.config.MaxMembers <= 0 {
+		return nil
+	}
+
+	s.memberLock.RLock()
+	defer s.memberLock.RUnlock()
+
+	count := 0
+	for _, member := range s.members {
+		if member.Status != StatusLeft {
+			count++
+		}
+	}
+	added := 0
+	seen := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		if _, ok := s.members[name]; !ok && name != s.config.NodeName {
+			added++
+		}
+	}
+	if added == 0 || count+added <= s.config.MaxMembers {
+		return nil
+	}
+
+	s.config.Metrics.IncrCounter([]string{"serf", "member", "refused"}, float32(added))
+	s.logger.Printf("[WARN] serf: Refusing %d new members, which would grow the "+
+		"cluster of %d members over the maximum of %d", added, count, s.config.MaxMembers)
+	return fmt.Errorf("cluster would have %d members, more than the maximum of %d",
+		count+added, s.config.MaxMembers)
+}
@@ -0,0 +1,90 @@
+package serf
+
+import (
+	"github.com/hashicorp/serf/testutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestSerf_checkMaxMembers(t *testing.T) {
+	sink := new(mockSink)
+	s := &Serf{
+		config:  DefaultConfig(),
+		members: make(map[string]*memberState),
+		logger:  log.New(os.Stderr, "", log.LstdFlags),
+	}
+	s.config.NodeName = "self"
+	s.config.Metrics = sink
+	s.members["self"] = &memberState{Member: Member{Name: "self", Status: StatusAlive}}
+	s.members["web"] = &memberState{Member: Member{Name: "web", Status: StatusFailed}}
+	s.members["db"] = &memberState{Member: Member{Name: "db", Status: StatusLeft}}
+
+	// No limit by default
+	if err := s.checkMaxMembers([]string{"a", "b", "c"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Left members don't count, and known ones are always admitted
+	s.config.MaxMembers = 3
+	if err := s.checkMaxMembers([]string{"self", "web", "db", "a", "a"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.checkMaxMembers([]string{"a", "b"}); err == nil {
+		t.Fatalf("should err")
+	}
+	if c := sink.counter("serf.member.refused"); c != 2 {
+		t.Fatalf("bad: %v", c)
+	}
+
+	s.config.MaxMembers = 2
+	if err := s.checkMaxMembers([]string{"web"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestSerf_MaxMembers(t *testing.T) {
+	s1Config := testConfig()
+	s1Config.MaxMembers = 2
+	s2Config := testConfig()
+	s3Config := testConfig()
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s2.Shutdown()
+
+	s3, err := Create(s3Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s3.Shutdown()
+
+	testutil.Yield()
+
+	if _, err := s2.Join([]string{s3Config.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	// Merging with the cluster of two would make three members
+	if _, err := s1.Join([]string{s2Config.MemberlistConfig.BindAddr}, false); err == nil {
+		t.Fatalf("should err")
+	}
+
+	testutil.Yield()
+
+	// The other side may still gossip its members, but only up to the
+	// maximum are admitted
+	if n := len(s1.Members()); n > 2 {
+		t.Fatalf("bad: %d", n)
+	}
+}
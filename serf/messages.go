@@ -2,7 +2,11 @@ package serf
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/hashicorp/memberlist"
 	"github.com/ugorji/go/codec"
+	"hash/crc32"
 )
 
 // messageType are the types of gossip messages Serf will send along
@@ -46,9 +50,65 @@ type messageUserEvent struct {
 	Name    string
 	Payload []byte
 	CC      bool // "Can Coalesce". Zero value is compatible with Serf 0.1
+
+	// Version is the schema version of the payload, see UserEvent.
+	// Older members ignore it, and their events have version zero.
+	Version uint8
+
+	// Origin is the name of the member that sent the event. Older
+	// members ignore it, and their events have no origin.
+	Origin string
+
+	// Target, if set, is the name of the only member whose handlers
+	// should act on the event, see UserEvent. Older members ignore it and
+	// handle the event like any other.
+	Target string
+
+	// HasCRC is set if CRC is a checksum of the event, see eventChecksum.
+	// Older members ignore both fields.
+	HasCRC bool
+	CRC    uint32
+}
+
+// eventChecksum computes the checksum of a user event message. It covers
+// every field that affects how the event is delivered, so that a
+// corrupted event isn't delivered as another one.
+func eventChecksum(msg *messageUserEvent) uint32 {
+	var ltime [8]byte
+	binary.BigEndian.PutUint64(ltime[:], uint64(msg.LTime))
+
+	var cc uint8
+	if msg.CC {
+		cc = 1
+	}
+
+	h := crc32.NewIEEE()
+	h.Write(ltime[:])
+	h.Write([]byte{cc, msg.Version})
+	h.Write([]byte(msg.Origin))
+	h.Write([]byte{0})
+	h.Write([]byte(msg.Target))
+	h.Write([]byte{0})
+	h.Write([]byte(msg.Name))
+	h.Write([]byte{0})
+	h.Write(msg.Payload)
+	return h.Sum32()
 }
 
-func decodeMessage(buf []byte, out interface{}) error {
+// tagMagicByte is used to prefix node meta that contains encoded tags.
+// Meta without this prefix is treated as a plain role for compatibility
+// with older members.
+const tagMagicByte uint8 = 255
+
+func decodeMessage(buf []byte, out interface{}) (err error) {
+	// Messages come from the network, so whatever the decoder does with
+	// malformed ones must not crash the agent
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decoder panic: %v", r)
+		}
+	}()
+
 	var handle codec.MsgpackHandle
 	return codec.NewDecoder(bytes.NewBuffer(buf), &handle).Decode(out)
 }
@@ -62,3 +122,56 @@ func encodeMessage(t messageType, msg interface{}) ([]byte, error) {
 	err := encoder.Encode(msg)
 	return buf.Bytes(), err
 }
+
+// encodeTags encodes a set of tags for use as the memberlist node meta.
+// If the only tag is the role, it is encoded as plain bytes so that
+// members speaking older protocol versions can still understand it.
+func encodeTags(tags map[string]string) ([]byte, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	if role, ok := tags["role"]; ok && len(tags) == 1 {
+		return []byte(role), nil
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(tagMagicByte)
+
+	handle := codec.MsgpackHandle{}
+	encoder := codec.NewEncoder(buf, &handle)
+	err := encoder.Encode(tags)
+	return buf.Bytes(), err
+}
+
+// ValidateTags checks that the tags, including the role as the "role"
+// tag, fit in the node meta of memberlist once encoded. Serf refuses to
+// advertise tags that don't.
+func ValidateTags(tags map[string]string) error {
+	meta, err := encodeTags(tags)
+	if err != nil {
+		return fmt.Errorf("Failed to encode tags: %v", err)
+	}
+	if len(meta) > memberlist.MetaMaxSize {
+		return fmt.Errorf("Encoded tags are %d bytes, which exceeds the limit of %d bytes",
+			len(meta), memberlist.MetaMaxSize)
+	}
+	return nil
+}
+
+// decodeTags decodes the node meta of a member into a set of tags.
+// Meta that is not prefixed with tagMagicByte is treated as the role.
+func decodeTags(buf []byte) map[string]string {
+	tags := make(map[string]string)
+	if len(buf) == 0 {
+		return tags
+	}
+	if buf[0] != tagMagicByte {
+		tags["role"] = string(buf)
+		return tags
+	}
+
+	if err := decodeMessage(buf[1:], &tags); err != nil {
+		return make(map[string]string)
+	}
+	return tags
+}
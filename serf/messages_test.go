@@ -1,6 +1,9 @@
 package serf
 
 import (
+	"github.com/hashicorp/memberlist"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -14,3 +17,144 @@ func TestEncodeMessage(t *testing.T) {
 		t.Fatal("should have type header")
 	}
 }
+
+func TestEncodeDecodeTags(t *testing.T) {
+	tags := map[string]string{
+		"role": "web",
+		"dc":   "east",
+	}
+
+	raw, err := encodeTags(tags)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if raw[0] != tagMagicByte {
+		t.Fatal("should have magic byte")
+	}
+
+	out := decodeTags(raw)
+	if !reflect.DeepEqual(out, tags) {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestEncodeTags_roleOnly(t *testing.T) {
+	raw, err := encodeTags(map[string]string{"role": "web"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !reflect.DeepEqual(raw, []byte("web")) {
+		t.Fatalf("bad: %#v", raw)
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	if err := ValidateTags(map[string]string{"role": "web", "dc": "east"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The role alone is encoded as is
+	role := strings.Repeat("x", memberlist.MetaMaxSize)
+	if err := ValidateTags(map[string]string{"role": role}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ValidateTags(map[string]string{"role": role + "x"}); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	if err := ValidateTags(map[string]string{"dc": role}); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestDecodeTags_role(t *testing.T) {
+	out := decodeTags([]byte("web"))
+	if !reflect.DeepEqual(out, map[string]string{"role": "web"}) {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	out = decodeTags(nil)
+	if len(out) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestEventChecksum_compatible(t *testing.T) {
+	msg := messageUserEvent{LTime: 3, Name: "deploy", Payload: []byte("v1")}
+	msg.HasCRC = true
+	msg.CRC = eventChecksum(&msg)
+
+	buf, err := encodeMessage(messageUserEventType, &msg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Members without checksum support must still decode the event
+	var old struct {
+		LTime   LamportTime
+		Name    string
+		Payload []byte
+		CC      bool
+	}
+	if err := decodeMessage(buf[1:], &old); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if old.Name != "deploy" || string(old.Payload) != "v1" {
+		t.Fatalf("bad: %#v", old)
+	}
+
+	msg.Payload = []byte("v2")
+	if eventChecksum(&msg) == msg.CRC {
+		t.Fatalf("checksum should change")
+	}
+}
+
+func TestEventChecksum_fields(t *testing.T) {
+	msg := messageUserEvent{LTime: 3, Name: "deploy", Payload: []byte("v1")}
+	crc := eventChecksum(&msg)
+
+	// Every field that affects the delivery is covered
+	changes := []func(*messageUserEvent){
+		func(m *messageUserEvent) { m.LTime = 4 },
+		func(m *messageUserEvent) { m.Name = "deplo" },
+		func(m *messageUserEvent) { m.CC = true },
+		func(m *messageUserEvent) { m.Version = 1 },
+		func(m *messageUserEvent) { m.Origin = "foo" },
+		func(m *messageUserEvent) { m.Target = "web-3" },
+	}
+	for i, change := range changes {
+		other := msg
+		change(&other)
+		if eventChecksum(&other) == crc {
+			t.Fatalf("checksum should change: %d %#v", i, other)
+		}
+	}
+}
+
+func TestDecodeUserEvent_noOrigin(t *testing.T) {
+	// An event from a member that doesn't know about origins
+	old := struct {
+		LTime   LamportTime
+		Name    string
+		Payload []byte
+		CC      bool
+	}{LTime: 3, Name: "deploy", Payload: []byte("v1"), CC: true}
+
+	buf, err := encodeMessage(messageUserEventType, &old)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var msg messageUserEvent
+	if err := decodeMessage(buf[1:], &msg); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if msg.Name != "deploy" || string(msg.Payload) != "v1" || !msg.CC {
+		t.Fatalf("bad: %#v", msg)
+	}
+	if msg.Origin != "" || msg.HasCRC {
+		t.Fatalf("bad: %#v", msg)
+	}
+}
@@ -0,0 +1,31 @@
+package serf
+
+import (
+	"time"
+)
+
+// MetricsSink receives the metrics of Serf, and of the agent, so that
+// they can be sent to any metrics library. Keys are made of parts such
+// as []string{"serf", "member", "join"}, which the sink joins as its
+// backend expects. Sinks are used from many goroutines at once, and must
+// not block. See the metrics package for adapters to statsd and
+// Prometheus.
+type MetricsSink interface {
+	// IncrCounter adds val to the counter of the key
+	IncrCounter(key []string, val float32)
+
+	// SetGauge sets the current value of the gauge of the key
+	SetGauge(key []string, val float32)
+
+	// MeasureSince records the time elapsed since start as a sample of
+	// the timer of the key
+	MeasureSince(key []string, start time.Time)
+}
+
+// BlackholeSink is a MetricsSink that discards all metrics. It is used
+// if Config.Metrics is not set.
+type BlackholeSink struct{}
+
+func (BlackholeSink) IncrCounter(key []string, val float32)      {}
+func (BlackholeSink) SetGauge(key []string, val float32)         {}
+func (BlackholeSink) MeasureSince(key []string, start time.Time) {}
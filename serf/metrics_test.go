@@ -0,0 +1,96 @@
+package serf
+
+import (
+	"github.com/hashicorp/serf/testutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockSink records the counters and the keys of the timers
+type mockSink struct {
+	lock     sync.Mutex
+	counters map[string]float32
+	timers   map[string]int
+}
+
+func (m *mockSink) IncrCounter(key []string, val float32) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.counters == nil {
+		m.counters = make(map[string]float32)
+	}
+	m.counters[strings.Join(key, ".")] += val
+}
+
+func (m *mockSink) SetGauge(key []string, val float32) {}
+
+func (m *mockSink) MeasureSince(key []string, start time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.timers == nil {
+		m.timers = make(map[string]int)
+	}
+	m.timers[strings.Join(key, ".")]++
+}
+
+func (m *mockSink) counter(name string) float32 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.counters[name]
+}
+
+func TestSerf_metrics(t *testing.T) {
+	sink := new(mockSink)
+	s1Config := testConfig()
+	s1Config.Metrics = sink
+	s2Config := testConfig()
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s2.Shutdown()
+
+	testutil.Yield()
+
+	if _, err := s1.Join([]string{s2Config.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := s2.UserEvent("deploy", nil, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if err := s2.Leave(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	// Both nodes joined from the view of s1
+	if c := sink.counter("serf.member.join"); c != 2 {
+		t.Fatalf("bad: %v", c)
+	}
+	if c := sink.counter("serf.member.left"); c != 1 {
+		t.Fatalf("bad: %v", c)
+	}
+	if c := sink.counter("serf.events"); c != 1 {
+		t.Fatalf("bad: %v", c)
+	}
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if sink.timers["serf.join"] != 1 {
+		t.Fatalf("bad: %#v", sink.timers)
+	}
+}
@@ -0,0 +1,91 @@
+package serf
+
+import (
+	"fmt"
+	"github.com/hashicorp/memberlist"
+	"net"
+	"strconv"
+)
+
+// NameReusePolicy decides whether a name that Serf still knows, for a
+// member that failed or left and wasn't reaped yet, can come back with a
+// different address. See Config.NameReuse.
+type NameReusePolicy int
+
+const (
+	// NameReuseAccept lets the new address take over the name.
+	NameReuseAccept NameReusePolicy = iota
+
+	// NameReuseAfterLeave only lets a new address take over the name
+	// once the old member left, gracefully or by a force-leave.
+	NameReuseAfterLeave
+
+	// NameReuseEpoch only lets a new address take over the name if its
+	// "epoch" tag is a greater number than the one of the old member.
+	NameReuseEpoch
+)
+
+// epochTag is the tag compared by NameReuseEpoch
+const epochTag = "epoch"
+
+func (p NameReusePolicy) String() string {
+	switch p {
+	case NameReuseAccept:
+		return "accept"
+	case NameReuseAfterLeave:
+		return "after-leave"
+	case NameReuseEpoch:
+		return "epoch"
+	default:
+		panic(fmt.Sprintf("unknown name reuse policy: %d", p))
+	}
+}
+
+// aliveDelegate is the memberlist.AliveDelegate of Serf, which rejects
+// alive messages that reuse a name against the NameReuse policy, or of
+// new nodes over the MaxMembers.
+type aliveDelegate struct {
+	serf *Serf
+}
+
+func (a *aliveDelegate) NotifyAlive(peer *memberlist.Node) error {
+	if err := a.serf.checkNameReuse(peer); err != nil {
+		return err
+	}
+	return a.serf.checkMaxMembers([]string{peer.Name})
+}
+
+// checkNameReuse returns an error if the node reuses the name of a known
+// member with a different address, and the policy doesn't allow it.
+func (s *Serf) checkNameReuse(n *memberlist.Node) error {
+	if s.config.NameReuse == NameReuseAccept {
+		return nil
+	}
+
+	s.memberLock.RLock()
+	defer s.memberLock.RUnlock()
+
+	member, ok := s.members[n.Name]
+	if !ok || (member.Addr.Equal(net.IP(n.Addr)) && member.Port == n.Port) {
+		return nil
+	}
+
+	switch s.config.NameReuse {
+	case NameReuseAfterLeave:
+		if member.Status == StatusLeft {
+			return nil
+		}
+		return fmt.Errorf("name is used by %s:%d until it leaves or is force-left",
+			member.Addr, member.Port)
+
+	case NameReuseEpoch:
+		oldEpoch, _ := strconv.ParseUint(member.Tags[epochTag], 10, 64)
+		newEpoch, err := strconv.ParseUint(decodeTags(n.Meta)[epochTag], 10, 64)
+		if err == nil && newEpoch > oldEpoch {
+			return nil
+		}
+		return fmt.Errorf("name is used by %s:%d with epoch %d, which must be increased",
+			member.Addr, member.Port, oldEpoch)
+	}
+	return nil
+}
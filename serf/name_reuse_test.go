@@ -0,0 +1,64 @@
+package serf
+
+import (
+	"github.com/hashicorp/memberlist"
+	"net"
+	"testing"
+)
+
+func TestSerf_checkNameReuse(t *testing.T) {
+	s := &Serf{
+		config:  DefaultConfig(),
+		members: make(map[string]*memberState),
+	}
+	s.members["web"] = &memberState{Member: Member{
+		Name:   "web",
+		Addr:   net.IPv4(10, 0, 0, 1),
+		Port:   7946,
+		Tags:   map[string]string{"epoch": "2"},
+		Status: StatusFailed,
+	}}
+
+	node := func(addr string, tags map[string]string) *memberlist.Node {
+		meta, err := encodeTags(tags)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return &memberlist.Node{Name: "web", Addr: net.ParseIP(addr), Port: 7946, Meta: meta}
+	}
+	same := node("10.0.0.1", map[string]string{"epoch": "2"})
+	moved := node("10.0.0.2", map[string]string{"epoch": "2"})
+	newer := node("10.0.0.2", map[string]string{"epoch": "3"})
+	other := &memberlist.Node{Name: "db", Addr: net.ParseIP("10.0.0.3"), Port: 7946}
+
+	// Accept takes any address
+	if err := s.checkNameReuse(moved); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	s.config.NameReuse = NameReuseAfterLeave
+	if err := s.checkNameReuse(same); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.checkNameReuse(other); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.checkNameReuse(moved); err == nil {
+		t.Fatalf("should err")
+	}
+	s.members["web"].Status = StatusLeft
+	if err := s.checkNameReuse(moved); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	s.config.NameReuse = NameReuseEpoch
+	if err := s.checkNameReuse(moved); err == nil {
+		t.Fatalf("should err")
+	}
+	if err := s.checkNameReuse(node("10.0.0.2", nil)); err == nil {
+		t.Fatalf("should err")
+	}
+	if err := s.checkNameReuse(newer); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
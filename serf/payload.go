@@ -0,0 +1,86 @@
+package serf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ugorji/go/codec"
+)
+
+// PayloadCodec encodes and decodes the payloads of user events, so that
+// structured values can be sent with UserEventValue and received with
+// UserEvent.DecodePayload. JSONCodec and MsgpackCodec are provided, and
+// other formats, such as protocol buffers, can be used by implementing
+// this interface.
+type PayloadCodec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(buf []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec encodes payloads with encoding/json
+	JSONCodec PayloadCodec = jsonCodec{}
+
+	// MsgpackCodec encodes payloads with msgpack, which is more compact
+	// than JSON and leaves more room within UserEventSizeLimit
+	MsgpackCodec PayloadCodec = msgpackCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Decode(buf []byte, v interface{}) error {
+	return json.Unmarshal(buf, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	var handle codec.MsgpackHandle
+	err := codec.NewEncoder(&buf, &handle).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (msgpackCodec) Decode(buf []byte, v interface{}) error {
+	var handle codec.MsgpackHandle
+	return codec.NewDecoder(bytes.NewReader(buf), &handle).Decode(v)
+}
+
+// EncodeUserEvent encodes a value as the payload of a user event with
+// the given name, and checks that the result fits in UserEventSizeLimit.
+// This allows the size to be checked before anything is broadcast.
+func EncodeUserEvent(name string, v interface{}, c PayloadCodec) ([]byte, error) {
+	payload, err := c.Encode(v)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode user event payload: %s", err)
+	}
+
+	if size := len(name) + len(payload); size > UserEventSizeLimit {
+		return nil, fmt.Errorf("user event is %d bytes, which exceeds limit of %d bytes",
+			size, UserEventSizeLimit)
+	}
+	return payload, nil
+}
+
+// UserEventValue is like UserEvent, but the payload is the value v
+// encoded with the given codec. See EncodeUserEvent.
+func (s *Serf) UserEventValue(name string, v interface{}, c PayloadCodec, coalesce bool) error {
+	payload, err := EncodeUserEvent(name, v, c)
+	if err != nil {
+		return err
+	}
+	return s.UserEvent(name, payload, coalesce)
+}
+
+// DecodePayload decodes the payload of the event into v using the
+// codec the event was sent with.
+func (u UserEvent) DecodePayload(c PayloadCodec, v interface{}) error {
+	if err := c.Decode(u.Payload, v); err != nil {
+		return fmt.Errorf("Failed to decode payload of user event '%s': %s", u.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package serf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testPayload struct {
+	Version string
+	Hosts   []string
+}
+
+func TestPayloadCodecs(t *testing.T) {
+	in := testPayload{Version: "1.2.3", Hosts: []string{"web-1", "web-2"}}
+
+	for _, c := range []PayloadCodec{JSONCodec, MsgpackCodec} {
+		payload, err := EncodeUserEvent("deploy", &in, c)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		var out testPayload
+		e := UserEvent{Name: "deploy", Payload: payload}
+		if err := e.DecodePayload(c, &out); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if !reflect.DeepEqual(in, out) {
+			t.Fatalf("bad: %#v", out)
+		}
+	}
+}
+
+func TestEncodeUserEvent_sizeLimit(t *testing.T) {
+	in := testPayload{Version: strings.Repeat("x", UserEventSizeLimit)}
+
+	_, err := EncodeUserEvent("deploy", &in, JSONCodec)
+	if err == nil || !strings.Contains(err.Error(), "exceeds limit") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestUserEvent_DecodePayload_bad(t *testing.T) {
+	var out testPayload
+	e := UserEvent{Name: "deploy", Payload: []byte("not json")}
+	if err := e.DecodePayload(JSONCodec, &out); err == nil {
+		t.Fatalf("should err")
+	}
+}
+
+func TestSerf_UserEventValue(t *testing.T) {
+	eventCh := make(chan Event, 4)
+	c := testConfig()
+	c.EventCh = eventCh
+	s1, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s1.Shutdown()
+
+	in := testPayload{Version: "1.2.3"}
+	if err := s1.UserEventValue("deploy", &in, MsgpackCodec, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-eventCh:
+			ue, ok := e.(UserEvent)
+			if !ok {
+				continue
+			}
+
+			var out testPayload
+			if err := ue.DecodePayload(MsgpackCodec, &out); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if out.Version != "1.2.3" {
+				t.Fatalf("bad: %#v", out)
+			}
+			return
+
+		case <-timeout:
+			t.Fatalf("no user event")
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package serf
+
+import (
+	"context"
+	"fmt"
+)
+
+// PullEventBuffer is the number of events that are kept for NextEvent
+// before Serf blocks, if PullEvents is set.
+const PullEventBuffer = 512
+
+// NextEvent returns the next event of a Serf created with PullEvents. It
+// blocks until there is an event, the context is done, or Serf is shut
+// down. Events that were already waiting are still returned after a
+// shutdown, and an error once they are exhausted.
+func (s *Serf) NextEvent(ctx context.Context) (Event, error) {
+	if s.pullCh == nil {
+		return nil, fmt.Errorf("NextEvent requires PullEvents")
+	}
+
+	select {
+	case e := <-s.pullCh:
+		return e, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.shutdownCh:
+	}
+
+	select {
+	case e := <-s.pullCh:
+		return e, nil
+	default:
+		return nil, fmt.Errorf("Serf is shut down")
+	}
+}
@@ -0,0 +1,77 @@
+package serf
+
+import (
+	"context"
+	"github.com/hashicorp/serf/testutil"
+	"testing"
+	"time"
+)
+
+func TestSerf_NextEvent(t *testing.T) {
+	s1Config := testConfig()
+	s1Config.PullEvents = true
+	s2Config := testConfig()
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s2.Shutdown()
+
+	testutil.Yield()
+
+	// Only the join of s1 itself has happened, so the context expires
+	// after it
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	e, err := s1.NextEvent(ctx)
+	if me, ok := e.(MemberEvent); err != nil || !ok || me.Members[0].Name != s1Config.NodeName {
+		t.Fatalf("bad: %#v %v", e, err)
+	}
+	if e, err := s1.NextEvent(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("bad: %#v %v", e, err)
+	}
+
+	if _, err := s2.Join([]string{s1Config.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for {
+		e, err := s1.NextEvent(ctx)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		me, ok := e.(MemberEvent)
+		if ok && me.Type == EventMemberJoin && me.Members[0].Name == s2Config.NodeName {
+			break
+		}
+	}
+
+	// The Serf without PullEvents has nothing to pull
+	if _, err := s2.NextEvent(context.Background()); err == nil {
+		t.Fatalf("should err")
+	}
+
+	s1.Shutdown()
+	if _, err := s1.NextEvent(context.Background()); err == nil {
+		t.Fatalf("should err")
+	}
+}
+
+func TestCreate_pullEventsWithEventCh(t *testing.T) {
+	c := testConfig()
+	c.PullEvents = true
+	c.EventCh = make(chan Event, 1)
+
+	if _, err := Create(c); err == nil {
+		t.Fatalf("should err")
+	}
+}
@@ -0,0 +1,154 @@
+package serf
+
+import (
+	"github.com/hashicorp/memberlist"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxLimitedSources is the number of source addresses that a
+// pushPullLimiter tracks before it forgets the ones that are idle.
+const maxLimitedSources = 4096
+
+// pushPullLimiter is a memberlist transport that limits the rate of the
+// stream connections accepted from each source address, see
+// Config.PushPullRateLimit. Connections over the limit are closed before
+// memberlist reads them.
+type pushPullLimiter struct {
+	memberlist.Transport
+
+	rate     float64
+	burst    float64
+	rejected *uint64
+	metrics  MetricsSink
+	logger   *log.Logger
+
+	streamCh     chan net.Conn
+	shutdownCh   chan struct{}
+	shutdown     bool
+	shutdownLock sync.Mutex
+
+	lock    sync.Mutex
+	sources map[string]*tokenBucket
+}
+
+// tokenBucket is the number of connections that a source can still
+// open, as of the last time it opened one.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newPushPullLimiter(t memberlist.Transport, rate float64, burst int,
+	rejected *uint64, metrics MetricsSink, logger *log.Logger) *pushPullLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	l := &pushPullLimiter{
+		Transport:  t,
+		rate:       rate,
+		burst:      float64(burst),
+		rejected:   rejected,
+		metrics:    metrics,
+		logger:     logger,
+		streamCh:   make(chan net.Conn),
+		shutdownCh: make(chan struct{}),
+		sources:    make(map[string]*tokenBucket),
+	}
+	go l.filter()
+	return l
+}
+
+func (l *pushPullLimiter) StreamCh() <-chan net.Conn {
+	return l.streamCh
+}
+
+// Shutdown may be called twice, by memberlist and by Create if memberlist
+// fails to start
+func (l *pushPullLimiter) Shutdown() error {
+	l.shutdownLock.Lock()
+	defer l.shutdownLock.Unlock()
+	if l.shutdown {
+		return nil
+	}
+	l.shutdown = true
+	close(l.shutdownCh)
+	return l.Transport.Shutdown()
+}
+
+// filter passes the connections of the underlying transport on to
+// memberlist, unless their source is over the limit.
+func (l *pushPullLimiter) filter() {
+	for {
+		select {
+		case conn := <-l.Transport.StreamCh():
+			source := conn.RemoteAddr().String()
+			if host, _, err := net.SplitHostPort(source); err == nil {
+				source = host
+			}
+
+			if !l.allow(source, time.Now()) {
+				atomic.AddUint64(l.rejected, 1)
+				l.metrics.IncrCounter([]string{"serf", "push_pull", "rejected"}, 1)
+				l.logger.Printf("[DEBUG] serf: Rejected push/pull from %s over the rate limit", source)
+				conn.Close()
+				continue
+			}
+
+			select {
+			case l.streamCh <- conn:
+			case <-l.shutdownCh:
+				conn.Close()
+				return
+			}
+
+		case <-l.shutdownCh:
+			return
+		}
+	}
+}
+
+// allow takes a token from the bucket of the source, if it has one.
+func (l *pushPullLimiter) allow(source string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	b, ok := l.sources[source]
+	if !ok {
+		if len(l.sources) >= maxLimitedSources {
+			l.forgetIdle(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.sources[source] = b
+	}
+
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill returns the tokens that a bucket has at the given time.
+func (l *pushPullLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.rate
+	if tokens > l.burst {
+		tokens = l.burst
+	}
+	return tokens
+}
+
+// forgetIdle removes the sources whose buckets are full again, since
+// tracking them makes no difference. Locking is left to the caller.
+func (l *pushPullLimiter) forgetIdle(now time.Time) {
+	for source, b := range l.sources {
+		if l.refill(b, now) >= l.burst {
+			delete(l.sources, source)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package serf
+
+import (
+	"github.com/hashicorp/serf/testutil"
+	"testing"
+	"time"
+)
+
+func TestPushPullLimiter_allow(t *testing.T) {
+	var rejected uint64
+	l := &pushPullLimiter{
+		rate:     1,
+		burst:    2,
+		rejected: &rejected,
+		sources:  make(map[string]*tokenBucket),
+	}
+
+	now := time.Now()
+	if !l.allow("10.0.0.1", now) || !l.allow("10.0.0.1", now) {
+		t.Fatalf("should allow the burst")
+	}
+	if l.allow("10.0.0.1", now) {
+		t.Fatalf("should not allow more than the burst")
+	}
+
+	// Other sources have their own buckets
+	if !l.allow("10.0.0.2", now) {
+		t.Fatalf("should allow another source")
+	}
+
+	// The bucket refills at the rate
+	if l.allow("10.0.0.1", now.Add(500*time.Millisecond)) {
+		t.Fatalf("should not allow half a token")
+	}
+	if !l.allow("10.0.0.1", now.Add(time.Second)) {
+		t.Fatalf("should allow after a second")
+	}
+
+	// Idle sources are forgotten
+	l.forgetIdle(now.Add(time.Hour))
+	if len(l.sources) != 0 {
+		t.Fatalf("bad: %#v", l.sources)
+	}
+}
+
+func TestSerf_PushPullRateLimit(t *testing.T) {
+	s1Config := testConfig()
+	s1Config.PushPullRateLimit = 0.001
+	s1Config.PushPullBurst = 1
+	s2Config := testConfig()
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s2.Shutdown()
+
+	testutil.Yield()
+
+	if _, err := s2.Join([]string{s1Config.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The second join from the same source is over the limit
+	if _, err := s2.Join([]string{s1Config.MemberlistConfig.BindAddr}, false); err == nil {
+		t.Fatalf("should err")
+	}
+
+	testutil.Yield()
+
+	if s1.Stats()["rejected_push_pulls"] != "1" {
+		t.Fatalf("bad: %#v", s1.Stats())
+	}
+	if len(s1.Members()) != 2 {
+		t.Fatalf("bad: %#v", s1.Members())
+	}
+}
@@ -8,7 +8,12 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,7 +22,7 @@ import (
 // version to memberlist below.
 const (
 	ProtocolVersionMin uint8 = 0
-	ProtocolVersionMax       = 2
+	ProtocolVersionMax       = 3
 )
 
 func init() {
@@ -36,14 +41,39 @@ type Serf struct {
 	clock      LamportClock
 	eventClock LamportClock
 
+	// pushPulls counts the state exchanges with other members. It is
+	// updated atomically, so it is kept here for alignment as well.
+	pushPulls uint64
+
+	// corruptEvents counts the user events dropped for a bad checksum
+	corruptEvents uint64
+
+	// throttledBroadcasts counts the times user events were held back by
+	// the bandwidth budget
+	throttledBroadcasts uint64
+
+	// rejectedPushPulls counts the connections closed over the
+	// PushPullRateLimit
+	rejectedPushPulls uint64
+
+	// malformedMessages counts the messages dropped by malformedMessage
+	malformedMessages uint64
+
 	broadcasts    *memberlist.TransmitLimitedQueue
 	config        *Config
+	tagLock       sync.RWMutex // protects the Tags of the config, see SetTags
 	failedMembers []*memberState
 	leftMembers   []*memberState
 	memberlist    *memberlist.Memberlist
 	memberLock    sync.RWMutex
 	members       map[string]*memberState
 
+	// leftNodes are the members that left gracefully, and suppressed are
+	// the ones of them that memberlist reports alive again before they
+	// broadcast a newer join, see suppressRejoin
+	leftNodes  map[string]leftNode
+	suppressed map[string]*memberlist.Node
+
 	// Circular buffers for recent intents, used
 	// in case we get the intent before the relevent event
 	recentLeave      []nodeIntent
@@ -64,6 +94,20 @@ type Serf struct {
 	shutdownCh chan struct{}
 
 	snapshotter *Snapshotter
+
+	// pullCh holds the events for NextEvent, if PullEvents is set
+	pullCh chan Event
+
+	// budget limits the bytes of broadcasts, if GossipBandwidthLimit is set
+	budget *bandwidthBudget
+
+	// rand is the source of random choices, see Config.Rand
+	randLock sync.Mutex
+	rand     *rand.Rand
+
+	// traceUntil is when tracing of gossip messages stops
+	traceLock  sync.Mutex
+	traceUntil time.Time
 }
 
 // SerfState is the state of the Serf instance.
@@ -97,6 +141,7 @@ type Member struct {
 	Addr   net.IP
 	Port   uint16
 	Role   string
+	Tags   map[string]string
 	Status MemberStatus
 
 	// The minimum, maximum, and current values of the protocol versions
@@ -145,6 +190,28 @@ type memberState struct {
 	Member
 	statusLTime LamportTime // lamport clock time of last received message
 	leaveTime   time.Time   // wall clock time of leave
+	statusTime  time.Time   // wall clock time of last status change
+	tagsTime    time.Time   // wall clock time of last tags change
+	addrHistory []AddrChange
+}
+
+// AddrChange is a previous address of a member, and the local wall clock
+// time until which the member advertised it.
+type AddrChange struct {
+	Addr  net.IP
+	Port  uint16
+	Until time.Time
+}
+
+// maxAddrHistory is the number of previous addresses kept per member
+const maxAddrHistory = 8
+
+// MemberTimes are the times at which the local member observed changes
+// of another member. These are local wall clock times, and members may
+// disagree on them.
+type MemberTimes struct {
+	Status time.Time
+	Tags   time.Time
 }
 
 // nodeIntent is used to buffer intents for out-of-order deliveries
@@ -157,10 +224,13 @@ type nodeIntent struct {
 type userEvent struct {
 	Name    string
 	Payload []byte
+	Target  string `codec:",omitempty"`
+	Origin  string `codec:",omitempty"`
+	Version uint8  `codec:",omitempty"`
 }
 
 func (ue *userEvent) Equals(other *userEvent) bool {
-	if ue.Name != other.Name {
+	if ue.Name != other.Name || ue.Target != other.Target || ue.Version != other.Version {
 		return false
 	}
 	if bytes.Compare(ue.Payload, other.Payload) != 0 {
@@ -194,14 +264,57 @@ func Create(conf *Config) (*Serf, error) {
 			conf.ProtocolVersion, ProtocolVersionMin, ProtocolVersionMax)
 	}
 
+	if conf.UpgradeCheckVersion > ProtocolVersionMax {
+		return nil, fmt.Errorf("Upgrade check version '%d' too high. Must be at most %d",
+			conf.UpgradeCheckVersion, ProtocolVersionMax)
+	}
+
+	// Tags beyond the role can only be understood by newer members
+	if conf.ProtocolVersion < 3 {
+		for key := range conf.Tags {
+			if key != "role" {
+				return nil, fmt.Errorf("Tags are only supported in protocol version 3 and above")
+			}
+		}
+	}
+
+	// The tags must fit in the node meta, or memberlist can't advertise
+	// them
+	if err := ValidateTags(withRole(conf.Tags, conf.Role)); err != nil {
+		return nil, err
+	}
+
 	serf := &Serf{
 		config:     conf,
 		logger:     log.New(conf.LogOutput, "", log.LstdFlags),
 		members:    make(map[string]*memberState),
+		leftNodes:  make(map[string]leftNode),
+		suppressed: make(map[string]*memberlist.Node),
 		shutdownCh: make(chan struct{}),
 		state:      SerfAlive,
 	}
 
+	serf.rand = conf.Rand
+	if serf.rand == nil {
+		serf.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	if conf.Metrics == nil {
+		conf.Metrics = BlackholeSink{}
+	}
+
+	if conf.GossipBandwidthLimit > 0 {
+		serf.budget = &bandwidthBudget{limit: conf.GossipBandwidthLimit}
+	}
+
+	if conf.PullEvents {
+		if conf.EventCh != nil {
+			return nil, fmt.Errorf("EventCh can't be set with PullEvents")
+		}
+		serf.pullCh = make(chan Event, PullEventBuffer)
+		conf.EventCh = serf.pullCh
+	}
+
 	// Check if serf member event coalescing is enabled
 	if conf.CoalescePeriod > 0 && conf.QuiescentPeriod > 0 && conf.EventCh != nil {
 		c := &memberEventCoalescer{
@@ -216,7 +329,7 @@ func Create(conf *Config) (*Serf, error) {
 	// Check if user event coalescing is enabled
 	if conf.UserCoalescePeriod > 0 && conf.UserQuiescentPeriod > 0 && conf.EventCh != nil {
 		c := &userEventCoalescer{
-			events: make(map[string]*latestUserEvents),
+			events: make(map[userEventKey]*latestUserEvents),
 		}
 
 		conf.EventCh = coalescedEventCh(conf.EventCh, serf.shutdownCh,
@@ -227,17 +340,21 @@ func Create(conf *Config) (*Serf, error) {
 	var oldClock, oldEventClock LamportTime
 	var prev []*PreviousNode
 	if conf.SnapshotPath != "" {
-		eventCh, snap, err := NewSnapshotter(conf.SnapshotPath, snapshotSizeLimit,
-			serf.logger, &serf.clock, conf.EventCh, serf.shutdownCh)
+		eventCh, snap, err := newSnapshotter(conf.SnapshotPath, snapshotSizeLimit,
+			conf.TombstoneTimeout, serf.logger, &serf.clock, conf.EventCh, serf.shutdownCh)
 		if err != nil {
+			serf.abortCreate(nil)
 			return nil, fmt.Errorf("Failed to setup snapshot: %v", err)
 		}
 		serf.snapshotter = snap
 		conf.EventCh = eventCh
-		prev = snap.AliveNodes()
+		prev = serf.shuffleNodes(snap.AliveNodes())
 		oldClock = snap.LastClock()
 		oldEventClock = snap.LastEventClock()
 		serf.eventMinTime = oldEventClock + 1
+		for name, left := range snap.recentlyLeft() {
+			serf.leftNodes[name] = left
+		}
 	}
 
 	// Setup the broadcast queue, which we use to send our own custom
@@ -274,21 +391,62 @@ func Create(conf *Config) (*Serf, error) {
 	// Modify the memberlist configuration with keys that we set
 	conf.MemberlistConfig.Events = &eventDelegate{serf: serf}
 	conf.MemberlistConfig.Delegate = &delegate{serf: serf}
+	conf.MemberlistConfig.Alive = &aliveDelegate{serf: serf}
+	conf.MemberlistConfig.Merge = &mergeDelegate{serf: serf}
 	conf.MemberlistConfig.DelegateProtocolVersion = conf.ProtocolVersion
 	conf.MemberlistConfig.DelegateProtocolMin = ProtocolVersionMin
 	conf.MemberlistConfig.DelegateProtocolMax = ProtocolVersionMax
 	conf.MemberlistConfig.Name = conf.NodeName
 	conf.MemberlistConfig.ProtocolVersion = ProtocolVersionMap[conf.ProtocolVersion]
 
+	// Create the transport here if memberlist would create the default
+	// one, but it must bind extra addresses or be wrapped below. Unlike
+	// its own, memberlist doesn't shut these down if it fails to start.
+	var transport memberlist.Transport
+	if conf.MemberlistConfig.Transport == nil &&
+		(len(conf.ExtraBindAddrs) > 0 || conf.PushPullRateLimit > 0) {
+		bindAddrs := append([]string{conf.MemberlistConfig.BindAddr}, conf.ExtraBindAddrs...)
+		nt, err := memberlist.NewNetTransport(&memberlist.NetTransportConfig{
+			BindAddrs: bindAddrs,
+			BindPort:  conf.MemberlistConfig.BindPort,
+			Logger:    serf.logger,
+		})
+		if err != nil {
+			serf.abortCreate(nil)
+			return nil, fmt.Errorf("Could not set up network transport: %v", err)
+		}
+		if conf.MemberlistConfig.BindPort == 0 {
+			conf.MemberlistConfig.BindPort = nt.GetAutoBindPort()
+		}
+		conf.MemberlistConfig.Transport = nt
+		transport = nt
+	}
+
+	// Limit the rate of inbound push/pulls by wrapping the transport
+	if conf.PushPullRateLimit > 0 {
+		conf.MemberlistConfig.Transport = newPushPullLimiter(conf.MemberlistConfig.Transport,
+			conf.PushPullRateLimit, conf.PushPullBurst, &serf.rejectedPushPulls, conf.Metrics, serf.logger)
+		transport = conf.MemberlistConfig.Transport
+	}
+
 	// Create the underlying memberlist that will manage membership
 	// and failure detection for the Serf instance.
 	memberlist, err := memberlist.Create(conf.MemberlistConfig)
 	if err != nil {
+		serf.abortCreate(transport)
 		return nil, err
 	}
 
 	serf.memberlist = memberlist
 
+	// Make sure the snapshot is our own before rejoining with it
+	if serf.snapshotter != nil {
+		if err := serf.checkSnapshotIdentity(); err != nil {
+			serf.Shutdown()
+			return nil, err
+		}
+	}
+
 	// Start the background tasks. See the documentation above each method
 	// for more information on their role.
 	go serf.handleReap()
@@ -304,6 +462,97 @@ func Create(conf *Config) (*Serf, error) {
 	return serf, nil
 }
 
+// abortCreate stops what Create started before it failed to create the
+// memberlist: the coalescers, the snapshotter and the given transport,
+// if it was created by Serf.
+func (s *Serf) abortCreate(transport memberlist.Transport) {
+	close(s.shutdownCh)
+	if transport != nil {
+		transport.Shutdown()
+	}
+	if s.snapshotter != nil {
+		s.snapshotter.Wait()
+	}
+}
+
+// checkSnapshotIdentity verifies that the snapshot was written by the
+// node name and IP address of the local node, unless ForceSnapshotIdentity
+// is set, and records them in the snapshot. The port isn't compared,
+// since it is picked at random when binding port 0.
+func (s *Serf) checkSnapshotIdentity() error {
+	s.memberLock.RLock()
+	local, ok := s.members[s.config.NodeName]
+	s.memberLock.RUnlock()
+	if !ok {
+		return nil
+	}
+	addr := net.TCPAddr{IP: local.Addr, Port: int(local.Port)}
+
+	name, prevAddr := s.snapshotter.lastIdentity()
+	prevIP := prevAddr
+	if host, _, err := net.SplitHostPort(prevAddr); err == nil {
+		prevIP = host
+	}
+	if name != "" && (name != s.config.NodeName || prevIP != local.Addr.String()) {
+		if !s.config.ForceSnapshotIdentity {
+			return fmt.Errorf("Snapshot %s was written by node %s at %s, not by %s at %s. "+
+				"If this node was cloned from another one, move the snapshot away, "+
+				"otherwise force the start to take the snapshot over",
+				s.config.SnapshotPath, name, prevAddr, s.config.NodeName, addr.String())
+		}
+		s.logger.Printf("[WARN] serf: Taking over snapshot of node %s at %s", name, prevAddr)
+	}
+
+	s.snapshotter.setIdentity(s.config.NodeName, addr.String())
+	return nil
+}
+
+// localTags returns the tags that this node advertises, which are the
+// configured tags along with the role, if any.
+func (s *Serf) localTags() map[string]string {
+	s.tagLock.RLock()
+	defer s.tagLock.RUnlock()
+	return withRole(s.config.Tags, s.config.Role)
+}
+
+// withRole returns a copy of the tags with the role, if any, added as
+// the "role" tag.
+func withRole(tags map[string]string, role string) map[string]string {
+	result := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		result[k] = v
+	}
+	if role != "" {
+		result["role"] = role
+	}
+	return result
+}
+
+// SetTags changes the tags that the local node advertises, and broadcasts
+// them to the cluster. The members, including the local one, emit a
+// member-update event with the previous and the new tags. The role is
+// kept unless the tags set it. Tags other than the role require protocol
+// version 3.
+func (s *Serf) SetTags(tags map[string]string) error {
+	if s.config.ProtocolVersion < 3 {
+		for key := range tags {
+			if key != "role" {
+				return fmt.Errorf("Tags are only supported in protocol version 3 and above")
+			}
+		}
+	}
+
+	if err := ValidateTags(withRole(tags, s.config.Role)); err != nil {
+		return err
+	}
+
+	s.tagLock.Lock()
+	s.config.Tags = tags
+	s.tagLock.Unlock()
+
+	return s.memberlist.UpdateNode(s.config.BroadcastTimeout)
+}
+
 // ProtocolVersion returns the current protocol version in use by Serf.
 // This is the Serf protocol version, not the memberlist protocol version.
 func (s *Serf) ProtocolVersion() uint8 {
@@ -316,17 +565,73 @@ func (s *Serf) ProtocolVersion() uint8 {
 // nodes are allowed to coalesce this event. Coalescing is only available
 // starting in v0.2
 func (s *Serf) UserEvent(name string, payload []byte, coalesce bool) error {
+	return s.userEvent(name, payload, 0, "", coalesce, nil)
+}
+
+// UserEventVersion is like UserEvent, but also sets the schema version
+// of the payload, see UserEvent.Version.
+func (s *Serf) UserEventVersion(name string, payload []byte, version uint8, coalesce bool) error {
+	return s.userEvent(name, payload, version, "", coalesce, nil)
+}
+
+// UserEventNode is like UserEventVersion, but the event is meant for the
+// member with the given name only, see UserEvent.Target. Coalescing only
+// combines events with the same target.
+func (s *Serf) UserEventNode(name string, payload []byte, version uint8, node string, coalesce bool) error {
+	if node == "" {
+		return fmt.Errorf("missing target node name")
+	}
+	return s.userEvent(name, payload, version, node, coalesce, nil)
+}
+
+// UserEventAsync is like UserEvent, but doesn't wait for the event to be
+// checked and queued. The returned future tells when the event has been
+// handed to the broadcast queue, and when it has left the queue again.
+func (s *Serf) UserEventAsync(name string, payload []byte, coalesce bool) *UserEventFuture {
+	f := &UserEventFuture{
+		queuedCh:      make(chan struct{}),
+		transmittedCh: make(chan struct{}),
+	}
+	go func() {
+		f.err = s.userEvent(name, payload, 0, "", coalesce, f.transmittedCh)
+		if f.err != nil {
+			close(f.transmittedCh)
+		}
+		close(f.queuedCh)
+	}()
+	return f
+}
+
+// userEvent sends a user event, for all members if target is empty. If
+// notify is given, it is closed once the broadcast of the event is
+// finished.
+func (s *Serf) userEvent(name string, payload []byte, version uint8, target string,
+	coalesce bool, notify chan<- struct{}) error {
 	// Check the size limit
 	if len(name)+len(payload) > UserEventSizeLimit {
 		return fmt.Errorf("user event payload exceeds limit of %d bytes", UserEventSizeLimit)
 	}
 
+	// Give the application a chance to refuse the event
+	if s.config.UserEventVeto != nil {
+		if err := s.config.UserEventVeto(name, payload); err != nil {
+			return err
+		}
+	}
+
 	// Create a message
 	msg := messageUserEvent{
 		LTime:   s.eventClock.Time(),
 		Name:    name,
 		Payload: payload,
 		CC:      coalesce,
+		Version: version,
+		Origin:  s.config.NodeName,
+		Target:  target,
+	}
+	if s.config.UserEventChecksums {
+		msg.HasCRC = true
+		msg.CRC = eventChecksum(&msg)
 	}
 	s.eventClock.Increment()
 
@@ -339,7 +644,8 @@ func (s *Serf) UserEvent(name string, payload []byte, coalesce bool) error {
 		return err
 	}
 	s.eventBroadcasts.QueueBroadcast(&broadcast{
-		msg: raw,
+		msg:    raw,
+		notify: notify,
 	})
 	return nil
 }
@@ -354,6 +660,8 @@ func (s *Serf) Join(existing []string, ignoreOld bool) (int, error) {
 		return 0, fmt.Errorf("Serf can't Join after Leave or Shutdown")
 	}
 
+	defer s.config.Metrics.MeasureSince([]string{"serf", "join"}, time.Now())
+
 	// Hold the joinLock, this is to make eventJoinIgnore safe
 	s.joinLock.Lock()
 	defer s.joinLock.Unlock()
@@ -501,37 +809,83 @@ func (s *Serf) Members() []Member {
 	return members
 }
 
+// MemberTimes returns the times of the last changes of the members,
+// keyed by the member name.
+func (s *Serf) MemberTimes() map[string]MemberTimes {
+	s.memberLock.RLock()
+	defer s.memberLock.RUnlock()
+
+	times := make(map[string]MemberTimes, len(s.members))
+	for name, m := range s.members {
+		times[name] = MemberTimes{
+			Status: m.statusTime,
+			Tags:   m.tagsTime,
+		}
+	}
+	return times
+}
+
+// AddrHistory returns the previous addresses of the members that have
+// changed their address, oldest first, keyed by the member name. Only
+// the last few addresses of each member are kept.
+func (s *Serf) AddrHistory() map[string][]AddrChange {
+	s.memberLock.RLock()
+	defer s.memberLock.RUnlock()
+
+	history := make(map[string][]AddrChange)
+	for name, m := range s.members {
+		if len(m.addrHistory) > 0 {
+			history[name] = append([]AddrChange(nil), m.addrHistory...)
+		}
+	}
+	return history
+}
+
 // RemoveFailedNode forcibly removes a failed node from the cluster
 // immediately, instead of waiting for the reaper to eventually reclaim it.
 // This also has the effect that Serf will no longer attempt to reconnect
 // to this node.
 func (s *Serf) RemoveFailedNode(node string) error {
-	// Construct the message to broadcast
-	msg := messageLeave{
-		LTime: s.clock.Time(),
-		Node:  node,
-	}
-	s.clock.Increment()
+	return s.RemoveFailedNodes([]string{node})
+}
 
-	// Process our own event
-	s.handleNodeLeaveIntent(&msg)
+// RemoveFailedNodes is like RemoveFailedNode for several nodes at once.
+// The removals are all broadcast before waiting for them, so removing
+// many nodes takes no longer than removing one.
+func (s *Serf) RemoveFailedNodes(nodes []string) error {
+	notifyChs := make([]chan struct{}, 0, len(nodes))
+	for _, node := range nodes {
+		// Construct the message to broadcast
+		msg := messageLeave{
+			LTime: s.clock.Time(),
+			Node:  node,
+		}
+		s.clock.Increment()
 
-	// If we have no members, then we don't need to broadcast
-	if !s.hasAliveMembers() {
-		return nil
-	}
+		// Process our own event
+		s.handleNodeLeaveIntent(&msg)
 
-	// Broadcast the remove
-	notifyCh := make(chan struct{})
-	if err := s.broadcast(messageLeaveType, &msg, notifyCh); err != nil {
-		return err
+		// If we have no members, then we don't need to broadcast
+		if !s.hasAliveMembers() {
+			continue
+		}
+
+		// Broadcast the remove
+		notifyCh := make(chan struct{})
+		if err := s.broadcast(messageLeaveType, &msg, notifyCh); err != nil {
+			return err
+		}
+		notifyChs = append(notifyChs, notifyCh)
 	}
 
-	// Wait for the broadcast
-	select {
-	case <-notifyCh:
-	case <-time.After(s.config.BroadcastTimeout):
-		return fmt.Errorf("timed out broadcasting node removal")
+	// Wait for the broadcasts
+	timeout := time.After(s.config.BroadcastTimeout)
+	for _, notifyCh := range notifyChs {
+		select {
+		case <-notifyCh:
+		case <-timeout:
+			return fmt.Errorf("timed out broadcasting node removal")
+		}
 	}
 
 	return nil
@@ -573,6 +927,96 @@ func (s *Serf) Shutdown() error {
 	return nil
 }
 
+// SaveSnapshot compacts the snapshot and syncs it to disk right away,
+// see Snapshotter.Save. It returns the path and the size of the snapshot,
+// or an error if Serf has no snapshot.
+func (s *Serf) SaveSnapshot() (string, int64, error) {
+	if s.snapshotter == nil {
+		return "", 0, fmt.Errorf("No snapshot is configured")
+	}
+	size, err := s.snapshotter.Save()
+	return s.snapshotter.Path(), size, err
+}
+
+// Stats is used to provide operator debugging information, such as the
+// number of members in each state, the clock values and the depth of the
+// broadcast queues.
+func (s *Serf) Stats() map[string]string {
+	toString := func(v uint64) string {
+		return strconv.FormatUint(v, 10)
+	}
+
+	s.memberLock.RLock()
+	defer s.memberLock.RUnlock()
+
+	stats := map[string]string{
+		"members":      toString(uint64(len(s.members))),
+		"failed":       toString(uint64(len(s.failedMembers))),
+		"left":         toString(uint64(len(s.leftMembers))),
+		"member_time":  toString(uint64(s.clock.Time())),
+		"event_time":   toString(uint64(s.eventClock.Time())),
+		"intent_queue": toString(uint64(s.broadcasts.NumQueued())),
+		"event_queue":  toString(uint64(s.eventBroadcasts.NumQueued())),
+
+		"push_pulls":           toString(atomic.LoadUint64(&s.pushPulls)),
+		"corrupt_events":       toString(atomic.LoadUint64(&s.corruptEvents)),
+		"throttled_broadcasts": toString(atomic.LoadUint64(&s.throttledBroadcasts)),
+		"rejected_push_pulls":  toString(atomic.LoadUint64(&s.rejectedPushPulls)),
+		"malformed_messages":   toString(atomic.LoadUint64(&s.malformedMessages)),
+		"push_pull_interval":   s.config.MemberlistConfig.PushPullInterval.String(),
+	}
+
+	// Count the alive members that share their address in one pass, since
+	// the lock blocks gossip and duplicateAddr scans all the members
+	addrs := make(map[string]int)
+	for _, m := range s.members {
+		if m.Status == StatusAlive {
+			addr := net.TCPAddr{IP: m.Addr, Port: int(m.Port)}
+			addrs[addr.String()]++
+		}
+	}
+	duplicates := 0
+	for _, n := range addrs {
+		if n > 1 {
+			duplicates += n
+		}
+	}
+	stats["duplicate_addresses"] = toString(uint64(duplicates))
+
+	if s.checkingUpgrade() {
+		blockers := 0
+		for _, m := range s.members {
+			if m.Status == StatusAlive && m.DelegateMax < s.config.UpgradeCheckVersion {
+				blockers++
+			}
+		}
+		stats["upgrade_blockers"] = toString(uint64(blockers))
+	}
+	return stats
+}
+
+// duplicateAddr returns the name of another alive member that advertises
+// the same address and port as the given alive member, or "" if there is
+// none. The member lock must be held.
+func (s *Serf) duplicateAddr(member *memberState) string {
+	if member.Status != StatusAlive {
+		return ""
+	}
+	for _, m := range s.members {
+		if m.Name != member.Name && m.Status == StatusAlive &&
+			m.Port == member.Port && m.Addr.Equal(member.Addr) {
+			return m.Name
+		}
+	}
+	return ""
+}
+
+// checkingUpgrade returns true if members are checked for an upgrade of
+// the protocol version, see Config.UpgradeCheckVersion
+func (s *Serf) checkingUpgrade() bool {
+	return s.config.UpgradeCheckVersion > s.config.ProtocolVersion
+}
+
 // State is the current state of this Serf instance.
 func (s *Serf) State() SerfState {
 	s.stateLock.Lock()
@@ -603,7 +1047,17 @@ func (s *Serf) handleNodeJoin(n *memberlist.Node) {
 	s.memberLock.Lock()
 	defer s.memberLock.Unlock()
 
+	if s.suppressRejoin(n) {
+		return
+	}
+	s.nodeJoined(n)
+}
+
+// nodeJoined admits a node that memberlist reports alive as a member.
+// The memberLock must be held.
+func (s *Serf) nodeJoined(n *memberlist.Node) {
 	var oldStatus MemberStatus
+	tags := decodeTags(n.Meta)
 	member, ok := s.members[n.Name]
 	if !ok {
 		oldStatus = StatusNone
@@ -612,9 +1066,12 @@ func (s *Serf) handleNodeJoin(n *memberlist.Node) {
 				Name:   n.Name,
 				Addr:   net.IP(n.Addr),
 				Port:   n.Port,
-				Role:   string(n.Meta),
+				Role:   tags["role"],
+				Tags:   tags,
 				Status: StatusAlive,
 			},
+			statusTime: time.Now(),
+			tagsTime:   time.Now(),
 		}
 
 		// Check if we have a join intent and use the LTime
@@ -633,11 +1090,17 @@ func (s *Serf) handleNodeJoin(n *memberlist.Node) {
 		s.members[n.Name] = member
 	} else {
 		oldStatus = member.Status
+		if oldStatus != StatusAlive {
+			member.statusTime = time.Now()
+		}
+		if !reflect.DeepEqual(member.Tags, tags) {
+			member.tagsTime = time.Now()
+		}
+		s.updateAddr(member, n)
 		member.Status = StatusAlive
 		member.leaveTime = time.Time{}
-		member.Addr = net.IP(n.Addr)
-		member.Port = n.Port
-		member.Role = string(n.Meta)
+		member.Role = tags["role"]
+		member.Tags = tags
 	}
 
 	// Update the protocol versions every time we get an event
@@ -648,6 +1111,18 @@ func (s *Serf) handleNodeJoin(n *memberlist.Node) {
 	member.DelegateMax = n.DMax
 	member.DelegateCur = n.DCur
 
+	if other := s.duplicateAddr(member); other != "" {
+		s.logger.Printf("[WARN] serf: %s and %s both advertise the address %s:%d. "+
+			"This usually means one was cloned along with its snapshot",
+			member.Name, other, member.Addr, member.Port)
+	}
+
+	if s.checkingUpgrade() && member.DelegateMax < s.config.UpgradeCheckVersion {
+		s.logger.Printf("[WARN] serf: %s only understands protocol versions up to %d, "+
+			"it must be upgraded before the protocol version %d can be used",
+			member.Name, member.DelegateMax, s.config.UpgradeCheckVersion)
+	}
+
 	// If node was previously in a failed state, then clean up some
 	// internal accounting.
 	// TODO(mitchellh): needs tests to verify not reaped
@@ -657,6 +1132,7 @@ func (s *Serf) handleNodeJoin(n *memberlist.Node) {
 	}
 
 	// Send an event along
+	s.config.Metrics.IncrCounter([]string{"serf", "member", "join"}, 1)
 	s.logger.Printf("[INFO] serf: EventMemberJoin: %s %s",
 		member.Member.Name, member.Member.Addr)
 	if s.config.EventCh != nil {
@@ -667,12 +1143,79 @@ func (s *Serf) handleNodeJoin(n *memberlist.Node) {
 	}
 }
 
+// updateAddr sets the address of the member to the one of the node, and
+// records the previous one if it changed. It returns true if it changed.
+// The memberLock must be held.
+func (s *Serf) updateAddr(member *memberState, n *memberlist.Node) bool {
+	if member.Addr.Equal(net.IP(n.Addr)) && member.Port == n.Port {
+		return false
+	}
+
+	s.logger.Printf("[INFO] serf: %s changed address from %s:%d to %s:%d",
+		member.Name, member.Addr, member.Port, net.IP(n.Addr), n.Port)
+	member.addrHistory = append(member.addrHistory, AddrChange{
+		Addr:  member.Addr,
+		Port:  member.Port,
+		Until: time.Now(),
+	})
+	if len(member.addrHistory) > maxAddrHistory {
+		member.addrHistory = member.addrHistory[1:]
+	}
+	member.Addr = net.IP(n.Addr)
+	member.Port = n.Port
+	return true
+}
+
+// handleNodeUpdate is called when memberlist reports that an alive node
+// changed its meta or address, such as after Serf.SetTags.
+func (s *Serf) handleNodeUpdate(n *memberlist.Node) {
+	s.memberLock.Lock()
+	defer s.memberLock.Unlock()
+
+	// Nodes that aren't members are admitted by their join instead
+	member, ok := s.members[n.Name]
+	if !ok || member.Status != StatusAlive {
+		return
+	}
+
+	tags := decodeTags(n.Meta)
+	prev := member.Tags
+	tagsChanged := !reflect.DeepEqual(prev, tags)
+	addrChanged := s.updateAddr(member, n)
+	if !tagsChanged && !addrChanged {
+		return
+	}
+	if tagsChanged {
+		member.tagsTime = time.Now()
+	}
+	member.Role = tags["role"]
+	member.Tags = tags
+
+	// Send an event along
+	s.config.Metrics.IncrCounter([]string{"serf", "member", "update"}, 1)
+	s.logger.Printf("[INFO] serf: EventMemberUpdate: %s", member.Name)
+	if s.config.EventCh != nil {
+		s.config.EventCh <- MemberEvent{
+			Type:     EventMemberUpdate,
+			Members:  []Member{member.Member},
+			PrevTags: map[string]map[string]string{member.Name: prev},
+		}
+	}
+}
+
 // handleNodeLeave is called when a node leave event is received
 // from memberlist.
 func (s *Serf) handleNodeLeave(n *memberlist.Node) {
 	s.memberLock.Lock()
 	defer s.memberLock.Unlock()
 
+	// A suppressed node was never admitted again, so its member is
+	// still left
+	if _, ok := s.suppressed[n.Name]; ok {
+		delete(s.suppressed, n.Name)
+		return
+	}
+
 	member, ok := s.members[n.Name]
 	if !ok {
 		// We've never even heard of this node that is supposedly
@@ -684,10 +1227,13 @@ func (s *Serf) handleNodeLeave(n *memberlist.Node) {
 	case StatusLeaving:
 		member.Status = StatusLeft
 		member.leaveTime = time.Now()
+		member.statusTime = member.leaveTime
 		s.leftMembers = append(s.leftMembers, member)
+		s.recordLeft(member)
 	case StatusAlive:
 		member.Status = StatusFailed
 		member.leaveTime = time.Now()
+		member.statusTime = member.leaveTime
 		s.failedMembers = append(s.failedMembers, member)
 	default:
 		// Unknown state that it was in? Just don't do anything
@@ -698,10 +1244,13 @@ func (s *Serf) handleNodeLeave(n *memberlist.Node) {
 	// Send an event along
 	event := EventMemberLeave
 	eventStr := "EventMemberLeave"
+	metric := "left"
 	if member.Status != StatusLeft {
 		event = EventMemberFailed
 		eventStr = "EventMemberFailed"
+		metric = "failed"
 	}
+	s.config.Metrics.IncrCounter([]string{"serf", "member", metric}, 1)
 
 	s.logger.Printf("[INFO] serf: %s: %s %s",
 		eventStr, member.Member.Name, member.Member.Addr)
@@ -755,16 +1304,19 @@ func (s *Serf) handleNodeLeaveIntent(leaveMsg *messageLeave) bool {
 	case StatusAlive:
 		member.Status = StatusLeaving
 		member.statusLTime = leaveMsg.LTime
+		member.statusTime = time.Now()
 		return true
 	case StatusFailed:
 		member.Status = StatusLeft
 		member.statusLTime = leaveMsg.LTime
+		member.statusTime = time.Now()
 
 		// Remove from the failed list and add to the left list. We add
 		// to the left list so that when we do a sync, other nodes will
 		// remove it from their failed list.
 		s.failedMembers = removeOldMember(s.failedMembers, member.Name)
 		s.leftMembers = append(s.leftMembers, member)
+		s.recordLeft(member)
 
 		return true
 	default:
@@ -791,6 +1343,7 @@ func (s *Serf) handleNodeJoinIntent(joinMsg *messageJoin) bool {
 		// We don't know this member so store it in a buffer for now
 		s.recentJoin[s.recentJoinIndex] = nodeIntent{LTime: joinMsg.LTime, Node: joinMsg.Node}
 		s.recentJoinIndex = (s.recentJoinIndex + 1) % len(s.recentJoin)
+		s.admitSuppressed(joinMsg.Node)
 		return true
 	}
 
@@ -806,13 +1359,24 @@ func (s *Serf) handleNodeJoinIntent(joinMsg *messageJoin) bool {
 	// since the leaving message must have been for an older time
 	if member.Status == StatusLeaving {
 		member.Status = StatusAlive
+		member.statusTime = time.Now()
 	}
+	s.admitSuppressed(joinMsg.Node)
 	return true
 }
 
 // handleUserEvent is called when a user event broadcast is
 // received. Returns if the message should be rebroadcast.
 func (s *Serf) handleUserEvent(eventMsg *messageUserEvent) bool {
+	// Drop corrupt events before the clock witnesses their time
+	if eventMsg.HasCRC && eventChecksum(eventMsg) != eventMsg.CRC {
+		atomic.AddUint64(&s.corruptEvents, 1)
+		s.config.Metrics.IncrCounter([]string{"serf", "events", "corrupt"}, 1)
+		s.logger.Printf("[WARN] serf: dropping user event %s with bad checksum",
+			eventMsg.Name)
+		return false
+	}
+
 	// Witness a potentially newer time
 	s.eventClock.Witness(eventMsg.LTime)
 
@@ -839,7 +1403,13 @@ func (s *Serf) handleUserEvent(eventMsg *messageUserEvent) bool {
 	// Check if we've already seen this
 	idx := eventMsg.LTime % LamportTime(len(s.eventBuffer))
 	seen := s.eventBuffer[idx]
-	userEvent := userEvent{Name: eventMsg.Name, Payload: eventMsg.Payload}
+	userEvent := userEvent{
+		Name:    eventMsg.Name,
+		Payload: eventMsg.Payload,
+		Target:  eventMsg.Target,
+		Origin:  eventMsg.Origin,
+		Version: eventMsg.Version,
+	}
 	if seen != nil && seen.LTime == eventMsg.LTime {
 		for _, previous := range seen.Events {
 			if previous.Equals(&userEvent) {
@@ -853,6 +1423,7 @@ func (s *Serf) handleUserEvent(eventMsg *messageUserEvent) bool {
 
 	// Add to recent events
 	seen.Events = append(seen.Events, userEvent)
+	s.config.Metrics.IncrCounter([]string{"serf", "events"}, 1)
 
 	if s.config.EventCh != nil {
 		s.config.EventCh <- UserEvent{
@@ -860,6 +1431,9 @@ func (s *Serf) handleUserEvent(eventMsg *messageUserEvent) bool {
 			Name:     eventMsg.Name,
 			Payload:  eventMsg.Payload,
 			Coalesce: eventMsg.CC,
+			Version:  eventMsg.Version,
+			Origin:   eventMsg.Origin,
+			Target:   eventMsg.Target,
 		}
 	}
 	return true
@@ -871,8 +1445,9 @@ func (s *Serf) handleReap() {
 		select {
 		case <-time.After(s.config.ReapInterval):
 			s.memberLock.Lock()
-			s.failedMembers = s.reap(s.failedMembers, s.config.ReconnectTimeout)
+			s.failedMembers = s.reapFunc(s.failedMembers, s.reconnectTimeout)
 			s.leftMembers = s.reap(s.leftMembers, s.config.TombstoneTimeout)
+			s.reapLeftNodes()
 			s.memberLock.Unlock()
 		case <-s.shutdownCh:
 			return
@@ -885,7 +1460,7 @@ func (s *Serf) handleReap() {
 func (s *Serf) handleReconnect() {
 	for {
 		select {
-		case <-time.After(s.config.ReconnectInterval):
+		case <-time.After(s.reconnectInterval()):
 			s.reconnect()
 		case <-s.shutdownCh:
 			return
@@ -893,17 +1468,44 @@ func (s *Serf) handleReconnect() {
 	}
 }
 
+// reconnectInterval returns the interval until the next reconnect attempt,
+// which is the SmallClusterReconnectInterval if no more than one other
+// member, failed or not, is known.
+func (s *Serf) reconnectInterval() time.Duration {
+	if s.config.SmallClusterReconnectInterval <= 0 {
+		return s.config.ReconnectInterval
+	}
+
+	s.memberLock.RLock()
+	small := len(s.members)-len(s.leftMembers) <= 2
+	s.memberLock.RUnlock()
+
+	if small {
+		return s.config.SmallClusterReconnectInterval
+	}
+	return s.config.ReconnectInterval
+}
+
 // reap is called with a list of old members and a timeout, and removes
 // members that have exceeded the timeout. The members are removed from
 // both the old list and the members itself. Locking is left to the caller.
 func (s *Serf) reap(old []*memberState, timeout time.Duration) []*memberState {
+	return s.reapFunc(old, func(*memberState) time.Duration {
+		return timeout
+	})
+}
+
+// reapFunc is like reap, but the timeout is determined for each member
+// by the timeout function.
+func (s *Serf) reapFunc(old []*memberState,
+	timeout func(*memberState) time.Duration) []*memberState {
 	now := time.Now()
 	n := len(old)
 	for i := 0; i < n; i++ {
 		m := old[i]
 
 		// Skip if the timeout is not yet reached
-		if now.Sub(m.leaveTime) <= timeout {
+		if now.Sub(m.leaveTime) <= timeout(m) {
 			continue
 		}
 
@@ -920,6 +1522,25 @@ func (s *Serf) reap(old []*memberState, timeout time.Duration) []*memberState {
 	return old
 }
 
+// reconnectTimeout returns how long to attempt to reconnect to a failed
+// member before reaping it. Members in another datacenter, as given by
+// the "dc" tag, use the RemoteReconnectTimeout.
+func (s *Serf) reconnectTimeout(m *memberState) time.Duration {
+	if s.config.RemoteReconnectTimeout > 0 && s.isRemoteDC(m.Tags) {
+		return s.config.RemoteReconnectTimeout
+	}
+	return s.config.ReconnectTimeout
+}
+
+// isRemoteDC checks if the given tags are for a member in a different
+// datacenter than our own. If either side has no "dc" tag, the member
+// is considered local.
+func (s *Serf) isRemoteDC(tags map[string]string) bool {
+	local := s.config.Tags["dc"]
+	remote := tags["dc"]
+	return local != "" && remote != "" && local != remote
+}
+
 // reconnect attempts to reconnect to recently fail nodes.
 func (s *Serf) reconnect() {
 	s.memberLock.RLock()
@@ -942,14 +1563,14 @@ func (s *Serf) reconnect() {
 		numAlive = 1 // guard against zero divide
 	}
 	prob := numFailed / numAlive
-	if rand.Float32() > prob {
+	if s.randFloat32() > prob {
 		s.memberLock.RUnlock()
 		s.logger.Printf("[DEBUG] serf: forgoing reconnect for random throttling")
 		return
 	}
 
 	// Select a random member to try and join
-	idx := int(rand.Uint32() % uint32(n))
+	idx := s.randIntn(n)
 	mem := s.failedMembers[idx]
 	s.memberLock.RUnlock()
 	s.logger.Printf("[INFO] serf: attempting reconnect to %v %v", mem.Name, net.IP(mem.Addr))
@@ -961,6 +1582,40 @@ func (s *Serf) reconnect() {
 	s.memberlist.Join([]string{addr})
 }
 
+// randFloat32 returns a random number in [0.0, 1.0) from the source of
+// the Serf
+func (s *Serf) randFloat32() float32 {
+	s.randLock.Lock()
+	defer s.randLock.Unlock()
+	return s.rand.Float32()
+}
+
+// randIntn returns a random number in [0, n) from the source of the Serf
+func (s *Serf) randIntn(n int) int {
+	s.randLock.Lock()
+	defer s.randLock.Unlock()
+	return s.rand.Intn(n)
+}
+
+// shuffleNodes puts the previously known nodes in a random order from the
+// source of the Serf. They are sorted first, so the order only depends on
+// the source.
+func (s *Serf) shuffleNodes(nodes []*PreviousNode) []*PreviousNode {
+	sort.Sort(previousNodes(nodes))
+	for i := range nodes {
+		j := s.randIntn(i + 1)
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+	return nodes
+}
+
+// previousNodes sorts previous nodes by name
+type previousNodes []*PreviousNode
+
+func (p previousNodes) Len() int           { return len(p) }
+func (p previousNodes) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p previousNodes) Less(i, j int) bool { return p[i].Name < p[j].Name }
+
 // checkQueueDepth periodically checks the size of a queue to see if
 // it is too large
 func (s *Serf) checkQueueDepth(name string, queue *memberlist.TransmitLimitedQueue) {
@@ -968,6 +1623,7 @@ func (s *Serf) checkQueueDepth(name string, queue *memberlist.TransmitLimitedQue
 		select {
 		case <-time.After(time.Second):
 			numq := queue.NumQueued()
+			s.config.Metrics.SetGauge([]string{"serf", "queue", strings.ToLower(name)}, float32(numq))
 			if numq >= s.config.QueueDepthWarning {
 				s.logger.Printf("[WARN] serf: %s queue depth: %d", name, numq)
 			}
@@ -3,7 +3,10 @@ package serf
 import (
 	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/serf/testutil"
+	"math/rand"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestSerf_joinLeave_ltime(t *testing.T) {
@@ -108,6 +111,86 @@ func TestSerf_join_pendingIntents(t *testing.T) {
 	}
 }
 
+func TestSerf_join_suppressedAfterLeave(t *testing.T) {
+	c := testConfig()
+	c.TombstoneTimeout = time.Hour
+	s, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s.Shutdown()
+
+	s.leftNodes["test"] = leftNode{LTime: 5, Time: time.Now()}
+
+	n := memberlist.Node{Name: "test",
+		Addr: nil,
+		Meta: []byte("test"),
+	}
+
+	// Alive again without a newer join
+	s.handleNodeJoin(&n)
+	if _, ok := s.members["test"]; ok {
+		t.Fatalf("should be suppressed")
+	}
+
+	s.handleNodeJoinIntent(&messageJoin{LTime: 6, Node: "test"})
+
+	mem, ok := s.members["test"]
+	if !ok || mem.Status != StatusAlive {
+		t.Fatalf("should be admitted: %#v", mem)
+	}
+	if _, ok := s.leftNodes["test"]; ok {
+		t.Fatalf("should be forgotten")
+	}
+	if len(s.suppressed) != 0 {
+		t.Fatalf("bad: %#v", s.suppressed)
+	}
+}
+
+func TestSerf_join_suppressedLeft(t *testing.T) {
+	c := testConfig()
+	c.TombstoneTimeout = time.Hour
+	s, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s.Shutdown()
+
+	n := memberlist.Node{Name: "test",
+		Addr: nil,
+		Meta: []byte("test"),
+	}
+	s.handleNodeJoin(&n)
+	s.handleNodeLeaveIntent(&messageLeave{LTime: 5, Node: "test"})
+	s.handleNodeLeave(&n)
+
+	if s.members["test"].Status != StatusLeft {
+		t.Fatalf("bad: %#v", s.members["test"])
+	}
+
+	// The leave of memberlist is only followed by an alive
+	s.handleNodeJoin(&n)
+	if s.members["test"].Status != StatusLeft {
+		t.Fatalf("should be suppressed: %#v", s.members["test"])
+	}
+	s.handleNodeLeave(&n)
+	if len(s.suppressed) != 0 {
+		t.Fatalf("bad: %#v", s.suppressed)
+	}
+
+	// An old join doesn't help
+	s.handleNodeJoinIntent(&messageJoin{LTime: 4, Node: "test"})
+	s.handleNodeJoin(&n)
+	if s.members["test"].Status != StatusLeft {
+		t.Fatalf("should be suppressed: %#v", s.members["test"])
+	}
+
+	s.handleNodeJoinIntent(&messageJoin{LTime: 6, Node: "test"})
+	if s.members["test"].Status != StatusAlive {
+		t.Fatalf("should be admitted: %#v", s.members["test"])
+	}
+}
+
 func TestSerf_leaveIntent_bufferEarly(t *testing.T) {
 	c := testConfig()
 	s, err := Create(c)
@@ -367,3 +450,50 @@ func TestSerf_userEvent_sameClock(t *testing.T) {
 		[]string{"first", "first", "second"},
 		[][]byte{[]byte("test"), []byte("newpayload"), []byte("other")})
 }
+
+func TestSerf_userEvent_versions(t *testing.T) {
+	eventCh := make(chan Event, 4)
+	c := testConfig()
+	c.EventCh = eventCh
+	s, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s.Shutdown()
+
+	// The same event with another schema version is a different event
+	msg := messageUserEvent{LTime: 1, Name: "deploy", Payload: []byte("v1")}
+	if !s.handleUserEvent(&msg) {
+		t.Fatalf("should rebroadcast")
+	}
+	msg = messageUserEvent{LTime: 1, Name: "deploy", Payload: []byte("v1"), Version: 2}
+	if !s.handleUserEvent(&msg) {
+		t.Fatalf("should rebroadcast")
+	}
+	if s.handleUserEvent(&msg) {
+		t.Fatalf("should not rebroadcast")
+	}
+
+	if v := s.eventBuffer[1].Events[1].Version; v != 2 {
+		t.Fatalf("bad: %d", v)
+	}
+}
+
+func TestSerf_shuffleNodes(t *testing.T) {
+	nodes := func(names ...string) []*PreviousNode {
+		result := make([]*PreviousNode, len(names))
+		for i, name := range names {
+			result[i] = &PreviousNode{Name: name}
+		}
+		return result
+	}
+
+	// The same seed gives the same order, whatever the input order
+	s1 := &Serf{rand: rand.New(rand.NewSource(1))}
+	s2 := &Serf{rand: rand.New(rand.NewSource(1))}
+	out1 := s1.shuffleNodes(nodes("a", "b", "c", "d", "e"))
+	out2 := s2.shuffleNodes(nodes("e", "d", "c", "b", "a"))
+	if !reflect.DeepEqual(out1, out2) {
+		t.Fatalf("bad: %v %v", out1, out2)
+	}
+}
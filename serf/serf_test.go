@@ -2,9 +2,12 @@ package serf
 
 import (
 	"fmt"
+	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/serf/testutil"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -27,6 +30,7 @@ func testConfig() *Config {
 
 	// Set a short reconnect interval so that it can run a lot during tests
 	config.ReconnectInterval = 100 * time.Millisecond
+	config.SmallClusterReconnectInterval = 100 * time.Millisecond
 
 	// Set basically zero on the reconnect/tombstone timeouts so that
 	// they're removed on the first ReapInterval.
@@ -252,6 +256,164 @@ func TestSerf_eventsUser(t *testing.T) {
 		[][]byte{[]byte("test"), []byte("foobar")})
 }
 
+func TestSerf_eventsUser_version(t *testing.T) {
+	eventCh := make(chan Event, 4)
+	s1Config := testConfig()
+	s2Config := testConfig()
+	s2Config.EventCh = eventCh
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s2.Shutdown()
+
+	testutil.Yield()
+
+	if _, err := s1.Join([]string{s2Config.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if err := s1.UserEventVersion("deploy", []byte("v2"), 2, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	for {
+		select {
+		case e := <-eventCh:
+			ue, ok := e.(UserEvent)
+			if !ok {
+				continue
+			}
+			if ue.Name != "deploy" || ue.Version != 2 {
+				t.Fatalf("bad: %#v", ue)
+			}
+			if ue.Origin != s1Config.NodeName {
+				t.Fatalf("bad origin: %#v", ue)
+			}
+			return
+		default:
+			t.Fatalf("no user event")
+		}
+	}
+}
+
+func TestSerf_eventsUser_node(t *testing.T) {
+	eventCh := make(chan Event, 4)
+	s1Config := testConfig()
+	s2Config := testConfig()
+	s2Config.EventCh = eventCh
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s2.Shutdown()
+
+	testutil.Yield()
+
+	if _, err := s1.Join([]string{s2Config.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if err := s1.UserEventNode("restart", nil, 0, "", false); err == nil {
+		t.Fatalf("should err")
+	}
+	if err := s1.UserEventNode("restart", nil, 0, "web-3", false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	for {
+		select {
+		case e := <-eventCh:
+			ue, ok := e.(UserEvent)
+			if !ok {
+				continue
+			}
+			if ue.Name != "restart" || ue.Target != "web-3" {
+				t.Fatalf("bad: %#v", ue)
+			}
+			return
+		default:
+			t.Fatalf("no user event")
+		}
+	}
+}
+
+func TestSerf_UserEventAsync(t *testing.T) {
+	s1Config := testConfig()
+	s2Config := testConfig()
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	defer s1.Shutdown()
+	defer s2.Shutdown()
+
+	testutil.Yield()
+
+	_, err = s1.Join([]string{s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	f := s1.UserEventAsync("deploy", []byte("test"), false)
+	select {
+	case <-f.Queued():
+	case <-time.After(time.Second):
+		t.Fatal("should be queued")
+	}
+	if err := f.Error(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	select {
+	case <-f.Transmitted():
+	case <-time.After(5 * time.Second):
+		t.Fatal("should be transmitted")
+	}
+
+	// Refused events are resolved right away
+	f = s1.UserEventAsync("big", make([]byte, UserEventSizeLimit+1), false)
+	if err := f.Error(); err == nil {
+		t.Fatal("should error")
+	}
+	select {
+	case <-f.Transmitted():
+	default:
+		t.Fatal("should be closed")
+	}
+}
+
 func TestSerf_eventsUser_sizeLimit(t *testing.T) {
 	// Create the s1 config with an event channel so we can listen
 	s1Config := testConfig()
@@ -461,6 +623,51 @@ func TestSerf_reconnect(t *testing.T) {
 		[]EventType{EventMemberJoin, EventMemberFailed, EventMemberJoin})
 }
 
+func TestSerf_reconnectInterval(t *testing.T) {
+	c := testConfig()
+	c.ReconnectInterval = time.Hour
+	c.SmallClusterReconnectInterval = time.Second
+
+	s, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s.Shutdown()
+
+	// Alone and with a single peer, the cluster is small
+	if d := s.reconnectInterval(); d != time.Second {
+		t.Fatalf("bad: %s", d)
+	}
+
+	s.memberLock.Lock()
+	peer := &memberState{Member: Member{Name: "peer", Status: StatusFailed}}
+	s.members["peer"] = peer
+	s.failedMembers = append(s.failedMembers, peer)
+	s.memberLock.Unlock()
+
+	if d := s.reconnectInterval(); d != time.Second {
+		t.Fatalf("bad: %s", d)
+	}
+
+	s.memberLock.Lock()
+	s.members["other"] = &memberState{Member: Member{Name: "other", Status: StatusAlive}}
+	s.memberLock.Unlock()
+
+	if d := s.reconnectInterval(); d != time.Hour {
+		t.Fatalf("bad: %s", d)
+	}
+
+	// Members that left don't count
+	s.memberLock.Lock()
+	s.members["other"].Status = StatusLeft
+	s.leftMembers = append(s.leftMembers, s.members["other"])
+	s.memberLock.Unlock()
+
+	if d := s.reconnectInterval(); d != time.Second {
+		t.Fatalf("bad: %s", d)
+	}
+}
+
 func TestSerf_role(t *testing.T) {
 	s1Config := testConfig()
 	s2Config := testConfig()
@@ -507,6 +714,505 @@ func TestSerf_role(t *testing.T) {
 	}
 }
 
+func TestSerf_tags(t *testing.T) {
+	s1Config := testConfig()
+	s2Config := testConfig()
+
+	s1Config.Tags = map[string]string{"dc": "east"}
+	s2Config.Role = "lb"
+	s2Config.Tags = map[string]string{"dc": "west"}
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	defer s1.Shutdown()
+	defer s2.Shutdown()
+
+	_, err = s1.Join([]string{s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	members := s1.Members()
+	if len(members) != 2 {
+		t.Fatalf("should have 2 members")
+	}
+
+	for _, m := range members {
+		switch m.Name {
+		case s1Config.NodeName:
+			if m.Tags["dc"] != "east" || m.Role != "" {
+				t.Fatalf("bad tags: %#v", m)
+			}
+		case s2Config.NodeName:
+			if m.Tags["dc"] != "west" || m.Role != "lb" {
+				t.Fatalf("bad tags: %#v", m)
+			}
+		}
+	}
+}
+
+func TestSerf_SetTags(t *testing.T) {
+	eventCh := make(chan Event, 4)
+	s1Config := testConfig()
+	s2Config := testConfig()
+	s2Config.EventCh = eventCh
+
+	s1Config.Tags = map[string]string{"dc": "east"}
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	defer s1.Shutdown()
+	defer s2.Shutdown()
+
+	_, err = s1.Join([]string{s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if err := s1.SetTags(map[string]string{"dc": "west"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	var update *MemberEvent
+	for update == nil {
+		select {
+		case e := <-eventCh:
+			if me, ok := e.(MemberEvent); ok && me.Type == EventMemberUpdate {
+				update = &me
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no member-update event")
+		}
+	}
+
+	if len(update.Members) != 1 || update.Members[0].Name != s1Config.NodeName {
+		t.Fatalf("bad: %#v", update)
+	}
+	if update.Members[0].Tags["dc"] != "west" {
+		t.Fatalf("bad tags: %#v", update.Members[0])
+	}
+	if update.PrevTags[s1Config.NodeName]["dc"] != "east" {
+		t.Fatalf("bad prev tags: %#v", update.PrevTags)
+	}
+
+	for _, m := range s2.Members() {
+		if m.Name == s1Config.NodeName && m.Tags["dc"] != "west" {
+			t.Fatalf("bad tags: %#v", m)
+		}
+	}
+
+	// Tags that don't fit in the meta are refused, and the old ones kept
+	big := map[string]string{"big": strings.Repeat("x", memberlist.MetaMaxSize)}
+	if err := s1.SetTags(big); err == nil {
+		t.Fatalf("should fail")
+	}
+	if s1.localTags()["dc"] != "west" {
+		t.Fatalf("bad tags: %#v", s1.localTags())
+	}
+}
+
+func TestSerf_SetTags_oldProtocol(t *testing.T) {
+	c := testConfig()
+	c.ProtocolVersion = 2
+
+	s, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s.Shutdown()
+
+	if err := s.SetTags(map[string]string{"dc": "east"}); err == nil {
+		t.Fatalf("should fail")
+	}
+	if err := s.SetTags(map[string]string{"role": "web"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestSerf_ExtraBindAddrs(t *testing.T) {
+	s1Config := testConfig()
+	s2Config := testConfig()
+
+	extraAddr := testutil.GetBindAddr().String()
+	s1Config.ExtraBindAddrs = []string{extraAddr}
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	defer s1.Shutdown()
+	defer s2.Shutdown()
+
+	// Join through the extra address, which isn't advertised
+	_, err = s2.Join([]string{extraAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	if len(s1.Members()) != 2 || len(s2.Members()) != 2 {
+		t.Fatalf("should have 2 members")
+	}
+
+	for _, m := range s2.Members() {
+		if m.Name == s1Config.NodeName && m.Addr.String() != s1Config.MemberlistConfig.BindAddr {
+			t.Fatalf("bad addr: %s", m.Addr)
+		}
+	}
+}
+
+func TestCreate_memberlistFails(t *testing.T) {
+	c := testConfig()
+	c.ExtraBindAddrs = []string{testutil.GetBindAddr().String()}
+	c.PushPullRateLimit = 10
+	c.MemberlistConfig.SecretKey = []byte("bad")
+	if _, err := Create(c); err == nil {
+		t.Fatalf("should not allow a bad key")
+	}
+
+	// The transport created for the failed attempt must be closed, or
+	// the addresses can't be bound again
+	c2 := testConfig()
+	c2.NodeName = c.NodeName
+	c2.MemberlistConfig.BindAddr = c.MemberlistConfig.BindAddr
+	c2.ExtraBindAddrs = c.ExtraBindAddrs
+	c2.PushPullRateLimit = 10
+	s, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	s.Shutdown()
+}
+
+func TestCreate_tagsTooLarge(t *testing.T) {
+	c := testConfig()
+	c.Role = "web"
+	c.Tags = map[string]string{"big": strings.Repeat("x", memberlist.MetaMaxSize)}
+	if _, err := Create(c); err == nil {
+		t.Fatalf("should not allow tags over the meta limit")
+	}
+}
+
+func TestCreate_tagsOldProtocol(t *testing.T) {
+	c := testConfig()
+	c.ProtocolVersion = 2
+	c.Tags = map[string]string{"dc": "east"}
+	if _, err := Create(c); err == nil {
+		t.Fatalf("should not allow tags with protocol 2")
+	}
+}
+
+func TestSerf_MemberTimes(t *testing.T) {
+	s1Config := testConfig()
+	s2Config := testConfig()
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s2.Shutdown()
+
+	testutil.Yield()
+
+	_, err = s1.Join([]string{s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testutil.Yield()
+
+	joined := s1.MemberTimes()[s2Config.NodeName]
+	if joined.Status.IsZero() || joined.Tags.IsZero() {
+		t.Fatalf("bad: %#v", joined)
+	}
+
+	if err := s2.Shutdown(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	time.Sleep(s2Config.MemberlistConfig.ProbeInterval * 5)
+
+	failed := s1.MemberTimes()[s2Config.NodeName]
+	if !failed.Status.After(joined.Status) {
+		t.Fatalf("bad: %#v %#v", joined, failed)
+	}
+	if !failed.Tags.Equal(joined.Tags) {
+		t.Fatalf("bad: %#v %#v", joined, failed)
+	}
+}
+
+func TestSerf_UserEventChecksums(t *testing.T) {
+	eventCh := make(chan Event, 4)
+	c := testConfig()
+	c.EventCh = eventCh
+	c.UserEventChecksums = true
+	s1, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s1.Shutdown()
+
+	// Deliver a corrupted event as if it came over the network
+	msg := messageUserEvent{LTime: 1, Name: "deploy", Payload: []byte("v1")}
+	msg.HasCRC = true
+	msg.CRC = eventChecksum(&msg) + 1
+	buf, err := encodeMessage(messageUserEventType, &msg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	d := &delegate{s1}
+	d.NotifyMsg(buf)
+
+	if s1.Stats()["corrupt_events"] != "1" {
+		t.Fatalf("bad: %#v", s1.Stats())
+	}
+
+	// Including one whose target was corrupted
+	msg = messageUserEvent{LTime: 2, Name: "deploy", Payload: []byte("v1"), Target: "web-3"}
+	msg.HasCRC = true
+	msg.CRC = eventChecksum(&msg)
+	msg.Target = "web-4"
+	buf, err = encodeMessage(messageUserEventType, &msg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	d.NotifyMsg(buf)
+
+	if s1.Stats()["corrupt_events"] != "2" {
+		t.Fatalf("bad: %#v", s1.Stats())
+	}
+
+	// Our own events carry a valid checksum
+	if err := s1.UserEvent("deploy", []byte("v2"), false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-eventCh:
+			ue, ok := e.(UserEvent)
+			if !ok {
+				continue
+			}
+			if string(ue.Payload) != "v2" {
+				t.Fatalf("bad: %#v", ue)
+			}
+			if s1.Stats()["corrupt_events"] != "2" {
+				t.Fatalf("bad: %#v", s1.Stats())
+			}
+			return
+
+		case <-timeout:
+			t.Fatalf("no user event")
+		}
+	}
+}
+
+func TestSerf_UserEventVeto(t *testing.T) {
+	c := testConfig()
+	c.UserEventVeto = func(name string, payload []byte) error {
+		if name == "forbidden" {
+			return fmt.Errorf("forbidden")
+		}
+		return nil
+	}
+	s1, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s1.Shutdown()
+
+	ltime := s1.eventClock.Time()
+	if err := s1.UserEvent("forbidden", nil, false); err == nil || err.Error() != "forbidden" {
+		t.Fatalf("err: %v", err)
+	}
+	if s1.eventClock.Time() != ltime {
+		t.Fatalf("rejected event should not advance the clock")
+	}
+
+	if err := s1.UserEvent("deploy", nil, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestSerf_UpgradeCheckVersion(t *testing.T) {
+	c := testConfig()
+	c.ProtocolVersion = 2
+	c.UpgradeCheckVersion = 3
+	s1, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s1.Shutdown()
+
+	testutil.Yield()
+
+	if s1.Stats()["upgrade_blockers"] != "0" {
+		t.Fatalf("bad: %#v", s1.Stats())
+	}
+
+	// Pretend there is an alive member of an older version
+	s1.memberLock.Lock()
+	s1.members["old"] = &memberState{
+		Member: Member{Name: "old", Status: StatusAlive, DelegateMax: 2},
+	}
+	s1.memberLock.Unlock()
+
+	if s1.Stats()["upgrade_blockers"] != "1" {
+		t.Fatalf("bad: %#v", s1.Stats())
+	}
+
+	c = testConfig()
+	c.UpgradeCheckVersion = ProtocolVersionMax + 1
+	if _, err := Create(c); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestSerf_duplicateAddr(t *testing.T) {
+	s1, err := Create(testConfig())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s1.Shutdown()
+
+	testutil.Yield()
+
+	if s1.Stats()["duplicate_addresses"] != "0" {
+		t.Fatalf("bad: %#v", s1.Stats())
+	}
+
+	// Pretend there are two alive members with the same address, and a
+	// failed one that doesn't count
+	s1.memberLock.Lock()
+	addr := net.ParseIP("10.0.0.1")
+	s1.members["clone1"] = &memberState{
+		Member: Member{Name: "clone1", Addr: addr, Port: 7946, Status: StatusAlive},
+	}
+	s1.members["clone2"] = &memberState{
+		Member: Member{Name: "clone2", Addr: addr, Port: 7946, Status: StatusAlive},
+	}
+	s1.members["old"] = &memberState{
+		Member: Member{Name: "old", Addr: addr, Port: 7946, Status: StatusFailed},
+	}
+	other := s1.duplicateAddr(s1.members["clone1"])
+	s1.memberLock.Unlock()
+
+	if other != "clone2" {
+		t.Fatalf("bad: %s", other)
+	}
+	if s1.Stats()["duplicate_addresses"] != "2" {
+		t.Fatalf("bad: %#v", s1.Stats())
+	}
+}
+
+func TestSerf_AddrHistory(t *testing.T) {
+	s1, err := Create(testConfig())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s1.Shutdown()
+
+	// Pretend a member keeps getting new addresses, as with DHCP churn
+	for i := 1; i <= maxAddrHistory+2; i++ {
+		s1.handleNodeJoin(&memberlist.Node{
+			Name: "web",
+			Addr: net.IPv4(10, 0, 0, byte(i)),
+			Port: 7946,
+		})
+	}
+	s1.handleNodeJoin(&memberlist.Node{
+		Name: "web",
+		Addr: net.IPv4(10, 0, 0, byte(maxAddrHistory+2)),
+		Port: 7946,
+	})
+
+	history := s1.AddrHistory()["web"]
+	if len(history) != maxAddrHistory {
+		t.Fatalf("bad: %#v", history)
+	}
+	if !history[0].Addr.Equal(net.IPv4(10, 0, 0, 2)) || history[0].Until.IsZero() {
+		t.Fatalf("bad: %#v", history[0])
+	}
+	last := history[len(history)-1]
+	if !last.Addr.Equal(net.IPv4(10, 0, 0, byte(maxAddrHistory+1))) {
+		t.Fatalf("bad: %#v", last)
+	}
+
+	if _, ok := s1.AddrHistory()[s1.config.NodeName]; ok {
+		t.Fatal("should have no history")
+	}
+}
+
+func TestSerf_Stats(t *testing.T) {
+	s1Config := testConfig()
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s1.Shutdown()
+
+	testutil.Yield()
+
+	stats := s1.Stats()
+	expected := map[string]string{
+		"members":      "1",
+		"failed":       "0",
+		"left":         "0",
+		"intent_queue": "0",
+		"event_queue":  "0",
+
+		"push_pulls":         "0",
+		"corrupt_events":     "0",
+		"push_pull_interval": s1Config.MemberlistConfig.PushPullInterval.String(),
+	}
+	for k, v := range expected {
+		if stats[k] != v {
+			t.Fatalf("bad %s: %#v", k, stats)
+		}
+	}
+
+	if stats["member_time"] == "" || stats["event_time"] == "" {
+		t.Fatalf("missing clocks: %#v", stats)
+	}
+}
+
 func TestSerfProtocolVersion(t *testing.T) {
 	config := testConfig()
 	config.ProtocolVersion = ProtocolVersionMax
@@ -648,9 +1354,9 @@ func TestSerf_ReapHandler(t *testing.T) {
 
 	m := Member{}
 	s.leftMembers = []*memberState{
-		&memberState{m, 0, time.Now()},
-		&memberState{m, 0, time.Now().Add(-5 * time.Second)},
-		&memberState{m, 0, time.Now().Add(-10 * time.Second)},
+		&memberState{Member: m, leaveTime: time.Now()},
+		&memberState{Member: m, leaveTime: time.Now().Add(-5 * time.Second)},
+		&memberState{Member: m, leaveTime: time.Now().Add(-10 * time.Second)},
 	}
 
 	go func() {
@@ -674,9 +1380,9 @@ func TestSerf_Reap(t *testing.T) {
 
 	m := Member{}
 	old := []*memberState{
-		&memberState{m, 0, time.Now()},
-		&memberState{m, 0, time.Now().Add(-5 * time.Second)},
-		&memberState{m, 0, time.Now().Add(-10 * time.Second)},
+		&memberState{Member: m, leaveTime: time.Now()},
+		&memberState{Member: m, leaveTime: time.Now().Add(-5 * time.Second)},
+		&memberState{Member: m, leaveTime: time.Now().Add(-10 * time.Second)},
 	}
 
 	old = s.reap(old, time.Second*6)
@@ -685,6 +1391,39 @@ func TestSerf_Reap(t *testing.T) {
 	}
 }
 
+func TestSerf_reconnectTimeout(t *testing.T) {
+	c := testConfig()
+	c.Tags = map[string]string{"dc": "east"}
+	c.ReconnectTimeout = time.Second
+	c.RemoteReconnectTimeout = time.Minute
+	s, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s.Shutdown()
+
+	local := &memberState{Member: Member{Tags: map[string]string{"dc": "east"}}}
+	remote := &memberState{Member: Member{Tags: map[string]string{"dc": "west"}}}
+	unknown := &memberState{Member: Member{}}
+
+	if s.reconnectTimeout(local) != time.Second {
+		t.Fatalf("bad: %v", s.reconnectTimeout(local))
+	}
+	if s.reconnectTimeout(remote) != time.Minute {
+		t.Fatalf("bad: %v", s.reconnectTimeout(remote))
+	}
+	if s.reconnectTimeout(unknown) != time.Second {
+		t.Fatalf("bad: %v", s.reconnectTimeout(unknown))
+	}
+
+	remote.leaveTime = time.Now().Add(-10 * time.Second)
+	local.leaveTime = time.Now().Add(-10 * time.Second)
+	old := s.reapFunc([]*memberState{local, remote}, s.reconnectTimeout)
+	if len(old) != 1 || old[0] != remote {
+		t.Fatalf("bad: %#v", old)
+	}
+}
+
 func TestRemoveOldMember(t *testing.T) {
 	old := []*memberState{
 		&memberState{Member: Member{Name: "foo"}},
@@ -1035,3 +1774,65 @@ func TestSerf_Leave_SnapshotRecovery(t *testing.T) {
 		t.Fatalf("bad members: %#v", s2.Members())
 	}
 }
+
+func TestSerf_SnapshotIdentity(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	s1Config := testConfig()
+	s1Config.SnapshotPath = filepath.Join(td, "snap")
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s1.Shutdown(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A node with another name must not take the snapshot over
+	s1Config.NodeName = "clone"
+	_, err = Create(s1Config)
+	if err == nil || !strings.Contains(err.Error(), "was written by node") {
+		t.Fatalf("should err: %v", err)
+	}
+
+	// Unless forced, after which the snapshot is its own
+	s1Config.ForceSnapshotIdentity = true
+	s1, err = Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s1.Shutdown(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	s1Config.ForceSnapshotIdentity = false
+	s1, err = Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s1.Shutdown(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Another port on the same address is still the same node
+	s1Config.MemberlistConfig.BindPort++
+	s1, err = Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s1.Shutdown(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// But another address is not
+	s1Config.MemberlistConfig.BindAddr = testutil.GetBindAddr().String()
+	_, err = Create(s1Config)
+	if err == nil || !strings.Contains(err.Error(), "was written by node") {
+		t.Fatalf("should err: %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package serf
 import (
 	"bufio"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
@@ -20,12 +21,37 @@ as the latest clock values to the file during normal operation,
 and periodically checkpoint and roll over the file. During a restore,
 we can replay the various member events to recall a list of known
 nodes to re-join, as well as restore our clock values to avoid replaying
-old events.
+old events. The members that left gracefully are recorded as well,
+so that they are not admitted again after a restart unless they join
+again, see leftNode.
+
+The first line of the snapshot is a version header, such as "version: 1".
+Snapshots without one were written before the format was versioned, and
+are rewritten with the header when they are first opened. A snapshot
+with a newer version than snapshotVersion is refused rather than being
+rewritten, since that would silently discard the state this version
+doesn't understand.
+
+The snapshot also records the identity of the node that writes it, which
+is its name and advertised address, such as "identity: web-1 10.0.0.1:7946".
+Serf refuses to start with a snapshot written by another identity unless
+forced, see Config.ForceSnapshotIdentity, so that a VM cloned with its
+snapshot doesn't rejoin the cluster as its source node.
 */
 
 const fsyncInterval = 100 * time.Millisecond
 const clockUpdateInterval = 500 * time.Millisecond
 const tmpExt = ".compact"
+const lockExt = ".lock"
+
+// defaultLeftTimeout is how long NewSnapshotter keeps the left nodes,
+// which is the default TombstoneTimeout
+const defaultLeftTimeout = 24 * time.Hour
+
+// snapshotVersion is the version of the snapshot format that is written.
+// Increase it whenever the format changes in a way that older versions
+// of Serf can't read, and add a migration to replay.
+const snapshotVersion = 1
 
 // Snapshotter is responsible for ingesting events and persisting
 // them to disk, and providing a recovery mechanism at start time.
@@ -33,21 +59,41 @@ type Snapshotter struct {
 	aliveNodes     map[string]string
 	clock          *LamportClock
 	fh             *os.File
+	identity       snapshotIdentity
+	identityCh     chan snapshotIdentity
 	inCh           <-chan Event
 	lastFsync      time.Time
 	lastClock      LamportTime
 	lastEventClock LamportTime
 	leaveCh        chan struct{}
 	leaving        bool
+	leftNodes      map[string]leftNode
+	leftTimeout    time.Duration
+	lock           *os.File
 	logger         *log.Logger
 	maxSize        int64
 	path           string
 	offset         int64
 	outCh          chan<- Event
+	saveCh         chan chan snapshotSave
 	shutdownCh     <-chan struct{}
+	version        int
 	waitCh         chan struct{}
 }
 
+// snapshotSave is the result of a save requested with Save
+type snapshotSave struct {
+	size int64
+	err  error
+}
+
+// snapshotIdentity is the node name and address of the node that writes
+// the snapshot
+type snapshotIdentity struct {
+	name string
+	addr string
+}
+
 // PreviousNode is used to represent the previously known alive nodes
 type PreviousNode struct {
 	Name string
@@ -64,11 +110,26 @@ func (p PreviousNode) String() string {
 // passing through to an output channel, and persisting relevant events to disk.
 func NewSnapshotter(path string, maxSize int, logger *log.Logger, clock *LamportClock,
 	outCh chan<- Event, shutdownCh <-chan struct{}) (chan<- Event, *Snapshotter, error) {
+	return newSnapshotter(path, maxSize, defaultLeftTimeout, logger, clock, outCh, shutdownCh)
+}
+
+// newSnapshotter is NewSnapshotter, keeping the left nodes for the
+// given time, which is the TombstoneTimeout of Serf
+func newSnapshotter(path string, maxSize int, leftTimeout time.Duration, logger *log.Logger,
+	clock *LamportClock, outCh chan<- Event, shutdownCh <-chan struct{}) (chan<- Event, *Snapshotter, error) {
 	inCh := make(chan Event, 1024)
 
+	// Make sure no other agent uses the same snapshot, since both would
+	// append to it and compact it under each other
+	lock, err := lockSnapshot(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Try to open the file
 	fh, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
 	if err != nil {
+		lock.Close()
 		return nil, nil, fmt.Errorf("failed to open snapshot: %v", err)
 	}
 
@@ -76,6 +137,7 @@ func NewSnapshotter(path string, maxSize int, logger *log.Logger, clock *Lamport
 	info, err := fh.Stat()
 	if err != nil {
 		fh.Close()
+		lock.Close()
 		return nil, nil, fmt.Errorf("failed to stat snapshot: %v", err)
 	}
 	offset := info.Size()
@@ -85,15 +147,20 @@ func NewSnapshotter(path string, maxSize int, logger *log.Logger, clock *Lamport
 		aliveNodes:     make(map[string]string),
 		clock:          clock,
 		fh:             fh,
+		identityCh:     make(chan snapshotIdentity, 1),
 		inCh:           inCh,
 		lastClock:      0,
 		lastEventClock: 0,
 		leaveCh:        make(chan struct{}),
+		leftNodes:      make(map[string]leftNode),
+		leftTimeout:    leftTimeout,
+		lock:           lock,
 		logger:         logger,
 		maxSize:        int64(maxSize),
 		path:           path,
 		offset:         offset,
 		outCh:          outCh,
+		saveCh:         make(chan chan snapshotSave),
 		shutdownCh:     shutdownCh,
 		waitCh:         make(chan struct{}),
 	}
@@ -101,9 +168,24 @@ func NewSnapshotter(path string, maxSize int, logger *log.Logger, clock *Lamport
 	// Recover the last known state
 	if err := snap.replay(); err != nil {
 		fh.Close()
+		lock.Close()
 		return nil, nil, err
 	}
 
+	// Rewrite older snapshots in the current format, this also writes
+	// the header of new snapshots
+	if snap.version < snapshotVersion {
+		if snap.offset > 0 {
+			logger.Printf("[INFO] serf: Upgrading snapshot from version %d to %d",
+				snap.version, snapshotVersion)
+		}
+		if err := snap.compact(); err != nil {
+			snap.fh.Close()
+			lock.Close()
+			return nil, nil, fmt.Errorf("failed to upgrade snapshot: %v", err)
+		}
+	}
+
 	// Start handling new commands
 	go snap.stream()
 	return inCh, snap, nil
@@ -135,6 +217,34 @@ func (s *Snapshotter) AliveNodes() []*PreviousNode {
 	return previous
 }
 
+// recentlyLeft returns the members that left gracefully, recently
+// enough that they are still remembered. Like AliveNodes, it is used by
+// Serf before it streams any events to the snapshotter.
+func (s *Snapshotter) recentlyLeft() map[string]leftNode {
+	left := make(map[string]leftNode, len(s.leftNodes))
+	for name, node := range s.leftNodes {
+		left[name] = node
+	}
+	return left
+}
+
+// lastIdentity returns the node name and address that the snapshot was
+// last written by, which are empty for snapshots written before they were
+// recorded. Like recentlyLeft, it is used by Serf before setIdentity.
+func (s *Snapshotter) lastIdentity() (string, string) {
+	return s.identity.name, s.identity.addr
+}
+
+// setIdentity records the node name and address of the local node. It
+// doesn't wait for the snapshot, which may be blocked on forwarding the
+// join of the local node until Serf is created.
+func (s *Snapshotter) setIdentity(name, addr string) {
+	select {
+	case s.identityCh <- snapshotIdentity{name, addr}:
+	case <-s.shutdownCh:
+	}
+}
+
 // Wait is used to wait until the snapshotter finishes shut down
 func (s *Snapshotter) Wait() {
 	<-s.waitCh
@@ -149,6 +259,44 @@ func (s *Snapshotter) Leave() {
 	}
 }
 
+// Save compacts the snapshot right away and syncs it to disk, such as
+// before a planned reboot or a backup, and returns its new size.
+func (s *Snapshotter) Save() (int64, error) {
+	respCh := make(chan snapshotSave, 1)
+	select {
+	case s.saveCh <- respCh:
+	case <-s.shutdownCh:
+		return 0, fmt.Errorf("snapshot is shut down")
+	}
+	resp := <-respCh
+	return resp.size, resp.err
+}
+
+// Path returns the path of the snapshot
+func (s *Snapshotter) Path() string {
+	return s.path
+}
+
+// lockSnapshot locks the snapshot at the given path for this process,
+// and records the process ID in the lock file for the error message of
+// other processes.
+func lockSnapshot(path string) (*os.File, error) {
+	lockPath := path + lockExt
+	lock, err := lockFile(lockPath)
+	if err != nil {
+		msg := fmt.Sprintf("snapshot %s is in use by another process", path)
+		if pid, _ := ioutil.ReadFile(lockPath); len(pid) > 0 {
+			msg += fmt.Sprintf(" (pid %s)", strings.TrimSpace(string(pid)))
+		}
+		return nil, fmt.Errorf("%s: %v", msg, err)
+	}
+
+	if err := lock.Truncate(0); err == nil {
+		fmt.Fprintf(lock, "%d\n", os.Getpid())
+	}
+	return lock, nil
+}
+
 // stream is a long running routine that is used to handle events
 func (s *Snapshotter) stream() {
 	for {
@@ -156,45 +304,96 @@ func (s *Snapshotter) stream() {
 		case <-s.leaveCh:
 			// Clear the known nodes
 			s.aliveNodes = make(map[string]string)
+			s.leftNodes = make(map[string]leftNode)
 			s.leaving = true
 			s.tryAppend("leave\n")
 			if err := s.fh.Sync(); err != nil {
 				s.logger.Printf("[ERR] serf: failed to sync leave to snapshot: %v", err)
 			}
 
-		case e := <-s.inCh:
-			// Forward the event immediately
-			if s.outCh != nil {
-				s.outCh <- e
+		case id := <-s.identityCh:
+			if id != s.identity && !s.leaving {
+				s.identity = id
+				s.tryAppend(formatIdentity(id))
 			}
 
-			// Stop recording events after a leave is issued
-			if s.leaving {
-				continue
-			}
-			switch typed := e.(type) {
-			case MemberEvent:
-				s.processMemberEvent(typed)
-			case UserEvent:
-				s.processUserEvent(typed)
-			default:
-				s.logger.Printf("[ERR] serf: Unknown event to snapshot: %#v", e)
-			}
+		case respCh := <-s.saveCh:
+			size, err := s.save()
+			respCh <- snapshotSave{size, err}
+
+		case e := <-s.inCh:
+			s.processEvent(e)
 
 		case <-time.After(clockUpdateInterval):
 			s.updateClock()
 
 		case <-s.shutdownCh:
+			// Save the latest clock, so that a restart, such as by a
+			// handoff, continues from it
+			if !s.leaving {
+				s.updateClock()
+			}
 			if err := s.fh.Sync(); err != nil {
 				s.logger.Printf("[ERR] serf: failed to sync snapshot: %v", err)
 			}
 			s.fh.Close()
+			s.lock.Close()
 			close(s.waitCh)
 			return
 		}
 	}
 }
 
+// processEvent is used to forward and record a single event
+func (s *Snapshotter) processEvent(e Event) {
+	// Forward the event immediately
+	if s.outCh != nil {
+		s.outCh <- e
+	}
+
+	// Stop recording events after a leave is issued
+	if s.leaving {
+		return
+	}
+	switch typed := e.(type) {
+	case MemberEvent:
+		s.processMemberEvent(typed)
+	case UserEvent:
+		s.processUserEvent(typed)
+	default:
+		s.logger.Printf("[ERR] serf: Unknown event to snapshot: %#v", e)
+	}
+}
+
+// save is used to handle a Save
+func (s *Snapshotter) save() (int64, error) {
+	// Compacting after a leave would drop the leave, and the next start
+	// would rejoin the cluster
+	if s.leaving {
+		return 0, fmt.Errorf("snapshot is not updated after a leave")
+	}
+
+	// Record the events that are already queued, so that the snapshot
+	// includes everything that happened before the save
+	for pending := true; pending; {
+		select {
+		case e := <-s.inCh:
+			s.processEvent(e)
+		default:
+			pending = false
+		}
+	}
+
+	s.updateClock()
+	if err := s.compact(); err != nil {
+		return 0, err
+	}
+	if err := s.fh.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync snapshot: %v", err)
+	}
+	return s.offset, nil
+}
+
 // processMemberEvent is used to handle a single member event
 func (s *Snapshotter) processMemberEvent(e MemberEvent) {
 	switch e.Type {
@@ -202,11 +401,32 @@ func (s *Snapshotter) processMemberEvent(e MemberEvent) {
 		for _, mem := range e.Members {
 			addr := net.TCPAddr{IP: mem.Addr, Port: int(mem.Port)}
 			s.aliveNodes[mem.Name] = addr.String()
+			delete(s.leftNodes, mem.Name)
 			s.tryAppend(fmt.Sprintf("alive: %s %s\n", mem.Name, addr.String()))
 		}
 
+	case EventMemberUpdate:
+		// Only the address matters to the snapshot
+		for _, mem := range e.Members {
+			addr := net.TCPAddr{IP: mem.Addr, Port: int(mem.Port)}
+			if prev, ok := s.aliveNodes[mem.Name]; ok && prev != addr.String() {
+				s.aliveNodes[mem.Name] = addr.String()
+				s.tryAppend(fmt.Sprintf("alive: %s %s\n", mem.Name, addr.String()))
+			}
+		}
+
 	case EventMemberLeave:
-		fallthrough
+		// The event doesn't carry the Lamport time of the leave, but the
+		// clock is past it already, which is as good to compare joins to
+		now := time.Now()
+		for _, mem := range e.Members {
+			delete(s.aliveNodes, mem.Name)
+			left := leftNode{LTime: s.clock.Time(), Time: now}
+			s.leftNodes[mem.Name] = left
+			s.tryAppend(fmt.Sprintf("not-alive: %s\n", mem.Name))
+			s.tryAppend(formatLeftNode(mem.Name, left))
+		}
+
 	case EventMemberFailed:
 		for _, mem := range e.Members {
 			delete(s.aliveNodes, mem.Name)
@@ -220,6 +440,9 @@ func (s *Snapshotter) processMemberEvent(e MemberEvent) {
 // clock value. This is done after member events but should also be done
 // periodically due to race conditions with join and leave intents
 func (s *Snapshotter) updateClock() {
+	if s.clock.Time() == 0 {
+		return
+	}
 	lastSeen := s.clock.Time() - 1
 	if lastSeen > s.lastClock {
 		s.lastClock = lastSeen
@@ -277,8 +500,26 @@ func (s *Snapshotter) compact() error {
 		return fmt.Errorf("failed to open new snapshot: %v", err)
 	}
 
+	// Write out the header
+	line := fmt.Sprintf("version: %d\n", snapshotVersion)
+	n, err := fh.WriteString(line)
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	offset := int64(n)
+
+	// Write out the identity, if it is known yet
+	if s.identity.name != "" {
+		n, err := fh.WriteString(formatIdentity(s.identity))
+		if err != nil {
+			fh.Close()
+			return err
+		}
+		offset += int64(n)
+	}
+
 	// Write out the live nodes
-	var offset int64
 	for name, addr := range s.aliveNodes {
 		line := fmt.Sprintf("alive: %s %s\n", name, addr)
 		n, err := fh.WriteString(line)
@@ -289,9 +530,24 @@ func (s *Snapshotter) compact() error {
 		offset += int64(n)
 	}
 
+	// Write out the left nodes that are still remembered
+	now := time.Now()
+	for name, left := range s.leftNodes {
+		if now.Sub(left.Time) > s.leftTimeout {
+			delete(s.leftNodes, name)
+			continue
+		}
+		n, err := fh.WriteString(formatLeftNode(name, left))
+		if err != nil {
+			fh.Close()
+			return err
+		}
+		offset += int64(n)
+	}
+
 	// Write out the clocks
-	line := fmt.Sprintf("clock: %d\n", s.lastClock)
-	n, err := fh.WriteString(line)
+	line = fmt.Sprintf("clock: %d\n", s.lastClock)
+	n, err = fh.WriteString(line)
 	if err != nil {
 		fh.Close()
 		return err
@@ -316,6 +572,7 @@ func (s *Snapshotter) compact() error {
 	s.fh.Close()
 	s.fh = fh
 	s.offset = offset
+	s.version = snapshotVersion
 	s.lastFsync = time.Now()
 	return nil
 }
@@ -341,7 +598,28 @@ func (s *Snapshotter) replay() error {
 		line = line[:len(line)-1]
 
 		// Switch on the prefix
-		if strings.HasPrefix(line, "alive: ") {
+		if strings.HasPrefix(line, "version: ") {
+			versionStr := strings.TrimPrefix(line, "version: ")
+			version, err := strconv.Atoi(versionStr)
+			if err != nil {
+				return fmt.Errorf("failed to parse snapshot version: %v", err)
+			}
+			if version > snapshotVersion {
+				return fmt.Errorf("snapshot version %d is newer than the supported version %d, "+
+					"move the snapshot away to start without it", version, snapshotVersion)
+			}
+			s.version = version
+
+		} else if strings.HasPrefix(line, "identity: ") {
+			info := strings.TrimPrefix(line, "identity: ")
+			addrIdx := strings.LastIndex(info, " ")
+			if addrIdx == -1 {
+				s.logger.Printf("[WARN] serf: Failed to parse identity: %v", line)
+				continue
+			}
+			s.identity = snapshotIdentity{name: info[:addrIdx], addr: info[addrIdx+1:]}
+
+		} else if strings.HasPrefix(line, "alive: ") {
 			info := strings.TrimPrefix(line, "alive: ")
 			addrIdx := strings.LastIndex(info, " ")
 			if addrIdx == -1 {
@@ -351,11 +629,22 @@ func (s *Snapshotter) replay() error {
 			addr := info[addrIdx+1:]
 			name := info[:addrIdx]
 			s.aliveNodes[name] = addr
+			delete(s.leftNodes, name)
 
 		} else if strings.HasPrefix(line, "not-alive: ") {
 			name := strings.TrimPrefix(line, "not-alive: ")
 			delete(s.aliveNodes, name)
 
+		} else if strings.HasPrefix(line, "left: ") {
+			name, left, err := parseLeftNode(strings.TrimPrefix(line, "left: "))
+			if err != nil {
+				s.logger.Printf("[WARN] serf: Failed to parse left node: %v", line)
+				continue
+			}
+			if time.Since(left.Time) <= s.leftTimeout {
+				s.leftNodes[name] = left
+			}
+
 		} else if strings.HasPrefix(line, "clock: ") {
 			timeStr := strings.TrimPrefix(line, "clock: ")
 			timeInt, err := strconv.ParseUint(timeStr, 10, 64)
@@ -376,6 +665,7 @@ func (s *Snapshotter) replay() error {
 
 		} else if line == "leave" {
 			s.aliveNodes = make(map[string]string)
+			s.leftNodes = make(map[string]leftNode)
 			s.lastClock = 0
 			s.lastEventClock = 0
 
@@ -393,3 +683,41 @@ func (s *Snapshotter) replay() error {
 	}
 	return nil
 }
+
+// formatIdentity returns the snapshot line of the identity of the node
+func formatIdentity(id snapshotIdentity) string {
+	return fmt.Sprintf("identity: %s %s\n", id.name, id.addr)
+}
+
+// formatLeftNode returns the snapshot line of a left node, which is its
+// name followed by the Lamport time and the Unix time of the leave.
+func formatLeftNode(name string, left leftNode) string {
+	return fmt.Sprintf("left: %s %d %d\n", name, left.LTime, left.Time.Unix())
+}
+
+// parseLeftNode parses a left node line without its prefix. Names may
+// contain spaces, so the times are taken from the end.
+func parseLeftNode(info string) (string, leftNode, error) {
+	var left leftNode
+	unixIdx := strings.LastIndex(info, " ")
+	if unixIdx == -1 {
+		return "", left, fmt.Errorf("missing times")
+	}
+	ltimeIdx := strings.LastIndex(info[:unixIdx], " ")
+	if ltimeIdx == -1 {
+		return "", left, fmt.Errorf("missing times")
+	}
+
+	ltime, err := strconv.ParseUint(info[ltimeIdx+1:unixIdx], 10, 64)
+	if err != nil {
+		return "", left, err
+	}
+	unix, err := strconv.ParseInt(info[unixIdx+1:], 10, 64)
+	if err != nil {
+		return "", left, err
+	}
+
+	left.LTime = LamportTime(ltime)
+	left.Time = time.Unix(unix, 0)
+	return info[:ltimeIdx], left, nil
+}
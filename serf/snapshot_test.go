@@ -4,7 +4,9 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -245,3 +247,330 @@ func TestSnapshoter_leave(t *testing.T) {
 		t.Fatalf("expected none alive: %#v", prev)
 	}
 }
+
+func TestSnapshoter_save(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	clock := new(LamportClock)
+	stopCh := make(chan struct{})
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	inCh, snap, err := NewSnapshotter(td+"snap", snapshotSizeLimit,
+		logger, clock, nil, stopCh)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Wait()
+	defer close(stopCh)
+
+	// Join, fail and rejoin a member, the save only keeps the last state
+	clock.Witness(100)
+	for _, typ := range []EventType{EventMemberJoin, EventMemberFailed, EventMemberJoin} {
+		inCh <- MemberEvent{
+			Type: typ,
+			Members: []Member{
+				Member{
+					Name: "foo",
+					Addr: []byte{127, 0, 0, 1},
+					Port: 5000,
+				},
+			},
+		}
+	}
+
+	size, err := snap.Save()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if snap.Path() != td+"snap" {
+		t.Fatalf("bad path: %s", snap.Path())
+	}
+
+	raw, err := ioutil.ReadFile(td + "snap")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if int64(len(raw)) != size {
+		t.Fatalf("bad size: %d %d", len(raw), size)
+	}
+	expected := "version: 1\nalive: foo 127.0.0.1:5000\nclock: 100\nevent-clock: 0\n"
+	if string(raw) != expected {
+		t.Fatalf("bad: %q", raw)
+	}
+
+	// Saving after a leave would lose the leave
+	snap.Leave()
+	if _, err := snap.Save(); err == nil {
+		t.Fatalf("should err")
+	}
+}
+
+func TestSnapshoter_leftNodes(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	clock := new(LamportClock)
+	outCh := make(chan Event, 64)
+	stopCh := make(chan struct{})
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	inCh, snap, err := NewSnapshotter(td+"snap", snapshotSizeLimit,
+		logger, clock, outCh, stopCh)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Two members leave, one of them joins again and one fails
+	clock.Witness(100)
+	foo := Member{Name: "foo bar", Addr: []byte{127, 0, 0, 1}, Port: 5000}
+	baz := Member{Name: "baz", Addr: []byte{127, 0, 0, 2}, Port: 5000}
+	zip := Member{Name: "zip", Addr: []byte{127, 0, 0, 3}, Port: 5000}
+	inCh <- MemberEvent{Type: EventMemberLeave, Members: []Member{foo, baz}}
+	inCh <- MemberEvent{Type: EventMemberJoin, Members: []Member{baz}}
+	inCh <- MemberEvent{Type: EventMemberFailed, Members: []Member{zip}}
+
+	// Wait for the events to be recorded
+	for i := 0; i < 3; i++ {
+		select {
+		case <-outCh:
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("timeout")
+		}
+	}
+
+	// Close the snapshoter
+	close(stopCh)
+	snap.Wait()
+
+	// Open the snapshoter
+	stopCh = make(chan struct{})
+	_, snap, err = NewSnapshotter(td+"snap", snapshotSizeLimit,
+		logger, clock, nil, stopCh)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	left := snap.recentlyLeft()
+	if len(left) != 1 {
+		t.Fatalf("bad: %#v", left)
+	}
+	if left["foo bar"].LTime != 101 {
+		t.Fatalf("bad: %#v", left)
+	}
+
+	// Left nodes are kept through a compaction
+	if err := snap.compact(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	close(stopCh)
+	snap.Wait()
+
+	stopCh = make(chan struct{})
+	_, snap, err = NewSnapshotter(td+"snap", snapshotSizeLimit,
+		logger, clock, nil, stopCh)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if left := snap.recentlyLeft(); left["foo bar"].LTime != 101 {
+		t.Fatalf("bad: %#v", left)
+	}
+	close(stopCh)
+	snap.Wait()
+
+	// Left nodes are forgotten after the timeout
+	stopCh = make(chan struct{})
+	defer close(stopCh)
+	_, snap, err = newSnapshotter(td+"snap", snapshotSizeLimit, time.Nanosecond,
+		logger, clock, nil, stopCh)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if left := snap.recentlyLeft(); len(left) != 0 {
+		t.Fatalf("bad: %#v", left)
+	}
+}
+
+func TestSnapshoter_version(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	// A snapshot from before the format was versioned
+	path := td + "snap"
+	old := "alive: foo 127.0.0.1:5000\nclock: 10\nevent-clock: 5\n"
+	if err := ioutil.WriteFile(path, []byte(old), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	clock := new(LamportClock)
+	stopCh := make(chan struct{})
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	_, snap, err := NewSnapshotter(path, snapshotSizeLimit,
+		logger, clock, nil, stopCh)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	close(stopCh)
+	snap.Wait()
+
+	if snap.LastClock() != 10 || snap.LastEventClock() != 5 {
+		t.Fatalf("bad clocks: %d %d", snap.LastClock(), snap.LastEventClock())
+	}
+	if len(snap.AliveNodes()) != 1 {
+		t.Fatalf("bad: %v", snap.AliveNodes())
+	}
+
+	// The snapshot is upgraded in place
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := "version: 1\nalive: foo 127.0.0.1:5000\nclock: 10\nevent-clock: 5\n"
+	if string(raw) != expected {
+		t.Fatalf("bad: %q", raw)
+	}
+
+	// Snapshots of newer versions are refused and left alone
+	newer := "version: 99\nclock: 10\n"
+	if err := ioutil.WriteFile(path, []byte(newer), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stopCh = make(chan struct{})
+	defer close(stopCh)
+	if _, _, err := NewSnapshotter(path, snapshotSizeLimit,
+		logger, clock, nil, stopCh); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	raw, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(raw) != newer {
+		t.Fatalf("bad: %q", raw)
+	}
+}
+
+func TestSnapshoter_lock(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	clock := new(LamportClock)
+	stopCh := make(chan struct{})
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	_, snap, err := NewSnapshotter(td+"/snap", snapshotSizeLimit,
+		logger, clock, nil, stopCh)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A second snapshotter of the same file fails right away
+	_, _, err = NewSnapshotter(td+"/snap", snapshotSizeLimit,
+		logger, clock, nil, make(chan struct{}))
+	if err == nil || !strings.Contains(err.Error(), "in use by another process") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Once the first is shut down, the snapshot can be used again
+	close(stopCh)
+	snap.Wait()
+
+	stopCh = make(chan struct{})
+	defer close(stopCh)
+	_, _, err = NewSnapshotter(td+"/snap", snapshotSizeLimit,
+		logger, clock, nil, stopCh)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSnapshoter_identity(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	path := filepath.Join(td, "snap")
+	clock := new(LamportClock)
+	stopCh := make(chan struct{})
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	_, snap, err := NewSnapshotter(path, snapshotSizeLimit,
+		logger, clock, nil, stopCh)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// New snapshots have no identity yet
+	if name, addr := snap.lastIdentity(); name != "" || addr != "" {
+		t.Fatalf("bad identity: %s %s", name, addr)
+	}
+	snap.setIdentity("foo bar", "127.0.0.1:5000")
+
+	// The identity is kept by compactions
+	if _, err := snap.Save(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	close(stopCh)
+	snap.Wait()
+
+	stopCh = make(chan struct{})
+	_, snap, err = NewSnapshotter(path, snapshotSizeLimit,
+		logger, clock, nil, stopCh)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Wait()
+	defer close(stopCh)
+
+	name, addr := snap.lastIdentity()
+	if name != "foo bar" || addr != "127.0.0.1:5000" {
+		t.Fatalf("bad identity: %s %s", name, addr)
+	}
+}
+
+func TestSnapshoter_shutdownClock(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	path := filepath.Join(td, "snap")
+
+	clock := new(LamportClock)
+	stopCh := make(chan struct{})
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	_, snap, err := NewSnapshotter(path, snapshotSizeLimit,
+		logger, clock, nil, stopCh)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The clock is saved on shutdown, even without any events
+	clock.Witness(50)
+	close(stopCh)
+	snap.Wait()
+
+	stopCh = make(chan struct{})
+	_, snap, err = NewSnapshotter(path, snapshotSizeLimit,
+		logger, clock, nil, stopCh)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Wait()
+	defer close(stopCh)
+
+	if snap.LastClock() != 50 {
+		t.Fatalf("bad clock %d", snap.LastClock())
+	}
+}
@@ -0,0 +1,83 @@
+package serf
+
+import (
+	"fmt"
+	"time"
+)
+
+// TraceMessages logs every gossip message that Serf sends or receives
+// for the given duration, with its type, size and decoded contents.
+// This is used to diagnose protocol problems without capturing and
+// decoding the traffic by hand. Messages that memberlist handles itself,
+// such as probes, are not included. A duration of zero stops tracing.
+func (s *Serf) TraceMessages(d time.Duration) {
+	s.traceLock.Lock()
+	defer s.traceLock.Unlock()
+
+	if d <= 0 {
+		s.traceUntil = time.Time{}
+		s.logger.Printf("[INFO] serf: message tracing disabled")
+		return
+	}
+
+	s.traceUntil = time.Now().Add(d)
+	s.logger.Printf("[INFO] serf: message tracing enabled for %s", d)
+}
+
+// tracing returns if messages should currently be traced
+func (s *Serf) tracing() bool {
+	s.traceLock.Lock()
+	defer s.traceLock.Unlock()
+	return time.Now().Before(s.traceUntil)
+}
+
+// traceMessage logs a message if tracing is enabled. The direction is
+// either "sent" or "received".
+func (s *Serf) traceMessage(direction string, buf []byte) {
+	if len(buf) == 0 || !s.tracing() {
+		return
+	}
+	s.logger.Printf("[INFO] serf: trace: %s %d bytes: %s",
+		direction, len(buf), describeMessage(buf))
+}
+
+// describeMessage decodes a message into a short description. Since
+// memberlist doesn't expose the peer that delivered a message, the
+// node in a description is the node the message is about.
+func describeMessage(buf []byte) string {
+	t := messageType(buf[0])
+	switch t {
+	case messageLeaveType:
+		var leave messageLeave
+		if err := decodeMessage(buf[1:], &leave); err != nil {
+			return fmt.Sprintf("leave (decode error: %s)", err)
+		}
+		return fmt.Sprintf("leave node=%s ltime=%d", leave.Node, leave.LTime)
+
+	case messageJoinType:
+		var join messageJoin
+		if err := decodeMessage(buf[1:], &join); err != nil {
+			return fmt.Sprintf("join (decode error: %s)", err)
+		}
+		return fmt.Sprintf("join node=%s ltime=%d", join.Node, join.LTime)
+
+	case messagePushPullType:
+		var pp messagePushPull
+		if err := decodeMessage(buf[1:], &pp); err != nil {
+			return fmt.Sprintf("push-pull (decode error: %s)", err)
+		}
+		return fmt.Sprintf("push-pull ltime=%d members=%d left=%d event_ltime=%d",
+			pp.LTime, len(pp.StatusLTimes), len(pp.LeftMembers), pp.EventLTime)
+
+	case messageUserEventType:
+		var event messageUserEvent
+		if err := decodeMessage(buf[1:], &event); err != nil {
+			return fmt.Sprintf("user-event (decode error: %s)", err)
+		}
+		return fmt.Sprintf("user-event name=%s ltime=%d payload=%d coalesce=%v",
+			event.Name, event.LTime, len(event.Payload), event.CC)
+
+	default:
+		return fmt.Sprintf("unknown type %d", t)
+	}
+}
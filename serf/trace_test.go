@@ -0,0 +1,59 @@
+package serf
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSerf_TraceMessages(t *testing.T) {
+	var out bytes.Buffer
+	s := &Serf{logger: log.New(&out, "", 0)}
+
+	buf, err := encodeMessage(messageJoinType, &messageJoin{LTime: 4, Node: "foo"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Nothing is logged until tracing is enabled
+	s.traceMessage("received", buf)
+	if out.Len() != 0 {
+		t.Fatalf("bad: %s", out.String())
+	}
+
+	s.TraceMessages(time.Minute)
+	s.traceMessage("received", buf)
+	if !strings.Contains(out.String(), "join node=foo ltime=4") {
+		t.Fatalf("bad: %s", out.String())
+	}
+
+	out.Reset()
+	s.TraceMessages(0)
+	s.traceMessage("received", buf)
+	if strings.Contains(out.String(), "trace:") {
+		t.Fatalf("bad: %s", out.String())
+	}
+}
+
+func TestDescribeMessage(t *testing.T) {
+	buf, err := encodeMessage(messageUserEventType, &messageUserEvent{
+		LTime:   2,
+		Name:    "deploy",
+		Payload: []byte("abc"),
+		CC:      true,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	desc := describeMessage(buf)
+	if desc != "user-event name=deploy ltime=2 payload=3 coalesce=true" {
+		t.Fatalf("bad: %s", desc)
+	}
+
+	if desc := describeMessage([]byte{200}); desc != "unknown type 200" {
+		t.Fatalf("bad: %s", desc)
+	}
+}